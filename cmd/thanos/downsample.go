@@ -370,7 +370,7 @@ func processDownsampling(
 	begin = time.Now()
 
 	var pool chunkenc.Pool
-	if m.Thanos.Downsample.Resolution == 0 {
+	if m.IsRaw() {
 		pool = chunkenc.NewPool()
 	} else {
 		pool = downsample.NewPool()
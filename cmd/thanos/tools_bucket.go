@@ -251,8 +251,8 @@ func (tbc *bucketDownsampleConfig) registerBucketDownsampleFlag(cmd extkingpin.F
 		Default("1").IntVar(&tbc.blockFilesConcurrency)
 	cmd.Flag("data-dir", "Data directory in which to cache blocks and process downsamplings.").
 		Default("./data").StringVar(&tbc.dataDir)
-	cmd.Flag("hash-func", "Specify which hash function to use when calculating the hashes of produced files. If no function has been specified, it does not happen. This permits avoiding downloading some files twice albeit at some performance cost. Possible values are: \"\", \"SHA256\".").
-		Default("").EnumVar(&tbc.hashFunc, "SHA256", "")
+	cmd.Flag("hash-func", "Specify which hash function to use when calculating the hashes of produced files. If no function has been specified, it does not happen. This permits avoiding downloading some files twice albeit at some performance cost. Possible values are: \"\", \"SHA256\", \"XXHASH64\".").
+		Default("").EnumVar(&tbc.hashFunc, "SHA256", "XXHASH64", "")
 
 	return tbc
 }
@@ -1152,8 +1152,8 @@ func registerBucketRewrite(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 	tbc := &bucketRewriteConfig{}
 	tbc.registerBucketRewriteFlag(cmd)
 
-	hashFunc := cmd.Flag("hash-func", "Specify which hash function to use when calculating the hashes of produced files. If no function has been specified, it does not happen. This permits avoiding downloading some files twice albeit at some performance cost. Possible values are: \"\", \"SHA256\".").
-		Default("").Enum("SHA256", "")
+	hashFunc := cmd.Flag("hash-func", "Specify which hash function to use when calculating the hashes of produced files. If no function has been specified, it does not happen. This permits avoiding downloading some files twice albeit at some performance cost. Possible values are: \"\", \"SHA256\", \"XXHASH64\".").
+		Default("").Enum("SHA256", "XXHASH64", "")
 	toDelete := extflag.RegisterPathOrContent(cmd, "rewrite.to-delete-config", "YAML file that contains []metadata.DeletionRequest that will be applied to blocks", extflag.WithEnvSubstitution())
 	toRelabel := extflag.RegisterPathOrContent(cmd, "rewrite.to-relabel-config", "YAML file that contains relabel configs that will be applied to blocks", extflag.WithEnvSubstitution())
 	provideChangeLog := cmd.Flag("rewrite.add-change-log", "If specified, all modifications are written to new block directory. Disable if latency is to high.").Default("true").Bool()
@@ -1193,6 +1193,12 @@ func registerBucketRewrite(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 			if err := yaml.Unmarshal(deletionsYaml, &deletions); err != nil {
 				return err
 			}
+			for i := range deletions {
+				deletions[i].Normalize()
+				if err := deletions[i].Validate(); err != nil {
+					return errors.Wrapf(err, "invalid deletion request %d", i)
+				}
+			}
 			modifiers = append(modifiers, compactv2.WithDeletionModifier(deletions...))
 		}
 
@@ -1240,11 +1246,9 @@ func registerBucketRewrite(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 				p := compactv2.NewProgressLogger(logger, int(b.Meta().Stats.NumSeries))
 				newID := ulid.MustNew(ulid.Now(), rand.Reader)
 				meta.ULID = newID
-				meta.Thanos.Rewrites = append(meta.Thanos.Rewrites, metadata.Rewrite{
-					Sources:          meta.Compaction.Sources,
-					DeletionsApplied: deletions,
-					RelabelsApplied:  relabels,
-				})
+				if err := metadata.AppendRewrite(meta, meta.Compaction.Sources, deletions, relabels); err != nil {
+					return errors.Wrapf(err, "record rewrite of %v", id)
+				}
 				meta.Compaction.Sources = []ulid.ULID{newID}
 				meta.Thanos.Source = metadata.BucketRewriteSource
 
@@ -6,26 +6,25 @@
 package block
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"io"
+	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/thanos-io/objstore"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/thanos-io/thanos/pkg/block/metadata"
-	"github.com/thanos-io/thanos/pkg/runutil"
 )
 
 const (
@@ -37,331 +36,248 @@ const (
 	IndexHeaderFilename = "index-header"
 	// ChunksDirname is the known dir name for chunks with compressed samples.
 	ChunksDirname = "chunks"
+	// TombstonesFilename is the known file name for tombstones of deleted series, optional in a block.
+	TombstonesFilename = "tombstones"
 
 	// DebugMetas is a directory for debug meta files that happen in the past. Useful for debugging.
 	DebugMetas = "debug/metas"
 )
 
-// Download downloads directory that is mean to be block directory. If any of the files
-// have a hash calculated in the meta file and it matches with what is in the destination path then
-// we do not download it. We always re-download the meta file.
-func Download(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id ulid.ULID, dst string, options ...objstore.DownloadOption) error {
-	if err := os.MkdirAll(dst, 0750); err != nil {
-		return errors.Wrap(err, "create dir")
-	}
-
-	if err := objstore.DownloadFile(ctx, logger, bucket, path.Join(id.String(), MetaFilename), path.Join(dst, MetaFilename)); err != nil {
-		return err
-	}
-	m, err := metadata.ReadFromDir(dst)
-	if err != nil {
-		return errors.Wrapf(err, "reading meta from %s", dst)
-	}
-
-	ignoredPaths := []string{MetaFilename}
-	for _, fl := range m.Thanos.Files {
-		if fl.Hash == nil || fl.Hash.Func == metadata.NoneFunc || fl.RelPath == "" {
-			continue
-		}
-		actualHash, err := metadata.CalculateHash(filepath.Join(dst, fl.RelPath), fl.Hash.Func, logger)
-		if err != nil {
-			level.Info(logger).Log("msg", "failed to calculate hash when downloading; re-downloading", "relPath", fl.RelPath, "err", err)
-			continue
-		}
-
-		if fl.Hash.Equal(&actualHash) {
-			ignoredPaths = append(ignoredPaths, fl.RelPath)
-		}
-	}
-
-	if err := objstore.DownloadDir(ctx, logger, bucket, id.String(), id.String(), dst, append(options, objstore.WithDownloadIgnoredPaths(ignoredPaths...))...); err != nil {
-		return err
-	}
-
-	chunksDir := filepath.Join(dst, ChunksDirname)
-	_, err = os.Stat(chunksDir)
-	if os.IsNotExist(err) {
-		// This can happen if block is empty. We cannot easily upload empty directory, so create one here.
-		return os.Mkdir(chunksDir, os.ModePerm)
-	}
-
-	if err != nil {
-		return errors.Wrapf(err, "stat %s", chunksDir)
-	}
-
-	return nil
-}
-
-// Upload uploads a TSDB block to the object storage. It verifies basic
-// features of Thanos block.
-func Upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, options ...objstore.UploadOption) error {
-	return upload(ctx, logger, bkt, bdir, hf, true, options...)
+func IsBlockMetaFile(path string) bool {
+	base := filepath.Base(path)
+	return base == MetaFilename || base == metadata.MetaGzipFilename
 }
 
-// UploadPromBlock uploads a TSDB block to the object storage. It assumes
-// the block is used in Prometheus so it doesn't check Thanos external labels.
-func UploadPromBlock(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, options ...objstore.UploadOption) error {
-	return upload(ctx, logger, bkt, bdir, hf, false, options...)
+func IsBlockDir(path string) (id ulid.ULID, ok bool) {
+	id, err := ulid.Parse(filepath.Base(path))
+	return id, err == nil
 }
 
-// upload uploads block from given block dir that ends with block id.
-// It makes sure cleanup is done on error to avoid partial block uploads.
-// TODO(bplotka): Ensure bucket operations have reasonable backoff retries.
-// NOTE: Upload updates `meta.Thanos.File` section.
-func upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, checkExternalLabels bool, options ...objstore.UploadOption) error {
-	df, err := os.Stat(bdir)
-	if err != nil {
-		return err
-	}
-	if !df.IsDir() {
-		return errors.Errorf("%s is not a directory", bdir)
-	}
-
-	// Verify dir.
-	id, err := ulid.Parse(df.Name())
+// GetSegmentFiles returns list of segment files for given block. Paths are relative to the chunks directory.
+// In case of errors, nil is returned.
+func GetSegmentFiles(blockDir string) []string {
+	files, err := os.ReadDir(filepath.Join(blockDir, ChunksDirname))
 	if err != nil {
-		return errors.Wrap(err, "not a block dir")
+		return nil
 	}
 
-	meta, err := metadata.ReadFromDir(bdir)
-	if err != nil {
-		// No meta or broken meta file.
-		return errors.Wrap(err, "read meta")
+	// ReadDir returns files in sorted order already.
+	var result []string
+	for _, f := range files {
+		result = append(result, f.Name())
 	}
+	return result
+}
 
-	if checkExternalLabels {
-		if meta.Thanos.Labels == nil || len(meta.Thanos.Labels) == 0 {
-			return errors.New("empty external labels are not allowed for Thanos block.")
-		}
+// VerifyBlockID checks that the name of the given block directory is the ULID of the block in its meta. Mismatch means
+// that the block is misplaced or its meta is wrong, e.g. copied from another block.
+func VerifyBlockID(blockDir string) error {
+	id, ok := IsBlockDir(blockDir)
+	if !ok {
+		return errors.Errorf("%s is not a block directory", blockDir)
 	}
-
-	metaEncoded := strings.Builder{}
-	meta.Thanos.Files, err = GatherFileStats(bdir, hf, logger)
+	meta, err := metadata.ReadFromDir(blockDir)
 	if err != nil {
-		return errors.Wrap(err, "gather meta file stats")
-	}
-
-	if err := meta.Write(&metaEncoded); err != nil {
-		return errors.Wrap(err, "encode meta file")
-	}
-
-	if err := objstore.UploadDir(ctx, logger, bkt, filepath.Join(bdir, ChunksDirname), path.Join(id.String(), ChunksDirname), options...); err != nil {
-		return cleanUp(logger, bkt, id, errors.Wrap(err, "upload chunks"))
-	}
-
-	if err := objstore.UploadFile(ctx, logger, bkt, filepath.Join(bdir, IndexFilename), path.Join(id.String(), IndexFilename)); err != nil {
-		return cleanUp(logger, bkt, id, errors.Wrap(err, "upload index"))
+		return errors.Wrapf(err, "read meta from %s", blockDir)
 	}
-
-	// Meta.json always need to be uploaded as a last item. This will allow to assume block directories without meta file to be pending uploads.
-	if err := bkt.Upload(ctx, path.Join(id.String(), MetaFilename), strings.NewReader(metaEncoded.String())); err != nil {
-		// Don't call cleanUp here. Despite getting error, meta.json may have been uploaded in certain cases,
-		// and even though cleanUp will not see it yet, meta.json may appear in the bucket later.
-		// (Eg. S3 is known to behave this way when it returns 503 "SlowDown" error).
-		// If meta.json is not uploaded, this will produce partial blocks, but such blocks will be cleaned later.
-		return errors.Wrap(err, "upload meta file")
-	}
-
-	return nil
+	return verifyBlockID(id, meta)
 }
 
-func cleanUp(logger log.Logger, bkt objstore.Bucket, id ulid.ULID, err error) error {
-	// Cleanup the dir with an uncancelable context.
-	cleanErr := Delete(context.Background(), logger, bkt, id)
-	if cleanErr != nil {
-		return errors.Wrapf(err, "failed to clean block after upload issue. Partial block in system. Err: %s", err.Error())
+func verifyBlockID(id ulid.ULID, meta *metadata.Meta) error {
+	if meta.ULID != id {
+		return errors.Errorf("block directory %s has meta of block %s", id, meta.ULID)
 	}
-	return err
+	return nil
 }
 
-// MarkForDeletion creates a file which stores information about when the block was marked for deletion.
-func MarkForDeletion(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, details string, markedForDeletion prometheus.Counter) error {
-	deletionMarkFile := path.Join(id.String(), metadata.DeletionMarkFilename)
-	deletionMarkExists, err := bkt.Exists(ctx, deletionMarkFile)
-	if err != nil {
-		return errors.Wrapf(err, "check exists %s in bucket", deletionMarkFile)
-	}
-	if deletionMarkExists {
-		level.Warn(logger).Log("msg", "requested to mark for deletion, but file already exists; this should not happen; investigate", "err", errors.Errorf("file %s already exists in bucket", deletionMarkFile))
-		return nil
-	}
-
-	deletionMark, err := json.Marshal(metadata.DeletionMark{
-		ID:           id,
-		DeletionTime: time.Now().Unix(),
-		Version:      metadata.DeletionMarkVersion1,
-		Details:      details,
-	})
+// ValidateSegmentFiles checks that segment files of the given block are numbered contiguously starting from 000001,
+// with no gaps and no other files. The returned error names the first missing or unexpected segment file.
+func ValidateSegmentFiles(blockDir string) error {
+	files, err := os.ReadDir(filepath.Join(blockDir, ChunksDirname))
 	if err != nil {
-		return errors.Wrap(err, "json encode deletion mark")
+		return errors.Wrapf(err, "read dir %v", filepath.Join(blockDir, ChunksDirname))
 	}
 
-	if err := bkt.Upload(ctx, deletionMarkFile, bytes.NewBuffer(deletionMark)); err != nil {
-		return errors.Wrapf(err, "upload file %s to bucket", deletionMarkFile)
+	// ReadDir returns files in sorted order already, so with zero-padded names they are ordered by number.
+	for i, f := range files {
+		expected := fmt.Sprintf("%06d", i+1)
+		if f.Name() == expected && !f.IsDir() {
+			continue
+		}
+		if n, err := strconv.ParseUint(f.Name(), 10, 64); err == nil && n > uint64(i+1) && !f.IsDir() {
+			return errors.Errorf("missing segment file %s", filepath.Join(ChunksDirname, expected))
+		}
+		return errors.Errorf("unexpected segment file %s", filepath.Join(ChunksDirname, f.Name()))
 	}
-	markedForDeletion.Inc()
-	level.Info(logger).Log("msg", "block has been marked for deletion", "block", id)
 	return nil
 }
 
-// Delete removes directory that is meant to be block directory.
-// NOTE: Always prefer this method for deleting blocks.
-//   - We have to delete block's files in the certain order (meta.json first and deletion-mark.json last)
-//     to ensure we don't end up with malformed partial blocks. Thanos system handles well partial blocks
-//     only if they don't have meta.json. If meta.json is present Thanos assumes valid block.
-//   - This avoids deleting empty dir (whole bucket) by mistake.
-func Delete(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID) error {
-	metaFile := path.Join(id.String(), MetaFilename)
-	deletionMarkFile := path.Join(id.String(), metadata.DeletionMarkFilename)
-
-	// Delete block meta file.
-	ok, err := bkt.Exists(ctx, metaFile)
+// SegmentFile is a segment file of a block with its size.
+type SegmentFile struct {
+	// Name is the path of the file relative to the chunks directory.
+	Name      string
+	SizeBytes int64
+}
+
+// GetSegmentFilesWithSizes returns list of segment files for given block, together with their sizes.
+// Paths are relative to the chunks directory.
+func GetSegmentFilesWithSizes(blockDir string) ([]SegmentFile, error) {
+	files, err := os.ReadDir(filepath.Join(blockDir, ChunksDirname))
 	if err != nil {
-		return errors.Wrapf(err, "stat %s", metaFile)
+		return nil, errors.Wrapf(err, "read dir %v", filepath.Join(blockDir, ChunksDirname))
 	}
 
-	if ok {
-		if err := bkt.Delete(ctx, metaFile); err != nil {
-			return errors.Wrapf(err, "delete %s", metaFile)
+	// ReadDir returns files in sorted order already.
+	result := make([]SegmentFile, 0, len(files))
+	for _, f := range files {
+		fi, err := f.Info()
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting file info %v", filepath.Join(ChunksDirname, f.Name()))
 		}
-		level.Debug(logger).Log("msg", "deleted file", "file", metaFile, "bucket", bkt.Name())
+		result = append(result, SegmentFile{Name: f.Name(), SizeBytes: fi.Size()})
 	}
+	return result, nil
+}
 
-	// Delete the block objects, but skip:
-	// - The metaFile as we just deleted. This is required for eventual object storages (list after write).
-	// - The deletionMarkFile as we'll delete it at last.
-	err = deleteDirRec(ctx, logger, bkt, id.String(), func(name string) bool {
-		return name == metaFile || name == deletionMarkFile
-	})
-	if err != nil {
-		return err
-	}
+// GatherOption configures the provided params.
+type GatherOption func(params *gatherParams)
+
+// gatherParams holds the GatherFileStatsWithContext() parameters.
+type gatherParams struct {
+	// concurrency is the number of files hashed in parallel. Zero or negative means GOMAXPROCS.
+	concurrency int
+	// hashFilter makes only files it accepts hashed.
+	hashFilter HashFilter
+	// allowNoChunks makes a missing chunks directory treated like an empty one.
+	allowNoChunks bool
+	// indexHeader makes the index-header file, if present, included.
+	indexHeader bool
+}
 
-	// Delete block deletion mark.
-	ok, err = bkt.Exists(ctx, deletionMarkFile)
-	if err != nil {
-		return errors.Wrapf(err, "stat %s", deletionMarkFile)
+// WithGatherConcurrency is an option to calculate hashes of up to concurrency files in parallel. Zero or negative
+// concurrency means GOMAXPROCS, which is the default.
+func WithGatherConcurrency(concurrency int) GatherOption {
+	return func(params *gatherParams) {
+		params.concurrency = concurrency
 	}
+}
 
-	if ok {
-		if err := bkt.Delete(ctx, deletionMarkFile); err != nil {
-			return errors.Wrapf(err, "delete %s", deletionMarkFile)
-		}
-		level.Debug(logger).Log("msg", "deleted file", "file", deletionMarkFile, "bucket", bkt.Name())
+// WithGatherHashFilter is an option to calculate hashes only of files accepted by the given filter. Other files get
+// entries with size only.
+func WithGatherHashFilter(filter HashFilter) GatherOption {
+	return func(params *gatherParams) {
+		params.hashFilter = filter
 	}
-
-	return nil
 }
 
-// deleteDirRec removes all objects prefixed with dir from the bucket. It skips objects that return true for the passed keep function.
-// NOTE: For objects removal use `block.Delete` strictly.
-func deleteDirRec(ctx context.Context, logger log.Logger, bkt objstore.Bucket, dir string, keep func(name string) bool) error {
-	return bkt.Iter(ctx, dir, func(name string) error {
-		// If we hit a directory, call DeleteDir recursively.
-		if strings.HasSuffix(name, objstore.DirDelim) {
-			return deleteDirRec(ctx, logger, bkt, name, keep)
-		}
-		if keep(name) {
-			return nil
-		}
-		if err := bkt.Delete(ctx, name); err != nil {
-			return err
-		}
-		level.Debug(logger).Log("msg", "deleted file", "file", name, "bucket", bkt.Name())
-		return nil
-	})
+// GatherFileStats returns metadata.File entry for files inside TSDB block (index, chunks, meta.json and tombstones, if any).
+func GatherFileStats(blockDir string, hf metadata.HashFunc, logger log.Logger) (res []metadata.File, _ error) {
+	return GatherFileStatsWithContext(context.Background(), blockDir, hf, logger)
 }
 
-// DownloadMeta downloads only meta file from bucket by block ID.
-// TODO(bwplotka): Differentiate between network error & partial upload.
-func DownloadMeta(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID) (metadata.Meta, error) {
-	rc, err := bkt.Get(ctx, path.Join(id.String(), MetaFilename))
-	if err != nil {
-		return metadata.Meta{}, errors.Wrapf(err, "meta.json bkt get for %s", id.String())
+// GatherFileStatsWithContext works like GatherFileStats, configured by the given options. It stops hashing and returns
+// the context error as soon as the context is canceled.
+func GatherFileStatsWithContext(ctx context.Context, blockDir string, hf metadata.HashFunc, logger log.Logger, options ...GatherOption) (res []metadata.File, _ error) {
+	var opts gatherParams
+	for _, o := range options {
+		o(&opts)
 	}
-	defer runutil.CloseWithLogOnErr(logger, rc, "download meta bucket client")
+	return gatherFileStats(ctx, blockDir, hf, logger, opts)
+}
 
-	var m metadata.Meta
+// HashFilter decides whether the file with the given path relative to the block directory and size is hashed. It allows
+// to hash only files worth it, as hashing all files of big blocks is expensive.
+type HashFilter func(relPath string, sizeBytes int64) bool
 
-	obj, err := io.ReadAll(rc)
-	if err != nil {
-		return metadata.Meta{}, errors.Wrapf(err, "read meta.json for block %s", id.String())
+// HashOnlyFiles returns HashFilter accepting only files with the given paths relative to the block directory, e.g. IndexFilename.
+func HashOnlyFiles(relPaths ...string) HashFilter {
+	accepted := make(map[string]struct{}, len(relPaths))
+	for _, p := range relPaths {
+		accepted[p] = struct{}{}
 	}
-
-	if err = json.Unmarshal(obj, &m); err != nil {
-		return metadata.Meta{}, errors.Wrapf(err, "unmarshal meta.json for block %s", id.String())
+	return func(relPath string, _ int64) bool {
+		_, ok := accepted[relPath]
+		return ok
 	}
-
-	return m, nil
 }
 
-func IsBlockMetaFile(path string) bool {
-	return filepath.Base(path) == MetaFilename
+// HashFilesSmallerThan returns HashFilter accepting only files smaller than maxBytes.
+func HashFilesSmallerThan(maxBytes int64) HashFilter {
+	return func(_ string, sizeBytes int64) bool {
+		return sizeBytes < maxBytes
+	}
 }
 
-func IsBlockDir(path string) (id ulid.ULID, ok bool) {
-	id, err := ulid.Parse(filepath.Base(path))
-	return id, err == nil
+// shouldHash returns true if the file has to be hashed with the given hash function. Nil filter accepts all files.
+func shouldHash(hf metadata.HashFunc, filter HashFilter, relPath string, sizeBytes int64) bool {
+	return hf != metadata.NoneFunc && (filter == nil || filter(relPath, sizeBytes))
 }
 
-// GetSegmentFiles returns list of segment files for given block. Paths are relative to the chunks directory.
-// In case of errors, nil is returned.
-func GetSegmentFiles(blockDir string) []string {
-	files, err := os.ReadDir(filepath.Join(blockDir, ChunksDirname))
-	if err != nil {
-		return nil
-	}
-
-	// ReadDir returns files in sorted order already.
-	var result []string
-	for _, f := range files {
-		result = append(result, f.Name())
-	}
-	return result
+// hasChunksDir returns true if the given block has the chunks directory.
+func hasChunksDir(blockDir string) bool {
+	fi, err := os.Stat(filepath.Join(blockDir, ChunksDirname))
+	return err == nil && fi.IsDir()
 }
 
-// GatherFileStats returns metadata.File entry for files inside TSDB block (index, chunks, meta.json).
-func GatherFileStats(blockDir string, hf metadata.HashFunc, logger log.Logger) (res []metadata.File, _ error) {
+// gatherFileStats works like GatherFileStatsWithContext, configured by the given params, including the ones not exposed as options.
+func gatherFileStats(ctx context.Context, blockDir string, hf metadata.HashFunc, logger log.Logger, o gatherParams) (res []metadata.File, _ error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	files, err := os.ReadDir(filepath.Join(blockDir, ChunksDirname))
-	if err != nil {
+	if err != nil && !(o.allowNoChunks && os.IsNotExist(err)) {
 		return nil, errors.Wrapf(err, "read dir %v", filepath.Join(blockDir, ChunksDirname))
 	}
+	// Indexes of files in res to calculate hash for.
+	var toHash []int
 	for _, f := range files {
 		fi, err := f.Info()
 		if err != nil {
 			return nil, errors.Wrapf(err, "getting file info %v", filepath.Join(ChunksDirname, f.Name()))
 		}
 
-		mf := metadata.File{
-			RelPath:   filepath.Join(ChunksDirname, f.Name()),
-			SizeBytes: fi.Size(),
-		}
-		if hf != metadata.NoneFunc && !f.IsDir() {
-			h, err := metadata.CalculateHash(filepath.Join(blockDir, ChunksDirname, f.Name()), hf, logger)
-			if err != nil {
-				return nil, errors.Wrapf(err, "calculate hash %v", filepath.Join(ChunksDirname, f.Name()))
-			}
-			mf.Hash = &h
+		relPath := filepath.Join(ChunksDirname, f.Name())
+		if !f.IsDir() && shouldHash(hf, o.hashFilter, relPath, fi.Size()) {
+			toHash = append(toHash, len(res))
 		}
-		res = append(res, mf)
+		res = append(res, metadata.File{
+			RelPath:   relPath,
+			SizeBytes: fi.Size(),
+		})
 	}
 
 	indexFile, err := os.Stat(filepath.Join(blockDir, IndexFilename))
 	if err != nil {
 		return nil, errors.Wrapf(err, "stat %v", filepath.Join(blockDir, IndexFilename))
 	}
-	mf := metadata.File{
+	if shouldHash(hf, o.hashFilter, indexFile.Name(), indexFile.Size()) {
+		toHash = append(toHash, len(res))
+	}
+	res = append(res, metadata.File{
 		RelPath:   indexFile.Name(),
 		SizeBytes: indexFile.Size(),
+	})
+
+	optional := []string{TombstonesFilename}
+	if o.indexHeader {
+		optional = append(optional, IndexHeaderFilename)
 	}
-	if hf != metadata.NoneFunc {
-		h, err := metadata.CalculateHash(filepath.Join(blockDir, IndexFilename), hf, logger)
+	for _, name := range optional {
+		fi, err := os.Stat(filepath.Join(blockDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
 		if err != nil {
-			return nil, errors.Wrapf(err, "calculate hash %v", indexFile.Name())
+			return nil, errors.Wrapf(err, "stat %v", filepath.Join(blockDir, name))
+		}
+		if shouldHash(hf, o.hashFilter, fi.Name(), fi.Size()) {
+			toHash = append(toHash, len(res))
 		}
-		mf.Hash = &h
+		res = append(res, metadata.File{
+			RelPath:   fi.Name(),
+			SizeBytes: fi.Size(),
+		})
 	}
-	res = append(res, mf)
 
 	metaFile, err := os.Stat(filepath.Join(blockDir, MetaFilename))
 	if err != nil {
@@ -369,90 +285,227 @@ func GatherFileStats(blockDir string, hf metadata.HashFunc, logger log.Logger) (
 	}
 	res = append(res, metadata.File{RelPath: metaFile.Name()})
 
+	concurrency := o.concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for _, i := range toHash {
+		mf := &res[i]
+		g.Go(func() error {
+			if err := gctx.Err(); err != nil {
+				return err
+			}
+			h, err := metadata.CalculateHashWithContext(gctx, filepath.Join(blockDir, mf.RelPath), hf, logger)
+			if err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return ctxErr
+				}
+				return errors.Wrapf(err, "calculate hash %v", mf.RelPath)
+			}
+			mf.Hash = &h
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
 	sort.Slice(res, func(i, j int) bool {
 		return strings.Compare(res[i].RelPath, res[j].RelPath) < 0
 	})
-	return res, err
+	return res, nil
 }
 
-// MarkForNoCompact creates a file which marks block to be not compacted.
-func MarkForNoCompact(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, reason metadata.NoCompactReason, details string, markedForNoCompact prometheus.Counter) error {
-	m := path.Join(id.String(), metadata.NoCompactMarkFilename)
-	noCompactMarkExists, err := bkt.Exists(ctx, m)
-	if err != nil {
-		return errors.Wrapf(err, "check exists %s in bucket", m)
-	}
-	if noCompactMarkExists {
-		level.Warn(logger).Log("msg", "requested to mark for no compaction, but file already exists; this should not happen; investigate", "err", errors.Errorf("file %s already exists in bucket", m))
-		return nil
+// State is the state of a block in the bucket.
+type State int
+
+const (
+	// StateNotFound means that there are no objects of the block in the bucket.
+	StateNotFound State = iota
+	// StatePartial means that some objects of the block are in the bucket, but not its meta. The block is either being
+	// uploaded or deleted, or its upload or deletion was aborted.
+	StatePartial
+	// StateComplete means that the block has meta in the bucket, so it's fully uploaded.
+	StateComplete
+)
+
+func (s State) String() string {
+	switch s {
+	case StateNotFound:
+		return "not-found"
+	case StatePartial:
+		return "partial"
+	case StateComplete:
+		return "complete"
 	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
 
-	noCompactMark, err := json.Marshal(metadata.NoCompactMark{
-		ID:      id,
-		Version: metadata.NoCompactMarkVersion1,
+// errIterStop is used to stop bucket iteration early.
+var errIterStop = errors.New("stop iteration")
 
-		NoCompactTime: time.Now().Unix(),
-		Reason:        reason,
-		Details:       details,
-	})
-	if err != nil {
-		return errors.Wrap(err, "json encode no compact mark")
+// BlockState returns the state of the block with the given ID in the bucket.
+func BlockState(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID) (State, error) {
+	for _, metaFile := range []string{path.Join(id.String(), MetaFilename), path.Join(id.String(), metadata.MetaGzipFilename)} {
+		ok, err := bkt.Exists(ctx, metaFile)
+		if err != nil {
+			return StateNotFound, errors.Wrapf(err, "stat %s", metaFile)
+		}
+		if ok {
+			return StateComplete, nil
+		}
 	}
 
-	if err := bkt.Upload(ctx, m, bytes.NewBuffer(noCompactMark)); err != nil {
-		return errors.Wrapf(err, "upload file %s to bucket", m)
+	found := false
+	if err := bkt.Iter(ctx, id.String()+objstore.DirDelim, func(string) error {
+		found = true
+		return errIterStop
+	}); err != nil && errors.Cause(err) != errIterStop {
+		return StateNotFound, errors.Wrapf(err, "iter block %s", id)
 	}
-	markedForNoCompact.Inc()
-	level.Info(logger).Log("msg", "block has been marked for no compaction", "block", id)
-	return nil
+	if found {
+		return StatePartial, nil
+	}
+	return StateNotFound, nil
 }
 
-// MarkForNoDownsample creates a file which marks block to be not downsampled.
-func MarkForNoDownsample(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, reason metadata.NoDownsampleReason, details string, markedForNoDownsample prometheus.Counter) error {
-	m := path.Join(id.String(), metadata.NoDownsampleMarkFilename)
-	noDownsampleMarkExists, err := bkt.Exists(ctx, m)
+// ReconcileBlockFiles cross-checks the Files section of meta of the given block against objects of the block in the
+// bucket. It returns files listed in meta, but missing in the bucket, and objects in the bucket not listed in meta,
+// both as paths relative to the block directory. Meta and marker files are not reported. Only objects are listed,
+// their contents are not read.
+func ReconcileBlockFiles(ctx context.Context, bkt objstore.Bucket, id ulid.ULID) (missing, unexpected []string, err error) {
+	m, _, err := readBucketMeta(ctx, bkt, id)
 	if err != nil {
-		return errors.Wrapf(err, "check exists %s in bucket", m)
+		return nil, nil, err
 	}
-	if noDownsampleMarkExists {
-		level.Warn(logger).Log("msg", "requested to mark for no deletion, but file already exists; this should not happen; investigate", "err", errors.Errorf("file %s already exists in bucket", m))
-		return nil
+
+	ignored := map[string]struct{}{
+		MetaFilename:                      {},
+		metadata.MetaGzipFilename:         {},
+		metadata.DeletionMarkFilename:     {},
+		metadata.NoCompactMarkFilename:    {},
+		metadata.NoDownsampleMarkFilename: {},
+		metadata.FrozenMarkFilename:       {},
+	}
+	listed := make(map[string]struct{}, len(m.Thanos.Files))
+	for _, f := range m.Thanos.Files {
+		if _, ok := ignored[f.RelPath]; !ok {
+			listed[f.RelPath] = struct{}{}
+		}
 	}
-	noDownsampleMark, err := json.Marshal(metadata.NoDownsampleMark{
-		ID:      id,
-		Version: metadata.NoDownsampleMarkVersion1,
 
-		NoDownsampleTime: time.Now().Unix(),
-		Reason:           reason,
-		Details:          details,
-	})
-	if err != nil {
-		return errors.Wrap(err, "json encode no downsample mark")
+	prefix := id.String() + objstore.DirDelim
+	found := map[string]struct{}{}
+	if err := bkt.Iter(ctx, prefix, func(name string) error {
+		rel := strings.TrimPrefix(name, prefix)
+		if _, ok := ignored[rel]; ok {
+			return nil
+		}
+		found[rel] = struct{}{}
+		if _, ok := listed[rel]; !ok {
+			unexpected = append(unexpected, rel)
+		}
+		return nil
+	}, objstore.WithRecursiveIter); err != nil {
+		return nil, nil, errors.Wrapf(err, "iter block %s", id)
 	}
 
-	if err := bkt.Upload(ctx, m, bytes.NewBuffer(noDownsampleMark)); err != nil {
-		return errors.Wrapf(err, "upload file %s to bucket", m)
+	for rel := range listed {
+		if _, ok := found[rel]; !ok {
+			missing = append(missing, rel)
+		}
 	}
-	markedForNoDownsample.Inc()
-	level.Info(logger).Log("msg", "block has been marked for no downsample", "block", id)
-	return nil
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+	return missing, unexpected, nil
 }
 
-// RemoveMark removes the file which marked the block for deletion, no-downsample or no-compact.
-func RemoveMark(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, removeMark prometheus.Counter, markedFilename string) error {
-	markedFile := path.Join(id.String(), markedFilename)
-	markedFileExists, err := bkt.Exists(ctx, markedFile)
+// RepairFileStats recomputes Files of meta.json in the given local block directory from the actual files on disk, hashing
+// them with the given hash function, e.g. after a manual repair made meta drift from the block contents. It's the local
+// counterpart of ReconcileBlockFiles, to fix meta before the block is uploaded again. If Files changed, the repair is
+// recorded as a rewrite of the block and meta.json is replaced atomically, otherwise it's left untouched.
+// Use RepairFileStatsDryRun to review the changes first.
+func RepairFileStats(blockDir string, hf metadata.HashFunc, logger log.Logger) error {
+	repaired, diffs, err := repairFileStats(blockDir, hf, logger)
 	if err != nil {
-		return errors.Wrapf(err, "check if %s file exists in bucket", markedFile)
+		return err
 	}
-	if !markedFileExists {
-		level.Warn(logger).Log("msg", "requested to remove the mark, but file does not exist", "err", errors.Errorf("file %s does not exist in bucket", markedFile))
+	if len(diffs) == 0 {
 		return nil
 	}
-	if err := bkt.Delete(ctx, markedFile); err != nil {
-		return errors.Wrapf(err, "delete file %s from bucket", markedFile)
+	if err := repaired.WriteToDir(logger, blockDir); err != nil {
+		return errors.Wrap(err, "write repaired meta")
 	}
-	removeMark.Inc()
-	level.Info(logger).Log("msg", "mark has been removed from the block", "block", id)
+	level.Info(logger).Log("msg", "repaired files of block meta", "dir", blockDir, "changes", len(diffs))
 	return nil
 }
+
+// RepairFileStatsDryRun returns changes RepairFileStats would make to meta.json in the given local block directory,
+// including the rewrite entry, or nil if Files already match the block contents. Nothing is written.
+func RepairFileStatsDryRun(blockDir string, hf metadata.HashFunc, logger log.Logger) ([]metadata.MetaFieldDiff, error) {
+	_, diffs, err := repairFileStats(blockDir, hf, logger)
+	return diffs, err
+}
+
+// repairedFiles returns sorted relative paths of files, which stats differ between before and after.
+func repairedFiles(before, after []metadata.File) []string {
+	beforeByPath := make(map[string]metadata.File, len(before))
+	for _, f := range before {
+		beforeByPath[f.RelPath] = f
+	}
+	var paths []string
+	for _, f := range after {
+		b, ok := beforeByPath[f.RelPath]
+		delete(beforeByPath, f.RelPath)
+		if ok && reflect.DeepEqual(b, f) {
+			continue
+		}
+		paths = append(paths, f.RelPath)
+	}
+	for p := range beforeByPath {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// repairFileStats returns meta of the local block with Files recomputed from the block directory, together with its
+// changes against the current meta.
+func repairFileStats(blockDir string, hf metadata.HashFunc, logger log.Logger) (*metadata.Meta, []metadata.MetaFieldDiff, error) {
+	meta, err := metadata.ReadFromDir(blockDir)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read meta")
+	}
+
+	// Keep the optional files which were tracked in meta.
+	o := gatherParams{allowNoChunks: meta.Stats.NumChunks == 0}
+	for _, f := range meta.Thanos.Files {
+		if f.RelPath == IndexHeaderFilename {
+			o.indexHeader = true
+		}
+	}
+	files, err := gatherFileStats(context.Background(), blockDir, hf, logger, o)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "gather file stats")
+	}
+
+	repaired := *meta
+	repaired.Thanos.Files = files
+	if len(metadata.DiffMeta(meta, &repaired)) == 0 {
+		return meta, nil, nil
+	}
+
+	// Copy rewrites, so that the current meta is not changed by appending to them.
+	repaired.Thanos.Rewrites = append([]metadata.Rewrite(nil), meta.Thanos.Rewrites...)
+	sources := meta.Compaction.Sources
+	if len(sources) == 0 {
+		sources = []ulid.ULID{meta.ULID}
+	}
+	if err := metadata.AppendRewrite(&repaired, sources, nil, nil); err != nil {
+		return nil, nil, errors.Wrap(err, "record rewrite")
+	}
+	repaired.Thanos.Rewrites[len(repaired.Thanos.Rewrites)-1].FilesRepaired = repairedFiles(meta.Thanos.Files, files)
+	return &repaired, metadata.DiffMeta(meta, &repaired), nil
+}
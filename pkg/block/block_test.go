@@ -4,29 +4,24 @@
 package block
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
+	"math/rand"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
-	"time"
-
-	"github.com/thanos-io/thanos/pkg/extprom"
 
+	"github.com/efficientgo/core/testutil"
 	"github.com/go-kit/log"
 	"github.com/oklog/ulid"
-	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/thanos-io/objstore"
 
-	"github.com/efficientgo/core/testutil"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/testutil/custom"
 	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
@@ -78,664 +73,329 @@ func TestIsBlockDir(t *testing.T) {
 	}
 }
 
-func TestUpload(t *testing.T) {
-	defer custom.TolerantVerifyLeak(t)
+func TestGatherFileStatsWithConcurrency(t *testing.T) {
+	dir := t.TempDir()
+	createFileStatsTestBlock(t, dir, 10, 1024)
 
-	ctx := context.Background()
-
-	tmpDir := t.TempDir()
-
-	bkt := objstore.NewInMemBucket()
-	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
-		labels.New(labels.Label{Name: "a", Value: "1"}),
-		labels.New(labels.Label{Name: "a", Value: "2"}),
-		labels.New(labels.Label{Name: "a", Value: "3"}),
-		labels.New(labels.Label{Name: "a", Value: "4"}),
-		labels.New(labels.Label{Name: "b", Value: "1"}),
-	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	expected, err := GatherFileStatsWithContext(context.Background(), dir, metadata.SHA256Func, log.NewNopLogger(), WithGatherConcurrency(1))
 	testutil.Ok(t, err)
-	testutil.Ok(t, os.MkdirAll(path.Join(tmpDir, "test", b1.String()), os.ModePerm))
-
-	{
-		// Wrong dir.
-		err := Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "not-existing"), metadata.NoneFunc)
-		testutil.NotOk(t, err)
-		testutil.Assert(t, strings.HasSuffix(err.Error(), "/not-existing: no such file or directory"), "")
-	}
-	{
-		// Wrong existing dir (not a block).
-		err := Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "test"), metadata.NoneFunc)
-		testutil.NotOk(t, err)
-		testutil.Equals(t, "not a block dir: ulid: bad data size when unmarshaling", err.Error())
-	}
-	{
-		// Empty block dir.
-		err := Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "test", b1.String()), metadata.NoneFunc)
-		testutil.NotOk(t, err)
-		testutil.Assert(t, strings.HasSuffix(err.Error(), "/meta.json: no such file or directory"), "")
-	}
-	e2eutil.Copy(t, path.Join(tmpDir, b1.String(), MetaFilename), path.Join(tmpDir, "test", b1.String(), MetaFilename))
-	{
-		// Missing chunks.
-		err := Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "test", b1.String()), metadata.NoneFunc)
-		testutil.NotOk(t, err)
-		testutil.Assert(t, strings.HasSuffix(err.Error(), "/chunks: no such file or directory"), err.Error())
-	}
-	testutil.Ok(t, os.MkdirAll(path.Join(tmpDir, "test", b1.String(), ChunksDirname), os.ModePerm))
-	e2eutil.Copy(t, path.Join(tmpDir, b1.String(), ChunksDirname, "000001"), path.Join(tmpDir, "test", b1.String(), ChunksDirname, "000001"))
-	{
-		// Missing index file.
-		err := Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "test", b1.String()), metadata.NoneFunc)
-		testutil.NotOk(t, err)
-		testutil.Assert(t, strings.HasSuffix(err.Error(), "/index: no such file or directory"), "")
-	}
-	e2eutil.Copy(t, path.Join(tmpDir, b1.String(), IndexFilename), path.Join(tmpDir, "test", b1.String(), IndexFilename))
-	testutil.Ok(t, os.Remove(path.Join(tmpDir, "test", b1.String(), MetaFilename)))
-	{
-		// Missing meta.json file.
-		err := Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "test", b1.String()), metadata.NoneFunc)
-		testutil.NotOk(t, err)
-		testutil.Assert(t, strings.HasSuffix(err.Error(), "/meta.json: no such file or directory"), "")
-	}
-	e2eutil.Copy(t, path.Join(tmpDir, b1.String(), MetaFilename), path.Join(tmpDir, "test", b1.String(), MetaFilename))
-	{
-		// Full block.
-		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "test", b1.String()), metadata.NoneFunc))
-		testutil.Equals(t, 3, len(bkt.Objects()))
-		testutil.Equals(t, 3727, len(bkt.Objects()[path.Join(b1.String(), ChunksDirname, "000001")]))
-		testutil.Equals(t, 401, len(bkt.Objects()[path.Join(b1.String(), IndexFilename)]))
-		testutil.Equals(t, 595, len(bkt.Objects()[path.Join(b1.String(), MetaFilename)]))
-
-		// File stats are gathered.
-		testutil.Equals(t, fmt.Sprintf(`{
-	"ulid": "%s",
-	"minTime": 0,
-	"maxTime": 1000,
-	"stats": {
-		"numSamples": 500,
-		"numSeries": 5,
-		"numChunks": 5
-	},
-	"compaction": {
-		"level": 1,
-		"sources": [
-			"%s"
-		]
-	},
-	"version": 1,
-	"thanos": {
-		"labels": {
-			"ext1": "val1"
-		},
-		"downsample": {
-			"resolution": 124
-		},
-		"source": "test",
-		"files": [
-			{
-				"rel_path": "chunks/000001",
-				"size_bytes": 3727
-			},
-			{
-				"rel_path": "index",
-				"size_bytes": 401
-			},
-			{
-				"rel_path": "meta.json"
-			}
-		],
-		"index_stats": {
-			"series_max_size": 16
-		}
-	}
-}
-`, b1.String(), b1.String()), string(bkt.Objects()[path.Join(b1.String(), MetaFilename)]))
-	}
-	{
-		// Test Upload is idempotent.
-		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "test", b1.String()), metadata.NoneFunc))
-		testutil.Equals(t, 3, len(bkt.Objects()))
-		testutil.Equals(t, 3727, len(bkt.Objects()[path.Join(b1.String(), ChunksDirname, "000001")]))
-		testutil.Equals(t, 401, len(bkt.Objects()[path.Join(b1.String(), IndexFilename)]))
-		testutil.Equals(t, 595, len(bkt.Objects()[path.Join(b1.String(), MetaFilename)]))
-	}
-	{
-		// Upload with no external labels should be blocked.
-		b2, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
-			labels.New(labels.Label{Name: "a", Value: "1"}),
-			labels.New(labels.Label{Name: "a", Value: "2"}),
-			labels.New(labels.Label{Name: "a", Value: "3"}),
-			labels.New(labels.Label{Name: "a", Value: "4"}),
-			labels.New(labels.Label{Name: "b", Value: "1"}),
-		}, 100, 0, 1000, labels.EmptyLabels(), 124, metadata.NoneFunc)
-		testutil.Ok(t, err)
-		err = Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b2.String()), metadata.NoneFunc)
-		testutil.NotOk(t, err)
-		testutil.Equals(t, "empty external labels are not allowed for Thanos block.", err.Error())
-		testutil.Equals(t, 3, len(bkt.Objects()))
-	}
-	{
-		// No external labels with UploadPromBlocks.
-		b2, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
-			labels.New(labels.Label{Name: "a", Value: "1"}),
-			labels.New(labels.Label{Name: "a", Value: "2"}),
-			labels.New(labels.Label{Name: "a", Value: "3"}),
-			labels.New(labels.Label{Name: "a", Value: "4"}),
-			labels.New(labels.Label{Name: "b", Value: "1"}),
-		}, 100, 0, 1000, labels.EmptyLabels(), 124, metadata.NoneFunc)
-		testutil.Ok(t, err)
-		err = UploadPromBlock(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b2.String()), metadata.NoneFunc)
+	testutil.Equals(t, 12, len(expected))
+	for _, c := range []int{0, 4, 100} {
+		res, err := GatherFileStatsWithContext(context.Background(), dir, metadata.SHA256Func, log.NewNopLogger(), WithGatherConcurrency(c))
 		testutil.Ok(t, err)
-		testutil.Equals(t, 6, len(bkt.Objects()))
-		testutil.Equals(t, 3727, len(bkt.Objects()[path.Join(b2.String(), ChunksDirname, "000001")]))
-		testutil.Equals(t, 401, len(bkt.Objects()[path.Join(b2.String(), IndexFilename)]))
-		testutil.Equals(t, 574, len(bkt.Objects()[path.Join(b2.String(), MetaFilename)]))
+		testutil.Equals(t, expected, res)
 	}
-}
 
-func TestDelete(t *testing.T) {
-	defer custom.TolerantVerifyLeak(t)
-	ctx := context.Background()
-
-	tmpDir := t.TempDir()
-
-	bkt := objstore.NewInMemBucket()
-	{
-		b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
-			labels.New(labels.Label{Name: "a", Value: "1"}),
-			labels.New(labels.Label{Name: "a", Value: "2"}),
-			labels.New(labels.Label{Name: "a", Value: "3"}),
-			labels.New(labels.Label{Name: "a", Value: "4"}),
-			labels.New(labels.Label{Name: "b", Value: "1"}),
-		}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
-		testutil.Ok(t, err)
-		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
-		testutil.Equals(t, 3, len(bkt.Objects()))
+	// Hash errors are returned with the path of the offending file.
+	testutil.Ok(t, os.Symlink(filepath.Join(dir, "not-existing"), filepath.Join(dir, ChunksDirname, "000011")))
+	_, err = GatherFileStatsWithContext(context.Background(), dir, metadata.SHA256Func, log.NewNopLogger(), WithGatherConcurrency(4))
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), filepath.Join(ChunksDirname, "000011")), "unexpected error %v", err)
+}
 
-		markedForDeletion := promauto.With(prometheus.NewRegistry()).NewCounter(prometheus.CounterOpts{Name: "test"})
-		testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, b1, "", markedForDeletion))
+func TestGatherFileStatsCanceled(t *testing.T) {
+	dir := t.TempDir()
+	createFileStatsTestBlock(t, dir, 10, 1024)
 
-		// Full delete.
-		testutil.Ok(t, Delete(ctx, log.NewNopLogger(), bkt, b1))
-		testutil.Equals(t, 0, len(bkt.Objects()))
-	}
-	{
-		b2, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
-			labels.New(labels.Label{Name: "a", Value: "1"}),
-			labels.New(labels.Label{Name: "a", Value: "2"}),
-			labels.New(labels.Label{Name: "a", Value: "3"}),
-			labels.New(labels.Label{Name: "a", Value: "4"}),
-			labels.New(labels.Label{Name: "b", Value: "1"}),
-		}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
-		testutil.Ok(t, err)
-		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b2.String()), metadata.NoneFunc))
-		testutil.Equals(t, 3, len(bkt.Objects()))
+	expected, err := GatherFileStats(dir, metadata.SHA256Func, log.NewNopLogger())
+	testutil.Ok(t, err)
+	res, err := GatherFileStatsWithContext(context.Background(), dir, metadata.SHA256Func, log.NewNopLogger(), WithGatherConcurrency(4))
+	testutil.Ok(t, err)
+	testutil.Equals(t, expected, res)
 
-		// Remove meta.json and check if delete can delete it.
-		testutil.Ok(t, bkt.Delete(ctx, path.Join(b2.String(), MetaFilename)))
-		testutil.Ok(t, Delete(ctx, log.NewNopLogger(), bkt, b2))
-		testutil.Equals(t, 0, len(bkt.Objects()))
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = GatherFileStatsWithContext(ctx, dir, metadata.SHA256Func, log.NewNopLogger(), WithGatherConcurrency(4))
+	testutil.Equals(t, context.Canceled, err)
 }
 
-func TestMarkForDeletion(t *testing.T) {
-	defer custom.TolerantVerifyLeak(t)
-	ctx := context.Background()
-
-	tmpDir := t.TempDir()
-
-	for _, tcase := range []struct {
-		name      string
-		preUpload func(t testing.TB, id ulid.ULID, bkt objstore.Bucket)
+func TestGatherFileStatsWithHashFilter(t *testing.T) {
+	dir := t.TempDir()
+	createFileStatsTestBlock(t, dir, 2, 1024)
+	smallChunk := filepath.Join(ChunksDirname, "000003")
+	testutil.Ok(t, os.WriteFile(filepath.Join(dir, smallChunk), []byte("small"), os.ModePerm))
 
-		blocksMarked int
+	all, err := GatherFileStatsWithContext(context.Background(), dir, metadata.SHA256Func, log.NewNopLogger())
+	testutil.Ok(t, err)
+	for _, tc := range []struct {
+		name   string
+		filter HashFilter
+		hashed []string
 	}{
-		{
-			name:         "block marked for deletion",
-			preUpload:    func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {},
-			blocksMarked: 1,
-		},
-		{
-			name: "block with deletion mark already, expected log and no metric increment",
-			preUpload: func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {
-				deletionMark, err := json.Marshal(metadata.DeletionMark{
-					ID:           id,
-					DeletionTime: time.Now().Unix(),
-					Version:      metadata.DeletionMarkVersion1,
-				})
-				testutil.Ok(t, err)
-				testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.DeletionMarkFilename), bytes.NewReader(deletionMark)))
-			},
-			blocksMarked: 0,
-		},
+		{name: "index only", filter: HashOnlyFiles(IndexFilename), hashed: []string{IndexFilename}},
+		{name: "small files", filter: HashFilesSmallerThan(1024), hashed: []string{smallChunk}},
+		{name: "no filter", hashed: []string{filepath.Join(ChunksDirname, "000001"), filepath.Join(ChunksDirname, "000002"), smallChunk, IndexFilename}},
 	} {
-		t.Run(tcase.name, func(t *testing.T) {
-			bkt := objstore.NewInMemBucket()
-			id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
-				labels.New(labels.Label{Name: "a", Value: "1"}),
-				labels.New(labels.Label{Name: "a", Value: "2"}),
-				labels.New(labels.Label{Name: "a", Value: "3"}),
-				labels.New(labels.Label{Name: "a", Value: "4"}),
-				labels.New(labels.Label{Name: "b", Value: "1"}),
-			}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
-			testutil.Ok(t, err)
-
-			tcase.preUpload(t, id, bkt)
-
-			testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String()), metadata.NoneFunc))
-
-			c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
-			err = MarkForDeletion(ctx, log.NewNopLogger(), bkt, id, "", c)
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := GatherFileStatsWithContext(context.Background(), dir, metadata.SHA256Func, log.NewNopLogger(), WithGatherHashFilter(tc.filter))
 			testutil.Ok(t, err)
-			testutil.Equals(t, float64(tcase.blocksMarked), promtest.ToFloat64(c))
+			testutil.Equals(t, len(all), len(res))
+
+			var hashed []string
+			for i, f := range res {
+				testutil.Equals(t, all[i].RelPath, f.RelPath)
+				testutil.Equals(t, all[i].SizeBytes, f.SizeBytes)
+				if f.Hash != nil {
+					testutil.Equals(t, all[i].Hash, f.Hash)
+					hashed = append(hashed, f.RelPath)
+				}
+			}
+			testutil.Equals(t, tc.hashed, hashed)
 		})
 	}
 }
 
-func TestMarkForNoCompact(t *testing.T) {
-	defer custom.TolerantVerifyLeak(t)
-	ctx := context.Background()
+func TestGetSegmentFilesWithSizes(t *testing.T) {
+	dir := t.TempDir()
+	createFileStatsTestBlock(t, dir, 3, 1024)
+	testutil.Ok(t, os.WriteFile(filepath.Join(dir, ChunksDirname, "000004"), []byte("test"), os.ModePerm))
 
-	tmpDir := t.TempDir()
+	files, err := GetSegmentFilesWithSizes(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []SegmentFile{
+		{Name: "000001", SizeBytes: 1024},
+		{Name: "000002", SizeBytes: 1024},
+		{Name: "000003", SizeBytes: 1024},
+		{Name: "000004", SizeBytes: 4},
+	}, files)
+	testutil.Equals(t, []string{"000001", "000002", "000003", "000004"}, GetSegmentFiles(dir))
+
+	_, err = GetSegmentFilesWithSizes(filepath.Join(dir, "not-existing"))
+	testutil.NotOk(t, err)
+}
 
+func TestValidateSegmentFiles(t *testing.T) {
 	for _, tcase := range []struct {
-		name      string
-		preUpload func(t testing.TB, id ulid.ULID, bkt objstore.Bucket)
-
-		blocksMarked int
+		name        string
+		files       []string
+		expectedErr string
 	}{
-		{
-			name:         "block marked",
-			preUpload:    func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {},
-			blocksMarked: 1,
-		},
-		{
-			name: "block with no-compact mark already, expected log and no metric increment",
-			preUpload: func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {
-				m, err := json.Marshal(metadata.NoCompactMark{
-					ID:            id,
-					NoCompactTime: time.Now().Unix(),
-					Version:       metadata.NoCompactMarkVersion1,
-				})
-				testutil.Ok(t, err)
-				testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.NoCompactMarkFilename), bytes.NewReader(m)))
-			},
-			blocksMarked: 0,
-		},
+		{name: "no segments"},
+		{name: "contiguous", files: []string{"000001", "000002", "000003"}},
+		{name: "gap", files: []string{"000001", "000003", "000004"}, expectedErr: "missing segment file chunks/000002"},
+		{name: "not starting from first", files: []string{"000002"}, expectedErr: "missing segment file chunks/000001"},
+		{name: "unexpected file", files: []string{"000001", "000002", "000002.tmp"}, expectedErr: "unexpected segment file chunks/000002.tmp"},
+		{name: "not padded", files: []string{"000001", "2"}, expectedErr: "unexpected segment file chunks/2"},
 	} {
 		t.Run(tcase.name, func(t *testing.T) {
-			bkt := objstore.NewInMemBucket()
-			id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
-				labels.New(labels.Label{Name: "a", Value: "1"}),
-				labels.New(labels.Label{Name: "a", Value: "2"}),
-				labels.New(labels.Label{Name: "a", Value: "3"}),
-				labels.New(labels.Label{Name: "a", Value: "4"}),
-				labels.New(labels.Label{Name: "b", Value: "1"}),
-			}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
-			testutil.Ok(t, err)
+			dir := t.TempDir()
+			testutil.Ok(t, os.MkdirAll(filepath.Join(dir, ChunksDirname), os.ModePerm))
+			for _, f := range tcase.files {
+				testutil.Ok(t, os.WriteFile(filepath.Join(dir, ChunksDirname, f), []byte("test"), os.ModePerm))
+			}
 
-			tcase.preUpload(t, id, bkt)
+			err := ValidateSegmentFiles(dir)
+			if tcase.expectedErr == "" {
+				testutil.Ok(t, err)
+				return
+			}
+			testutil.NotOk(t, err)
+			testutil.Equals(t, tcase.expectedErr, err.Error())
+		})
+	}
+}
 
-			testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String()), metadata.NoneFunc))
+func BenchmarkGatherFileStats(b *testing.B) {
+	dir := b.TempDir()
+	createFileStatsTestBlock(b, dir, 100, 1024*1024)
 
-			c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
-			err = MarkForNoCompact(ctx, log.NewNopLogger(), bkt, id, metadata.ManualNoCompactReason, "", c)
-			testutil.Ok(t, err)
-			testutil.Equals(t, float64(tcase.blocksMarked), promtest.ToFloat64(c))
+	for _, c := range []int{1, runtime.GOMAXPROCS(0)} {
+		b.Run(fmt.Sprintf("concurrency=%d", c), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := GatherFileStatsWithContext(context.Background(), dir, metadata.SHA256Func, log.NewNopLogger(), WithGatherConcurrency(c))
+				testutil.Ok(b, err)
+			}
 		})
 	}
 }
 
-func TestMarkForNoDownsample(t *testing.T) {
+// createFileStatsTestBlock creates a block directory with the given number of chunk segments of the given size.
+func createFileStatsTestBlock(t testing.TB, dir string, segments, size int) {
+	testutil.Ok(t, os.MkdirAll(filepath.Join(dir, ChunksDirname), os.ModePerm))
+
+	data := make([]byte, size)
+	for i := 1; i <= segments; i++ {
+		_, err := rand.Read(data)
+		testutil.Ok(t, err)
+		testutil.Ok(t, os.WriteFile(filepath.Join(dir, ChunksDirname, fmt.Sprintf("%06d", i)), data, os.ModePerm))
+	}
+	testutil.Ok(t, os.WriteFile(filepath.Join(dir, IndexFilename), data, os.ModePerm))
+	testutil.Ok(t, os.WriteFile(filepath.Join(dir, MetaFilename), []byte("{}"), os.ModePerm))
+}
 
+func TestBlockState(t *testing.T) {
 	defer custom.TolerantVerifyLeak(t)
-	ctx := context.Background()
 
-	tmpDir := t.TempDir()
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	id := ulid.MustNew(1, nil)
 
-	for _, tcase := range []struct {
-		name      string
-		preUpload func(t testing.TB, id ulid.ULID, bkt objstore.Bucket)
+	state, err := BlockState(ctx, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, StateNotFound, state)
 
-		blocksMarked int
-	}{
-		{
-			name:         "block marked",
-			preUpload:    func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {},
-			blocksMarked: 1,
-		},
-		{
-			name: "block with no-downsample mark already, expected log and no metric increment",
-			preUpload: func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {
-				m, err := json.Marshal(metadata.NoDownsampleMark{
-					ID:               id,
-					NoDownsampleTime: time.Now().Unix(),
-					Version:          metadata.NoDownsampleMarkVersion1,
-				})
-				testutil.Ok(t, err)
-				testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.NoDownsampleMarkFilename), bytes.NewReader(m)))
-			},
-			blocksMarked: 0,
-		},
-	} {
-		t.Run(tcase.name, func(t *testing.T) {
-			bkt := objstore.NewInMemBucket()
-			id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
-				labels.New(labels.Label{Name: "a", Value: "1"}),
-				labels.New(labels.Label{Name: "a", Value: "2"}),
-				labels.New(labels.Label{Name: "a", Value: "3"}),
-				labels.New(labels.Label{Name: "a", Value: "4"}),
-				labels.New(labels.Label{Name: "b", Value: "1"}),
-			}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
-			testutil.Ok(t, err)
+	// Other block with similar prefix does not matter.
+	testutil.Ok(t, bkt.Upload(ctx, id.String()+"-tmp/index", strings.NewReader("index")))
+	state, err = BlockState(ctx, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, StateNotFound, state)
 
-			tcase.preUpload(t, id, bkt)
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), ChunksDirname, "000001"), strings.NewReader("chunks")))
+	state, err = BlockState(ctx, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, StatePartial, state)
 
-			testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String()), metadata.NoneFunc))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), IndexFilename), strings.NewReader("index")))
+	uploadTestMeta(t, bkt, id, 0, 100, nil)
+	state, err = BlockState(ctx, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, StateComplete, state)
 
-			c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
-			err = MarkForNoDownsample(ctx, log.NewNopLogger(), bkt, id, metadata.ManualNoDownsampleReason, "", c)
-			testutil.Ok(t, err)
-			testutil.Equals(t, float64(tcase.blocksMarked), promtest.ToFloat64(c))
-		})
-	}
+	// Block with compressed meta only.
+	gzID := ulid.MustNew(2, nil)
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(gzID.String(), metadata.MetaGzipFilename), strings.NewReader("meta")))
+	state, err = BlockState(ctx, bkt, gzID)
+	testutil.Ok(t, err)
+	testutil.Equals(t, StateComplete, state)
+	testutil.Equals(t, "complete", state.String())
 }
 
-// TestHashDownload uploads an empty block to in-memory storage
-// and tries to download it to the same dir. It should not try
-// to download twice.
-func TestHashDownload(t *testing.T) {
+func TestReconcileBlockFiles(t *testing.T) {
 	defer custom.TolerantVerifyLeak(t)
 
 	ctx := context.Background()
-
+	logger := log.NewNopLogger()
 	tmpDir := t.TempDir()
 
-	bkt := objstore.NewInMemBucket()
-	r := prometheus.NewRegistry()
-	instrumentedBkt := objstore.WrapWithMetrics(bkt, extprom.WrapRegistererWithPrefix("thanos_", r), "test")
-
-	b1, err := e2eutil.CreateBlockWithTombstone(ctx, tmpDir, []labels.Labels{
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
 		labels.New(labels.Label{Name: "a", Value: "1"}),
-	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 42, metadata.SHA256Func)
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
 	testutil.Ok(t, err)
 
-	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), instrumentedBkt, path.Join(tmpDir, b1.String()), metadata.SHA256Func))
-	testutil.Equals(t, 3, len(bkt.Objects()))
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, Upload(ctx, logger, bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+	testutil.Ok(t, MarkForDeletion(ctx, logger, bkt, b1, "", promauto.With(nil).NewCounter(prometheus.CounterOpts{})))
 
-	m, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, b1)
+	missing, unexpected, err := ReconcileBlockFiles(ctx, bkt, b1)
 	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(missing))
+	testutil.Equals(t, 0, len(unexpected))
 
-	for _, fl := range m.Thanos.Files {
-		if fl.RelPath == MetaFilename {
-			continue
-		}
-		testutil.Assert(t, fl.Hash != nil, "expected a hash for %s but got nil", fl.RelPath)
-	}
-
-	// Remove the hash from one file to check if we always download it.
-	m.Thanos.Files[1].Hash = nil
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(b1.String(), "chunks", "000001")))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(b1.String(), "chunks", "000002"), strings.NewReader("stray")))
 
-	metaEncoded := strings.Builder{}
-	testutil.Ok(t, m.Write(&metaEncoded))
-	testutil.Ok(t, bkt.Upload(ctx, path.Join(b1.String(), MetaFilename), strings.NewReader(metaEncoded.String())))
-
-	// Only downloads MetaFile and IndexFile.
-	{
-		err = Download(ctx, log.NewNopLogger(), instrumentedBkt, m.ULID, path.Join(tmpDir, b1.String()))
-		testutil.Ok(t, err)
-		testutil.Ok(t, promtest.GatherAndCompare(r, strings.NewReader(`
-		# HELP thanos_objstore_bucket_operations_total Total number of all attempted operations against a bucket.
-        # TYPE thanos_objstore_bucket_operations_total counter
-        thanos_objstore_bucket_operations_total{bucket="test",operation="attributes"} 0
-        thanos_objstore_bucket_operations_total{bucket="test",operation="delete"} 0
-        thanos_objstore_bucket_operations_total{bucket="test",operation="exists"} 0
-        thanos_objstore_bucket_operations_total{bucket="test",operation="get"} 2
-        thanos_objstore_bucket_operations_total{bucket="test",operation="get_range"} 0
-        thanos_objstore_bucket_operations_total{bucket="test",operation="iter"} 2
-        thanos_objstore_bucket_operations_total{bucket="test",operation="upload"} 3
-		`), `thanos_objstore_bucket_operations_total`))
-	}
-
-	// Ensures that we always download MetaFile.
-	{
-		testutil.Ok(t, os.Remove(path.Join(tmpDir, b1.String(), MetaFilename)))
-		err = Download(ctx, log.NewNopLogger(), instrumentedBkt, m.ULID, path.Join(tmpDir, b1.String()))
-		testutil.Ok(t, err)
-		testutil.Ok(t, promtest.GatherAndCompare(r, strings.NewReader(`
-		# HELP thanos_objstore_bucket_operations_total Total number of all attempted operations against a bucket.
-        # TYPE thanos_objstore_bucket_operations_total counter
-        thanos_objstore_bucket_operations_total{bucket="test",operation="attributes"} 0
-        thanos_objstore_bucket_operations_total{bucket="test",operation="delete"} 0
-        thanos_objstore_bucket_operations_total{bucket="test",operation="exists"} 0
-        thanos_objstore_bucket_operations_total{bucket="test",operation="get"} 4
-        thanos_objstore_bucket_operations_total{bucket="test",operation="get_range"} 0
-        thanos_objstore_bucket_operations_total{bucket="test",operation="iter"} 4
-        thanos_objstore_bucket_operations_total{bucket="test",operation="upload"} 3
-		`), `thanos_objstore_bucket_operations_total`))
-	}
+	missing, unexpected, err = ReconcileBlockFiles(ctx, bkt, b1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"chunks/000001"}, missing)
+	testutil.Equals(t, []string{"chunks/000002"}, unexpected)
 
-	// Remove chunks => gets redownloaded.
-	// Always downloads MetaFile.
-	// Finally, downloads the IndexFile since we have removed its hash.
-	{
-		testutil.Ok(t, os.RemoveAll(path.Join(tmpDir, b1.String(), ChunksDirname)))
-		err = Download(ctx, log.NewNopLogger(), instrumentedBkt, m.ULID, path.Join(tmpDir, b1.String()))
-		testutil.Ok(t, err)
-		testutil.Ok(t, promtest.GatherAndCompare(r, strings.NewReader(`
-			# HELP thanos_objstore_bucket_operations_total Total number of all attempted operations against a bucket.
-			# TYPE thanos_objstore_bucket_operations_total counter
-			thanos_objstore_bucket_operations_total{bucket="test",operation="attributes"} 0
-			thanos_objstore_bucket_operations_total{bucket="test",operation="delete"} 0
-			thanos_objstore_bucket_operations_total{bucket="test",operation="exists"} 0
-			thanos_objstore_bucket_operations_total{bucket="test",operation="get"} 7
-			thanos_objstore_bucket_operations_total{bucket="test",operation="get_range"} 0
-			thanos_objstore_bucket_operations_total{bucket="test",operation="iter"} 6
-			thanos_objstore_bucket_operations_total{bucket="test",operation="upload"} 3
-			`), `thanos_objstore_bucket_operations_total`))
-	}
+	_, _, err = ReconcileBlockFiles(ctx, bkt, ulid.MustNew(1, nil))
+	testutil.NotOk(t, err)
 }
 
-func TestUploadCleanup(t *testing.T) {
+func TestRepairFileStats(t *testing.T) {
 	defer custom.TolerantVerifyLeak(t)
 
 	ctx := context.Background()
-
+	logger := log.NewNopLogger()
 	tmpDir := t.TempDir()
 
-	bkt := objstore.NewInMemBucket()
 	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
 		labels.New(labels.Label{Name: "a", Value: "1"}),
 		labels.New(labels.Label{Name: "a", Value: "2"}),
-		labels.New(labels.Label{Name: "a", Value: "3"}),
-		labels.New(labels.Label{Name: "a", Value: "4"}),
-		labels.New(labels.Label{Name: "b", Value: "1"}),
 	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
 	testutil.Ok(t, err)
+	bdir := path.Join(tmpDir, b1.String())
 
-	{
-		errBkt := errBucket{Bucket: bkt, failSuffix: "/index"}
-
-		uploadErr := Upload(ctx, log.NewNopLogger(), errBkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc)
-		testutil.Assert(t, errors.Is(uploadErr, errUploadFailed))
+	// Meta of the created block has no files.
+	diffs, err := RepairFileStatsDryRun(bdir, metadata.SHA256Func, logger)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "thanos.rewrites[0]", diffs[0].Field)
+	before, err := metadata.ReadFromDir(bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(before.Thanos.Files))
 
-		// If upload of index fails, block is deleted.
-		testutil.Equals(t, 0, len(bkt.Objects()))
-		testutil.Assert(t, len(bkt.Objects()[path.Join(DebugMetas, fmt.Sprintf("%s.json", b1.String()))]) == 0)
+	testutil.Ok(t, RepairFileStats(bdir, metadata.SHA256Func, logger))
+	repaired, err := metadata.ReadFromDir(bdir)
+	testutil.Ok(t, err)
+	files, err := GatherFileStatsWithContext(ctx, bdir, metadata.SHA256Func, logger)
+	testutil.Ok(t, err)
+	testutil.Equals(t, files, repaired.Thanos.Files)
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.RelPath)
 	}
+	testutil.Equals(t, []metadata.Rewrite{{Sources: before.Compaction.Sources, FilesRepaired: paths}}, repaired.Thanos.Rewrites)
 
-	{
-		errBkt := errBucket{Bucket: bkt, failSuffix: "/meta.json"}
+	// Nothing to repair.
+	diffs, err = RepairFileStatsDryRun(bdir, metadata.SHA256Func, logger)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(diffs))
+	testutil.Ok(t, RepairFileStats(bdir, metadata.SHA256Func, logger))
+	unchanged, err := metadata.ReadFromDir(bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, repaired, unchanged)
 
-		uploadErr := Upload(ctx, log.NewNopLogger(), errBkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc)
-		testutil.Assert(t, errors.Is(uploadErr, errUploadFailed))
+	// Drifted file is repaired.
+	f, err := os.OpenFile(filepath.Join(bdir, ChunksDirname, "000001"), os.O_APPEND|os.O_WRONLY, 0)
+	testutil.Ok(t, err)
+	_, err = f.Write([]byte("drift"))
+	testutil.Ok(t, err)
+	testutil.Ok(t, f.Close())
 
-		// If upload of meta.json fails, nothing is cleaned up.
-		testutil.Equals(t, 3, len(bkt.Objects()))
-		testutil.Assert(t, len(bkt.Objects()[path.Join(b1.String(), ChunksDirname, "000001")]) > 0)
-		testutil.Assert(t, len(bkt.Objects()[path.Join(b1.String(), IndexFilename)]) > 0)
-		testutil.Assert(t, len(bkt.Objects()[path.Join(b1.String(), MetaFilename)]) > 0)
-		testutil.Assert(t, len(bkt.Objects()[path.Join(DebugMetas, fmt.Sprintf("%s.json", b1.String()))]) == 0)
-	}
+	diffs, err = RepairFileStatsDryRun(bdir, metadata.SHA256Func, logger)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(diffs))
+	testutil.Equals(t, "thanos.rewrites[1]", diffs[0].Field)
+	testutil.Equals(t, metadata.MetaFieldDiff{
+		Field: "thanos.files.chunks/000001", Kind: metadata.MetaFieldChanged,
+		Old: diffs[1].Old, New: diffs[1].New,
+	}, diffs[1])
+	testutil.Assert(t, diffs[1].Old != diffs[1].New, "expected changed file")
+
+	testutil.Ok(t, RepairFileStats(bdir, metadata.SHA256Func, logger))
+	repaired, err = metadata.ReadFromDir(bdir)
+	testutil.Ok(t, err)
+	files, err = GatherFileStatsWithContext(ctx, bdir, metadata.SHA256Func, logger)
+	testutil.Ok(t, err)
+	testutil.Equals(t, files, repaired.Thanos.Files)
+	testutil.Equals(t, 2, len(repaired.Thanos.Rewrites))
+	testutil.Equals(t, []string{"chunks/000001"}, repaired.Thanos.Rewrites[1].FilesRepaired)
 }
 
-var errUploadFailed = errors.New("upload failed")
-
-type errBucket struct {
-	objstore.Bucket
+func TestVerifyBlockID(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
 
-	failSuffix string
-}
+	ctx := context.Background()
+	tmpDir := t.TempDir()
 
-func (eb errBucket) Upload(ctx context.Context, name string, r io.Reader) error {
-	err := eb.Bucket.Upload(ctx, name, r)
-	if err != nil {
-		return err
-	}
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bdir := path.Join(tmpDir, b1.String())
+	testutil.Ok(t, VerifyBlockID(bdir))
 
-	if strings.HasSuffix(name, eb.failSuffix) {
-		return errUploadFailed
-	}
-	return nil
-}
+	// Block with meta of another block.
+	other := ulid.MustNew(1, nil)
+	misplaced := path.Join(tmpDir, other.String())
+	testutil.Ok(t, os.Rename(bdir, misplaced))
+	err = VerifyBlockID(misplaced)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), b1.String()), "error should name the block in meta: %v", err)
 
-func TestRemoveMarkForDeletion(t *testing.T) {
-	defer custom.TolerantVerifyLeak(t)
-	ctx := context.Background()
-	tmpDir := t.TempDir()
-	for _, testcases := range []struct {
-		name           string
-		preDelete      func(t testing.TB, id ulid.ULID, bkt objstore.Bucket)
-		blocksUnmarked int
-	}{
-		{
-			name: "unmarked block for deletion",
-			preDelete: func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {
-				deletionMark, err := json.Marshal(metadata.DeletionMark{
-					ID:           id,
-					DeletionTime: time.Now().Unix(),
-					Version:      metadata.DeletionMarkVersion1,
-				})
-				testutil.Ok(t, err)
-				testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.DeletionMarkFilename), bytes.NewReader(deletionMark)))
-			},
-			blocksUnmarked: 1,
-		},
-		{
-			name:           "block not marked for deletion, message logged and metric not incremented",
-			preDelete:      func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {},
-			blocksUnmarked: 0,
-		},
-	} {
-		t.Run(testcases.name, func(t *testing.T) {
-			bkt := objstore.NewInMemBucket()
-			id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
-				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-1"}),
-				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-2"}),
-				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-3"}),
-				labels.New(labels.Label{Name: "cluster-us1", Value: "service-1"}),
-				labels.New(labels.Label{Name: "cluster-us1", Value: "service-2"}),
-			}, 100, 0, 1000, labels.New(labels.Label{Name: "region-1", Value: "eu-west"}), 124, metadata.NoneFunc)
-			testutil.Ok(t, err)
-			testcases.preDelete(t, id, bkt)
-			counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
-			err = RemoveMark(ctx, log.NewNopLogger(), bkt, id, counter, metadata.DeletionMarkFilename)
-			testutil.Ok(t, err)
-			testutil.Equals(t, float64(testcases.blocksUnmarked), promtest.ToFloat64(counter))
-		})
-	}
-}
+	bkt := objstore.NewInMemBucket()
+	testutil.NotOk(t, UploadWithOptions(ctx, log.NewNopLogger(), bkt, misplaced, metadata.NoneFunc, WithBlockIDValidation()))
+	testutil.Equals(t, 0, len(bkt.Objects()))
 
-func TestRemoveMarkForNoCompact(t *testing.T) {
-	defer custom.TolerantVerifyLeak(t)
-	ctx := context.Background()
-	tmpDir := t.TempDir()
-	for _, testCases := range []struct {
-		name           string
-		preDelete      func(t testing.TB, id ulid.ULID, bkt objstore.Bucket)
-		blocksUnmarked int
-	}{
-		{
-			name: "unmarked block for no-compact",
-			preDelete: func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {
-				m, err := json.Marshal(metadata.NoCompactMark{
-					ID:            id,
-					NoCompactTime: time.Now().Unix(),
-					Version:       metadata.NoCompactMarkVersion1,
-				})
-				testutil.Ok(t, err)
-				testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.NoCompactMarkFilename), bytes.NewReader(m)))
-			},
-			blocksUnmarked: 1,
-		},
-		{
-			name:           "block not marked for no-compact, message logged and metric not incremented",
-			preDelete:      func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {},
-			blocksUnmarked: 0,
-		},
-	} {
-		t.Run(testCases.name, func(t *testing.T) {
-			bkt := objstore.NewInMemBucket()
-			id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
-				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-1"}),
-				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-2"}),
-				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-3"}),
-				labels.New(labels.Label{Name: "cluster-us1", Value: "service-1"}),
-				labels.New(labels.Label{Name: "cluster-us1", Value: "service-2"}),
-			}, 100, 0, 1000, labels.New(labels.Label{Name: "region-1", Value: "eu-west"}), 124, metadata.NoneFunc)
-			testutil.Ok(t, err)
-			testCases.preDelete(t, id, bkt)
-			counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
-			err = RemoveMark(ctx, log.NewNopLogger(), bkt, id, counter, metadata.NoCompactMarkFilename)
-			testutil.Ok(t, err)
-			testutil.Equals(t, float64(testCases.blocksUnmarked), promtest.ToFloat64(counter))
-		})
-	}
+	testutil.NotOk(t, VerifyBlockID(tmpDir))
 }
 
-func TestRemoveMmarkForNoDownsample(t *testing.T) {
-	defer custom.TolerantVerifyLeak(t)
-	ctx := context.Background()
-	tmpDir := t.TempDir()
-	for _, testCases := range []struct {
-		name           string
-		preDelete      func(t testing.TB, id ulid.ULID, bkt objstore.Bucket)
-		blocksUnmarked int
-	}{
-		{
-			name: "unmarked block for no-downsample",
-			preDelete: func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {
-				m, err := json.Marshal(metadata.NoDownsampleMark{
-					ID:               id,
-					NoDownsampleTime: time.Now().Unix(),
-					Version:          metadata.NoDownsampleMarkVersion1,
-				})
-				testutil.Ok(t, err)
-				testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.NoDownsampleMarkFilename), bytes.NewReader(m)))
-			},
-			blocksUnmarked: 1,
-		},
-		{
-			name:           "block not marked for no-downsample, message logged and metric not incremented",
-			preDelete:      func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {},
-			blocksUnmarked: 0,
-		},
-	} {
-		t.Run(testCases.name, func(t *testing.T) {
-			bkt := objstore.NewInMemBucket()
-			id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
-				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-1"}),
-				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-2"}),
-				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-3"}),
-				labels.New(labels.Label{Name: "cluster-us1", Value: "service-1"}),
-				labels.New(labels.Label{Name: "cluster-us1", Value: "service-2"}),
-			}, 100, 0, 1000, labels.New(labels.Label{Name: "region-1", Value: "eu-west"}), 124, metadata.NoneFunc)
-			testutil.Ok(t, err)
-			testCases.preDelete(t, id, bkt)
-			counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
-			err = RemoveMark(ctx, log.NewNopLogger(), bkt, id, counter, metadata.NoDownsampleMarkFilename)
-			testutil.Ok(t, err)
-			testutil.Equals(t, float64(testCases.blocksUnmarked), promtest.ToFloat64(counter))
-		})
+func fileRelPaths(files []metadata.File) []string {
+	res := make([]string, 0, len(files))
+	for _, f := range files {
+		res = append(res, f.RelPath)
 	}
+	return res
 }
@@ -0,0 +1,193 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// Copy copies the block with the given ID from src to dst bucket, streaming objects directly between buckets without
+// a need of having the block on local disk. Similar to Upload, meta file is copied last,
+// so dst never contains partial block with a valid meta, and the block is cleaned up from dst on error. Copied files
+// are verified against files listed in meta, if any. It fails if dst already contains the block.
+func Copy(ctx context.Context, logger log.Logger, src, dst objstore.Bucket, id ulid.ULID) error {
+	metaObject := path.Join(id.String(), MetaFilename)
+	rc, err := src.Get(ctx, metaObject)
+	if err != nil && src.IsObjNotFoundErr(err) {
+		metaObject = path.Join(id.String(), metadata.MetaGzipFilename)
+		rc, err = src.Get(ctx, metaObject)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "get meta file of block %s", id)
+	}
+	metaEncoded, err := io.ReadAll(rc)
+	runutil.CloseWithLogOnErr(logger, rc, "close meta reader")
+	if err != nil {
+		return errors.Wrapf(err, "read file %s", metaObject)
+	}
+	meta, err := metadata.Read(io.NopCloser(bytes.NewReader(metaEncoded)))
+	if err != nil {
+		return errors.Wrapf(err, "read file %s", metaObject)
+	}
+
+	for _, f := range []string{MetaFilename, metadata.MetaGzipFilename} {
+		ok, err := dst.Exists(ctx, path.Join(id.String(), f))
+		if err != nil {
+			return errors.Wrapf(err, "check block %s existence in destination bucket", id)
+		}
+		if ok {
+			return errors.Errorf("block %s already exists in destination bucket", id)
+		}
+	}
+
+	var copied []string
+	if err := src.Iter(ctx, id.String(), func(name string) error {
+		if IsBlockMetaFile(name) {
+			return nil
+		}
+		if err := copyObject(ctx, logger, src, dst, name); err != nil {
+			return err
+		}
+		copied = append(copied, strings.TrimPrefix(name, id.String()+objstore.DirDelim))
+		return nil
+	}, objstore.WithRecursiveIter); err != nil {
+		return cleanUp(logger, dst, id, errors.Wrap(err, "copy block files"))
+	}
+
+	if len(meta.Thanos.Files) > 0 {
+		if err := verifyCopiedFiles(meta.Thanos.Files, copied); err != nil {
+			return cleanUp(logger, dst, id, err)
+		}
+	}
+
+	// Meta file always need to be copied as a last item. See upload for details.
+	if err := dst.Upload(ctx, metaObject, bytes.NewReader(metaEncoded)); err != nil {
+		return cleanUp(logger, dst, id, errors.Wrap(err, "upload meta file"))
+	}
+	level.Info(logger).Log("msg", "copied block", "block", id, "files", len(copied)+1, "src", src.Name(), "dst", dst.Name())
+	return nil
+}
+
+func copyObject(ctx context.Context, logger log.Logger, src, dst objstore.Bucket, name string) error {
+	return copyObjectTo(ctx, logger, src, dst, name, name)
+}
+
+// copyObjectTo copies the object with the given name from src to dstName in dst bucket.
+func copyObjectTo(ctx context.Context, logger log.Logger, src, dst objstore.Bucket, name, dstName string) error {
+	rc, err := src.Get(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "get file %s", name)
+	}
+	defer runutil.CloseWithLogOnErr(logger, rc, "close file reader")
+
+	if err := dst.Upload(ctx, dstName, rc); err != nil {
+		return errors.Wrapf(err, "upload file %s", dstName)
+	}
+	return nil
+}
+
+// RepathBlock moves the block with the given ID under newID in the same bucket, e.g. to replace an ID which
+// can't be used anymore after a repair. Objects are copied to the new block directory, with meta file, updated
+// to newID, copied last. Old block is deleted only once the new one is complete. Occurrences of oldID in
+// compaction sources are replaced too, but marker files (e.g. deletion mark) are not moved. It fails if a block,
+// even partial, already exists under newID, and the new block is cleaned up on error. Frozen blocks (see MarkFrozen)
+// can't be moved.
+func RepathBlock(ctx context.Context, logger log.Logger, bkt objstore.Bucket, oldID, newID ulid.ULID) error {
+	if oldID == newID {
+		return errors.Errorf("block %s can't be moved to the same ID", oldID)
+	}
+	if err := checkNotFrozen(ctx, bkt, oldID); err != nil {
+		return err
+	}
+	meta, metaFile, err := readBucketMeta(ctx, bkt, oldID)
+	if err != nil {
+		return err
+	}
+	state, err := BlockState(ctx, bkt, newID)
+	if err != nil {
+		return err
+	}
+	if state != StateNotFound {
+		return errors.Errorf("block %s already exists in bucket (%s)", newID, state)
+	}
+	// Neither block has to be checked for frozen mark again when deleted: oldID was checked above, and newID
+	// didn't exist and doesn't get any markers.
+	skipFrozenCheck := WithForceDeleteFrozen()
+
+	markers := map[string]struct{}{
+		metadata.DeletionMarkFilename:     {},
+		metadata.NoCompactMarkFilename:    {},
+		metadata.NoDownsampleMarkFilename: {},
+		metadata.FrozenMarkFilename:       {},
+	}
+	oldPrefix := oldID.String() + objstore.DirDelim
+	var copied []string
+	if err := bkt.Iter(ctx, oldPrefix, func(name string) error {
+		rel := strings.TrimPrefix(name, oldPrefix)
+		if _, ok := markers[rel]; ok || IsBlockMetaFile(name) {
+			return nil
+		}
+		if err := copyObjectTo(ctx, logger, bkt, bkt, name, path.Join(newID.String(), rel)); err != nil {
+			return err
+		}
+		copied = append(copied, rel)
+		return nil
+	}, objstore.WithRecursiveIter); err != nil {
+		return cleanUp(logger, bkt, newID, errors.Wrap(err, "copy block files"), skipFrozenCheck)
+	}
+	if len(meta.Thanos.Files) > 0 {
+		if err := verifyCopiedFiles(meta.Thanos.Files, copied); err != nil {
+			return cleanUp(logger, bkt, newID, err, skipFrozenCheck)
+		}
+	}
+
+	meta.ULID = newID
+	for i, src := range meta.Compaction.Sources {
+		if src == oldID {
+			meta.Compaction.Sources[i] = newID
+		}
+	}
+	// Meta file always need to be copied as a last item. See upload for details.
+	if err := writeBucketMeta(ctx, bkt, meta, path.Join(newID.String(), path.Base(metaFile))); err != nil {
+		return cleanUp(logger, bkt, newID, err, skipFrozenCheck)
+	}
+
+	if err := Delete(ctx, logger, bkt, oldID, skipFrozenCheck); err != nil {
+		return errors.Wrapf(err, "delete block %s after moving it to %s", oldID, newID)
+	}
+	level.Info(logger).Log("msg", "moved block", "block", oldID, "newBlock", newID, "files", len(copied)+1)
+	return nil
+}
+
+// verifyCopiedFiles checks that exactly the files listed in meta, except meta.json itself, were copied.
+func verifyCopiedFiles(files []metadata.File, copied []string) error {
+	expected := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		if f.RelPath != MetaFilename {
+			expected[f.RelPath] = struct{}{}
+		}
+	}
+	if len(expected) != len(copied) {
+		return errors.Errorf("copied %d files, but meta lists %d", len(copied), len(expected))
+	}
+	for _, f := range copied {
+		if _, ok := expected[f]; !ok {
+			return errors.Errorf("copied file %s not listed in meta", f)
+		}
+	}
+	return nil
+}
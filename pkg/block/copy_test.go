@@ -0,0 +1,123 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+type uploadRecordingBucket struct {
+	objstore.Bucket
+
+	uploads []string
+}
+
+func (b *uploadRecordingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.uploads = append(b.uploads, name)
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestCopy(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	src := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, logger, src, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+
+	dst := &uploadRecordingBucket{Bucket: objstore.NewInMemBucket()}
+	testutil.Ok(t, Copy(ctx, logger, src, dst, b1))
+	testutil.Equals(t, src.Objects(), dst.Bucket.(*objstore.InMemBucket).Objects())
+	testutil.Equals(t, path.Join(b1.String(), MetaFilename), dst.uploads[len(dst.uploads)-1])
+
+	// Existing block is not overwritten.
+	testutil.NotOk(t, Copy(ctx, logger, src, dst, b1))
+
+	// Block with files not matching its meta is not copied.
+	testutil.Ok(t, src.Upload(ctx, path.Join(b1.String(), ChunksDirname, "000002"), strings.NewReader("chunks")))
+	dst = &uploadRecordingBucket{Bucket: objstore.NewInMemBucket()}
+	testutil.NotOk(t, Copy(ctx, logger, src, dst, b1))
+	testutil.Equals(t, 0, len(dst.Bucket.(*objstore.InMemBucket).Objects()))
+
+	// Missing block.
+	testutil.NotOk(t, Copy(ctx, logger, src, dst, ulid.MustNew(1, nil)))
+}
+
+func TestRepathBlock(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	oldID, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, Upload(ctx, logger, bkt, path.Join(tmpDir, oldID.String()), metadata.SHA256Func))
+	testutil.Ok(t, MarkForNoCompact(ctx, logger, bkt, oldID, metadata.ManualNoCompactReason, "", promauto.With(nil).NewCounter(prometheus.CounterOpts{})))
+	before, err := DownloadMeta(ctx, logger, bkt, oldID)
+	testutil.Ok(t, err)
+	objects := map[string][]byte{}
+	for name, b := range bkt.Objects() {
+		objects[name] = b
+	}
+
+	// Existing, even partial, blocks are not overwritten.
+	partial := ulid.MustNew(2, nil)
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(partial.String(), IndexFilename), strings.NewReader("index")))
+	testutil.NotOk(t, RepathBlock(ctx, logger, bkt, oldID, partial))
+	testutil.NotOk(t, RepathBlock(ctx, logger, bkt, oldID, oldID))
+	testutil.NotOk(t, RepathBlock(ctx, logger, bkt, ulid.MustNew(3, nil), ulid.MustNew(4, nil)))
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(partial.String(), IndexFilename)))
+
+	newID := ulid.MustNew(5, nil)
+	testutil.Ok(t, RepathBlock(ctx, logger, bkt, oldID, newID))
+
+	state, err := BlockState(ctx, bkt, oldID)
+	testutil.Ok(t, err)
+	testutil.Equals(t, StateNotFound, state)
+
+	after, err := DownloadMeta(ctx, logger, bkt, newID)
+	testutil.Ok(t, err)
+	testutil.Equals(t, newID, after.ULID)
+	testutil.Equals(t, []ulid.ULID{newID}, after.Compaction.Sources)
+	testutil.Equals(t, before.Thanos.Files, after.Thanos.Files)
+	testutil.Equals(t, before.Thanos.Labels, after.Thanos.Labels)
+
+	for name, b := range bkt.Objects() {
+		testutil.Assert(t, strings.HasPrefix(name, newID.String()+"/"), "unexpected object %s", name)
+		if path.Base(name) != MetaFilename {
+			testutil.Equals(t, objects[path.Join(oldID.String(), strings.TrimPrefix(name, newID.String()+"/"))], b)
+		}
+	}
+	// No-compact mark is not moved.
+	testutil.Equals(t, len(objects)-1, len(bkt.Objects()))
+}
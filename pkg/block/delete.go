@@ -0,0 +1,349 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// Delete removes directory that is meant to be block directory.
+// NOTE: Always prefer this method for deleting blocks.
+//   - We have to delete block's files in the certain order (meta.json first and deletion-mark.json last)
+//     to ensure we don't end up with malformed partial blocks. Thanos system handles well partial blocks
+//     only if they don't have meta.json. If meta.json is present Thanos assumes valid block.
+//   - This avoids deleting empty dir (whole bucket) by mistake.
+//   - Bucket operations failing with retriable errors are retried with DefaultRetryPolicy, unless another policy is
+//     given with WithDeleteRetries or the bucket is already wrapped by NewRetryBucket. If an object still can't be
+//     deleted, PartialDeleteError listing deleted and remaining objects is returned.
+//   - Frozen blocks (see MarkFrozen) are refused with ErrBlockFrozen unless WithForceDeleteFrozen option is passed.
+//   - If WithDeleteMarkIndex is given, the block is removed from the deletion mark index (see MarkIndex) once the
+//     deletion mark is deleted.
+func Delete(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, options ...DeleteOption) error {
+	params := applyDeleteOptions(options...)
+	// Index is updated through the given bucket, which might implement ConditionalBucket.
+	ibkt := bkt
+	bkt = withRetries(bkt, params.retries, params.retryMetrics)
+	if !params.forceFrozen {
+		if err := checkNotFrozen(ctx, bkt, id); err != nil {
+			return err
+		}
+	}
+
+	var deleted []string
+	err := deleteBlock(ctx, bkt, id, params.keepDeletionMark, func(name string) error {
+		if err := bkt.Delete(ctx, name); err != nil && !bkt.IsObjNotFoundErr(err) {
+			return err
+		}
+		deleted = append(deleted, name)
+		level.Debug(logger).Log("msg", "deleted file", "file", name, "bucket", bkt.Name())
+		return nil
+	})
+	if err == nil {
+		if params.updateIndex && !params.keepDeletionMark {
+			// Index is only a cache of deletion marks, so failing to update it does not fail the deletion.
+			if err := updateMarkIndex(ctx, logger, ibkt, metadata.DeletionMarkFilename, map[ulid.ULID]bool{id: false}); err != nil {
+				level.Warn(logger).Log("msg", "failed to remove deleted block from deletion mark index", "block", id, "err", err)
+			}
+		}
+		return nil
+	}
+	if len(deleted) == 0 {
+		return err
+	}
+
+	// Best effort listing of what's left, detached from cancellation of ctx in case deletion failed due to it.
+	lctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), remainingListTimeout)
+	defer cancel()
+	var remaining []string
+	if lerr := deleteBlock(lctx, bkt, id, params.keepDeletionMark, func(name string) error {
+		remaining = append(remaining, name)
+		return nil
+	}); lerr != nil {
+		level.Warn(logger).Log("msg", "failed to list objects remaining after failed deletion", "block", id, "err", lerr)
+		remaining = nil
+	}
+	return &PartialDeleteError{ID: id, Deleted: deleted, NotDeleted: remaining, Err: err}
+}
+
+// DeleteMany works like Delete for many blocks, deleting up to concurrency blocks in parallel. Objects of each block
+// are deleted in the order required by Delete. It returns errors of blocks which were not deleted, by block ID.
+// If WithDeleteMarkIndex is given, the deletion mark index is updated once, after all blocks are processed.
+func DeleteMany(ctx context.Context, logger log.Logger, bkt objstore.Bucket, ids []ulid.ULID, concurrency int, options ...DeleteOption) map[ulid.ULID]error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	params := applyDeleteOptions(options...)
+	// Blocks are removed from the index below in a single update.
+	options = append(options[:len(options):len(options)], func(params *deleteParams) { params.updateIndex = false })
+
+	var (
+		mtx  sync.Mutex
+		errs = map[ulid.ULID]error{}
+		g    errgroup.Group
+	)
+	g.SetLimit(concurrency)
+	for _, id := range ids {
+		id := id
+		g.Go(func() error {
+			if err := Delete(ctx, logger, bkt, id, options...); err != nil {
+				mtx.Lock()
+				errs[id] = err
+				mtx.Unlock()
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	if params.updateIndex && !params.keepDeletionMark {
+		deleted := make(map[ulid.ULID]bool, len(ids))
+		for _, id := range ids {
+			if _, ok := errs[id]; !ok {
+				deleted[id] = false
+			}
+		}
+		// Index is only a cache of deletion marks, so failing to update it does not fail the deletion.
+		if err := updateMarkIndex(ctx, logger, bkt, metadata.DeletionMarkFilename, deleted); err != nil {
+			level.Warn(logger).Log("msg", "failed to remove deleted blocks from deletion mark index", "err", err)
+		}
+	}
+	return errs
+}
+
+// DeleteOption configures the provided params.
+type DeleteOption func(params *deleteParams)
+
+// deleteParams holds the Delete() parameters.
+type deleteParams struct {
+	keepDeletionMark bool
+	forceFrozen      bool
+	updateIndex      bool
+	retries          *RetryPolicy
+	retryMetrics     *RetryMetrics
+}
+
+func applyDeleteOptions(options ...DeleteOption) deleteParams {
+	params := deleteParams{retries: &DefaultRetryPolicy}
+	for _, opt := range options {
+		opt(&params)
+	}
+	return params
+}
+
+// WithKeepDeletionMark is an option to keep the deletion mark of the block after all its other files are deleted,
+// e.g. as an audit record of what was deleted and when, which stays listed by ListMarkedBlocks.
+func WithKeepDeletionMark() DeleteOption {
+	return func(params *deleteParams) {
+		params.keepDeletionMark = true
+	}
+}
+
+// WithDeleteMarkIndex is an option to also remove the block from the deletion mark index (see MarkIndex). It has no
+// effect together with WithKeepDeletionMark, as the block stays marked.
+func WithDeleteMarkIndex() DeleteOption {
+	return func(params *deleteParams) {
+		params.updateIndex = true
+	}
+}
+
+// WithForceDeleteFrozen is an option to delete the block even if it's frozen (see MarkFrozen).
+func WithForceDeleteFrozen() DeleteOption {
+	return func(params *deleteParams) {
+		params.forceFrozen = true
+	}
+}
+
+// WithDeleteRetries is an option to retry failed bucket operations of Delete according to the given policy instead of
+// DefaultRetryPolicy. Policy with MaxAttempts lower than 2 disables retries. Metrics are optional.
+func WithDeleteRetries(policy RetryPolicy, metrics *RetryMetrics) DeleteOption {
+	return func(params *deleteParams) {
+		params.retries = &policy
+		params.retryMetrics = metrics
+	}
+}
+
+// remainingListTimeout bounds listing of objects remaining after a failed deletion.
+const remainingListTimeout = 30 * time.Second
+
+// PartialDeleteError is returned by Delete when the block was deleted only partially.
+type PartialDeleteError struct {
+	ID ulid.ULID
+	// Deleted are names of objects deleted before the failure, in the order of deletion.
+	Deleted []string
+	// NotDeleted are names of objects which are still present, in the order they would be deleted.
+	// It might be empty if listing them failed.
+	NotDeleted []string
+	Err        error
+}
+
+func (e *PartialDeleteError) Error() string {
+	return fmt.Sprintf("block %s deleted partially; deleted objects: %v; not deleted objects: %v: %v", e.ID, e.Deleted, e.NotDeleted, e.Err)
+}
+
+func (e *PartialDeleteError) Unwrap() error {
+	return e.Err
+}
+
+// DeleteDryRun returns names of all objects Delete would remove for the given block, in the order Delete would remove them.
+// Nothing is deleted. Like Delete, it returns ErrBlockFrozen for frozen blocks unless WithForceDeleteFrozen option is passed.
+func DeleteDryRun(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, options ...DeleteOption) ([]string, error) {
+	params := applyDeleteOptions(options...)
+	bkt = withRetries(bkt, params.retries, params.retryMetrics)
+	if !params.forceFrozen {
+		if err := checkNotFrozen(ctx, bkt, id); err != nil {
+			return nil, err
+		}
+	}
+
+	var names []string
+	err := deleteBlock(ctx, bkt, id, params.keepDeletionMark, func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	level.Debug(logger).Log("msg", "dry run of block deletion", "block", id, "objects", len(names), "bucket", bkt.Name())
+	return names, nil
+}
+
+// deleteBlock traverses objects of the block in the order required by Delete, calling del for each object to remove.
+// The deletion mark is not removed if keepDeletionMark is true.
+func deleteBlock(ctx context.Context, bkt objstore.Bucket, id ulid.ULID, keepDeletionMark bool, del func(name string) error) error {
+	metaFile := path.Join(id.String(), MetaFilename)
+	gzMetaFile := path.Join(id.String(), metadata.MetaGzipFilename)
+	deletionMarkFile := path.Join(id.String(), metadata.DeletionMarkFilename)
+
+	// Delete block meta file, in both uncompressed and compressed form.
+	for _, f := range []string{metaFile, gzMetaFile} {
+		ok, err := bkt.Exists(ctx, f)
+		if err != nil {
+			return errors.Wrapf(err, "stat %s", f)
+		}
+
+		if ok {
+			if err := del(f); err != nil {
+				return errors.Wrapf(err, "delete %s", f)
+			}
+		}
+	}
+
+	// Delete the block objects, but skip:
+	// - The meta files as we just deleted. This is required for eventual object storages (list after write).
+	// - The deletionMarkFile as we'll delete it at last.
+	err := deleteDirRec(ctx, bkt, id.String(), func(name string) bool {
+		return name == metaFile || name == gzMetaFile || name == deletionMarkFile
+	}, del)
+	if err != nil {
+		return err
+	}
+
+	if keepDeletionMark {
+		return nil
+	}
+
+	// Delete block deletion mark.
+	ok, err := bkt.Exists(ctx, deletionMarkFile)
+	if err != nil {
+		return errors.Wrapf(err, "stat %s", deletionMarkFile)
+	}
+
+	if ok {
+		if err := del(deletionMarkFile); err != nil {
+			return errors.Wrapf(err, "delete %s", deletionMarkFile)
+		}
+	}
+
+	return nil
+}
+
+// deleteDirRec removes all objects prefixed with dir from the bucket, calling del for each of them.
+// It skips objects that return true for the passed keep function.
+// NOTE: For objects removal use `block.Delete` strictly.
+func deleteDirRec(ctx context.Context, bkt objstore.Bucket, dir string, keep func(name string) bool, del func(name string) error) error {
+	return bkt.Iter(ctx, dir, func(name string) error {
+		// If we hit a directory, call DeleteDir recursively.
+		if strings.HasSuffix(name, objstore.DirDelim) {
+			return deleteDirRec(ctx, bkt, name, keep, del)
+		}
+		if keep(name) {
+			return nil
+		}
+		return del(name)
+	})
+}
+
+// ListPartialBlocks returns IDs of all block directories in the bucket which lack meta.json, sorted. Such blocks are
+// usually aborted uploads, but might also be uploads still in progress.
+func ListPartialBlocks(ctx context.Context, bkt objstore.BucketReader) ([]ulid.ULID, error) {
+	blocks := map[ulid.ULID]bool{}
+	err := bkt.Iter(ctx, "", func(name string) error {
+		parts := strings.SplitN(name, objstore.DirDelim, 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		id, ok := IsBlockDir(parts[0])
+		if !ok {
+			return nil
+		}
+		blocks[id] = blocks[id] || parts[1] == MetaFilename || parts[1] == metadata.MetaGzipFilename
+		return nil
+	}, objstore.WithRecursiveIter)
+	if err != nil {
+		return nil, errors.Wrap(err, "iter bucket")
+	}
+
+	var res []ulid.ULID
+	for id, hasMeta := range blocks {
+		if !hasMeta {
+			res = append(res, id)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Compare(res[j]) < 0
+	})
+	return res, nil
+}
+
+// CleanupPartialBlock deletes the partial block (block without meta.json) with the given ID, if the block is older
+// than minAge. The age of the block is determined by the time encoded in its ID. minAge should be long enough
+// to not race with uploads in progress. It returns true if the block was deleted.
+func CleanupPartialBlock(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, minAge time.Duration) (bool, error) {
+	if age := time.Since(ulid.Time(id.Time())); age < minAge {
+		level.Debug(logger).Log("msg", "partial block is too young to be cleaned up", "block", id, "age", age, "minAge", minAge)
+		return false, nil
+	}
+
+	for _, metaFile := range []string{path.Join(id.String(), MetaFilename), path.Join(id.String(), metadata.MetaGzipFilename)} {
+		ok, err := bkt.Exists(ctx, metaFile)
+		if err != nil {
+			return false, errors.Wrapf(err, "stat %s", metaFile)
+		}
+		if ok {
+			level.Info(logger).Log("msg", "block is not partial anymore; skipping cleanup", "block", id)
+			return false, nil
+		}
+	}
+
+	if err := Delete(ctx, logger, bkt, id); err != nil {
+		return false, errors.Wrapf(err, "delete partial block %s", id)
+	}
+	level.Info(logger).Log("msg", "deleted partial block", "block", id, "minAge", minAge)
+	return true, nil
+}
@@ -0,0 +1,274 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestDelete(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	{
+		b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+			labels.New(labels.Label{Name: "a", Value: "1"}),
+			labels.New(labels.Label{Name: "a", Value: "2"}),
+			labels.New(labels.Label{Name: "a", Value: "3"}),
+			labels.New(labels.Label{Name: "a", Value: "4"}),
+			labels.New(labels.Label{Name: "b", Value: "1"}),
+		}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+		testutil.Equals(t, 3, len(bkt.Objects()))
+
+		markedForDeletion := promauto.With(prometheus.NewRegistry()).NewCounter(prometheus.CounterOpts{Name: "test"})
+		testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, b1, "", markedForDeletion))
+
+		// Dry run lists objects in the deletion order, without deleting anything.
+		names, err := DeleteDryRun(ctx, log.NewNopLogger(), bkt, b1)
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{
+			path.Join(b1.String(), MetaFilename),
+			path.Join(b1.String(), IndexFilename),
+			path.Join(b1.String(), ChunksDirname, "000001"),
+			path.Join(b1.String(), metadata.DeletionMarkFilename),
+		}, names)
+		testutil.Equals(t, 4, len(bkt.Objects()))
+
+		// Full delete.
+		testutil.Ok(t, Delete(ctx, log.NewNopLogger(), bkt, b1))
+		testutil.Equals(t, 0, len(bkt.Objects()))
+	}
+	{
+		b2, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+			labels.New(labels.Label{Name: "a", Value: "1"}),
+			labels.New(labels.Label{Name: "a", Value: "2"}),
+			labels.New(labels.Label{Name: "a", Value: "3"}),
+			labels.New(labels.Label{Name: "a", Value: "4"}),
+			labels.New(labels.Label{Name: "b", Value: "1"}),
+		}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b2.String()), metadata.NoneFunc))
+		testutil.Equals(t, 3, len(bkt.Objects()))
+
+		// Remove meta.json and check if delete can delete it.
+		testutil.Ok(t, bkt.Delete(ctx, path.Join(b2.String(), MetaFilename)))
+		testutil.Ok(t, Delete(ctx, log.NewNopLogger(), bkt, b2))
+		testutil.Equals(t, 0, len(bkt.Objects()))
+	}
+	{
+		b3, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+			labels.New(labels.Label{Name: "a", Value: "1"}),
+			labels.New(labels.Label{Name: "b", Value: "1"}),
+		}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b3.String()), metadata.NoneFunc))
+		markedForDeletion := promauto.With(prometheus.NewRegistry()).NewCounter(prometheus.CounterOpts{Name: "test"})
+		testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, b3, "", markedForDeletion))
+
+		// Deletion mark is kept on request.
+		names, err := DeleteDryRun(ctx, log.NewNopLogger(), bkt, b3, WithKeepDeletionMark())
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{
+			path.Join(b3.String(), MetaFilename),
+			path.Join(b3.String(), IndexFilename),
+			path.Join(b3.String(), ChunksDirname, "000001"),
+		}, names)
+		testutil.Ok(t, Delete(ctx, log.NewNopLogger(), bkt, b3, WithKeepDeletionMark()))
+		testutil.Equals(t, 1, len(bkt.Objects()))
+		_, ok := bkt.Objects()[path.Join(b3.String(), metadata.DeletionMarkFilename)]
+		testutil.Assert(t, ok, "deletion mark should be kept")
+
+		marked, err := ListMarkedBlocks(ctx, bkt, metadata.DeletionMarkFilename)
+		testutil.Ok(t, err)
+		testutil.Equals(t, []ulid.ULID{b3}, marked)
+
+		testutil.Ok(t, Delete(ctx, log.NewNopLogger(), bkt, b3))
+		testutil.Equals(t, 0, len(bkt.Objects()))
+	}
+}
+
+func TestDeleteRetries(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	tmpDir := t.TempDir()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	markedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+
+	t.Run("transient failures are retried", func(t *testing.T) {
+		bkt := objstore.NewInMemBucket()
+		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+
+		fbkt := &failingDeleteBucket{Bucket: bkt, failSuffix: IndexFilename, failures: 2, err: statusError(503)}
+		testutil.Ok(t, Delete(ctx, log.NewNopLogger(), fbkt, b1, WithDeleteRetries(policy, nil)))
+		testutil.Equals(t, 0, len(bkt.Objects()))
+	})
+	t.Run("transient failures are retried by default", func(t *testing.T) {
+		bkt := objstore.NewInMemBucket()
+		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+
+		fbkt := &failingDeleteBucket{Bucket: bkt, failSuffix: IndexFilename, failures: 1, err: statusError(503)}
+		testutil.Ok(t, Delete(ctx, log.NewNopLogger(), fbkt, b1))
+		testutil.Equals(t, 0, fbkt.failures)
+		testutil.Equals(t, 0, len(bkt.Objects()))
+	})
+	t.Run("retries can be disabled", func(t *testing.T) {
+		bkt := objstore.NewInMemBucket()
+		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+
+		fbkt := &failingDeleteBucket{Bucket: bkt, failSuffix: IndexFilename, failures: 1, err: statusError(503)}
+		testutil.NotOk(t, Delete(ctx, log.NewNopLogger(), fbkt, b1, WithDeleteRetries(RetryPolicy{}, nil)))
+		testutil.Equals(t, 0, fbkt.failures)
+		testutil.Ok(t, Delete(ctx, log.NewNopLogger(), fbkt, b1))
+	})
+	t.Run("retry bucket retries with its policy", func(t *testing.T) {
+		bkt := objstore.NewInMemBucket()
+		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+
+		fbkt := &failingDeleteBucket{Bucket: bkt, failSuffix: IndexFilename, failures: 3, err: statusError(503)}
+		testutil.NotOk(t, Delete(ctx, log.NewNopLogger(), NewRetryBucket(fbkt, policy, nil), b1))
+		testutil.Equals(t, 0, fbkt.failures)
+	})
+	t.Run("persistent failure is reported", func(t *testing.T) {
+		bkt := objstore.NewInMemBucket()
+		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+		testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, b1, "", markedForDeletion))
+
+		// Unknown errors are not retried.
+		fbkt := &failingDeleteBucket{Bucket: bkt, failSuffix: IndexFilename, failures: 1}
+		err := Delete(ctx, log.NewNopLogger(), fbkt, b1)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, errors.Is(err, errDeleteFailed), "unexpected error %v", err)
+
+		var perr *PartialDeleteError
+		testutil.Assert(t, errors.As(err, &perr), "expected partial delete error, got %v", err)
+		testutil.Equals(t, []string{
+			path.Join(b1.String(), MetaFilename),
+		}, perr.Deleted)
+		testutil.Equals(t, []string{
+			path.Join(b1.String(), IndexFilename),
+			path.Join(b1.String(), ChunksDirname, "000001"),
+			path.Join(b1.String(), metadata.DeletionMarkFilename),
+		}, perr.NotDeleted)
+
+		// Deletion can be finished later.
+		testutil.Ok(t, Delete(ctx, log.NewNopLogger(), bkt, b1))
+		testutil.Equals(t, 0, len(bkt.Objects()))
+	})
+}
+
+func TestDeleteMany(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	bkt := objstore.NewInMemBucket()
+	var ids []ulid.ULID
+	for i := 1; i <= 5; i++ {
+		id := ulid.MustNew(uint64(i), nil)
+		uploadTestMeta(t, bkt, id, 0, 100, map[string]string{"a": "1"})
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), IndexFilename), strings.NewReader("index")))
+		ids = append(ids, id)
+	}
+
+	// Deletion of one block fails, others are deleted.
+	failing := ids[2]
+	fbkt := &failingDeleteBucket{Bucket: bkt, failSuffix: path.Join(failing.String(), IndexFilename), failures: 1}
+	errs := DeleteMany(ctx, log.NewNopLogger(), fbkt, ids, 2)
+	testutil.Equals(t, 1, len(errs))
+	testutil.Assert(t, errors.Is(errs[failing], errDeleteFailed), "unexpected error %v", errs[failing])
+	testutil.Equals(t, map[string][]byte{path.Join(failing.String(), IndexFilename): []byte("index")}, bkt.Objects())
+
+	testutil.Equals(t, 0, len(DeleteMany(ctx, log.NewNopLogger(), bkt, ids, 0)))
+	testutil.Equals(t, 0, len(bkt.Objects()))
+}
+
+var errDeleteFailed = errors.New("delete failed")
+
+// failingDeleteBucket fails the first failures deletions of objects with the given suffix.
+type failingDeleteBucket struct {
+	objstore.Bucket
+
+	failSuffix string
+	failures   int
+	// err is returned by failed deletions, errDeleteFailed if nil.
+	err error
+}
+
+func (b *failingDeleteBucket) Delete(ctx context.Context, name string) error {
+	if strings.HasSuffix(name, b.failSuffix) && b.failures > 0 {
+		b.failures--
+		if b.err != nil {
+			return b.err
+		}
+		return errDeleteFailed
+	}
+	return b.Bucket.Delete(ctx, name)
+}
+
+func TestListAndCleanupPartialBlocks(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.NewInMemBucket()
+
+	old := ulid.MustNew(ulid.Timestamp(time.Now().Add(-2*time.Hour)), nil)
+	young := ulid.MustNew(ulid.Now(), nil)
+	complete := ulid.MustNew(1, nil)
+
+	for _, id := range []ulid.ULID{old, young} {
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), IndexFilename), strings.NewReader("index")))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), ChunksDirname, "000001"), strings.NewReader("chunks")))
+	}
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(complete.String(), IndexFilename), strings.NewReader("index")))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(complete.String(), MetaFilename), strings.NewReader("{}")))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join("debug", MetaFilename), strings.NewReader("{}")))
+
+	ids, err := ListPartialBlocks(ctx, bkt)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{old, young}, ids)
+
+	deleted, err := CleanupPartialBlock(ctx, logger, bkt, young, time.Hour)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !deleted, "young partial block should not be deleted")
+
+	deleted, err = CleanupPartialBlock(ctx, logger, bkt, complete, time.Hour)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !deleted, "complete block should not be deleted")
+
+	deleted, err = CleanupPartialBlock(ctx, logger, bkt, old, time.Hour)
+	testutil.Ok(t, err)
+	testutil.Assert(t, deleted, "old partial block should be deleted")
+
+	ids, err = ListPartialBlocks(ctx, bkt)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{young}, ids)
+	testutil.Equals(t, 5, len(bkt.Objects()))
+}
@@ -0,0 +1,1146 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+	"github.com/thanos-io/objstore"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// DownloadOption configures the provided params.
+type DownloadOption func(params *downloadParams)
+
+// downloadParams holds the DownloadWithOptions() parameters.
+type downloadParams struct {
+	transferParams
+
+	concurrency  int
+	fsync        bool
+	verifyHashes bool
+	indexHeader  bool
+	decrypter    Decrypter
+	emitManifest bool
+	resumable    bool
+	progress     DownloadProgressFunc
+
+	objstoreOptions []objstore.DownloadOption
+}
+
+// WithFetchConcurrency is an option to set the number of block files that are hashed and fetched in parallel.
+// Meta file is always downloaded first and on its own.
+func WithFetchConcurrency(concurrency int) DownloadOption {
+	return func(params *downloadParams) {
+		params.concurrency = concurrency
+	}
+}
+
+// WithDownloadRateLimiter is an option to cap the bandwidth used by download. The limit applies to all files
+// fetched in parallel. Nil limiter means unlimited bandwidth.
+func WithDownloadRateLimiter(limiter *rate.Limiter) DownloadOption {
+	return func(params *downloadParams) {
+		params.limiter = limiter
+	}
+}
+
+// WithDownloadMetrics is an option to track download in the given metrics.
+func WithDownloadMetrics(metrics *BlockTransferMetrics) DownloadOption {
+	return func(params *downloadParams) {
+		params.metrics = metrics
+	}
+}
+
+// WithDownloadRetries is an option to retry failed bucket operations of the download according to the given policy.
+// Metrics are optional.
+func WithDownloadRetries(policy RetryPolicy, metrics *RetryMetrics) DownloadOption {
+	return func(params *downloadParams) {
+		params.retries = &policy
+		params.retryMetrics = metrics
+	}
+}
+
+// WithDownloadPrefix is an option to download the block from under the given object key prefix (e.g. "tenants/acme"),
+// instead of the bucket root. It's equivalent to downloading from objstore.NewPrefixedBucket, which should be used
+// to make Delete and the mark functions honor the same prefix.
+func WithDownloadPrefix(prefix string) DownloadOption {
+	return func(params *downloadParams) {
+		params.prefix = prefix
+	}
+}
+
+// WithFsyncOnDownload is an option to fsync each downloaded file, as well as the block directory, before download
+// returns, so the downloaded block survives a crash of the machine. It slows the download down.
+func WithFsyncOnDownload() DownloadOption {
+	return func(params *downloadParams) {
+		params.fsync = true
+	}
+}
+
+// WithDownloadVerification is an option to verify each downloaded file against its hash in meta, if any, right after
+// it's downloaded, failing the download on mismatch. This catches corruption in transit or at rest, at the cost of
+// reading each downloaded file once more.
+func WithDownloadVerification() DownloadOption {
+	return func(params *downloadParams) {
+		params.verifyHashes = true
+	}
+}
+
+// WithIndexHeader is an option to download the index-header file (IndexHeaderFilename) of the block too, if it was
+// uploaded with the block. Without it, the index-header is not downloaded, as readers can build it from the index.
+// Like other files, the index-header is not downloaded again if its hash in meta matches the local file.
+func WithIndexHeader() DownloadOption {
+	return func(params *downloadParams) {
+		params.indexHeader = true
+	}
+}
+
+// WithDecrypter is an option to decrypt block files uploaded encrypted (see WithEncrypter) with the given decrypter.
+// Download of a block with encrypted files fails without it.
+func WithDecrypter(d Decrypter) DownloadOption {
+	return func(params *downloadParams) {
+		params.decrypter = d
+	}
+}
+
+// WithEmitVerificationManifest is an option to write VerificationManifestFilename into the block directory once Download
+// succeeds, recording size and hash of every file of the block as present on local disk, so other processes can check
+// later that nothing changed. Hashes calculated anyway, e.g. when matching local files with meta or with
+// WithDownloadVerification, are reused, so each file is hashed at most once. It's supported only by Download.
+func WithEmitVerificationManifest() DownloadOption {
+	return func(params *downloadParams) {
+		params.emitManifest = true
+	}
+}
+
+// WithResumableDownload is an option to make download resumable. Files fully fetched so far are tracked in
+// DownloadProgressFilename inside the block directory, and are not fetched again by next resumable download of the same
+// block, as long as the Files section of meta did not change. Files are recorded with their hash, so those without hash
+// in meta are hashed with SHA256 while they are downloaded. The progress file is removed once download succeeds.
+// It's supported only by DownloadWithOptions, and not together with WithObjstoreDownloadOptions.
+func WithResumableDownload() DownloadOption {
+	return func(params *downloadParams) {
+		params.resumable = true
+	}
+}
+
+// WithDownloadProgress is an option to report progress of download of each block file to the given function, e.g.
+// to show progress or to detect stalled downloads. The function is called every DownloadProgressStep bytes of
+// a file and once the file is downloaded. It may be called concurrently for different files. Meta and files which are
+// not downloaded, e.g. because they match local files, are not reported.
+func WithDownloadProgress(fn DownloadProgressFunc) DownloadOption {
+	return func(params *downloadParams) {
+		params.progress = fn
+	}
+}
+
+// WithObjstoreDownloadOptions is an option to download block files with objstore.DownloadDir, forwarding the given
+// options to it (e.g. objstore.WithFetchConcurrency), as Download did before it had options of its own. Like with
+// objstore.DownloadDir, files fetched by a failed download are removed, so such download can't be resumed.
+// DownloadFiles and DownloadSharded don't support them.
+func WithObjstoreDownloadOptions(options ...objstore.DownloadOption) DownloadOption {
+	return func(params *downloadParams) {
+		params.objstoreOptions = append(params.objstoreOptions, options...)
+	}
+}
+
+func applyDownloadOptions(options ...DownloadOption) downloadParams {
+	out := downloadParams{
+		concurrency: 1,
+	}
+	for _, opt := range options {
+		opt(&out)
+	}
+	if out.concurrency < 1 {
+		out.concurrency = 1
+	}
+	return out
+}
+
+// downloadMetaFile downloads meta of the given block into <dst>/meta.json. If the block has compressed meta instead,
+// it's stored decompressed.
+func downloadMetaFile(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id ulid.ULID, dst string) error {
+	err := objstore.DownloadFile(ctx, logger, bucket, path.Join(id.String(), MetaFilename), path.Join(dst, MetaFilename))
+	if err == nil || !bucket.IsObjNotFoundErr(errors.Cause(err)) {
+		return err
+	}
+
+	gzMetaFile := path.Join(id.String(), metadata.MetaGzipFilename)
+	rc, gerr := bucket.Get(ctx, gzMetaFile)
+	if gerr != nil {
+		if bucket.IsObjNotFoundErr(gerr) {
+			return err
+		}
+		return errors.Wrapf(gerr, "get file %s", gzMetaFile)
+	}
+	m, gerr := metadata.Read(rc)
+	if gerr != nil {
+		return errors.Wrapf(gerr, "read file %s", gzMetaFile)
+	}
+	return m.WriteToDir(logger, dst)
+}
+
+// Download downloads directory that is mean to be block directory. If any of the files
+// have a hash calculated in the meta file and it matches with what is in the destination path then
+// we do not download it. We always re-download the meta file.
+//
+// The given options are forwarded to objstore.DownloadDir, see WithObjstoreDownloadOptions. Use DownloadWithOptions
+// to configure the download with options of this package.
+func Download(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id ulid.ULID, dst string, options ...objstore.DownloadOption) error {
+	return DownloadWithOptions(ctx, logger, bucket, id, dst, WithObjstoreDownloadOptions(options...))
+}
+
+// DownloadWithOptions works like Download, configured by the given options. Use WithResumableDownload to make it
+// resumable.
+func DownloadWithOptions(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id ulid.ULID, dst string, options ...DownloadOption) (err error) {
+	opts := applyDownloadOptions(options...)
+	bucket, tbkt := wrapBucket(bucket, opts.transferParams)
+	defer func(start time.Time) {
+		tbkt.observe(opts.metrics, transferOpDownload, start, err)
+	}(time.Now())
+
+	if err := os.MkdirAll(dst, 0750); err != nil {
+		return errors.Wrap(err, "create dir")
+	}
+	if opts.emitManifest {
+		// Manifest of previous download must not outlive this one if it fails.
+		if err := os.Remove(filepath.Join(dst, VerificationManifestFilename)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove verification manifest")
+		}
+	}
+
+	if err := downloadMetaFile(ctx, logger, bucket, id, dst); err != nil {
+		return err
+	}
+	if opts.fsync {
+		if err := syncPath(logger, filepath.Join(dst, MetaFilename), false); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// Partially downloaded block must not look like a valid one. Downloaded files are kept for the next attempt.
+		if rerr := os.Remove(filepath.Join(dst, MetaFilename)); rerr != nil && !os.IsNotExist(rerr) {
+			level.Warn(logger).Log("msg", "failed to remove meta file of partially downloaded block", "dir", dst, "err", rerr)
+		}
+	}()
+
+	m, err := metadata.ReadFromDir(dst)
+	if err != nil {
+		return errors.Wrapf(err, "reading meta from %s", dst)
+	}
+	bucket = withDownloadProgress(bucket, id, m.Thanos.Files, opts.progress)
+	bucket, err = withDecrypter(logger, bucket, id, m.Thanos.Files, opts)
+	if err != nil {
+		return err
+	}
+
+	ignoredPaths, err := matchingHashPaths(ctx, logger, dst, m.Thanos.Files, opts.concurrency)
+	if err != nil {
+		return err
+	}
+	opts.metrics.observeHashSkipped(m.Thanos.Files, ignoredPaths)
+	ignoredPaths = append(ignoredPaths, MetaFilename, metadata.MetaGzipFilename)
+
+	progress, err := newDownloadProgress(ctx, logger, dst, m.Thanos.Files, opts.resumable && len(opts.objstoreOptions) == 0, opts.concurrency)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := progress.close(); cerr != nil {
+			level.Warn(logger).Log("msg", "failed to close download progress", "dir", dst, "err", cerr)
+		}
+	}()
+	ignored := make(map[string]struct{}, len(ignoredPaths))
+	for _, p := range ignoredPaths {
+		ignored[p] = struct{}{}
+	}
+	skip := func(relPath string) bool {
+		if relPath == IndexHeaderFilename && !opts.indexHeader {
+			return true
+		}
+		if _, ok := ignored[relPath]; ok {
+			level.Debug(logger).Log("msg", "not downloading again because a provided path matches this one", "file", relPath)
+			return true
+		}
+		if progress.completed(relPath) {
+			level.Debug(logger).Log("msg", "not downloading again because file was already downloaded by previous attempt", "file", relPath)
+			return true
+		}
+		return false
+	}
+	known := filesByRelPath(m.Thanos.Files)
+	var manifest *verificationManifest
+	if opts.emitManifest {
+		manifest = newVerificationManifest(logger, dst)
+		for _, p := range ignoredPaths {
+			if f, ok := known[p]; ok && f.Hash != nil {
+				if err := manifest.add(ctx, p, f.Hash); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	hashFunc := func(relPath string) metadata.HashFunc {
+		return downloadHashFunc(known[relPath], opts.verifyHashes, manifest != nil || progress.tracked())
+	}
+	done := func(relPath string, fileHash *metadata.ObjectHash) error {
+		if opts.verifyHashes {
+			var err error
+			if fileHash, err = verifyDownloadedFile(ctx, logger, filepath.Join(dst, filepath.FromSlash(relPath)), known[relPath], fileHash); err != nil {
+				return err
+			}
+		}
+		if err := manifest.add(ctx, relPath, fileHash); err != nil {
+			return err
+		}
+		// File is synced before it's marked completed, so resumed download does not rely on torn files.
+		if opts.fsync {
+			if err := syncPath(logger, filepath.Join(dst, filepath.FromSlash(relPath)), false); err != nil {
+				return err
+			}
+		}
+		opts.metrics.observeDownloaded()
+		return progress.markCompleted(relPath, fileHash)
+	}
+	if len(opts.objstoreOptions) > 0 {
+		err = downloadDirWithObjstore(ctx, logger, bucket, id.String(), dst, m.Thanos.Files, skip, done,
+			append([]objstore.DownloadOption{objstore.WithFetchConcurrency(opts.concurrency)}, opts.objstoreOptions...))
+	} else {
+		err = downloadDir(ctx, logger, bucket, id.String(), id.String(), dst, opts.concurrency, skip, hashFunc, done)
+	}
+	if err != nil {
+		return err
+	}
+
+	chunksDir := filepath.Join(dst, ChunksDirname)
+	_, err = os.Stat(chunksDir)
+	if os.IsNotExist(err) {
+		// This can happen if block is empty. We cannot easily upload empty directory, so create one here.
+		if err := os.Mkdir(chunksDir, os.ModePerm); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return errors.Wrapf(err, "stat %s", chunksDir)
+	}
+
+	if err := progress.remove(); err != nil {
+		return err
+	}
+	if manifest != nil {
+		// Files not downloaded now (meta and files fetched by previous attempt) are hashed only if needed.
+		relPaths := []string{MetaFilename}
+		for _, f := range m.Thanos.Files {
+			if f.RelPath != MetaFilename && !(f.RelPath == IndexHeaderFilename && !opts.indexHeader) {
+				relPaths = append(relPaths, f.RelPath)
+			}
+		}
+		if err := manifest.write(ctx, relPaths, opts.concurrency); err != nil {
+			return err
+		}
+		if opts.fsync {
+			if err := syncPath(logger, filepath.Join(dst, VerificationManifestFilename), false); err != nil {
+				return err
+			}
+		}
+	}
+	if opts.fsync {
+		for _, dir := range []string{chunksDir, dst} {
+			if err := syncPath(logger, dir, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// syncPath fsyncs the file or directory at the given path.
+func syncPath(logger log.Logger, p string, dir bool) error {
+	var (
+		f   *os.File
+		err error
+	)
+	if dir {
+		f, err = fileutil.OpenDir(p)
+	} else {
+		f, err = os.Open(filepath.Clean(p))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "open %s", p)
+	}
+	if err := f.Sync(); err != nil {
+		runutil.CloseWithLogOnErr(logger, f, "close %s", p)
+		return errors.Wrapf(err, "sync %s", p)
+	}
+	return f.Close()
+}
+
+// DownloadFiles downloads only the given files of the block directory. Paths are relative to the block directory and
+// have to be listed in the Files section of meta file. Duplicate paths are downloaded once. Files which have a hash
+// calculated in the meta file matching with what is in the destination path are not downloaded. We always re-download
+// the meta file.
+func DownloadFiles(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id ulid.ULID, dst string, relPaths []string, options ...DownloadOption) (err error) {
+	opts := applyDownloadOptions(options...)
+	if len(opts.objstoreOptions) > 0 {
+		return errors.New("objstore download options are not supported by DownloadFiles, use WithFetchConcurrency instead")
+	}
+	bucket, tbkt := wrapBucket(bucket, opts.transferParams)
+	defer func(start time.Time) {
+		tbkt.observe(opts.metrics, transferOpDownload, start, err)
+	}(time.Now())
+
+	if err := os.MkdirAll(dst, 0750); err != nil {
+		return errors.Wrap(err, "create dir")
+	}
+
+	if err := downloadMetaFile(ctx, logger, bucket, id, dst); err != nil {
+		return err
+	}
+	if opts.fsync {
+		if err := syncPath(logger, filepath.Join(dst, MetaFilename), false); err != nil {
+			return err
+		}
+	}
+	m, err := metadata.ReadFromDir(dst)
+	if err != nil {
+		return errors.Wrapf(err, "reading meta from %s", dst)
+	}
+	bucket = withDownloadProgress(bucket, id, m.Thanos.Files, opts.progress)
+	bucket, err = withDecrypter(logger, bucket, id, m.Thanos.Files, opts)
+	if err != nil {
+		return err
+	}
+
+	known := filesByRelPath(m.Thanos.Files)
+	files := make([]metadata.File, 0, len(relPaths))
+	seen := make(map[string]struct{}, len(relPaths))
+	for _, relPath := range relPaths {
+		fl, ok := known[relPath]
+		if !ok {
+			return errors.Errorf("file %s not found in meta of block %s", relPath, id.String())
+		}
+		// The same file must not be written by two goroutines at once.
+		if _, ok := seen[relPath]; ok {
+			continue
+		}
+		seen[relPath] = struct{}{}
+		files = append(files, fl)
+	}
+
+	ignoredPaths, err := matchingHashPaths(ctx, logger, dst, files, opts.concurrency)
+	if err != nil {
+		return err
+	}
+	opts.metrics.observeHashSkipped(files, ignoredPaths)
+	ignored := make(map[string]struct{}, len(ignoredPaths)+1)
+	ignored[MetaFilename] = struct{}{}
+	for _, p := range ignoredPaths {
+		ignored[p] = struct{}{}
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.concurrency)
+	for _, fl := range files {
+		if _, ok := ignored[fl.RelPath]; ok {
+			level.Debug(logger).Log("msg", "not downloading again because a provided path matches this one", "file", fl.RelPath)
+			continue
+		}
+		relPath := fl.RelPath
+		g.Go(func() error {
+			fdst := filepath.Join(dst, filepath.FromSlash(relPath))
+			if err := os.MkdirAll(filepath.Dir(fdst), 0750); err != nil {
+				return errors.Wrap(err, "create dir")
+			}
+			h, err := downloadFile(gctx, logger, bucket, path.Join(id.String(), relPath), fdst, downloadHashFunc(known[relPath], opts.verifyHashes, false))
+			if err != nil {
+				return err
+			}
+			if opts.verifyHashes {
+				if _, err := verifyDownloadedFile(gctx, logger, fdst, known[relPath], h); err != nil {
+					return err
+				}
+			}
+			if opts.fsync {
+				if err := syncPath(logger, fdst, false); err != nil {
+					return err
+				}
+			}
+			opts.metrics.observeDownloaded()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if !opts.fsync {
+		return nil
+	}
+	// Sync directories of downloaded files, then the block directory itself.
+	dirs := map[string]struct{}{}
+	for _, fl := range files {
+		if dir := filepath.Dir(filepath.Join(dst, filepath.FromSlash(fl.RelPath))); dir != filepath.Clean(dst) {
+			dirs[dir] = struct{}{}
+		}
+	}
+	for dir := range dirs {
+		if err := syncPath(logger, dir, true); err != nil {
+			return err
+		}
+	}
+	return syncPath(logger, dst, true)
+}
+
+// DownloadSharded downloads the block like Download, but spreads its files across the given local directories, e.g.
+// on different disks, placing each file into dst[shardFn(relPath)], where relPath is relative to the block directory.
+// The first directory is the block directory: meta file is always placed there, and each file placed elsewhere is
+// symlinked from it, so the first directory can be opened as a regular block. Unlike Download, files are always
+// downloaded again and the download can't be resumed, see WithResumableDownload.
+func DownloadSharded(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id ulid.ULID, dst []string, shardFn func(relPath string) int, options ...DownloadOption) (err error) {
+	if len(dst) == 0 {
+		return errors.New("no destination directories")
+	}
+	opts := applyDownloadOptions(options...)
+	if len(opts.objstoreOptions) > 0 {
+		return errors.New("objstore download options are not supported by DownloadSharded, use WithFetchConcurrency instead")
+	}
+	bucket, tbkt := wrapBucket(bucket, opts.transferParams)
+	defer func(start time.Time) {
+		tbkt.observe(opts.metrics, transferOpDownload, start, err)
+	}(time.Now())
+
+	blockDir := dst[0]
+	if err := os.MkdirAll(blockDir, 0750); err != nil {
+		return errors.Wrap(err, "create dir")
+	}
+	if err := downloadMetaFile(ctx, logger, bucket, id, blockDir); err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// Partially downloaded block must not look like a valid one.
+		if rerr := os.Remove(filepath.Join(blockDir, MetaFilename)); rerr != nil && !os.IsNotExist(rerr) {
+			level.Warn(logger).Log("msg", "failed to remove meta file of partially downloaded block", "dir", blockDir, "err", rerr)
+		}
+	}()
+
+	m, err := metadata.ReadFromDir(blockDir)
+	if err != nil {
+		return errors.Wrapf(err, "reading meta from %s", blockDir)
+	}
+	bucket = withDownloadProgress(bucket, id, m.Thanos.Files, opts.progress)
+	bucket, err = withDecrypter(logger, bucket, id, m.Thanos.Files, opts)
+	if err != nil {
+		return err
+	}
+	known := filesByRelPath(m.Thanos.Files)
+
+	prefix := id.String() + objstore.DirDelim
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.concurrency)
+	err = bucket.Iter(gctx, prefix, func(name string) error {
+		if IsBlockMetaFile(name) {
+			return nil
+		}
+		relPath := strings.TrimPrefix(name, prefix)
+		if relPath == IndexHeaderFilename && !opts.indexHeader {
+			return nil
+		}
+		shard := shardFn(relPath)
+		if shard < 0 || shard >= len(dst) {
+			return errors.Errorf("file %s assigned to directory %d out of %d", relPath, shard, len(dst))
+		}
+		g.Go(func() error {
+			fdst := filepath.Join(dst[shard], filepath.FromSlash(relPath))
+			if err := os.MkdirAll(filepath.Dir(fdst), 0750); err != nil {
+				return errors.Wrap(err, "create dir")
+			}
+			h, err := downloadFile(gctx, logger, bucket, name, fdst, downloadHashFunc(known[relPath], opts.verifyHashes, false))
+			if err != nil {
+				return err
+			}
+			if opts.verifyHashes {
+				if _, err := verifyDownloadedFile(gctx, logger, fdst, known[relPath], h); err != nil {
+					return err
+				}
+			}
+			if shard != 0 {
+				if err := symlinkFile(fdst, filepath.Join(blockDir, filepath.FromSlash(relPath))); err != nil {
+					return err
+				}
+			}
+			opts.metrics.observeDownloaded()
+			return nil
+		})
+		return nil
+	}, objstore.WithRecursiveIter)
+	if werr := g.Wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+
+	// This can happen if block is empty. We cannot easily upload empty directory, so create one here.
+	if err := os.MkdirAll(filepath.Join(blockDir, ChunksDirname), 0750); err != nil {
+		return errors.Wrap(err, "create chunks dir")
+	}
+	return nil
+}
+
+// symlinkFile creates symlink at the given path pointing to the absolute path of target, replacing any existing file.
+func symlinkFile(target, link string) error {
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return errors.Wrapf(err, "absolute path of %s", target)
+	}
+	if err := os.MkdirAll(filepath.Dir(link), 0750); err != nil {
+		return errors.Wrap(err, "create dir")
+	}
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "remove %s", link)
+	}
+	if err := os.Symlink(abs, link); err != nil {
+		return errors.Wrapf(err, "symlink %s to %s", link, abs)
+	}
+	return nil
+}
+
+var (
+	// ErrLocalFileMissing is the error when a block file is missing in the local block directory.
+	ErrLocalFileMissing = errors.New("file missing")
+	// ErrLocalFileMismatch is the error when a block file in the local block directory differs from the one in the bucket.
+	ErrLocalFileMismatch = errors.New("file mismatch")
+)
+
+// LocalFileError describes a file of the local block directory which does not match the block in the bucket.
+type LocalFileError struct {
+	// RelPath is the path of the file, relative to the block directory.
+	RelPath string
+	// Err is ErrLocalFileMissing, ErrLocalFileMismatch or the error which prevented verification of the file.
+	Err error
+}
+
+func (e LocalFileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.RelPath, e.Err)
+}
+
+func (e LocalFileError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyLocalBlock verifies the block in localDir against the meta file of the block in the bucket. It checks that all files
+// listed in the meta file exist locally and have the expected size and hash, if those are known. It returns an entry for every
+// file which did not pass verification. Local directory is never modified.
+func VerifyLocalBlock(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id ulid.ULID, localDir string) ([]LocalFileError, error) {
+	m, err := DownloadMeta(ctx, logger, bucket, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []LocalFileError
+	for _, fl := range m.Thanos.Files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if fl.RelPath == MetaFilename || fl.RelPath == "" {
+			continue
+		}
+
+		fi, err := os.Stat(filepath.Join(localDir, fl.RelPath))
+		if err != nil {
+			if os.IsNotExist(err) {
+				err = ErrLocalFileMissing
+			}
+			res = append(res, LocalFileError{RelPath: fl.RelPath, Err: err})
+			continue
+		}
+		if fl.Encrypted {
+			// Size and hash are of the ciphertext, so they can't be compared with the local plaintext.
+			continue
+		}
+		if fl.SizeBytes > 0 && fi.Size() != fl.SizeBytes {
+			res = append(res, LocalFileError{RelPath: fl.RelPath, Err: errors.Wrapf(ErrLocalFileMismatch, "expected size %d, got %d", fl.SizeBytes, fi.Size())})
+			continue
+		}
+		if fl.Hash == nil || fl.Hash.Func == metadata.NoneFunc {
+			continue
+		}
+		actualHash, err := metadata.CalculateHash(filepath.Join(localDir, fl.RelPath), fl.Hash.Func, logger)
+		if err != nil {
+			res = append(res, LocalFileError{RelPath: fl.RelPath, Err: errors.Wrap(err, "calculate hash")})
+			continue
+		}
+		if !fl.Hash.Equal(&actualHash) {
+			res = append(res, LocalFileError{RelPath: fl.RelPath, Err: errors.Wrapf(ErrLocalFileMismatch, "expected hash %s, got %s", fl.Hash.Value, actualHash.Value)})
+		}
+	}
+	return res, nil
+}
+
+// downloadDir downloads all objects found in the src directory of the bucket into the local dst directory, skipping
+// the ones for which skip returns true. Unlike objstore.DownloadDir, files downloaded successfully are kept on failure,
+// so they can be reused by the next attempt. Files are hashed while they are written with the function returned by
+// hashFunc, and the hash is passed to done, or nil for metadata.NoneFunc. Relative paths passed to skip, hashFunc and
+// done are relative to the blockDir. Up to concurrency files are downloaded in parallel, including subdirectories.
+func downloadDir(
+	ctx context.Context,
+	logger log.Logger,
+	bkt objstore.BucketReader,
+	blockDir, src, dst string,
+	concurrency int,
+	skip func(relPath string) bool,
+	hashFunc func(relPath string) metadata.HashFunc,
+	done func(relPath string, h *metadata.ObjectHash) error,
+) error {
+	// The derived Context is canceled the first time a function passed to Go returns a non-nil error or the first
+	// time Wait returns, whichever occurs first.
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+
+	err := scheduleDownloads(gctx, logger, bkt, g, blockDir, src, dst, skip, hashFunc, done)
+	// Wait even if listing failed, so that no download in flight writes into dst once we return.
+	if werr := g.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// scheduleDownloads lists the src directory of the bucket and its subdirectories, and schedules downloads of objects
+// found into the local dst directory on g. See downloadDir.
+func scheduleDownloads(
+	ctx context.Context,
+	logger log.Logger,
+	bkt objstore.BucketReader,
+	g *errgroup.Group,
+	blockDir, src, dst string,
+	skip func(relPath string) bool,
+	hashFunc func(relPath string) metadata.HashFunc,
+	done func(relPath string, h *metadata.ObjectHash) error,
+) error {
+	if err := os.MkdirAll(dst, 0750); err != nil {
+		return errors.Wrap(err, "create dir")
+	}
+	return bkt.Iter(ctx, src, func(name string) error {
+		dst := filepath.Join(dst, filepath.Base(name))
+		if strings.HasSuffix(name, objstore.DirDelim) {
+			// Subdirectories are listed in place, so that they don't take a slot of g needed by their files.
+			return scheduleDownloads(ctx, logger, bkt, g, blockDir, name, dst, skip, hashFunc, done)
+		}
+
+		relPath := strings.TrimPrefix(name, blockDir+objstore.DirDelim)
+		if skip(relPath) {
+			return nil
+		}
+		g.Go(func() error {
+			h, err := downloadFile(ctx, logger, bkt, name, dst, hashFunc(relPath))
+			if err != nil {
+				return err
+			}
+			return done(relPath, h)
+		})
+		return nil
+	})
+}
+
+// downloadFile downloads the object src of the bucket into the local file dst, like objstore.DownloadFile. Unless hf is
+// metadata.NoneFunc, the content is hashed with hf while it's written and the hash is returned, otherwise it's nil.
+func downloadFile(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, src, dst string, hf metadata.HashFunc) (_ *metadata.ObjectHash, err error) {
+	if hf == metadata.NoneFunc {
+		return nil, objstore.DownloadFile(ctx, logger, bkt, src, dst)
+	}
+	h, err := metadata.NewHash(hf)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := bkt.Get(ctx, src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get file %s", src)
+	}
+	defer runutil.CloseWithLogOnErr(logger, rc, "close block's file reader")
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create file %s", dst)
+	}
+	defer func() {
+		if err != nil {
+			if rerr := os.Remove(dst); rerr != nil {
+				level.Warn(logger).Log("msg", "failed to remove partially downloaded file", "file", dst, "err", rerr)
+			}
+		}
+	}()
+	defer runutil.CloseWithLogOnErr(logger, f, "close block's output file")
+
+	if _, err = io.Copy(io.MultiWriter(f, h), rc); err != nil {
+		return nil, errors.Wrapf(err, "copy object to file %s", src)
+	}
+	oh := metadata.ObjectHashFrom(hf, h)
+	return &oh, nil
+}
+
+// downloadHashFunc returns the function the downloaded file f is hashed with while it's written, so that it's not read
+// again to be verified or recorded (in the verification manifest or download progress), or metadata.NoneFunc if the
+// hash is not needed.
+func downloadHashFunc(f metadata.File, verify, record bool) metadata.HashFunc {
+	if !verify && !record {
+		return metadata.NoneFunc
+	}
+	// Hash of encrypted files in meta is over the ciphertext, so it can't be verified against the local file.
+	if f.Hash != nil && f.Hash.Func != metadata.NoneFunc && !f.Encrypted {
+		return f.Hash.Func
+	}
+	if record {
+		return metadata.SHA256Func
+	}
+	return metadata.NoneFunc
+}
+
+// downloadDirWithObjstore is like downloadDir, but it downloads files with objstore.DownloadDir with the given options.
+// Files skipped have to be known upfront, so files which are not listed in the Files section of meta are always
+// downloaded, and done is called only for listed files once all of them are downloaded.
+func downloadDirWithObjstore(
+	ctx context.Context,
+	logger log.Logger,
+	bkt objstore.BucketReader,
+	blockDir, dst string,
+	files []metadata.File,
+	skip func(relPath string) bool,
+	done func(relPath string, h *metadata.ObjectHash) error,
+	options []objstore.DownloadOption,
+) error {
+	ignoredPaths := []string{MetaFilename, metadata.MetaGzipFilename}
+	if skip(IndexHeaderFilename) {
+		ignoredPaths = append(ignoredPaths, IndexHeaderFilename)
+	}
+	var downloaded []string
+	for _, f := range files {
+		if f.RelPath == MetaFilename || f.RelPath == metadata.MetaGzipFilename {
+			continue
+		}
+		if skip(f.RelPath) {
+			ignoredPaths = append(ignoredPaths, f.RelPath)
+			continue
+		}
+		downloaded = append(downloaded, f.RelPath)
+	}
+
+	if err := objstore.DownloadDir(ctx, logger, bkt, blockDir, blockDir, dst, append(options, objstore.WithDownloadIgnoredPaths(ignoredPaths...))...); err != nil {
+		return err
+	}
+	for _, relPath := range downloaded {
+		if err := done(relPath, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DownloadProgressFilename is the name of the file in the local block directory which tracks the files already downloaded
+// by an interrupted Download.
+const DownloadProgressFilename = ".download-progress.json"
+
+// downloadProgressHeader is the first line of DownloadProgressFilename. It's followed by a line of downloadProgressEntry
+// for each downloaded file, appended once the file is downloaded.
+type downloadProgressHeader struct {
+	// Files is the Files section of meta.json of the block being downloaded.
+	Files []metadata.File `json:"files"`
+}
+
+// downloadProgressEntry records a fully downloaded file with the hash of its local content.
+type downloadProgressEntry struct {
+	RelPath string              `json:"relPath"`
+	Hash    metadata.ObjectHash `json:"hash"`
+}
+
+// downloadProgress tracks files downloaded so far in the local block directory.
+type downloadProgress struct {
+	logger log.Logger
+	dir    string
+	files  []metadata.File
+
+	mtx sync.Mutex
+	// resumed are entries of files downloaded by previous attempt, which are still intact.
+	resumed []downloadProgressEntry
+	done    map[string]struct{}
+	// f is the progress file opened for appending, once the first file is downloaded.
+	f *os.File
+}
+
+// newDownloadProgress loads the progress of a previous download attempt from dir. Progress recorded for
+// different Files section (i.e. a different block content) is discarded. Files recorded by previous attempt are
+// hashed again, up to concurrency of them in parallel, and those which don't match the recorded hash (e.g. torn by a
+// crash) are downloaded again. Progress is not tracked at all if not enabled, or if files are empty, as there is nothing
+// to reconcile against.
+func newDownloadProgress(ctx context.Context, logger log.Logger, dir string, files []metadata.File, enabled bool, concurrency int) (*downloadProgress, error) {
+	p := &downloadProgress{
+		logger: logger,
+		dir:    dir,
+		done:   map[string]struct{}{},
+	}
+	if !enabled || len(files) == 0 {
+		return p, nil
+	}
+	p.files = files
+
+	b, err := os.ReadFile(filepath.Join(dir, DownloadProgressFilename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			level.Warn(logger).Log("msg", "failed to read download progress; downloading all files", "dir", dir, "err", err)
+		}
+		return p, nil
+	}
+	lines := bytes.Split(b, []byte("\n"))
+	var header downloadProgressHeader
+	if err := json.Unmarshal(lines[0], &header); err != nil {
+		level.Warn(logger).Log("msg", "failed to parse download progress; downloading all files", "dir", dir, "err", err)
+		return p, nil
+	}
+	if !reflect.DeepEqual(header.Files, files) {
+		level.Info(logger).Log("msg", "block files changed since previous download attempt; downloading all files", "dir", dir)
+		return p, nil
+	}
+
+	known := filesByRelPath(files)
+	recorded := map[string]downloadProgressEntry{}
+	for _, l := range lines[1:] {
+		var e downloadProgressEntry
+		// The last line might be torn by a crash.
+		if err := json.Unmarshal(l, &e); err != nil {
+			continue
+		}
+		if _, ok := known[e.RelPath]; ok {
+			recorded[e.RelPath] = e
+		}
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for _, e := range recorded {
+		e := e
+		g.Go(func() error {
+			// Make sure the file is still there and it was not modified in the meantime.
+			fp := filepath.Join(dir, filepath.FromSlash(e.RelPath))
+			fi, err := os.Stat(fp)
+			if err != nil || (known[e.RelPath].SizeBytes > 0 && fi.Size() != known[e.RelPath].SizeBytes) {
+				return nil
+			}
+			h, err := metadata.CalculateHashWithContext(gctx, fp, e.Hash.Func, logger)
+			if err != nil {
+				if gctx.Err() != nil {
+					return gctx.Err()
+				}
+				level.Info(logger).Log("msg", "failed to calculate hash of file downloaded by previous attempt; re-downloading", "relPath", e.RelPath, "err", err)
+				return nil
+			}
+			if !e.Hash.Equal(&h) {
+				level.Info(logger).Log("msg", "file downloaded by previous attempt changed; re-downloading", "relPath", e.RelPath)
+				return nil
+			}
+
+			p.mtx.Lock()
+			defer p.mtx.Unlock()
+			p.done[e.RelPath] = struct{}{}
+			p.resumed = append(p.resumed, e)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// tracked returns true if downloaded files are recorded, and need to be hashed for that.
+func (p *downloadProgress) tracked() bool {
+	return len(p.files) > 0
+}
+
+func (p *downloadProgress) completed(relPath string) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	_, ok := p.done[relPath]
+	return ok
+}
+
+// markCompleted records relPath as fully downloaded, with the hash h of its local content, appending it to the progress
+// file. Files without hash are not recorded, so they are downloaded again by the next attempt.
+func (p *downloadProgress) markCompleted(relPath string, h *metadata.ObjectHash) error {
+	if !p.tracked() || h == nil || h.Func == metadata.NoneFunc {
+		return nil
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.f == nil {
+		if err := p.create(); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(downloadProgressEntry{RelPath: relPath, Hash: *h})
+	if err != nil {
+		return errors.Wrap(err, "encode download progress")
+	}
+	if _, err := p.f.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "write download progress")
+	}
+	p.done[relPath] = struct{}{}
+	return nil
+}
+
+// create writes the progress file with files resumed from previous attempt and opens it for appending.
+func (p *downloadProgress) create() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if err := enc.Encode(downloadProgressHeader{Files: p.files}); err != nil {
+		return errors.Wrap(err, "encode download progress")
+	}
+	for _, e := range p.resumed {
+		if err := enc.Encode(e); err != nil {
+			return errors.Wrap(err, "encode download progress")
+		}
+	}
+	// Make the new file replace progress of previous attempt atomically.
+	progressFile := filepath.Join(p.dir, DownloadProgressFilename)
+	tmp := progressFile + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return errors.Wrap(err, "write download progress")
+	}
+	if err := os.Rename(tmp, progressFile); err != nil {
+		return errors.Wrap(err, "rename download progress")
+	}
+	f, err := os.OpenFile(progressFile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "open download progress")
+	}
+	p.f = f
+	return nil
+}
+
+// close closes the progress file, keeping it for the next attempt.
+func (p *downloadProgress) close() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.f == nil {
+		return nil
+	}
+	err := p.f.Close()
+	p.f = nil
+	return errors.Wrap(err, "close download progress")
+}
+
+// remove removes the progress file, once download is completed.
+func (p *downloadProgress) remove() error {
+	if !p.tracked() {
+		return nil
+	}
+	if err := p.close(); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(p.dir, DownloadProgressFilename)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove download progress")
+	}
+	return nil
+}
+
+// matchingHashPaths returns relative paths of files which are already present in dir with the same hash as recorded in meta.
+// Files are hashed by up to concurrency goroutines. Failure to hash a file is not an error; such file is simply downloaded again.
+func matchingHashPaths(ctx context.Context, logger log.Logger, dir string, files []metadata.File, concurrency int) ([]string, error) {
+	var (
+		mtx     sync.Mutex
+		matched []string
+	)
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for _, fl := range files {
+		// Hash of encrypted file is over the ciphertext, so it can't match the local plaintext.
+		if fl.Hash == nil || fl.Hash.Func == metadata.NoneFunc || fl.RelPath == "" || fl.Encrypted {
+			continue
+		}
+		fl := fl
+		g.Go(func() error {
+			if err := gctx.Err(); err != nil {
+				return err
+			}
+			actualHash, err := metadata.CalculateHashWithContext(gctx, filepath.Join(dir, fl.RelPath), fl.Hash.Func, logger)
+			if err != nil {
+				if gctx.Err() != nil {
+					return gctx.Err()
+				}
+				level.Info(logger).Log("msg", "failed to calculate hash when downloading; re-downloading", "relPath", fl.RelPath, "err", err)
+				return nil
+			}
+			if !fl.Hash.Equal(&actualHash) {
+				return nil
+			}
+
+			mtx.Lock()
+			matched = append(matched, fl.RelPath)
+			mtx.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return matched, nil
+}
+
+// verifyDownloadedFile checks that the downloaded file at the given path has the hash of f, if f has any. h is the hash
+// calculated while the file was downloaded, if any, in which case the file is not read again unless h was calculated
+// with a different function. It returns the hash of the file, or h if the file was not verified.
+func verifyDownloadedFile(ctx context.Context, logger log.Logger, p string, f metadata.File, h *metadata.ObjectHash) (*metadata.ObjectHash, error) {
+	// Encrypted files are verified while they are downloaded, as their hash is over the ciphertext.
+	if f.Hash == nil || f.Hash.Func == metadata.NoneFunc || f.Encrypted {
+		return h, nil
+	}
+	if h == nil || h.Func != f.Hash.Func {
+		actualHash, err := metadata.CalculateHashWithContext(ctx, p, f.Hash.Func, logger)
+		if err != nil {
+			return nil, errors.Wrapf(err, "calculate hash of downloaded file %s", f.RelPath)
+		}
+		h = &actualHash
+	}
+	if !f.Hash.Equal(h) {
+		return nil, errors.Wrapf(ErrLocalFileMismatch, "downloaded file %s has hash %s, expected %s", f.RelPath, h.Value, f.Hash.Value)
+	}
+	return h, nil
+}
+
+// filesByRelPath returns files by their relative paths.
+func filesByRelPath(files []metadata.File) map[string]metadata.File {
+	res := make(map[string]metadata.File, len(files))
+	for _, f := range files {
+		res[f.RelPath] = f
+	}
+	return res
+}
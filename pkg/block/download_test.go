@@ -0,0 +1,664 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/extprom"
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+// TestHashDownload uploads an empty block to in-memory storage
+// and tries to download it to the same dir. It should not try
+// to download twice.
+func TestHashDownload(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	r := prometheus.NewRegistry()
+	instrumentedBkt := objstore.WrapWithMetrics(bkt, extprom.WrapRegistererWithPrefix("thanos_", r), "test")
+
+	b1, err := e2eutil.CreateBlockWithTombstone(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 42, metadata.SHA256Func)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), instrumentedBkt, path.Join(tmpDir, b1.String()), metadata.SHA256Func))
+	testutil.Equals(t, 4, len(bkt.Objects()))
+
+	m, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, b1)
+	testutil.Ok(t, err)
+
+	for _, fl := range m.Thanos.Files {
+		if fl.RelPath == MetaFilename {
+			continue
+		}
+		testutil.Assert(t, fl.Hash != nil, "expected a hash for %s but got nil", fl.RelPath)
+	}
+
+	// Remove the hash from one file to check if we always download it.
+	m.Thanos.Files[1].Hash = nil
+
+	metaEncoded := strings.Builder{}
+	testutil.Ok(t, m.Write(&metaEncoded))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(b1.String(), MetaFilename), strings.NewReader(metaEncoded.String())))
+
+	// Only downloads MetaFile and IndexFile.
+	{
+		err = Download(ctx, log.NewNopLogger(), instrumentedBkt, m.ULID, path.Join(tmpDir, b1.String()))
+		testutil.Ok(t, err)
+		testutil.Ok(t, promtest.GatherAndCompare(r, strings.NewReader(`
+		# HELP thanos_objstore_bucket_operations_total Total number of all attempted operations against a bucket.
+        # TYPE thanos_objstore_bucket_operations_total counter
+        thanos_objstore_bucket_operations_total{bucket="test",operation="attributes"} 0
+        thanos_objstore_bucket_operations_total{bucket="test",operation="delete"} 0
+        thanos_objstore_bucket_operations_total{bucket="test",operation="exists"} 0
+        thanos_objstore_bucket_operations_total{bucket="test",operation="get"} 2
+        thanos_objstore_bucket_operations_total{bucket="test",operation="get_range"} 0
+        thanos_objstore_bucket_operations_total{bucket="test",operation="iter"} 2
+        thanos_objstore_bucket_operations_total{bucket="test",operation="upload"} 4
+		`), `thanos_objstore_bucket_operations_total`))
+	}
+
+	// Ensures that we always download MetaFile.
+	{
+		testutil.Ok(t, os.Remove(path.Join(tmpDir, b1.String(), MetaFilename)))
+		err = Download(ctx, log.NewNopLogger(), instrumentedBkt, m.ULID, path.Join(tmpDir, b1.String()))
+		testutil.Ok(t, err)
+		testutil.Ok(t, promtest.GatherAndCompare(r, strings.NewReader(`
+		# HELP thanos_objstore_bucket_operations_total Total number of all attempted operations against a bucket.
+        # TYPE thanos_objstore_bucket_operations_total counter
+        thanos_objstore_bucket_operations_total{bucket="test",operation="attributes"} 0
+        thanos_objstore_bucket_operations_total{bucket="test",operation="delete"} 0
+        thanos_objstore_bucket_operations_total{bucket="test",operation="exists"} 0
+        thanos_objstore_bucket_operations_total{bucket="test",operation="get"} 4
+        thanos_objstore_bucket_operations_total{bucket="test",operation="get_range"} 0
+        thanos_objstore_bucket_operations_total{bucket="test",operation="iter"} 4
+        thanos_objstore_bucket_operations_total{bucket="test",operation="upload"} 4
+		`), `thanos_objstore_bucket_operations_total`))
+	}
+
+	// Remove chunks => gets redownloaded.
+	// Always downloads MetaFile.
+	// Finally, downloads the IndexFile since we have removed its hash.
+	{
+		testutil.Ok(t, os.RemoveAll(path.Join(tmpDir, b1.String(), ChunksDirname)))
+		err = Download(ctx, log.NewNopLogger(), instrumentedBkt, m.ULID, path.Join(tmpDir, b1.String()))
+		testutil.Ok(t, err)
+		testutil.Ok(t, promtest.GatherAndCompare(r, strings.NewReader(`
+			# HELP thanos_objstore_bucket_operations_total Total number of all attempted operations against a bucket.
+			# TYPE thanos_objstore_bucket_operations_total counter
+			thanos_objstore_bucket_operations_total{bucket="test",operation="attributes"} 0
+			thanos_objstore_bucket_operations_total{bucket="test",operation="delete"} 0
+			thanos_objstore_bucket_operations_total{bucket="test",operation="exists"} 0
+			thanos_objstore_bucket_operations_total{bucket="test",operation="get"} 7
+			thanos_objstore_bucket_operations_total{bucket="test",operation="get_range"} 0
+			thanos_objstore_bucket_operations_total{bucket="test",operation="iter"} 6
+			thanos_objstore_bucket_operations_total{bucket="test",operation="upload"} 4
+			`), `thanos_objstore_bucket_operations_total`))
+	}
+}
+
+func TestDownloadConcurrently(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 42, metadata.SHA256Func)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.SHA256Func))
+
+	cBkt := &getCountingBucket{Bucket: bkt}
+	dst := path.Join(t.TempDir(), b1.String())
+	testutil.Ok(t, DownloadWithOptions(ctx, log.NewNopLogger(), cBkt, b1, dst, WithFetchConcurrency(4)))
+	for _, f := range []string{MetaFilename, IndexFilename, path.Join(ChunksDirname, "000001")} {
+		_, err := os.Stat(path.Join(dst, f))
+		testutil.Ok(t, err)
+	}
+	testutil.Equals(t, int64(3), cBkt.gets.Load())
+
+	// All files match their hashes, so only meta.json is fetched again.
+	testutil.Ok(t, DownloadWithOptions(ctx, log.NewNopLogger(), cBkt, b1, dst, WithFetchConcurrency(4)))
+	testutil.Equals(t, int64(4), cBkt.gets.Load())
+
+	// Cancelled context stops the download.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	testutil.NotOk(t, DownloadWithOptions(cctx, log.NewNopLogger(), cBkt, b1, path.Join(t.TempDir(), b1.String()), WithFetchConcurrency(4)))
+}
+
+func TestDownloadDirConcurrency(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	for _, name := range []string{"b/a", "b/d1/a", "b/d1/b", "b/d2/a", "b/d2/d3/a", "b/d2/d3/b"} {
+		testutil.Ok(t, bkt.Upload(ctx, name, strings.NewReader("content")))
+	}
+	noSkip := func(string) bool { return false }
+	noHash := func(string) metadata.HashFunc { return metadata.NoneFunc }
+	noop := func(string, *metadata.ObjectHash) error { return nil }
+
+	// Concurrency limit applies to files of all subdirectories together.
+	tBkt := &inFlightBucket{Bucket: bkt, delay: 10 * time.Millisecond}
+	testutil.Ok(t, downloadDir(ctx, log.NewNopLogger(), tBkt, "b", "b", t.TempDir(), 2, noSkip, noHash, noop))
+	testutil.Equals(t, int64(6), tBkt.done.Load())
+	testutil.Assert(t, tBkt.max.Load() <= 2, "expected at most 2 downloads in flight, got %d", tBkt.max.Load())
+
+	// Downloads in flight are finished before listing error is returned.
+	tBkt = &inFlightBucket{Bucket: bkt, delay: 50 * time.Millisecond, iterErr: errors.New("iter failed")}
+	err := downloadDir(ctx, log.NewNopLogger(), tBkt, "b", "b", t.TempDir(), 2, noSkip, noHash, noop)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, tBkt.started.Load(), tBkt.done.Load())
+}
+
+// inFlightBucket tracks downloads in flight, from Get, which takes at least delay, until the reader is closed. If iterErr
+// is set, Iter fails with it after listing the first object of the top directory.
+type inFlightBucket struct {
+	objstore.Bucket
+
+	delay   time.Duration
+	iterErr error
+
+	started, done, inFlight, max atomic.Int64
+}
+
+func (b *inFlightBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	if b.iterErr == nil {
+		return b.Bucket.Iter(ctx, dir, f, options...)
+	}
+	if err := b.Bucket.Iter(ctx, dir, func(name string) error {
+		if err := f(name); err != nil {
+			return err
+		}
+		return b.iterErr
+	}, options...); err != nil {
+		return err
+	}
+	return b.iterErr
+}
+
+func (b *inFlightBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.start()
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		b.finish()
+		return nil, err
+	}
+	return inFlightReader{ReadCloser: rc, b: b}, nil
+}
+
+func (b *inFlightBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.start()
+	defer b.finish()
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func (b *inFlightBucket) start() {
+	b.started.Add(1)
+	n := b.inFlight.Add(1)
+	for m := b.max.Load(); n > m && !b.max.CompareAndSwap(m, n); m = b.max.Load() {
+	}
+	time.Sleep(b.delay)
+}
+
+func (b *inFlightBucket) finish() {
+	b.inFlight.Add(-1)
+	b.done.Add(1)
+}
+
+type inFlightReader struct {
+	io.ReadCloser
+
+	b *inFlightBucket
+}
+
+func (r inFlightReader) Close() error {
+	defer r.b.finish()
+	return r.ReadCloser.Close()
+}
+
+func TestDownloadUploadWithObjstoreOptions(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 42, metadata.SHA256Func)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc, objstore.WithUploadConcurrency(2)))
+
+	cBkt := &getCountingBucket{Bucket: bkt}
+	dst := path.Join(t.TempDir(), b1.String())
+	testutil.Ok(t, DownloadWithOptions(ctx, log.NewNopLogger(), cBkt, b1, dst, WithObjstoreDownloadOptions(objstore.WithFetchConcurrency(4)), WithDownloadVerification()))
+	for _, f := range []string{MetaFilename, IndexFilename, path.Join(ChunksDirname, "000001")} {
+		_, err := os.Stat(path.Join(dst, f))
+		testutil.Ok(t, err)
+	}
+	testutil.Equals(t, int64(3), cBkt.gets.Load())
+	_, err = os.Stat(path.Join(dst, DownloadProgressFilename))
+	testutil.Assert(t, os.IsNotExist(err), "download progress should be removed")
+}
+
+func TestDownloadResume(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 42, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+
+	dst := path.Join(t.TempDir(), b1.String())
+
+	// Progress is not tracked by default.
+	err = Download(ctx, log.NewNopLogger(), errGetBucket{Bucket: bkt, failSuffix: "/" + IndexFilename}, b1, dst)
+	testutil.Assert(t, errors.Is(err, errGetFailed))
+	_, err = os.Stat(path.Join(dst, DownloadProgressFilename))
+	testutil.Assert(t, os.IsNotExist(err), "download progress should not be tracked by default")
+	testutil.Ok(t, os.RemoveAll(dst))
+
+	// Fetching index fails, after chunks were already downloaded.
+	err = DownloadWithOptions(ctx, log.NewNopLogger(), errGetBucket{Bucket: bkt, failSuffix: "/" + IndexFilename}, b1, dst, WithResumableDownload())
+	testutil.NotOk(t, err)
+	testutil.Assert(t, errors.Is(err, errGetFailed))
+
+	_, err = os.Stat(path.Join(dst, MetaFilename))
+	testutil.Assert(t, os.IsNotExist(err), "partially downloaded block should not have meta.json")
+	_, err = os.Stat(path.Join(dst, ChunksDirname, "000001"))
+	testutil.Ok(t, err)
+	_, err = os.Stat(path.Join(dst, DownloadProgressFilename))
+	testutil.Ok(t, err)
+
+	// Resumed download fetches only meta.json and index.
+	cBkt := &getCountingBucket{Bucket: bkt}
+	testutil.Ok(t, DownloadWithOptions(ctx, log.NewNopLogger(), cBkt, b1, dst, WithResumableDownload()))
+	testutil.Equals(t, int64(2), cBkt.gets.Load())
+	_, err = os.Stat(path.Join(dst, DownloadProgressFilename))
+	testutil.Assert(t, os.IsNotExist(err), "download progress should be removed after successful download")
+
+	// Progress for a different block content is ignored.
+	testutil.Ok(t, os.WriteFile(path.Join(dst, DownloadProgressFilename), []byte(`{"files":[{"rel_path":"index"}]}
+{"relPath":"index","hash":{"hashFunc":"SHA256","value":"00"}}
+`), 0600))
+	cBkt = &getCountingBucket{Bucket: bkt}
+	testutil.Ok(t, DownloadWithOptions(ctx, log.NewNopLogger(), cBkt, b1, dst, WithResumableDownload()))
+	testutil.Equals(t, int64(3), cBkt.gets.Load())
+
+	// File recorded as downloaded, but modified in the meantime with the same size (e.g. torn by a crash), is downloaded again.
+	testutil.Ok(t, os.RemoveAll(dst))
+	err = DownloadWithOptions(ctx, log.NewNopLogger(), errGetBucket{Bucket: bkt, failSuffix: "/" + IndexFilename}, b1, dst, WithResumableDownload())
+	testutil.Assert(t, errors.Is(err, errGetFailed))
+
+	chunksFile := path.Join(dst, ChunksDirname, "000001")
+	want, err := os.ReadFile(chunksFile)
+	testutil.Ok(t, err)
+	testutil.Ok(t, os.WriteFile(chunksFile, make([]byte, len(want)), 0600))
+	// Torn last line of the progress is ignored.
+	pf, err := os.OpenFile(path.Join(dst, DownloadProgressFilename), os.O_APPEND|os.O_WRONLY, 0600)
+	testutil.Ok(t, err)
+	_, err = pf.WriteString(`{"relPath":"ind`)
+	testutil.Ok(t, err)
+	testutil.Ok(t, pf.Close())
+
+	cBkt = &getCountingBucket{Bucket: bkt}
+	testutil.Ok(t, DownloadWithOptions(ctx, log.NewNopLogger(), cBkt, b1, dst, WithResumableDownload()))
+	testutil.Equals(t, int64(3), cBkt.gets.Load())
+	got, err := os.ReadFile(chunksFile)
+	testutil.Ok(t, err)
+	testutil.Equals(t, want, got)
+}
+
+func TestDownloadFiles(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 42, metadata.SHA256Func)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.SHA256Func))
+
+	dst := path.Join(t.TempDir(), b1.String())
+	cBkt := &getCountingBucket{Bucket: bkt}
+	testutil.Ok(t, DownloadFiles(ctx, log.NewNopLogger(), cBkt, b1, dst, []string{IndexFilename}))
+	testutil.Equals(t, int64(2), cBkt.gets.Load())
+
+	_, err = os.Stat(path.Join(dst, IndexFilename))
+	testutil.Ok(t, err)
+	_, err = os.Stat(path.Join(dst, ChunksDirname))
+	testutil.Assert(t, os.IsNotExist(err), "chunks should not be downloaded")
+
+	// Index hash matches, so it's not downloaded again. Chunk file in nested directory is.
+	testutil.Ok(t, DownloadFiles(ctx, log.NewNopLogger(), cBkt, b1, dst, []string{IndexFilename, path.Join(ChunksDirname, "000001")}))
+	testutil.Equals(t, int64(4), cBkt.gets.Load())
+	_, err = os.Stat(path.Join(dst, ChunksDirname, "000001"))
+	testutil.Ok(t, err)
+
+	// Duplicate paths are downloaded once.
+	dst = path.Join(t.TempDir(), b1.String())
+	cBkt = &getCountingBucket{Bucket: bkt}
+	testutil.Ok(t, DownloadFiles(ctx, log.NewNopLogger(), cBkt, b1, dst, []string{IndexFilename, IndexFilename, IndexFilename}, WithFetchConcurrency(3)))
+	testutil.Equals(t, int64(2), cBkt.gets.Load())
+	fileErrs, err := VerifyLocalBlock(ctx, log.NewNopLogger(), bkt, b1, dst)
+	testutil.Ok(t, err)
+	for _, fe := range fileErrs {
+		testutil.Assert(t, fe.RelPath != IndexFilename, "index should be intact, got %v", fe)
+	}
+
+	err = DownloadFiles(ctx, log.NewNopLogger(), cBkt, b1, dst, []string{"tombstones"})
+	testutil.NotOk(t, err)
+	testutil.Equals(t, fmt.Sprintf("file tombstones not found in meta of block %s", b1.String()), err.Error())
+}
+
+func TestDownloadFileWithHash(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	dir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, bkt.Upload(ctx, "obj", strings.NewReader("content")))
+
+	h, err := downloadFile(ctx, logger, bkt, "obj", filepath.Join(dir, "hashed"), metadata.SHA256Func)
+	testutil.Ok(t, err)
+	expected, err := metadata.CalculateHash(filepath.Join(dir, "hashed"), metadata.SHA256Func, logger)
+	testutil.Ok(t, err)
+	testutil.Equals(t, &expected, h)
+
+	h, err = downloadFile(ctx, logger, bkt, "obj", filepath.Join(dir, "unhashed"), metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Assert(t, h == nil, "expected no hash")
+	b, err := os.ReadFile(filepath.Join(dir, "unhashed"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "content", string(b))
+
+	// Partially downloaded file is removed.
+	_, err = downloadFile(ctx, logger, &failingReadBucket{Bucket: bkt}, "obj", filepath.Join(dir, "failed"), metadata.SHA256Func)
+	testutil.NotOk(t, err)
+	_, err = os.Stat(filepath.Join(dir, "failed"))
+	testutil.Assert(t, os.IsNotExist(err), "partial file should be removed")
+}
+
+func TestDownloadWithFsync(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 42, metadata.SHA256Func)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.SHA256Func))
+
+	dst := path.Join(t.TempDir(), b1.String())
+	testutil.Ok(t, DownloadWithOptions(ctx, log.NewNopLogger(), bkt, b1, dst, WithFsyncOnDownload()))
+	fileErrs, err := VerifyLocalBlock(ctx, log.NewNopLogger(), bkt, b1, dst)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(fileErrs))
+	_, err = os.Stat(path.Join(dst, DownloadProgressFilename))
+	testutil.Assert(t, os.IsNotExist(err), "progress file should be removed")
+
+	dst = path.Join(t.TempDir(), b1.String())
+	testutil.Ok(t, DownloadFiles(ctx, log.NewNopLogger(), bkt, b1, dst, []string{IndexFilename, path.Join(ChunksDirname, "000001")}, WithFsyncOnDownload()))
+	_, err = os.Stat(path.Join(dst, ChunksDirname, "000001"))
+	testutil.Ok(t, err)
+}
+
+func TestDownloadWithVerification(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 42, metadata.SHA256Func)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.SHA256Func))
+
+	testutil.Ok(t, DownloadWithOptions(ctx, log.NewNopLogger(), bkt, b1, path.Join(t.TempDir(), b1.String()), WithDownloadVerification()))
+
+	// Corrupt the index in the bucket.
+	index, err := os.ReadFile(path.Join(tmpDir, b1.String(), IndexFilename))
+	testutil.Ok(t, err)
+	index[len(index)-1]++
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(b1.String(), IndexFilename), bytes.NewReader(index)))
+
+	err = DownloadWithOptions(ctx, log.NewNopLogger(), bkt, b1, path.Join(t.TempDir(), b1.String()), WithDownloadVerification())
+	testutil.NotOk(t, err)
+	testutil.Assert(t, errors.Is(err, ErrLocalFileMismatch), "expected file mismatch, got %v", err)
+
+	err = DownloadFiles(ctx, log.NewNopLogger(), bkt, b1, path.Join(t.TempDir(), b1.String()), []string{IndexFilename}, WithDownloadVerification())
+	testutil.Assert(t, errors.Is(err, ErrLocalFileMismatch), "expected file mismatch, got %v", err)
+
+	// Verification is skipped by default.
+	testutil.Ok(t, Download(ctx, log.NewNopLogger(), bkt, b1, path.Join(t.TempDir(), b1.String())))
+}
+
+func TestDownloadWithIndexHeader(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 42, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+
+	// No-op if the block has no index-header.
+	dst := path.Join(t.TempDir(), b1.String())
+	testutil.Ok(t, DownloadWithOptions(ctx, log.NewNopLogger(), bkt, b1, dst, WithIndexHeader()))
+	_, err = os.Stat(path.Join(dst, IndexHeaderFilename))
+	testutil.Assert(t, os.IsNotExist(err), "index-header should not exist")
+
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(b1.String(), IndexHeaderFilename), strings.NewReader("header")))
+
+	dst = path.Join(t.TempDir(), b1.String())
+	testutil.Ok(t, Download(ctx, log.NewNopLogger(), bkt, b1, dst))
+	_, err = os.Stat(path.Join(dst, IndexHeaderFilename))
+	testutil.Assert(t, os.IsNotExist(err), "index-header should not be downloaded without the option")
+
+	testutil.Ok(t, DownloadWithOptions(ctx, log.NewNopLogger(), bkt, b1, dst, WithIndexHeader()))
+	b, err := os.ReadFile(path.Join(dst, IndexHeaderFilename))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "header", string(b))
+}
+
+func TestVerifyLocalBlock(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 42, metadata.SHA256Func)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.SHA256Func))
+
+	dst := path.Join(t.TempDir(), b1.String())
+	testutil.Ok(t, Download(ctx, log.NewNopLogger(), bkt, b1, dst))
+
+	res, err := VerifyLocalBlock(ctx, log.NewNopLogger(), bkt, b1, dst)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(res))
+
+	// Corrupt the index keeping its size and remove the chunk file.
+	index, err := os.ReadFile(path.Join(dst, IndexFilename))
+	testutil.Ok(t, err)
+	index[len(index)-1]++
+	testutil.Ok(t, os.WriteFile(path.Join(dst, IndexFilename), index, 0600))
+	testutil.Ok(t, os.Remove(path.Join(dst, ChunksDirname, "000001")))
+
+	res, err = VerifyLocalBlock(ctx, log.NewNopLogger(), bkt, b1, dst)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(res))
+	testutil.Equals(t, path.Join(ChunksDirname, "000001"), res[0].RelPath)
+	testutil.Assert(t, errors.Is(res[0], ErrLocalFileMissing))
+	testutil.Equals(t, IndexFilename, res[1].RelPath)
+	testutil.Assert(t, errors.Is(res[1], ErrLocalFileMismatch))
+
+	// Local directory is untouched.
+	_, err = os.Stat(path.Join(dst, ChunksDirname, "000001"))
+	testutil.Assert(t, os.IsNotExist(err))
+}
+
+var errGetFailed = errors.New("get failed")
+
+type errGetBucket struct {
+	objstore.Bucket
+
+	failSuffix string
+}
+
+func (eb errGetBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if strings.HasSuffix(name, eb.failSuffix) {
+		return nil, errGetFailed
+	}
+	return eb.Bucket.Get(ctx, name)
+}
+
+// failingReadBucket returns readers failing after the first byte of the object.
+type failingReadBucket struct {
+	objstore.Bucket
+}
+
+func (b *failingReadBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(io.LimitReader(rc, 1), iotest.ErrReader(errGetFailed)), rc}, nil
+}
+
+type getCountingBucket struct {
+	objstore.Bucket
+
+	gets atomic.Int64
+}
+
+func (b *getCountingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	b.gets.Add(1)
+	return b.Bucket.Get(ctx, name)
+}
+
+func TestDownloadSharded(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, Upload(ctx, logger, bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+
+	dst := []string{filepath.Join(t.TempDir(), b1.String()), filepath.Join(t.TempDir(), b1.String())}
+	chunksToSecond := func(relPath string) int {
+		if strings.HasPrefix(relPath, ChunksDirname+"/") {
+			return 1
+		}
+		return 0
+	}
+	testutil.Ok(t, DownloadSharded(ctx, logger, bkt, b1, dst, chunksToSecond, WithFetchConcurrency(2)))
+
+	_, err = metadata.ReadFromDir(dst[0])
+	testutil.Ok(t, err)
+	fi, err := os.Lstat(filepath.Join(dst[0], IndexFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, fi.Mode().IsRegular(), "index should be a regular file")
+	fi, err = os.Lstat(filepath.Join(dst[0], ChunksDirname, "000001"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, fi.Mode()&os.ModeSymlink != 0, "chunks should be symlinked")
+
+	for _, relPath := range []string{IndexFilename, path.Join(ChunksDirname, "000001")} {
+		b, err := os.ReadFile(filepath.Join(dst[0], relPath))
+		testutil.Ok(t, err)
+		testutil.Equals(t, bkt.Objects()[path.Join(b1.String(), relPath)], b)
+	}
+	_, err = os.Stat(filepath.Join(dst[1], IndexFilename))
+	testutil.Assert(t, os.IsNotExist(err), "index should not be in second directory")
+
+	// Download again works over existing symlinks.
+	testutil.Ok(t, DownloadSharded(ctx, logger, bkt, b1, dst, chunksToSecond))
+
+	dst = []string{filepath.Join(t.TempDir(), b1.String())}
+	testutil.NotOk(t, DownloadSharded(ctx, logger, bkt, b1, dst, func(string) int { return 1 }))
+	_, err = os.Stat(filepath.Join(dst[0], MetaFilename))
+	testutil.Assert(t, os.IsNotExist(err), "meta should be removed after failed download")
+}
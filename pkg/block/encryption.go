@@ -0,0 +1,155 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"hash"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// Encrypter encrypts block files before they are uploaded. See WithEncrypter.
+type Encrypter interface {
+	// Encrypt returns the ciphertext stream of the given plaintext stream of the block file with the given path,
+	// relative to the block directory.
+	Encrypt(relPath string, plaintext io.Reader) (io.Reader, error)
+}
+
+// Decrypter decrypts block files encrypted by Encrypter when they are downloaded. See WithDecrypter.
+type Decrypter interface {
+	// Decrypt returns the plaintext stream of the given ciphertext stream of the block file with the given path,
+	// relative to the block directory.
+	Decrypt(relPath string, ciphertext io.Reader) (io.Reader, error)
+}
+
+// uploadEncrypted uploads the plaintext of the block file with the given path to dst in the bucket, encrypted by enc.
+// It returns the size of the ciphertext and its hash calculated with the hash function hf while uploading, or nil hash
+// for metadata.NoneFunc. Time spent hashing is added to the timer, if any.
+func uploadEncrypted(ctx context.Context, logger log.Logger, bkt objstore.Bucket, enc Encrypter, relPath string, plaintext io.Reader, dst string, hf metadata.HashFunc, timer *hashTimer) (int64, *metadata.ObjectHash, error) {
+	ciphertext, err := enc.Encrypt(relPath, plaintext)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "encrypt file %s", relPath)
+	}
+	r := &hashingReader{r: ciphertext, timer: timer}
+	if hf != metadata.NoneFunc {
+		if r.h, err = metadata.NewHash(hf); err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := bkt.Upload(ctx, dst, r); err != nil {
+		return 0, nil, err
+	}
+	level.Debug(logger).Log("msg", "uploaded encrypted file", "file", relPath, "dst", dst, "bucket", bkt.Name())
+	if r.h == nil {
+		return r.read, nil, nil
+	}
+	h := metadata.ObjectHashFrom(hf, r.h)
+	return r.read, &h, nil
+}
+
+// hashingReader is a reader of unknown size, which optionally hashes everything read through it, adding time spent
+// hashing to the timer, if any.
+type hashingReader struct {
+	r     io.Reader
+	h     hash.Hash
+	timer *hashTimer
+	read  int64
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.read += int64(n)
+		if r.h != nil {
+			start := time.Now()
+			_, _ = r.h.Write(p[:n])
+			r.timer.since(start)
+		}
+	}
+	return n, err
+}
+
+// withDecrypter returns the bucket decrypting encrypted files of the given block when they are read, or the given
+// bucket if no file is encrypted. It fails if some file is encrypted, but no decrypter is given.
+func withDecrypter(logger log.Logger, bkt objstore.Bucket, id ulid.ULID, files []metadata.File, opts downloadParams) (objstore.Bucket, error) {
+	encrypted := map[string]metadata.File{}
+	for _, f := range files {
+		if f.Encrypted {
+			encrypted[f.RelPath] = f
+		}
+	}
+	if len(encrypted) == 0 {
+		return bkt, nil
+	}
+	if opts.decrypter == nil {
+		return nil, errors.Errorf("block %s has encrypted files, but no decrypter was given", id)
+	}
+	return &decryptingBucket{
+		Bucket:    bkt,
+		logger:    logger,
+		dec:       opts.decrypter,
+		prefix:    id.String() + objstore.DirDelim,
+		encrypted: encrypted,
+		verify:    opts.verifyHashes,
+	}, nil
+}
+
+// decryptingBucket is a bucket decrypting encrypted files of a block when they are read. If verify is true, hash of
+// the ciphertext is verified against the one in meta as it's read.
+type decryptingBucket struct {
+	objstore.Bucket
+
+	logger    log.Logger
+	dec       Decrypter
+	prefix    string
+	encrypted map[string]metadata.File
+	verify    bool
+}
+
+func (b *decryptingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	f, ok := b.encrypted[strings.TrimPrefix(name, b.prefix)]
+	if !ok {
+		return b.Bucket.Get(ctx, name)
+	}
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var ciphertext io.Reader = rc
+	if b.verify && f.Hash != nil && f.Hash.Func != metadata.NoneFunc {
+		h, err := metadata.NewHash(f.Hash.Func)
+		if err != nil {
+			runutil.CloseWithLogOnErr(b.logger, rc, "close %s", name)
+			return nil, err
+		}
+		ciphertext = &verifyingReader{r: rc, h: h, f: f, err: ErrLocalFileMismatch}
+	}
+	plaintext, err := b.dec.Decrypt(f.RelPath, ciphertext)
+	if err != nil {
+		runutil.CloseWithLogOnErr(b.logger, rc, "close %s", name)
+		return nil, errors.Wrapf(err, "decrypt file %s", f.RelPath)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{plaintext, rc}, nil
+}
+
+func (b *decryptingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if _, ok := b.encrypted[strings.TrimPrefix(name, b.prefix)]; ok {
+		return nil, errors.Errorf("range reads of encrypted file %s are not supported", name)
+	}
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
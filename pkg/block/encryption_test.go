@@ -0,0 +1,124 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+// xorCipher "encrypts" files by xoring them with the key.
+type xorCipher byte
+
+func (c xorCipher) Encrypt(_ string, r io.Reader) (io.Reader, error) {
+	return &xorReader{r: r, key: byte(c)}, nil
+}
+func (c xorCipher) Decrypt(_ string, r io.Reader) (io.Reader, error) {
+	return &xorReader{r: r, key: byte(c)}, nil
+}
+
+type xorReader struct {
+	r   io.Reader
+	key byte
+}
+
+func (r *xorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for i := range p[:n] {
+		p[i] ^= r.key
+	}
+	return n, err
+}
+
+func TestUploadDownloadEncrypted(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bdir := filepath.Join(tmpDir, b1.String())
+	index, err := os.ReadFile(filepath.Join(bdir, IndexFilename))
+	testutil.Ok(t, err)
+
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, UploadWithOptions(ctx, logger, bkt, bdir, metadata.SHA256Func, WithEncrypter(xorCipher(0x5a))))
+
+	uploaded := bkt.Objects()[path.Join(b1.String(), IndexFilename)]
+	testutil.Assert(t, !bytes.Equal(index, uploaded), "index should be encrypted")
+	testutil.Equals(t, len(index), len(uploaded))
+
+	m, err := DownloadMeta(ctx, logger, bkt, b1)
+	testutil.Ok(t, err)
+	for _, f := range m.Thanos.Files {
+		if f.RelPath == MetaFilename {
+			testutil.Assert(t, !f.Encrypted, "meta should not be encrypted")
+			continue
+		}
+		testutil.Assert(t, f.Encrypted, "%s should be encrypted", f.RelPath)
+		sum := sha256.Sum256(bkt.Objects()[path.Join(b1.String(), f.RelPath)])
+		testutil.Equals(t, hex.EncodeToString(sum[:]), f.Hash.Value)
+	}
+
+	t.Run("download without decrypter fails", func(t *testing.T) {
+		testutil.NotOk(t, Download(ctx, logger, bkt, b1, filepath.Join(t.TempDir(), b1.String())))
+	})
+	t.Run("download decrypts", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), b1.String())
+		testutil.Ok(t, DownloadWithOptions(ctx, logger, bkt, b1, dst, WithDecrypter(xorCipher(0x5a)), WithDownloadVerification()))
+		downloaded, err := os.ReadFile(filepath.Join(dst, IndexFilename))
+		testutil.Ok(t, err)
+		testutil.Equals(t, index, downloaded)
+
+		// Encrypted files are always downloaded again and are not compared with local files.
+		testutil.Ok(t, DownloadWithOptions(ctx, logger, bkt, b1, dst, WithDecrypter(xorCipher(0x5a))))
+		fileErrs, err := VerifyLocalBlock(ctx, logger, bkt, b1, dst)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(fileErrs))
+
+		dst = filepath.Join(t.TempDir(), b1.String())
+		testutil.Ok(t, DownloadFiles(ctx, logger, bkt, b1, dst, []string{IndexFilename}, WithDecrypter(xorCipher(0x5a))))
+		downloaded, err = os.ReadFile(filepath.Join(dst, IndexFilename))
+		testutil.Ok(t, err)
+		testutil.Equals(t, index, downloaded)
+	})
+	t.Run("corrupted ciphertext fails verification", func(t *testing.T) {
+		corrupted := append([]byte{}, uploaded...)
+		corrupted[0]++
+		cbkt := objstore.NewInMemBucket()
+		for name, b := range bkt.Objects() {
+			testutil.Ok(t, cbkt.Upload(ctx, name, bytes.NewReader(b)))
+		}
+		testutil.Ok(t, cbkt.Upload(ctx, path.Join(b1.String(), IndexFilename), bytes.NewReader(corrupted)))
+
+		err := DownloadWithOptions(ctx, logger, cbkt, b1, filepath.Join(t.TempDir(), b1.String()), WithDecrypter(xorCipher(0x5a)), WithDownloadVerification())
+		testutil.Assert(t, errors.Is(err, ErrLocalFileMismatch), "expected file mismatch, got %v", err)
+		testutil.Ok(t, DownloadWithOptions(ctx, logger, cbkt, b1, filepath.Join(t.TempDir(), b1.String()), WithDecrypter(xorCipher(0x5a))))
+	})
+	t.Run("upload readers does not support encryption", func(t *testing.T) {
+		testutil.NotOk(t, UploadReaders(ctx, logger, objstore.NewInMemBucket(), &m, nil, metadata.NoneFunc, WithEncrypter(xorCipher(0x5a))))
+	})
+}
@@ -251,6 +251,13 @@ func (f *ConcurrentLister) GetActiveAndPartialBlockIDs(ctx context.Context, ch c
 				if err != nil {
 					return errors.Wrapf(err, "meta.json file exists: %v", uid)
 				}
+				if !ok {
+					// Block might have compressed meta instead.
+					ok, err = f.bkt.Exists(gCtx, path.Join(uid.String(), metadata.MetaGzipFilename))
+					if err != nil {
+						return errors.Wrapf(err, "meta.json.gz file exists: %v", uid)
+					}
+				}
 				if !ok {
 					mu.Lock()
 					partialBlocks[uid] = true
@@ -414,6 +421,12 @@ func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Met
 	}
 
 	r, err := f.bkt.ReaderWithExpectedErrs(f.bkt.IsObjNotFoundErr).Get(ctx, metaFile)
+	if f.bkt.IsObjNotFoundErr(err) {
+		// Block might have compressed meta instead.
+		if gzr, gzerr := f.bkt.ReaderWithExpectedErrs(f.bkt.IsObjNotFoundErr).Get(ctx, path.Join(id.String(), metadata.MetaGzipFilename)); gzerr == nil || !f.bkt.IsObjNotFoundErr(gzerr) {
+			r, err = gzr, gzerr
+		}
+	}
 	if f.bkt.IsObjNotFoundErr(err) {
 		// Meta.json was deleted between bkt.Exists and here.
 		return nil, errors.Wrapf(ErrorSyncMetaNotFound, "%v", err)
@@ -424,7 +437,11 @@ func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Met
 
 	defer runutil.CloseWithLogOnErr(f.logger, r, "close bkt meta get")
 
-	metaContent, err := io.ReadAll(r)
+	mr, err := metadata.NewMetaReader(r)
+	if err != nil {
+		return nil, errors.Wrapf(ErrorSyncMetaCorrupted, "meta.json %v decompress: %v", metaFile, err)
+	}
+	metaContent, err := io.ReadAll(mr)
 	if err != nil {
 		return nil, errors.Wrapf(err, "read meta file: %v", metaFile)
 	}
@@ -0,0 +1,147 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// ErrCorruptedObject is the error returned when the content of a block file read from the bucket does not have the
+// hash recorded in the block's meta.
+var ErrCorruptedObject = errors.New("corrupted object")
+
+// ErrUnverifiableRead is the error returned by range reads of block files with known hash in strict mode, see
+// WithStrictHashVerification.
+var ErrUnverifiableRead = errors.New("unverifiable read")
+
+// HashVerifyOption configures the provided params.
+type HashVerifyOption func(params *hashVerifyParams)
+
+// hashVerifyParams holds the NewHashVerifyingBucket() parameters.
+type hashVerifyParams struct {
+	strict bool
+}
+
+// WithStrictHashVerification is an option to fail GetRange of a part of files with known hash with an error wrapping
+// ErrUnverifiableRead, instead of passing it through unverified.
+func WithStrictHashVerification() HashVerifyOption {
+	return func(params *hashVerifyParams) {
+		params.strict = true
+	}
+}
+
+// NewHashVerifyingBucket returns the bucket which verifies hashes of the files of the block with the given meta as
+// they are read. Get of a file with known hash fails with an error wrapping ErrCorruptedObject when the end of the
+// object is read and the content does not match the hash in meta. Encrypted files and files without hash are read
+// as they are.
+// GetRange covering the whole file, i.e. from offset 0 with negative length or length of at least the file size in
+// meta, is verified the same way.
+// NOTE: A hash can only be checked against the whole object, so GetRange of a part of file with known hash is passed
+// through unverified, or fails in strict mode (see WithStrictHashVerification). Thus the query path of store gateway,
+// which reads parts of index and chunks with range reads only, is out of scope of this bucket.
+func NewHashVerifyingBucket(bkt objstore.Bucket, meta *metadata.Meta, options ...HashVerifyOption) objstore.Bucket {
+	var opts hashVerifyParams
+	for _, opt := range options {
+		opt(&opts)
+	}
+	files := map[string]metadata.File{}
+	for _, f := range meta.Thanos.Files {
+		if f.Encrypted || f.Hash == nil || f.Hash.Func == metadata.NoneFunc {
+			continue
+		}
+		files[f.RelPath] = f
+	}
+	return &hashVerifyingBucket{
+		Bucket: bkt,
+		prefix: meta.ULID.String() + objstore.DirDelim,
+		files:  files,
+		strict: opts.strict,
+	}
+}
+
+type hashVerifyingBucket struct {
+	objstore.Bucket
+
+	prefix string
+	files  map[string]metadata.File
+	strict bool
+}
+
+// hashedFile returns the file with known hash stored as the object with the given name, if any.
+func (b *hashVerifyingBucket) hashedFile(name string) (metadata.File, bool) {
+	if !strings.HasPrefix(name, b.prefix) {
+		return metadata.File{}, false
+	}
+	f, ok := b.files[strings.TrimPrefix(name, b.prefix)]
+	return f, ok
+}
+
+func (b *hashVerifyingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	f, ok := b.hashedFile(name)
+	if !ok {
+		return b.Bucket.Get(ctx, name)
+	}
+	return verifiedRead(f, func() (io.ReadCloser, error) { return b.Bucket.Get(ctx, name) })
+}
+
+func (b *hashVerifyingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	f, ok := b.hashedFile(name)
+	if !ok {
+		return b.Bucket.GetRange(ctx, name, off, length)
+	}
+	if off == 0 && (length < 0 || (f.SizeBytes > 0 && length >= f.SizeBytes)) {
+		return verifiedRead(f, func() (io.ReadCloser, error) { return b.Bucket.GetRange(ctx, name, off, length) })
+	}
+	if b.strict {
+		return nil, errors.Wrapf(ErrUnverifiableRead, "range read of file %s with known hash", name)
+	}
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
+
+// verifiedRead returns the whole content of the file f, opened by get, verified against the hash of f.
+func verifiedRead(f metadata.File, get func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	h, err := metadata.NewHash(f.Hash.Func)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := get()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&verifyingReader{r: rc, h: h, f: f, err: ErrCorruptedObject}, rc}, nil
+}
+
+// verifyingReader fails reading the end of the stream with an error wrapping err if the stream does not have the
+// hash of the file.
+type verifyingReader struct {
+	r   io.Reader
+	h   hash.Hash
+	f   metadata.File
+	err error
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		_, _ = r.h.Write(p[:n])
+	}
+	if err == io.EOF {
+		actualHash := metadata.ObjectHashFrom(r.f.Hash.Func, r.h)
+		if !r.f.Hash.Equal(&actualHash) {
+			return n, errors.Wrapf(r.err, "file %s has hash %s, expected %s", r.f.RelPath, actualHash.Value, r.f.Hash.Value)
+		}
+	}
+	return n, err
+}
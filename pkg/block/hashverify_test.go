@@ -0,0 +1,107 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestHashVerifyingBucket(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bdir := filepath.Join(tmpDir, b1.String())
+	index, err := os.ReadFile(filepath.Join(bdir, IndexFilename))
+	testutil.Ok(t, err)
+
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, Upload(ctx, logger, bkt, bdir, metadata.SHA256Func))
+	m, err := DownloadMeta(ctx, logger, bkt, b1)
+	testutil.Ok(t, err)
+
+	readAll := func(bkt objstore.Bucket, name string) ([]byte, error) {
+		rc, err := bkt.Get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { testutil.Ok(t, rc.Close()) }()
+		return io.ReadAll(rc)
+	}
+
+	indexName := path.Join(b1.String(), IndexFilename)
+	t.Run("intact files are read", func(t *testing.T) {
+		b, err := readAll(NewHashVerifyingBucket(bkt, &m), indexName)
+		testutil.Ok(t, err)
+		testutil.Equals(t, index, b)
+
+		rc, err := NewHashVerifyingBucket(bkt, &m, WithStrictHashVerification()).GetRange(ctx, indexName, 0, -1)
+		testutil.Ok(t, err)
+		b, err = io.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, index, b)
+
+		// Files without hash are not verified.
+		_, err = readAll(NewHashVerifyingBucket(bkt, &m), path.Join(b1.String(), MetaFilename))
+		testutil.Ok(t, err)
+	})
+	t.Run("corrupted file fails", func(t *testing.T) {
+		corrupted := append([]byte{}, index...)
+		corrupted[len(corrupted)-1]++
+		testutil.Ok(t, bkt.Upload(ctx, indexName, bytes.NewReader(corrupted)))
+
+		_, err := readAll(NewHashVerifyingBucket(bkt, &m), indexName)
+		testutil.Assert(t, errors.Is(err, ErrCorruptedObject), "expected corrupted object, got %v", err)
+
+		// Range reads of the whole file are verified.
+		for _, length := range []int64{-1, int64(len(index)), int64(len(index)) + 1} {
+			rc, err := NewHashVerifyingBucket(bkt, &m, WithStrictHashVerification()).GetRange(ctx, indexName, 0, length)
+			testutil.Ok(t, err)
+			_, err = io.ReadAll(rc)
+			testutil.Assert(t, errors.Is(err, ErrCorruptedObject), "expected corrupted object for length %d, got %v", length, err)
+			testutil.Ok(t, rc.Close())
+		}
+
+		// Range reads of a part of the file are not verified.
+		rc, err := NewHashVerifyingBucket(bkt, &m).GetRange(ctx, indexName, 0, 10)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+	})
+	t.Run("range reads of hashed files fail in strict mode", func(t *testing.T) {
+		sbkt := NewHashVerifyingBucket(bkt, &m, WithStrictHashVerification())
+		_, err := sbkt.GetRange(ctx, indexName, 0, 10)
+		testutil.Assert(t, errors.Is(err, ErrUnverifiableRead), "expected unverifiable read, got %v", err)
+		_, err = sbkt.GetRange(ctx, indexName, 1, -1)
+		testutil.Assert(t, errors.Is(err, ErrUnverifiableRead), "expected unverifiable read, got %v", err)
+
+		// Files without hash can still be read with range reads.
+		rc, err := sbkt.GetRange(ctx, path.Join(b1.String(), MetaFilename), 0, 10)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+	})
+}
@@ -401,6 +401,71 @@ func GatherIndexHealthStats(ctx context.Context, logger log.Logger, fn string, m
 	return stats, nil
 }
 
+// ComputeIndexStats computes index stats of the block in blockDir from its index file, to be recorded in meta.
+// Sizes are approximated the same way as by GatherIndexHealthStats.
+func ComputeIndexStats(ctx context.Context, logger log.Logger, blockDir string) (metadata.IndexStats, error) {
+	stats, err := GatherIndexHealthStats(ctx, logger, filepath.Join(blockDir, IndexFilename), math.MinInt64, math.MaxInt64)
+	if err != nil {
+		return metadata.IndexStats{}, errors.Wrapf(err, "gather index stats of %s", blockDir)
+	}
+	return metadata.IndexStats{SeriesMaxSize: stats.SeriesMaxSize, ChunkMaxSize: stats.ChunkMaxSize}, nil
+}
+
+// ValidateTimeBounds checks that all chunks of the block in the given dir, as recorded in its index, are within the time
+// range declared in its meta. Meta MaxTime is exclusive, so chunks have to end before it. The returned error describes
+// by how much the chunks exceed the declared range.
+func ValidateTimeBounds(blockDir string) (err error) {
+	meta, err := metadata.ReadFromDir(blockDir)
+	if err != nil {
+		return errors.Wrap(err, "read meta")
+	}
+
+	r, err := index.NewFileReader(filepath.Join(blockDir, IndexFilename))
+	if err != nil {
+		return errors.Wrap(err, "open index file")
+	}
+	defer runutil.CloseWithErrCapture(&err, r, "validate time bounds index reader")
+
+	key, value := index.AllPostingsKey()
+	p, err := r.Postings(context.Background(), key, value)
+	if err != nil {
+		return errors.Wrap(err, "get all postings")
+	}
+	var (
+		builder    labels.ScratchBuilder
+		chks       []chunks.Meta
+		minT, maxT = int64(math.MaxInt64), int64(math.MinInt64)
+	)
+	for p.Next() {
+		if err := r.Series(p.At(), &builder, &chks); err != nil {
+			return errors.Wrap(err, "read series")
+		}
+		for _, c := range chks {
+			minT = min(minT, c.MinTime)
+			maxT = max(maxT, c.MaxTime)
+		}
+	}
+	if err := p.Err(); err != nil {
+		return errors.Wrap(err, "iterate postings")
+	}
+	if minT > maxT {
+		// No chunks, nothing can be outside.
+		return nil
+	}
+
+	var problems []string
+	if minT < meta.MinTime {
+		problems = append(problems, fmt.Sprintf("index min time %d is %s before meta min time %d", minT, time.Duration(meta.MinTime-minT)*time.Millisecond, meta.MinTime))
+	}
+	if maxT >= meta.MaxTime {
+		problems = append(problems, fmt.Sprintf("index max time %d is %s after meta max time %d (exclusive)", maxT, time.Duration(maxT-meta.MaxTime+1)*time.Millisecond, meta.MaxTime))
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("chunks of block %s outside of its time range: %s", meta.ULID, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
 type ignoreFnType func(mint, maxt int64, prev *chunks.Meta, curr *chunks.Meta) (bool, error)
 
 // Repair open the block with given id in dir and creates a new one with fixed data.
@@ -423,7 +488,7 @@ func Repair(ctx context.Context, logger log.Logger, dir string, id ulid.ULID, so
 	if err != nil {
 		return resid, errors.Wrap(err, "read meta file")
 	}
-	if meta.Thanos.Downsample.Resolution > 0 {
+	if meta.IsDownsampled() {
 		return resid, errors.New("cannot repair downsampled block")
 	}
 
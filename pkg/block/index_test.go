@@ -8,6 +8,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/go-kit/log"
@@ -15,6 +16,7 @@ import (
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/chunks"
 	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/thanos-io/objstore"
 
 	"github.com/efficientgo/core/testutil"
 
@@ -96,3 +98,83 @@ func TestGatherIndexHealthStatsReturnsOutOfOrderChunksErr(t *testing.T) {
 	testutil.Equals(t, 1, stats.OutOfOrderChunks)
 	testutil.NotOk(t, stats.OutOfOrderChunksErr())
 }
+
+func TestComputeIndexStats(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	// Known fixture.
+	health, err := GatherIndexHealthStats(ctx, logger, "testdata/out_of_order_chunks/index", math.MinInt64, math.MaxInt64)
+	testutil.Ok(t, err)
+	stats, err := ComputeIndexStats(ctx, logger, "testdata/out_of_order_chunks")
+	testutil.Ok(t, err)
+	testutil.Equals(t, metadata.IndexStats{SeriesMaxSize: health.SeriesMaxSize, ChunkMaxSize: health.ChunkMaxSize}, stats)
+
+	_, err = ComputeIndexStats(ctx, logger, "testdata/not-existing")
+	testutil.NotOk(t, err)
+
+	tmpDir := t.TempDir()
+	b, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2", "b", "long-value-making-series-entry-larger"),
+		labels.FromStrings("a", "3"),
+	}, 1000, 0, 10000, labels.FromStrings("ext1", "1"), 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bdir := filepath.Join(tmpDir, b.String())
+
+	meta, err := metadata.ReadFromDir(bdir)
+	testutil.Ok(t, err)
+	stats, err = ComputeIndexStats(ctx, logger, bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, meta.Thanos.IndexStats.SeriesMaxSize, stats.SeriesMaxSize)
+	testutil.Assert(t, stats.ChunkMaxSize > 0, "expected chunk size to be computed")
+
+	// Upload populates missing stats.
+	meta.Thanos.IndexStats = metadata.IndexStats{}
+	testutil.Ok(t, meta.WriteToDir(logger, bdir))
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, UploadWithOptions(ctx, logger, bkt, bdir, metadata.NoneFunc, WithIndexStats()))
+	uploaded, err := DownloadMeta(ctx, logger, bkt, b)
+	testutil.Ok(t, err)
+	testutil.Equals(t, stats, uploaded.Thanos.IndexStats)
+}
+
+func TestValidateTimeBounds(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	tmpDir := t.TempDir()
+	b, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+	}, 100, 0, 1000, labels.FromStrings("ext1", "1"), 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bdir := filepath.Join(tmpDir, b.String())
+	testutil.Ok(t, ValidateTimeBounds(bdir))
+
+	meta, err := metadata.ReadFromDir(bdir)
+	testutil.Ok(t, err)
+	orig := meta.BlockMeta
+
+	// Producer bug declaring too short time range.
+	meta.MaxTime = 500
+	testutil.Ok(t, meta.WriteToDir(logger, bdir))
+	err = ValidateTimeBounds(bdir)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "after meta max time 500"), "unexpected error: %v", err)
+
+	bkt := objstore.NewInMemBucket()
+	testutil.NotOk(t, UploadWithOptions(ctx, logger, bkt, bdir, metadata.NoneFunc, WithTimeBoundsValidation()))
+	testutil.Equals(t, 0, len(bkt.Objects()))
+
+	meta.BlockMeta = orig
+	meta.MinTime = 100
+	testutil.Ok(t, meta.WriteToDir(logger, bdir))
+	err = ValidateTimeBounds(bdir)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "before meta min time 100"), "unexpected error: %v", err)
+
+	meta.BlockMeta = orig
+	testutil.Ok(t, meta.WriteToDir(logger, bdir))
+	testutil.Ok(t, UploadWithOptions(ctx, logger, bkt, bdir, metadata.NoneFunc, WithTimeBoundsValidation()))
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/prometheus/prometheus/tsdb/fileutil"
 	"github.com/prometheus/prometheus/tsdb/index"
 	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/objstore/providers/filesystem"
 
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/runutil"
@@ -161,6 +162,21 @@ func WriteBinary(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID, f
 	return bw.Buffer(), nil
 }
 
+// WriteBinaryFromDir builds index header from the index of the block in the given local block directory and writes it
+// to the given file. It can be used as block.IndexHeaderWriter to upload index header with the block.
+func WriteBinaryFromDir(ctx context.Context, bdir, filename string) error {
+	id, err := ulid.Parse(filepath.Base(bdir))
+	if err != nil {
+		return errors.Wrapf(err, "not a block dir %s", bdir)
+	}
+	bkt, err := filesystem.NewBucket(filepath.Dir(bdir))
+	if err != nil {
+		return errors.Wrap(err, "create filesystem bucket")
+	}
+	_, err = WriteBinary(ctx, bkt, id, filename)
+	return err
+}
+
 type chunkedIndexReader struct {
 	ctx  context.Context
 	path string
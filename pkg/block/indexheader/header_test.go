@@ -625,3 +625,41 @@ func TestReaderPostingsOffsets(t *testing.T) {
 		require.Equal(t, rngs2, rngs, "Got mismatched results from batched and non-batched API.\nInput cluster labels: %v.\nValues queried: %v", clusterLbls, vals)
 	}
 }
+
+func TestUploadWithGeneratedIndexHeader(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	tmpDir := t.TempDir()
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+	}, 100, 0, 1000, labels.FromStrings("ext1", "1"), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, block.UploadWithOptions(ctx, logger, bkt, filepath.Join(tmpDir, id.String()), metadata.SHA256Func, block.WithGenerateIndexHeader(WriteBinaryFromDir)))
+
+	// Uploaded index-header is the same as built from the uploaded index.
+	expected, err := WriteBinary(ctx, bkt, id, "")
+	testutil.Ok(t, err)
+	testutil.Equals(t, expected, bkt.Objects()[filepath.Join(id.String(), block.IndexHeaderFilename)])
+
+	m, err := block.DownloadMeta(ctx, logger, bkt, id)
+	testutil.Ok(t, err)
+	var found bool
+	for _, f := range m.Thanos.Files {
+		if f.RelPath == block.IndexHeaderFilename {
+			found = true
+			testutil.Equals(t, int64(len(expected)), f.SizeBytes)
+			testutil.Assert(t, f.Hash != nil, "index-header should be hashed")
+		}
+	}
+	testutil.Assert(t, found, "index-header should be in meta files")
+
+	dst := filepath.Join(t.TempDir(), id.String())
+	testutil.Ok(t, block.DownloadWithOptions(ctx, logger, bkt, id, dst, block.WithIndexHeader()))
+	br, err := newFileBinaryReader(filepath.Join(dst, block.IndexHeaderFilename), 32, NewBinaryReaderMetrics(nil))
+	testutil.Ok(t, err)
+	testutil.Ok(t, br.Close())
+}
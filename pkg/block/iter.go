@@ -0,0 +1,210 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// iterBlocksInRangeSlack is how much earlier than the end of its data a block ID can be created, e.g. due to clock skew.
+const iterBlocksInRangeSlack = 2 * time.Hour
+
+// StartAfterBucket is an optional interface of buckets supporting listing of objects after the given name, e.g. using
+// StartAfter of S3 ListObjectsV2. IterBlocksInRange uses it to skip listing of blocks created before the range.
+// Providers of objstore don't implement it, so it has to be implemented by the caller's bucket.
+type StartAfterBucket interface {
+	// IterStartAfter works like Iter of the top level of the bucket, but calls f only for entries lexicographically
+	// after startAfter, without listing the others.
+	IterStartAfter(ctx context.Context, startAfter string, f func(string) error) error
+}
+
+// IterBlocksInRange calls f with meta of every block in the bucket which overlaps the given time range (in milliseconds,
+// inclusive). Blocks IDs are created not earlier than the data of the block ends, so blocks with IDs clearly older than
+// minTime are skipped without reading their meta.json. Meta of all remaining blocks is read to check the actual range,
+// as compacted blocks might contain data much older than their ID. Partial blocks are skipped.
+// NOTE: Only buckets implementing StartAfterBucket skip listing of older blocks. Others still list the whole bucket,
+// so for them only the cost of reading meta is cut, not the cost of listing.
+func IterBlocksInRange(ctx context.Context, logger log.Logger, bkt objstore.Bucket, minTime, maxTime int64, f func(metadata.Meta) error) error {
+	minIDTime := minTime - iterBlocksInRangeSlack.Milliseconds()
+	iterFn := func(name string) error {
+		id, ok := IsBlockDir(name)
+		if !ok || int64(id.Time()) < minIDTime {
+			return nil
+		}
+		m, err := DownloadMeta(ctx, logger, bkt, id)
+		if err != nil {
+			if bkt.IsObjNotFoundErr(errors.Cause(err)) {
+				return nil
+			}
+			return err
+		}
+		if m.MinTime > maxTime || m.MaxTime <= minTime {
+			return nil
+		}
+		return f(m)
+	}
+
+	sbkt, ok := bkt.(StartAfterBucket)
+	if !ok || minIDTime <= 0 {
+		return bkt.Iter(ctx, "", iterFn)
+	}
+	// IDs are lexicographically sorted by time, so the smallest ID of minIDTime precedes all blocks created since then.
+	startAfter, err := ulid.New(uint64(minIDTime), nil)
+	if err != nil {
+		return errors.Wrap(err, "create start after ID")
+	}
+	return sbkt.IterStartAfter(ctx, startAfter.String(), iterFn)
+}
+
+// MetaPredicate selects blocks by their meta.
+type MetaPredicate func(*metadata.Meta) bool
+
+// FilterBlocks returns IDs of blocks in the bucket whose meta satisfies the predicate, in order of iteration. Only meta
+// of blocks is read. Partial blocks are skipped.
+func FilterBlocks(ctx context.Context, logger log.Logger, bkt objstore.Bucket, pred MetaPredicate) ([]ulid.ULID, error) {
+	var res []ulid.ULID
+	if err := bkt.Iter(ctx, "", func(name string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		id, ok := IsBlockDir(name)
+		if !ok {
+			return nil
+		}
+		m, err := DownloadMeta(ctx, logger, bkt, id)
+		if err != nil {
+			if bkt.IsObjNotFoundErr(errors.Cause(err)) {
+				return nil
+			}
+			return err
+		}
+		if pred(&m) {
+			res = append(res, id)
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "iter bucket")
+	}
+	return res, nil
+}
+
+// FilterBlocksBySource returns IDs of blocks in the bucket uploaded by any of the given sources. See FilterBlocks.
+func FilterBlocksBySource(ctx context.Context, logger log.Logger, bkt objstore.Bucket, sources ...metadata.SourceType) ([]ulid.ULID, error) {
+	return FilterBlocks(ctx, logger, bkt, func(m *metadata.Meta) bool {
+		return slices.Contains(sources, m.Thanos.Source)
+	})
+}
+
+// GroupBlocksOption configures the provided params.
+type GroupBlocksOption func(params *groupBlocksParams)
+
+// groupBlocksParams holds the GroupBlocks() parameters.
+type groupBlocksParams struct {
+	resolutions []int64
+	sources     []metadata.SourceType
+}
+
+// WithGroupResolutions is an option to group only blocks with any of the given downsample resolutions.
+func WithGroupResolutions(resolutions ...int64) GroupBlocksOption {
+	return func(params *groupBlocksParams) {
+		params.resolutions = resolutions
+	}
+}
+
+// WithGroupSources is an option to group only blocks uploaded by any of the given sources.
+func WithGroupSources(sources ...metadata.SourceType) GroupBlocksOption {
+	return func(params *groupBlocksParams) {
+		params.sources = sources
+	}
+}
+
+// GroupBlocks returns IDs of blocks in the bucket by their compaction group key (see metadata.Thanos.GroupKey), in
+// order of iteration. Only the header of meta of blocks is read (see DownloadMetaHeader). Partial blocks are skipped.
+func GroupBlocks(ctx context.Context, logger log.Logger, bkt objstore.Bucket, options ...GroupBlocksOption) (map[string][]ulid.ULID, error) {
+	var opts groupBlocksParams
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	groups := map[string][]ulid.ULID{}
+	if err := bkt.Iter(ctx, "", func(name string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		id, ok := IsBlockDir(name)
+		if !ok {
+			return nil
+		}
+		h, err := DownloadMetaHeader(ctx, logger, bkt, id)
+		if err != nil {
+			if bkt.IsObjNotFoundErr(errors.Cause(err)) {
+				return nil
+			}
+			return err
+		}
+		if len(opts.resolutions) > 0 && !slices.Contains(opts.resolutions, h.Downsample.Resolution) {
+			return nil
+		}
+		if len(opts.sources) > 0 && !slices.Contains(opts.sources, h.Source) {
+			return nil
+		}
+		groupKey := h.GroupKey()
+		groups[groupKey] = append(groups[groupKey], id)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "iter bucket")
+	}
+	return groups, nil
+}
+
+// DetectDuplicateExternalLabels looks for blocks in the same compaction group (i.e. having the same external labels and
+// resolution) with overlapping time ranges, which usually means that multiple producers (e.g. two sidecars) are
+// configured with the same external labels, duplicating data. Only meta of blocks is read. It returns overlaps by
+// group key; partial blocks are skipped.
+// NOTE: Blocks which are being compacted also overlap with the result of compaction until they are deleted.
+func DetectDuplicateExternalLabels(ctx context.Context, logger log.Logger, bkt objstore.Bucket) (map[string]tsdb.Overlaps, error) {
+	groups := map[string][]tsdb.BlockMeta{}
+	if err := bkt.Iter(ctx, "", func(name string) error {
+		id, ok := IsBlockDir(name)
+		if !ok {
+			return nil
+		}
+		m, err := DownloadMeta(ctx, logger, bkt, id)
+		if err != nil {
+			if bkt.IsObjNotFoundErr(errors.Cause(err)) {
+				return nil
+			}
+			return err
+		}
+		groupKey := m.Thanos.GroupKey()
+		groups[groupKey] = append(groups[groupKey], m.BlockMeta)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "iter bucket")
+	}
+
+	overlaps := map[string]tsdb.Overlaps{}
+	for k, metas := range groups {
+		sort.Slice(metas, func(i, j int) bool {
+			return metas[i].MinTime < metas[j].MinTime
+		})
+		if o := tsdb.OverlappingBlocks(metas); len(o) > 0 {
+			overlaps[k] = o
+			level.Warn(logger).Log("msg", "found blocks with duplicated external labels overlapping in time", "group", k, "overlap", o)
+		}
+	}
+	return overlaps, nil
+}
@@ -0,0 +1,231 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+)
+
+func TestIterBlocksInRange(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.NewInMemBucket()
+
+	hour := time.Hour.Milliseconds()
+	uploadMeta := func(idTime, minTime, maxTime int64) ulid.ULID {
+		id := ulid.MustNew(uint64(idTime), rand.New(rand.NewSource(minTime)))
+		uploadTestMeta(t, bkt, id, minTime, maxTime, nil)
+		return id
+	}
+
+	// Block created long before the range is skipped without reading its meta.
+	uploadMeta(10*hour, 0, 10*hour)
+	inRange := uploadMeta(25*hour, 20*hour, 22*hour)
+	// Compacted block created after the range still has data within it.
+	compacted := uploadMeta(40*hour, 0, 24*hour)
+	uploadMeta(40*hour, 31*hour, 40*hour)
+	// Block created just before the range is read, but does not overlap.
+	uploadMeta(19*hour, 17*hour, 19*hour)
+	// Partial block.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ulid.MustNew(uint64(26*hour), nil).String(), IndexFilename), strings.NewReader("index")))
+
+	cBkt := &getCountingBucket{Bucket: bkt}
+	var ids []ulid.ULID
+	testutil.Ok(t, IterBlocksInRange(ctx, logger, cBkt, 20*hour, 30*hour, func(m metadata.Meta) error {
+		ids = append(ids, m.ULID)
+		return nil
+	}))
+	testutil.Equals(t, []ulid.ULID{inRange, compacted}, ids)
+	// Four metas and both meta files of the partial block.
+	testutil.Equals(t, int64(6), cBkt.gets.Load())
+
+	errStop := errors.New("stop")
+	testutil.Equals(t, errStop, IterBlocksInRange(ctx, logger, cBkt, 20*hour, 30*hour, func(metadata.Meta) error {
+		return errStop
+	}))
+
+	// Blocks created before the range are not even listed by buckets supporting it.
+	sBkt := &startAfterBucket{Bucket: bkt}
+	ids = nil
+	testutil.Ok(t, IterBlocksInRange(ctx, logger, sBkt, 20*hour, 30*hour, func(m metadata.Meta) error {
+		ids = append(ids, m.ULID)
+		return nil
+	}))
+	testutil.Equals(t, []ulid.ULID{inRange, compacted}, ids)
+	// Block created just before the range, in range, partial and both created after the range.
+	testutil.Equals(t, 5, sBkt.listed)
+}
+
+// startAfterBucket is StartAfterBucket which counts listed entries.
+type startAfterBucket struct {
+	objstore.Bucket
+
+	listed int
+}
+
+func (b *startAfterBucket) IterStartAfter(ctx context.Context, startAfter string, f func(string) error) error {
+	return b.Iter(ctx, "", func(name string) error {
+		if name <= startAfter {
+			return nil
+		}
+		b.listed++
+		return f(name)
+	})
+}
+
+func uploadTestMeta(t testing.TB, bkt objstore.Bucket, id ulid.ULID, minTime, maxTime int64, lset map[string]string) {
+	m := metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{ULID: id, MinTime: minTime, MaxTime: maxTime, Version: metadata.TSDBVersion1},
+		Thanos:    metadata.Thanos{Version: metadata.ThanosVersion1, Labels: lset},
+	}
+	var buf bytes.Buffer
+	testutil.Ok(t, m.Write(&buf))
+	testutil.Ok(t, bkt.Upload(context.Background(), path.Join(id.String(), MetaFilename), &buf))
+}
+
+func TestDetectDuplicateExternalLabels(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.NewInMemBucket()
+
+	replica := map[string]string{"cluster": "a"}
+	uploadTestMeta(t, bkt, ulid.MustNew(1, nil), 0, 100, replica)
+	uploadTestMeta(t, bkt, ulid.MustNew(2, nil), 100, 200, replica)
+	// Other producer with different labels.
+	uploadTestMeta(t, bkt, ulid.MustNew(3, nil), 0, 200, map[string]string{"cluster": "b"})
+	// Partial block.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ulid.MustNew(4, nil).String(), IndexFilename), strings.NewReader("index")))
+
+	overlaps, err := DetectDuplicateExternalLabels(ctx, logger, bkt)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(overlaps))
+
+	// Another producer with the same labels.
+	uploadTestMeta(t, bkt, ulid.MustNew(5, nil), 50, 150, replica)
+	overlaps, err = DetectDuplicateExternalLabels(ctx, logger, bkt)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(overlaps))
+
+	groupKey := (&metadata.Thanos{Labels: replica}).GroupKey()
+	testutil.Equals(t, 2, len(overlaps[groupKey]))
+	for _, metas := range overlaps[groupKey] {
+		testutil.Equals(t, 2, len(metas))
+	}
+}
+
+func TestFilterBlocks(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.NewInMemBucket()
+
+	for i, source := range []metadata.SourceType{metadata.ReceiveSource, metadata.SidecarSource, metadata.ReceiveSource, metadata.CompactorSource} {
+		id := ulid.MustNew(uint64(i+1), nil)
+		uploadTestMeta(t, bkt, id, int64(i)*100, int64(i+1)*100, map[string]string{"a": "1"})
+		testutil.Ok(t, UpdateMeta(ctx, bkt, id, func(m *metadata.Meta) error {
+			m.Thanos.Source = source
+			return nil
+		}))
+	}
+	// Partial block.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ulid.MustNew(5, nil).String(), IndexFilename), strings.NewReader("index")))
+
+	ids, err := FilterBlocksBySource(ctx, logger, bkt, metadata.ReceiveSource)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{ulid.MustNew(1, nil), ulid.MustNew(3, nil)}, ids)
+
+	ids, err = FilterBlocksBySource(ctx, logger, bkt, metadata.SidecarSource, metadata.CompactorSource)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{ulid.MustNew(2, nil), ulid.MustNew(4, nil)}, ids)
+
+	ids, err = FilterBlocksBySource(ctx, logger, bkt)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(ids))
+
+	ids, err = FilterBlocks(ctx, logger, bkt, func(m *metadata.Meta) bool { return m.MinTime >= 200 })
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{ulid.MustNew(3, nil), ulid.MustNew(4, nil)}, ids)
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = FilterBlocks(cctx, logger, bkt, func(*metadata.Meta) bool { return true })
+	testutil.NotOk(t, err)
+}
+
+func TestGroupBlocks(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.NewInMemBucket()
+
+	for i, b := range []struct {
+		lset       map[string]string
+		resolution int64
+		source     metadata.SourceType
+	}{
+		{lset: map[string]string{"a": "1"}, source: metadata.ReceiveSource},
+		{lset: map[string]string{"a": "2"}, source: metadata.ReceiveSource},
+		{lset: map[string]string{"a": "1"}, resolution: int64(metadata.ResolutionLevel5m), source: metadata.CompactorSource},
+		{lset: map[string]string{"a": "1"}, source: metadata.CompactorSource},
+	} {
+		id := ulid.MustNew(uint64(i+1), nil)
+		uploadTestMeta(t, bkt, id, 0, 100, b.lset)
+		testutil.Ok(t, UpdateMeta(ctx, bkt, id, func(m *metadata.Meta) error {
+			m.Thanos.Downsample.Resolution = b.resolution
+			m.Thanos.Source = b.source
+			return nil
+		}))
+	}
+	// Partial block.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ulid.MustNew(5, nil).String(), IndexFilename), strings.NewReader("index")))
+
+	raw1 := metadata.GroupKeyFor(0, labels.FromStrings("a", "1"))
+	raw2 := metadata.GroupKeyFor(0, labels.FromStrings("a", "2"))
+	res5m := metadata.GroupKeyFor(int64(metadata.ResolutionLevel5m), labels.FromStrings("a", "1"))
+
+	groups, err := GroupBlocks(ctx, logger, bkt)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string][]ulid.ULID{
+		raw1:  {ulid.MustNew(1, nil), ulid.MustNew(4, nil)},
+		raw2:  {ulid.MustNew(2, nil)},
+		res5m: {ulid.MustNew(3, nil)},
+	}, groups)
+
+	groups, err = GroupBlocks(ctx, logger, bkt, WithGroupResolutions(int64(metadata.ResolutionLevelRaw)))
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string][]ulid.ULID{
+		raw1: {ulid.MustNew(1, nil), ulid.MustNew(4, nil)},
+		raw2: {ulid.MustNew(2, nil)},
+	}, groups)
+
+	groups, err = GroupBlocks(ctx, logger, bkt, WithGroupSources(metadata.CompactorSource))
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string][]ulid.ULID{
+		raw1:  {ulid.MustNew(4, nil)},
+		res5m: {ulid.MustNew(3, nil)},
+	}, groups)
+}
@@ -0,0 +1,134 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// VerificationManifestFilename is the name of the file in the local block directory written by Download with
+// WithEmitVerificationManifest.
+const VerificationManifestFilename = ".verified.json"
+
+// VerificationManifest is the content of VerificationManifestFilename.
+type VerificationManifest struct {
+	// Files lists files of the local block directory with their size and hash, sorted by relative path.
+	Files []metadata.File `json:"files"`
+}
+
+// ReadVerificationManifest reads VerificationManifestFilename from the given local block directory.
+func ReadVerificationManifest(dir string) (*VerificationManifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, VerificationManifestFilename))
+	if err != nil {
+		return nil, errors.Wrap(err, "read verification manifest")
+	}
+	var m VerificationManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.Wrap(err, "parse verification manifest")
+	}
+	return &m, nil
+}
+
+// verificationManifest collects sizes and hashes of local block files for VerificationManifestFilename.
+// Nil manifest collects nothing.
+type verificationManifest struct {
+	logger log.Logger
+	dir    string
+
+	mtx   sync.Mutex
+	files map[string]metadata.File
+}
+
+func newVerificationManifest(logger log.Logger, dir string) *verificationManifest {
+	return &verificationManifest{
+		logger: logger,
+		dir:    dir,
+		files:  map[string]metadata.File{},
+	}
+}
+
+// add records the local file with the given relative path. If h is nil, the file is hashed, otherwise h has to be
+// the hash of the local file.
+func (m *verificationManifest) add(ctx context.Context, relPath string, h *metadata.ObjectHash) error {
+	if m == nil {
+		return nil
+	}
+	p := filepath.Join(m.dir, filepath.FromSlash(relPath))
+	fi, err := os.Stat(p)
+	if err != nil {
+		return errors.Wrapf(err, "stat %s", p)
+	}
+	if h == nil || h.Func == metadata.NoneFunc {
+		calculated, err := metadata.CalculateHashWithContext(ctx, p, metadata.SHA256Func, m.logger)
+		if err != nil {
+			return errors.Wrapf(err, "calculate hash of %s", relPath)
+		}
+		h = &calculated
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.files[relPath] = metadata.File{RelPath: relPath, SizeBytes: fi.Size(), Hash: h}
+	return nil
+}
+
+func (m *verificationManifest) recorded(relPath string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	_, ok := m.files[relPath]
+	return ok
+}
+
+// write records the given files not recorded yet, hashing up to concurrency of them in parallel, and writes the manifest.
+// Files missing in the local block directory are not recorded.
+func (m *verificationManifest) write(ctx context.Context, relPaths []string, concurrency int) error {
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for _, relPath := range relPaths {
+		if m.recorded(relPath) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(m.dir, filepath.FromSlash(relPath))); os.IsNotExist(err) {
+			continue
+		}
+		relPath := relPath
+		g.Go(func() error {
+			return m.add(gctx, relPath, nil)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	out := VerificationManifest{Files: make([]metadata.File, 0, len(m.files))}
+	for _, f := range m.files {
+		out.Files = append(out.Files, f)
+	}
+	sort.Slice(out.Files, func(i, j int) bool {
+		return out.Files[i].RelPath < out.Files[j].RelPath
+	})
+	b, err := json.MarshalIndent(out, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "encode verification manifest")
+	}
+	// Make the manifest appear atomically.
+	manifestFile := filepath.Join(m.dir, VerificationManifestFilename)
+	tmp := manifestFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, "write verification manifest")
+	}
+	return errors.Wrap(os.Rename(tmp, manifestFile), "rename verification manifest")
+}
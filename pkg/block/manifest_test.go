@@ -0,0 +1,82 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestDownloadWithVerificationManifest(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, Upload(ctx, logger, bkt, filepath.Join(tmpDir, b1.String()), metadata.SHA256Func))
+
+	expectManifest := func(t *testing.T, dir string) *VerificationManifest {
+		m, err := ReadVerificationManifest(dir)
+		testutil.Ok(t, err)
+
+		var relPaths []string
+		for _, f := range m.Files {
+			relPaths = append(relPaths, f.RelPath)
+			p := filepath.Join(dir, filepath.FromSlash(f.RelPath))
+			fi, err := os.Stat(p)
+			testutil.Ok(t, err)
+			testutil.Equals(t, fi.Size(), f.SizeBytes)
+			h, err := metadata.CalculateHash(p, metadata.SHA256Func, logger)
+			testutil.Ok(t, err)
+			testutil.Equals(t, &h, f.Hash)
+		}
+		testutil.Equals(t, []string{"chunks/000001", IndexFilename, MetaFilename}, relPaths)
+		return m
+	}
+
+	dst := filepath.Join(t.TempDir(), b1.String())
+	testutil.Ok(t, DownloadWithOptions(ctx, logger, bkt, b1, dst, WithEmitVerificationManifest()))
+	first := expectManifest(t, dst)
+
+	// Files matching meta are not downloaded again, but still recorded.
+	testutil.Ok(t, DownloadWithOptions(ctx, logger, bkt, b1, dst, WithEmitVerificationManifest(), WithDownloadVerification()))
+	testutil.Equals(t, first, expectManifest(t, dst))
+
+	// Manifest of previous download is removed.
+	testutil.Ok(t, os.Remove(filepath.Join(dst, IndexFilename)))
+	testutil.Ok(t, bkt.Delete(ctx, filepath.Join(b1.String(), MetaFilename)))
+	testutil.NotOk(t, DownloadWithOptions(ctx, logger, bkt, b1, dst, WithEmitVerificationManifest()))
+	_, err = os.Stat(filepath.Join(dst, VerificationManifestFilename))
+	testutil.Assert(t, os.IsNotExist(err), "stale manifest should be removed")
+
+	// Manifest is not written by default.
+	dst = filepath.Join(t.TempDir(), b1.String())
+	bkt = objstore.NewInMemBucket()
+	testutil.Ok(t, Upload(ctx, logger, bkt, filepath.Join(tmpDir, b1.String()), metadata.NoneFunc))
+	testutil.Ok(t, Download(ctx, logger, bkt, b1, dst))
+	_, err = os.Stat(filepath.Join(dst, VerificationManifestFilename))
+	testutil.Assert(t, os.IsNotExist(err), "manifest should not be written")
+
+	// Files without hash in meta are hashed.
+	testutil.Ok(t, DownloadWithOptions(ctx, logger, bkt, b1, dst, WithEmitVerificationManifest()))
+	expectManifest(t, dst)
+}
@@ -0,0 +1,199 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// MarkIndexDirname is the directory in the bucket holding the mark indexes.
+	MarkIndexDirname = "markers"
+	// MarkIndexVersion1 is the version of mark index file supported by Thanos.
+	MarkIndexVersion1 = 1
+)
+
+// MarkIndex lists blocks carrying a certain mark. It's stored in MarkIndexDirname and allows to find candidate
+// blocks in a single request, instead of probing every block.
+// NOTE: Mark files in block directories are the source of truth. Index is only a hint, which can be out of date
+// and can be rebuilt anytime with RebuildMarkIndex, so it can't tell whether a block is marked. Index is updated only
+// if asked to (e.g. with WithDeletionMarkIndex), after the mark file, so a failure in between leaves it out of date.
+// If the bucket implements ConditionalBucket, concurrent updates of the index (e.g. from two compactors) are detected
+// and retried. With other buckets, which are all buckets shipped with objstore, updates are best-effort
+// read-modify-writes which can lose each other's changes.
+type MarkIndex struct {
+	// Version of the file.
+	Version int `json:"version"`
+	// IDs of marked blocks, sorted.
+	IDs []ulid.ULID `json:"ids"`
+}
+
+// MarkIndexPath returns the path in the bucket of the index of the given mark file.
+func MarkIndexPath(markFilename string) string {
+	return path.Join(MarkIndexDirname, markFilename)
+}
+
+// ReadMarkIndex reads the index of the given mark file from the bucket.
+// It returns metadata.ErrorMarkerNotFound if the index does not exist.
+// NOTE: Index is a hint (see MarkIndex). Callers have to check the mark file of listed blocks before acting on it,
+// e.g. deleting the block, and reconcile the index with RebuildMarkIndex from time to time, as marked blocks may be
+// missing from it.
+func ReadMarkIndex(ctx context.Context, logger log.Logger, bkt objstore.InstrumentedBucketReader, markFilename string) (MarkIndex, error) {
+	indexFile := MarkIndexPath(markFilename)
+	r, err := bkt.ReaderWithExpectedErrs(bkt.IsObjNotFoundErr).Get(ctx, indexFile)
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return MarkIndex{}, metadata.ErrorMarkerNotFound
+		}
+		return MarkIndex{}, errors.Wrapf(err, "get file: %s", indexFile)
+	}
+	defer runutil.CloseWithLogOnErr(logger, r, "close bkt mark index reader")
+
+	return decodeMarkIndex(r, indexFile)
+}
+
+func decodeMarkIndex(r io.Reader, indexFile string) (MarkIndex, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return MarkIndex{}, errors.Wrapf(err, "read file: %s", indexFile)
+	}
+	var idx MarkIndex
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return MarkIndex{}, errors.Wrapf(metadata.ErrorUnmarshalMarker, "file: %s; err: %v", indexFile, err.Error())
+	}
+	if idx.Version != MarkIndexVersion1 {
+		return MarkIndex{}, errors.Errorf("unexpected mark index file version %d, expected %d", idx.Version, MarkIndexVersion1)
+	}
+	return idx, nil
+}
+
+// RebuildMarkIndex rebuilds the index of the given mark file from mark files found in block directories.
+func RebuildMarkIndex(ctx context.Context, bkt objstore.Bucket, markFilename string) error {
+	ids, err := ListMarkedBlocks(ctx, bkt, markFilename)
+	if err != nil {
+		return err
+	}
+	return writeMarkIndex(ctx, bkt, markFilename, MarkIndex{Version: MarkIndexVersion1, IDs: ids})
+}
+
+// updateMarkIndex adds blocks mapped to true to and removes blocks mapped to false from the index of the given mark
+// file, in a single read-modify-write. Missing index is created when adding blocks; there is nothing to remove from
+// a missing index. If the bucket implements ConditionalBucket, the index is written only if it wasn't modified since
+// it was read, retrying like UpdateMeta otherwise.
+func updateMarkIndex(ctx context.Context, logger log.Logger, bkt objstore.Bucket, markFilename string, marked map[ulid.ULID]bool) error {
+	cbkt, ok := bkt.(ConditionalBucket)
+	if !ok {
+		idx, err := ReadMarkIndex(ctx, logger, objstore.WithNoopInstr(bkt), markFilename)
+		if err != nil && err != metadata.ErrorMarkerNotFound {
+			return err
+		}
+		if !applyMarkIndexUpdate(&idx, marked) {
+			// Index is up to date.
+			return nil
+		}
+		return writeMarkIndex(ctx, bkt, markFilename, idx)
+	}
+
+	indexFile := MarkIndexPath(markFilename)
+	for attempt := 1; ; attempt++ {
+		idx, version, err := readConditionalMarkIndex(ctx, logger, bkt, cbkt, markFilename)
+		if err != nil {
+			return err
+		}
+		if !applyMarkIndexUpdate(&idx, marked) {
+			return nil
+		}
+		b, err := encodeMarkIndex(idx)
+		if err != nil {
+			return err
+		}
+		err = cbkt.UploadIfVersion(ctx, indexFile, bytes.NewReader(b), version)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrVersionConflict) || attempt >= conditionalUpdateAttempts {
+			return errors.Wrapf(err, "upload file %s to bucket", indexFile)
+		}
+	}
+}
+
+// readConditionalMarkIndex is ReadMarkIndex of ConditionalBucket, returning also the version of the index object.
+// Missing index is returned empty, with an empty version.
+func readConditionalMarkIndex(ctx context.Context, logger log.Logger, bkt objstore.Bucket, cbkt ConditionalBucket, markFilename string) (MarkIndex, string, error) {
+	indexFile := MarkIndexPath(markFilename)
+	r, version, err := cbkt.GetWithVersion(ctx, indexFile)
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return MarkIndex{}, "", nil
+		}
+		return MarkIndex{}, "", errors.Wrapf(err, "get file: %s", indexFile)
+	}
+	defer runutil.CloseWithLogOnErr(logger, r, "close bkt mark index reader")
+
+	idx, err := decodeMarkIndex(r, indexFile)
+	if err != nil {
+		return MarkIndex{}, "", err
+	}
+	return idx, version, nil
+}
+
+// applyMarkIndexUpdate adds blocks mapped to true to and removes blocks mapped to false from idx. It returns true
+// if idx changed.
+func applyMarkIndexUpdate(idx *MarkIndex, marked map[ulid.ULID]bool) bool {
+	idx.Version = MarkIndexVersion1
+
+	changed := false
+	for id, m := range marked {
+		i := sort.Search(len(idx.IDs), func(i int) bool { return idx.IDs[i].Compare(id) >= 0 })
+		found := i < len(idx.IDs) && idx.IDs[i] == id
+		switch {
+		case m && !found:
+			idx.IDs = append(idx.IDs, ulid.ULID{})
+			copy(idx.IDs[i+1:], idx.IDs[i:])
+			idx.IDs[i] = id
+		case !m && found:
+			idx.IDs = append(idx.IDs[:i], idx.IDs[i+1:]...)
+		default:
+			continue
+		}
+		changed = true
+	}
+	return changed
+}
+
+func encodeMarkIndex(idx MarkIndex) ([]byte, error) {
+	if idx.IDs == nil {
+		idx.IDs = []ulid.ULID{}
+	}
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return nil, errors.Wrap(err, "json encode mark index")
+	}
+	return b, nil
+}
+
+func writeMarkIndex(ctx context.Context, bkt objstore.Bucket, markFilename string, idx MarkIndex) error {
+	b, err := encodeMarkIndex(idx)
+	if err != nil {
+		return err
+	}
+	indexFile := MarkIndexPath(markFilename)
+	if err := bkt.Upload(ctx, indexFile, bytes.NewReader(b)); err != nil {
+		return errors.Wrapf(err, "upload file %s to bucket", indexFile)
+	}
+	return nil
+}
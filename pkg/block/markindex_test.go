@@ -0,0 +1,137 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+)
+
+func TestMarkIndex(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.NewInMemBucket()
+	ibkt := objstore.WithNoopInstr(bkt)
+
+	id1 := ulid.MustNew(1, nil)
+	id2 := ulid.MustNew(2, nil)
+	id3 := ulid.MustNew(3, nil)
+
+	_, err := ReadMarkIndex(ctx, logger, ibkt, metadata.DeletionMarkFilename)
+	testutil.Equals(t, metadata.ErrorMarkerNotFound, err)
+
+	marked := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	removed := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+
+	// Marking without the option leaves the index untouched.
+	testutil.Ok(t, MarkForDeletion(ctx, logger, bkt, id2, "", marked))
+	_, err = ReadMarkIndex(ctx, logger, ibkt, metadata.DeletionMarkFilename)
+	testutil.Equals(t, metadata.ErrorMarkerNotFound, err)
+
+	testutil.Ok(t, MarkForDeletion(ctx, logger, bkt, id3, "", marked, WithDeletionMarkIndex()))
+	testutil.Ok(t, MarkForDeletion(ctx, logger, bkt, id1, "", marked, WithDeletionMarkIndex()))
+	// Already marked block is added to the index too.
+	testutil.Ok(t, MarkForDeletion(ctx, logger, bkt, id2, "", marked, WithDeletionMarkIndex()))
+
+	idx, err := ReadMarkIndex(ctx, logger, ibkt, metadata.DeletionMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, MarkIndexVersion1, idx.Version)
+	testutil.Equals(t, []ulid.ULID{id1, id2, id3}, idx.IDs)
+
+	// Per-block marks are not affected by the index.
+	ids, err := ListMarkedBlocks(ctx, bkt, metadata.DeletionMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{id1, id2, id3}, ids)
+
+	testutil.Ok(t, RemoveMark(ctx, logger, bkt, id2, removed, metadata.DeletionMarkFilename, WithRemoveMarkIndex()))
+	idx, err = ReadMarkIndex(ctx, logger, ibkt, metadata.DeletionMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{id1, id3}, idx.IDs)
+
+	// Out of date index is fixed by rebuilding it.
+	testutil.Ok(t, RemoveMark(ctx, logger, bkt, id3, removed, metadata.DeletionMarkFilename))
+	idx, err = ReadMarkIndex(ctx, logger, ibkt, metadata.DeletionMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{id1, id3}, idx.IDs)
+
+	testutil.Ok(t, RebuildMarkIndex(ctx, bkt, metadata.DeletionMarkFilename))
+	idx, err = ReadMarkIndex(ctx, logger, ibkt, metadata.DeletionMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{id1}, idx.IDs)
+
+	// Deleting without the option leaves the index untouched.
+	testutil.Ok(t, MarkForDeletion(ctx, logger, bkt, id3, "", marked, WithDeletionMarkIndex()))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id3.String(), IndexFilename), strings.NewReader("index")))
+	testutil.Ok(t, Delete(ctx, logger, bkt, id3))
+	idx, err = ReadMarkIndex(ctx, logger, ibkt, metadata.DeletionMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{id1, id3}, idx.IDs)
+
+	// Deleted blocks are removed from the index.
+	testutil.Ok(t, MarkForDeletion(ctx, logger, bkt, id2, "", marked, WithDeletionMarkIndex()))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id2.String(), IndexFilename), strings.NewReader("index")))
+	testutil.Ok(t, Delete(ctx, logger, bkt, id2, WithDeleteMarkIndex()))
+	idx, err = ReadMarkIndex(ctx, logger, ibkt, metadata.DeletionMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{id1, id3}, idx.IDs)
+
+	// Blocks deleted together are removed from the index in one update.
+	testutil.Ok(t, MarkForDeletion(ctx, logger, bkt, id2, "", marked, WithDeletionMarkIndex()))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id2.String(), IndexFilename), strings.NewReader("index")))
+	testutil.Equals(t, 0, len(DeleteMany(ctx, logger, bkt, []ulid.ULID{id2, id3}, 2, WithDeleteMarkIndex())))
+	idx, err = ReadMarkIndex(ctx, logger, ibkt, metadata.DeletionMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{id1}, idx.IDs)
+
+	// Removing mark from the last block leaves an empty index behind.
+	testutil.Ok(t, RemoveMark(ctx, logger, bkt, id1, removed, metadata.DeletionMarkFilename, WithRemoveMarkIndex()))
+	idx, err = ReadMarkIndex(ctx, logger, ibkt, metadata.DeletionMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(idx.IDs))
+
+	// Indexes of other marks are separate.
+	_, err = ReadMarkIndex(ctx, logger, ibkt, metadata.NoCompactMarkFilename)
+	testutil.Equals(t, metadata.ErrorMarkerNotFound, err)
+}
+
+func TestMarkIndexConditional(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	marked := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+
+	id1 := ulid.MustNew(1, nil)
+	id2 := ulid.MustNew(2, nil)
+
+	// Index is updated concurrently, between read and write of the update of id1.
+	bkt := newConditionalBucket()
+	concurrent := true
+	bkt.beforeUpload = func() {
+		if !concurrent {
+			return
+		}
+		concurrent = false
+		testutil.Ok(t, updateMarkIndex(ctx, logger, bkt, metadata.DeletionMarkFilename, map[ulid.ULID]bool{id2: true}))
+	}
+	testutil.Ok(t, MarkForDeletion(ctx, logger, bkt, id1, "", marked, WithDeletionMarkIndex()))
+
+	idx, err := ReadMarkIndex(ctx, logger, objstore.WithNoopInstr(bkt), metadata.DeletionMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{id1, id2}, idx.IDs)
+}
@@ -0,0 +1,574 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/objstore"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/errutil"
+)
+
+// MarkForDeletionOption configures the provided params.
+type MarkForDeletionOption func(params *markForDeletionParams)
+
+// markForDeletionParams holds the MarkForDeletion() parameters.
+type markForDeletionParams struct {
+	retentionDelay      time.Duration
+	forceOverwrite      bool
+	refreshDeletionTime bool
+	updateIndex         bool
+	annotations         map[string]string
+	forceFrozen         bool
+	retries             *RetryPolicy
+	retryMetrics        *RetryMetrics
+}
+
+// WithRetentionDelay is an option to set the grace period after which the block marked for deletion can be deleted.
+func WithRetentionDelay(delay time.Duration) MarkForDeletionOption {
+	return func(params *markForDeletionParams) {
+		params.retentionDelay = delay
+	}
+}
+
+// WithForceOverwrite is an option to rewrite the deletion mark if the block is already marked for deletion.
+// Details and retention delay are updated, while DeletionTime of the existing mark is preserved unless refreshDeletionTime is true.
+func WithForceOverwrite(refreshDeletionTime bool) MarkForDeletionOption {
+	return func(params *markForDeletionParams) {
+		params.forceOverwrite = true
+		params.refreshDeletionTime = refreshDeletionTime
+	}
+}
+
+// WithDeletionMarkIndex is an option to also add the block to the deletion mark index (see MarkIndex).
+// The index is updated after the deletion mark is uploaded, also when the block was already marked.
+func WithDeletionMarkIndex() MarkForDeletionOption {
+	return func(params *markForDeletionParams) {
+		params.updateIndex = true
+	}
+}
+
+// WithDeletionAnnotations is an option to attach machine-readable key-value details to the deletion mark
+// (see metadata.DeletionMark.Annotations), next to the human readable details.
+func WithDeletionAnnotations(annotations map[string]string) MarkForDeletionOption {
+	return func(params *markForDeletionParams) {
+		params.annotations = make(map[string]string, len(annotations))
+		for k, v := range annotations {
+			params.annotations[k] = v
+		}
+	}
+}
+
+// WithForceMarkFrozen is an option to mark the block for deletion even if it's frozen (see MarkFrozen).
+func WithForceMarkFrozen() MarkForDeletionOption {
+	return func(params *markForDeletionParams) {
+		params.forceFrozen = true
+	}
+}
+
+// WithDeletionMarkRetries is an option to retry failed bucket operations of MarkForDeletion according to the given
+// policy. Metrics are optional.
+func WithDeletionMarkRetries(policy RetryPolicy, metrics *RetryMetrics) MarkForDeletionOption {
+	return func(params *markForDeletionParams) {
+		params.retries = &policy
+		params.retryMetrics = metrics
+	}
+}
+
+// MarkForDeletion creates a file which stores information about when the block was marked for deletion.
+// If the file already exists, it's left untouched unless WithForceOverwrite option is passed.
+// Frozen blocks (see MarkFrozen) are refused with ErrBlockFrozen unless WithForceMarkFrozen option is passed.
+func MarkForDeletion(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, details string, markedForDeletion prometheus.Counter, options ...MarkForDeletionOption) error {
+	var opts markForDeletionParams
+	for _, opt := range options {
+		opt(&opts)
+	}
+	bkt = withRetries(bkt, opts.retries, opts.retryMetrics)
+	if !opts.forceFrozen {
+		if err := checkNotFrozen(ctx, bkt, id); err != nil {
+			return err
+		}
+	}
+
+	deletionMarkFile := path.Join(id.String(), metadata.DeletionMarkFilename)
+	deletionMarkExists, err := bkt.Exists(ctx, deletionMarkFile)
+	if err != nil {
+		return errors.Wrapf(err, "check exists %s in bucket", deletionMarkFile)
+	}
+	if deletionMarkExists && !opts.forceOverwrite {
+		level.Warn(logger).Log("msg", "requested to mark for deletion, but file already exists; this should not happen; investigate", "err", errors.Errorf("file %s already exists in bucket", deletionMarkFile))
+		if opts.updateIndex {
+			return updateMarkIndex(ctx, logger, bkt, metadata.DeletionMarkFilename, map[ulid.ULID]bool{id: true})
+		}
+		return nil
+	}
+
+	mark := metadata.DeletionMark{
+		ID:             id,
+		DeletionTime:   time.Now().Unix(),
+		Version:        metadata.DeletionMarkVersion1,
+		Details:        details,
+		RetentionDelay: int64(opts.retentionDelay / time.Second),
+		Annotations:    opts.annotations,
+	}
+	if deletionMarkExists && !opts.refreshDeletionTime {
+		var prev metadata.DeletionMark
+		if err := metadata.ReadMarker(ctx, logger, objstore.WithNoopInstr(bkt), id.String(), &prev); err != nil {
+			return errors.Wrapf(err, "read existing %s", deletionMarkFile)
+		}
+		mark.DeletionTime = prev.DeletionTime
+	}
+
+	deletionMark, err := json.Marshal(mark)
+	if err != nil {
+		return errors.Wrap(err, "json encode deletion mark")
+	}
+
+	if err := bkt.Upload(ctx, deletionMarkFile, bytes.NewReader(deletionMark)); err != nil {
+		return errors.Wrapf(err, "upload file %s to bucket", deletionMarkFile)
+	}
+	if opts.updateIndex {
+		if err := updateMarkIndex(ctx, logger, bkt, metadata.DeletionMarkFilename, map[ulid.ULID]bool{id: true}); err != nil {
+			return errors.Wrap(err, "update deletion mark index")
+		}
+	}
+	if deletionMarkExists {
+		level.Info(logger).Log("msg", "deletion mark of the block has been overwritten", "block", id)
+		return nil
+	}
+	markedForDeletion.Inc()
+	level.Info(logger).Log("msg", "block has been marked for deletion", "block", id)
+	return nil
+}
+
+// MarkManyForDeletion works like MarkForDeletion for many blocks, marking up to concurrency blocks in parallel.
+// It returns errors of blocks which failed to be marked, by block ID.
+func MarkManyForDeletion(ctx context.Context, logger log.Logger, bkt objstore.Bucket, ids []ulid.ULID, concurrency int, details string, markedForDeletion prometheus.Counter) map[ulid.ULID]error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mtx  sync.Mutex
+		errs = map[ulid.ULID]error{}
+		g    errgroup.Group
+	)
+	g.SetLimit(concurrency)
+	for _, id := range ids {
+		id := id
+		g.Go(func() error {
+			if err := MarkForDeletion(ctx, logger, bkt, id, details, markedForDeletion); err != nil {
+				mtx.Lock()
+				errs[id] = err
+				mtx.Unlock()
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return errs
+}
+
+// MarkForNoCompactOption configures the provided params.
+type MarkForNoCompactOption func(params *markForNoCompactParams)
+
+// markForNoCompactParams holds the MarkForNoCompact() parameters.
+type markForNoCompactParams struct {
+	expiry            time.Duration
+	allowCustomReason bool
+	retries           *RetryPolicy
+	retryMetrics      *RetryMetrics
+}
+
+// AllowCustomNoCompactReason is an option to accept a reason which is not one of metadata.NoCompactReasons.
+func AllowCustomNoCompactReason() MarkForNoCompactOption {
+	return func(params *markForNoCompactParams) {
+		params.allowCustomReason = true
+	}
+}
+
+// WithNoCompactExpiry is an option to make the no-compact mark expire after the given duration (see
+// metadata.IsNoCompactActive). Expired marks are ignored by the compactor and can be removed by SweepExpiredMarks.
+func WithNoCompactExpiry(expiry time.Duration) MarkForNoCompactOption {
+	return func(params *markForNoCompactParams) {
+		params.expiry = expiry
+	}
+}
+
+// WithNoCompactMarkRetries is an option to retry failed bucket operations of MarkForNoCompact according to the given
+// policy. Metrics are optional.
+func WithNoCompactMarkRetries(policy RetryPolicy, metrics *RetryMetrics) MarkForNoCompactOption {
+	return func(params *markForNoCompactParams) {
+		params.retries = &policy
+		params.retryMetrics = metrics
+	}
+}
+
+// MarkForNoCompact creates a file which marks block to be not compacted.
+// Unknown reasons are rejected unless AllowCustomNoCompactReason option is passed.
+func MarkForNoCompact(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, reason metadata.NoCompactReason, details string, markedForNoCompact prometheus.Counter, options ...MarkForNoCompactOption) error {
+	var opts markForNoCompactParams
+	for _, opt := range options {
+		opt(&opts)
+	}
+	bkt = withRetries(bkt, opts.retries, opts.retryMetrics)
+	if !opts.allowCustomReason && !metadata.IsValidNoCompactReason(reason) {
+		return errors.Errorf("unknown no-compact reason %q", reason)
+	}
+
+	m := path.Join(id.String(), metadata.NoCompactMarkFilename)
+	noCompactMarkExists, err := bkt.Exists(ctx, m)
+	if err != nil {
+		return errors.Wrapf(err, "check exists %s in bucket", m)
+	}
+	if noCompactMarkExists {
+		level.Warn(logger).Log("msg", "requested to mark for no compaction, but file already exists; this should not happen; investigate", "err", errors.Errorf("file %s already exists in bucket", m))
+		return nil
+	}
+
+	now := time.Now()
+	mark := metadata.NoCompactMark{
+		ID:      id,
+		Version: metadata.NoCompactMarkVersion1,
+
+		NoCompactTime: now.Unix(),
+		Reason:        reason,
+		Details:       details,
+	}
+	if opts.expiry > 0 {
+		mark.ExpiryTime = now.Add(opts.expiry).Unix()
+	}
+	noCompactMark, err := json.Marshal(mark)
+	if err != nil {
+		return errors.Wrap(err, "json encode no compact mark")
+	}
+
+	if err := bkt.Upload(ctx, m, bytes.NewReader(noCompactMark)); err != nil {
+		return errors.Wrapf(err, "upload file %s to bucket", m)
+	}
+	markedForNoCompact.Inc()
+	level.Info(logger).Log("msg", "block has been marked for no compaction", "block", id)
+	return nil
+}
+
+// MarkForNoDownsampleOption configures the provided params.
+type MarkForNoDownsampleOption func(params *markForNoDownsampleParams)
+
+// markForNoDownsampleParams holds the MarkForNoDownsample() parameters.
+type markForNoDownsampleParams struct {
+	allowCustomReason bool
+	retries           *RetryPolicy
+	retryMetrics      *RetryMetrics
+}
+
+// AllowCustomNoDownsampleReason is an option to accept a reason which is not one of metadata.NoDownsampleReasons.
+func AllowCustomNoDownsampleReason() MarkForNoDownsampleOption {
+	return func(params *markForNoDownsampleParams) {
+		params.allowCustomReason = true
+	}
+}
+
+// WithNoDownsampleMarkRetries is an option to retry failed bucket operations of MarkForNoDownsample according to the
+// given policy. Metrics are optional.
+func WithNoDownsampleMarkRetries(policy RetryPolicy, metrics *RetryMetrics) MarkForNoDownsampleOption {
+	return func(params *markForNoDownsampleParams) {
+		params.retries = &policy
+		params.retryMetrics = metrics
+	}
+}
+
+// MarkForNoDownsample creates a file which marks block to be not downsampled.
+// Unknown reasons are rejected unless AllowCustomNoDownsampleReason option is passed.
+func MarkForNoDownsample(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, reason metadata.NoDownsampleReason, details string, markedForNoDownsample prometheus.Counter, options ...MarkForNoDownsampleOption) error {
+	var opts markForNoDownsampleParams
+	for _, opt := range options {
+		opt(&opts)
+	}
+	bkt = withRetries(bkt, opts.retries, opts.retryMetrics)
+	if !opts.allowCustomReason && !metadata.IsValidNoDownsampleReason(reason) {
+		return errors.Errorf("unknown no-downsample reason %q", reason)
+	}
+
+	m := path.Join(id.String(), metadata.NoDownsampleMarkFilename)
+	noDownsampleMarkExists, err := bkt.Exists(ctx, m)
+	if err != nil {
+		return errors.Wrapf(err, "check exists %s in bucket", m)
+	}
+	if noDownsampleMarkExists {
+		level.Warn(logger).Log("msg", "requested to mark for no deletion, but file already exists; this should not happen; investigate", "err", errors.Errorf("file %s already exists in bucket", m))
+		return nil
+	}
+	noDownsampleMark, err := json.Marshal(metadata.NoDownsampleMark{
+		ID:      id,
+		Version: metadata.NoDownsampleMarkVersion1,
+
+		NoDownsampleTime: time.Now().Unix(),
+		Reason:           reason,
+		Details:          details,
+	})
+	if err != nil {
+		return errors.Wrap(err, "json encode no downsample mark")
+	}
+
+	if err := bkt.Upload(ctx, m, bytes.NewReader(noDownsampleMark)); err != nil {
+		return errors.Wrapf(err, "upload file %s to bucket", m)
+	}
+	markedForNoDownsample.Inc()
+	level.Info(logger).Log("msg", "block has been marked for no downsample", "block", id)
+	return nil
+}
+
+// QuarantineCounters holds counters of marks created by MarkForQuarantine.
+type QuarantineCounters struct {
+	MarkedForNoCompact    prometheus.Counter
+	MarkedForNoDownsample prometheus.Counter
+}
+
+// MarkForQuarantine marks block to be neither compacted nor downsampled, with the same reason and details in both marks.
+// The reason has to be valid for both marks (see metadata.NoCompactReasons and metadata.NoDownsampleReasons), e.g. manual.
+// Like MarkForNoCompact and MarkForNoDownsample, existing marks are left untouched, so it's safe to call it repeatedly.
+// Both marks are attempted even if one of them fails, and errors of both are returned.
+func MarkForQuarantine(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, reason string, details string, counters QuarantineCounters) error {
+	if !metadata.IsValidNoCompactReason(metadata.NoCompactReason(reason)) || !metadata.IsValidNoDownsampleReason(metadata.NoDownsampleReason(reason)) {
+		return errors.Errorf("reason %q is not valid for both no-compact and no-downsample marks", reason)
+	}
+
+	errs := errutil.MultiError{}
+	if err := MarkForNoCompact(ctx, logger, bkt, id, metadata.NoCompactReason(reason), details, counters.MarkedForNoCompact); err != nil {
+		errs.Add(errors.Wrap(err, "mark for no compaction"))
+	}
+	if err := MarkForNoDownsample(ctx, logger, bkt, id, metadata.NoDownsampleReason(reason), details, counters.MarkedForNoDownsample); err != nil {
+		errs.Add(errors.Wrap(err, "mark for no downsample"))
+	}
+	return errs.Err()
+}
+
+// ReadDeletionMark reads the deletion mark of the given block from the bucket, including both its Details and Annotations.
+// It returns metadata.ErrorMarkerNotFound if the block is not marked for deletion.
+func ReadDeletionMark(ctx context.Context, logger log.Logger, bkt objstore.InstrumentedBucketReader, id ulid.ULID) (metadata.DeletionMark, error) {
+	var m metadata.DeletionMark
+	if err := metadata.ReadMarker(ctx, logger, bkt, id.String(), &m); err != nil {
+		return metadata.DeletionMark{}, err
+	}
+	return m, nil
+}
+
+// ReadNoCompactMark reads the no-compact mark of the given block from the bucket.
+// It returns metadata.ErrorMarkerNotFound if the block is not marked for no compaction.
+func ReadNoCompactMark(ctx context.Context, logger log.Logger, bkt objstore.InstrumentedBucketReader, id ulid.ULID) (metadata.NoCompactMark, error) {
+	var m metadata.NoCompactMark
+	if err := metadata.ReadMarker(ctx, logger, bkt, id.String(), &m); err != nil {
+		return metadata.NoCompactMark{}, err
+	}
+	return m, nil
+}
+
+// ReadNoDownsampleMark reads the no-downsample mark of the given block from the bucket.
+// It returns metadata.ErrorMarkerNotFound if the block is not marked for no downsample.
+func ReadNoDownsampleMark(ctx context.Context, logger log.Logger, bkt objstore.InstrumentedBucketReader, id ulid.ULID) (metadata.NoDownsampleMark, error) {
+	var m metadata.NoDownsampleMark
+	if err := metadata.ReadMarker(ctx, logger, bkt, id.String(), &m); err != nil {
+		return metadata.NoDownsampleMark{}, err
+	}
+	return m, nil
+}
+
+// ErrBlockFrozen is returned when a frozen block (see MarkFrozen) is about to be modified or deleted without a force option.
+var ErrBlockFrozen = errors.New("block is frozen")
+
+// MarkFrozen creates a file which marks block as frozen, e.g. to protect data under legal hold. Frozen blocks are
+// refused by Delete, MarkForDeletion and helpers modifying meta in the bucket (UpdateMeta, RelabelBlockMeta,
+// BackfillUploadTime and CompressMeta) with ErrBlockFrozen, unless their force option is passed. RepathBlock refuses
+// them unconditionally.
+// If the block is already frozen, the existing mark is left untouched.
+func MarkFrozen(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, details string, markedFrozen prometheus.Counter) error {
+	m := path.Join(id.String(), metadata.FrozenMarkFilename)
+	frozen, err := bkt.Exists(ctx, m)
+	if err != nil {
+		return errors.Wrapf(err, "check exists %s in bucket", m)
+	}
+	if frozen {
+		level.Info(logger).Log("msg", "requested to freeze the block, but it's already frozen", "block", id)
+		return nil
+	}
+
+	frozenMark, err := json.Marshal(metadata.FrozenMark{
+		ID:         id,
+		Version:    metadata.FrozenMarkVersion1,
+		Details:    details,
+		FrozenTime: time.Now().Unix(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "json encode frozen mark")
+	}
+	if err := bkt.Upload(ctx, m, bytes.NewBuffer(frozenMark)); err != nil {
+		return errors.Wrapf(err, "upload file %s to bucket", m)
+	}
+	markedFrozen.Inc()
+	level.Info(logger).Log("msg", "block has been frozen", "block", id)
+	return nil
+}
+
+// Unfreeze removes the frozen mark of the block (see MarkFrozen), so it can be modified and deleted again.
+func Unfreeze(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, unfrozen prometheus.Counter) error {
+	return RemoveMark(ctx, logger, bkt, id, unfrozen, metadata.FrozenMarkFilename)
+}
+
+// IsFrozen returns true if the block is frozen (see MarkFrozen).
+func IsFrozen(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID) (bool, error) {
+	m := path.Join(id.String(), metadata.FrozenMarkFilename)
+	frozen, err := bkt.Exists(ctx, m)
+	if err != nil {
+		return false, errors.Wrapf(err, "check exists %s in bucket", m)
+	}
+	return frozen, nil
+}
+
+// checkNotFrozen returns ErrBlockFrozen if the block is frozen.
+func checkNotFrozen(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID) error {
+	frozen, err := IsFrozen(ctx, bkt, id)
+	if err != nil {
+		return err
+	}
+	if frozen {
+		return errors.Wrapf(ErrBlockFrozen, "block %s has %s; unfreeze it or pass a force option", id, metadata.FrozenMarkFilename)
+	}
+	return nil
+}
+
+// ReadFrozenMark reads the frozen mark of the given block from the bucket.
+// It returns metadata.ErrorMarkerNotFound if the block is not frozen.
+func ReadFrozenMark(ctx context.Context, logger log.Logger, bkt objstore.InstrumentedBucketReader, id ulid.ULID) (metadata.FrozenMark, error) {
+	var m metadata.FrozenMark
+	if err := metadata.ReadMarker(ctx, logger, bkt, id.String(), &m); err != nil {
+		return metadata.FrozenMark{}, err
+	}
+	return m, nil
+}
+
+// RemoveMarkOption configures the provided params.
+type RemoveMarkOption func(params *removeMarkParams)
+
+// removeMarkParams holds the RemoveMark() parameters.
+type removeMarkParams struct {
+	updateIndex bool
+}
+
+// WithRemoveMarkIndex is an option to also remove the block from the index of the removed mark (see MarkIndex).
+// The index is updated after the mark is deleted, also when the block was not marked.
+func WithRemoveMarkIndex() RemoveMarkOption {
+	return func(params *removeMarkParams) {
+		params.updateIndex = true
+	}
+}
+
+// RemoveMark removes the file which marked the block for deletion, no-downsample or no-compact.
+func RemoveMark(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, removeMark prometheus.Counter, markedFilename string, options ...RemoveMarkOption) error {
+	_, err := RemoveMarkIfExists(ctx, logger, bkt, id, removeMark, markedFilename, options...)
+	return err
+}
+
+// RemoveMarkIfExists works like RemoveMark, but also returns true if the mark existed and was actually removed.
+func RemoveMarkIfExists(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, removeMark prometheus.Counter, markedFilename string, options ...RemoveMarkOption) (bool, error) {
+	var opts removeMarkParams
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	markedFile := path.Join(id.String(), markedFilename)
+	markedFileExists, err := bkt.Exists(ctx, markedFile)
+	if err != nil {
+		return false, errors.Wrapf(err, "check if %s file exists in bucket", markedFile)
+	}
+	if !markedFileExists {
+		level.Warn(logger).Log("msg", "requested to remove the mark, but file does not exist", "err", errors.Errorf("file %s does not exist in bucket", markedFile))
+		if opts.updateIndex {
+			return false, updateMarkIndex(ctx, logger, bkt, markedFilename, map[ulid.ULID]bool{id: false})
+		}
+		return false, nil
+	}
+	if err := bkt.Delete(ctx, markedFile); err != nil {
+		return false, errors.Wrapf(err, "delete file %s from bucket", markedFile)
+	}
+	removeMark.Inc()
+	level.Info(logger).Log("msg", "mark has been removed from the block", "block", id)
+	if opts.updateIndex {
+		if err := updateMarkIndex(ctx, logger, bkt, markedFilename, map[ulid.ULID]bool{id: false}); err != nil {
+			return true, errors.Wrap(err, "update mark index")
+		}
+	}
+	return true, nil
+}
+
+// ListMarkedBlocks returns IDs of all blocks in the bucket which carry the given mark file (e.g. metadata.DeletionMarkFilename),
+// sorted. It lists the bucket recursively in a single pass, so blocks without the mark and partial blocks are simply skipped.
+func ListMarkedBlocks(ctx context.Context, bkt objstore.BucketReader, markFilename string) ([]ulid.ULID, error) {
+	var res []ulid.ULID
+	err := bkt.Iter(ctx, "", func(name string) error {
+		parts := strings.Split(name, objstore.DirDelim)
+		if len(parts) != 2 || parts[1] != markFilename {
+			return nil
+		}
+		id, ok := IsBlockDir(parts[0])
+		if !ok {
+			return nil
+		}
+		res = append(res, id)
+		return nil
+	}, objstore.WithRecursiveIter)
+	if err != nil {
+		return nil, errors.Wrap(err, "iter bucket")
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Compare(res[j]) < 0
+	})
+	return res, nil
+}
+
+// SweepExpiredMarks removes no-compact marks which expired at the given time (see metadata.IsNoCompactActive) from all
+// blocks in the bucket. Marks which can't be read are left untouched. It returns the number of removed marks.
+func SweepExpiredMarks(ctx context.Context, logger log.Logger, bkt objstore.Bucket, now time.Time, removed prometheus.Counter) (int, error) {
+	ids, err := ListMarkedBlocks(ctx, bkt, metadata.NoCompactMarkFilename)
+	if err != nil {
+		return 0, err
+	}
+
+	swept := 0
+	for _, id := range ids {
+		var m metadata.NoCompactMark
+		if err := metadata.ReadMarker(ctx, logger, objstore.WithNoopInstr(bkt), id.String(), &m); err != nil {
+			if errors.Cause(err) == metadata.ErrorMarkerNotFound || errors.Cause(err) == metadata.ErrorUnmarshalMarker {
+				continue
+			}
+			return swept, errors.Wrapf(err, "read no-compact mark of block %s", id)
+		}
+		if metadata.IsNoCompactActive(m, now) {
+			continue
+		}
+		ok, err := RemoveMarkIfExists(ctx, logger, bkt, id, removed, metadata.NoCompactMarkFilename)
+		if err != nil {
+			return swept, err
+		}
+		if ok {
+			swept++
+		}
+	}
+	return swept, nil
+}
@@ -0,0 +1,690 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestMarkForDeletion(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	for _, tcase := range []struct {
+		name      string
+		preUpload func(t testing.TB, id ulid.ULID, bkt objstore.Bucket)
+
+		blocksMarked int
+	}{
+		{
+			name:         "block marked for deletion",
+			preUpload:    func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {},
+			blocksMarked: 1,
+		},
+		{
+			name: "block with deletion mark already, expected log and no metric increment",
+			preUpload: func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {
+				deletionMark, err := json.Marshal(metadata.DeletionMark{
+					ID:           id,
+					DeletionTime: time.Now().Unix(),
+					Version:      metadata.DeletionMarkVersion1,
+				})
+				testutil.Ok(t, err)
+				testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.DeletionMarkFilename), bytes.NewReader(deletionMark)))
+			},
+			blocksMarked: 0,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			bkt := objstore.NewInMemBucket()
+			id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+				labels.New(labels.Label{Name: "a", Value: "1"}),
+				labels.New(labels.Label{Name: "a", Value: "2"}),
+				labels.New(labels.Label{Name: "a", Value: "3"}),
+				labels.New(labels.Label{Name: "a", Value: "4"}),
+				labels.New(labels.Label{Name: "b", Value: "1"}),
+			}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+			testutil.Ok(t, err)
+
+			tcase.preUpload(t, id, bkt)
+
+			testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String()), metadata.NoneFunc))
+
+			c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+			err = MarkForDeletion(ctx, log.NewNopLogger(), bkt, id, "", c)
+			testutil.Ok(t, err)
+			testutil.Equals(t, float64(tcase.blocksMarked), promtest.ToFloat64(c))
+		})
+	}
+}
+
+func TestMarkForDeletionOverwrite(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	id := ulid.MustNew(1, nil)
+
+	deletionMark, err := json.Marshal(metadata.DeletionMark{
+		ID:           id,
+		DeletionTime: 100,
+		Version:      metadata.DeletionMarkVersion1,
+		Details:      "old",
+	})
+	testutil.Ok(t, err)
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.DeletionMarkFilename), bytes.NewReader(deletionMark)))
+
+	c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+
+	// Without forcing, existing mark is left untouched.
+	testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, id, "new", c))
+	m, err := ReadDeletionMark(ctx, log.NewNopLogger(), bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(100), m.DeletionTime)
+	testutil.Equals(t, "old", m.Details)
+
+	// Forcing updates details, but preserves the timestamp.
+	testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, id, "new", c, WithForceOverwrite(false)))
+	m, err = ReadDeletionMark(ctx, log.NewNopLogger(), bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(100), m.DeletionTime)
+	testutil.Equals(t, "new", m.Details)
+
+	// Timestamp is refreshed only when requested.
+	testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, id, "newer", c, WithForceOverwrite(true)))
+	m, err = ReadDeletionMark(ctx, log.NewNopLogger(), bkt, id)
+	testutil.Ok(t, err)
+	testutil.Assert(t, m.DeletionTime > 100, "expected refreshed deletion time, got %d", m.DeletionTime)
+	testutil.Equals(t, "newer", m.Details)
+
+	// Overwrites are not counted as new marks.
+	testutil.Equals(t, 0.0, promtest.ToFloat64(c))
+}
+
+func TestMarkManyForDeletion(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	bkt := objstore.NewInMemBucket()
+	ids := []ulid.ULID{ulid.MustNew(1, nil), ulid.MustNew(2, nil), ulid.MustNew(3, nil)}
+
+	// Block already marked is not counted again.
+	c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, ids[0], "", c))
+
+	c = promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	errs := MarkManyForDeletion(ctx, log.NewNopLogger(), bkt, ids, 2, "tenant offboarded", c)
+	testutil.Equals(t, 0, len(errs))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(c))
+	for _, id := range ids {
+		ok, err := bkt.Exists(ctx, path.Join(id.String(), metadata.DeletionMarkFilename))
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "block %s not marked", id)
+	}
+
+	// Failures are reported per block.
+	failing := ulid.MustNew(4, nil)
+	errBkt := errBucket{Bucket: bkt, failSuffix: path.Join(failing.String(), metadata.DeletionMarkFilename)}
+	errs = MarkManyForDeletion(ctx, log.NewNopLogger(), errBkt, append(ids, failing), 0, "", c)
+	testutil.Equals(t, 1, len(errs))
+	testutil.Assert(t, errors.Is(errs[failing], errUploadFailed))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(c))
+}
+
+func TestReadMarks(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	id := ulid.MustNew(1, nil)
+
+	_, err := ReadDeletionMark(ctx, log.NewNopLogger(), bkt, id)
+	testutil.Equals(t, metadata.ErrorMarkerNotFound, err)
+	_, err = ReadNoCompactMark(ctx, log.NewNopLogger(), bkt, id)
+	testutil.Equals(t, metadata.ErrorMarkerNotFound, err)
+	_, err = ReadNoDownsampleMark(ctx, log.NewNopLogger(), bkt, id)
+	testutil.Equals(t, metadata.ErrorMarkerNotFound, err)
+
+	c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, id, "retention", c))
+	testutil.Ok(t, MarkForNoCompact(ctx, log.NewNopLogger(), bkt, id, metadata.ManualNoCompactReason, "investigating", c))
+	testutil.Ok(t, MarkForNoDownsample(ctx, log.NewNopLogger(), bkt, id, metadata.ManualNoDownsampleReason, "investigating", c))
+
+	dm, err := ReadDeletionMark(ctx, log.NewNopLogger(), bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, id, dm.ID)
+	testutil.Equals(t, "retention", dm.Details)
+	testutil.Assert(t, dm.DeletionTime > 0)
+	testutil.Equals(t, int64(0), dm.RetentionDelay)
+	testutil.Equals(t, 0, len(dm.Annotations))
+
+	// Retention delay is recorded in the mark.
+	id2 := ulid.MustNew(2, nil)
+	testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, id2, "", c, WithRetentionDelay(48*time.Hour)))
+	dm, err = ReadDeletionMark(ctx, log.NewNopLogger(), bkt, id2)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(48*60*60), dm.RetentionDelay)
+	testutil.Assert(t, !metadata.IsReadyForDeletion(dm, time.Now()))
+	testutil.Assert(t, metadata.IsReadyForDeletion(dm, time.Now().Add(49*time.Hour)))
+
+	// Annotations are recorded next to details.
+	id3 := ulid.MustNew(3, nil)
+	annotations := map[string]string{"job": "offboarding", "ticket": "OPS-123"}
+	testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, id3, "tenant offboarded", c, WithDeletionAnnotations(annotations)))
+	dm, err = ReadDeletionMark(ctx, log.NewNopLogger(), bkt, id3)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "tenant offboarded", dm.Details)
+	testutil.Equals(t, annotations, dm.Annotations)
+
+	ncm, err := ReadNoCompactMark(ctx, log.NewNopLogger(), bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, metadata.ManualNoCompactReason, ncm.Reason)
+	testutil.Equals(t, "investigating", ncm.Details)
+
+	ndm, err := ReadNoDownsampleMark(ctx, log.NewNopLogger(), bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, metadata.ManualNoDownsampleReason, ndm.Reason)
+}
+
+func TestMarkForNoCompact(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	for _, tcase := range []struct {
+		name      string
+		preUpload func(t testing.TB, id ulid.ULID, bkt objstore.Bucket)
+
+		blocksMarked int
+	}{
+		{
+			name:         "block marked",
+			preUpload:    func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {},
+			blocksMarked: 1,
+		},
+		{
+			name: "block with no-compact mark already, expected log and no metric increment",
+			preUpload: func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {
+				m, err := json.Marshal(metadata.NoCompactMark{
+					ID:            id,
+					NoCompactTime: time.Now().Unix(),
+					Version:       metadata.NoCompactMarkVersion1,
+				})
+				testutil.Ok(t, err)
+				testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.NoCompactMarkFilename), bytes.NewReader(m)))
+			},
+			blocksMarked: 0,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			bkt := objstore.NewInMemBucket()
+			id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+				labels.New(labels.Label{Name: "a", Value: "1"}),
+				labels.New(labels.Label{Name: "a", Value: "2"}),
+				labels.New(labels.Label{Name: "a", Value: "3"}),
+				labels.New(labels.Label{Name: "a", Value: "4"}),
+				labels.New(labels.Label{Name: "b", Value: "1"}),
+			}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+			testutil.Ok(t, err)
+
+			tcase.preUpload(t, id, bkt)
+
+			testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String()), metadata.NoneFunc))
+
+			c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+			err = MarkForNoCompact(ctx, log.NewNopLogger(), bkt, id, metadata.ManualNoCompactReason, "", c)
+			testutil.Ok(t, err)
+			testutil.Equals(t, float64(tcase.blocksMarked), promtest.ToFloat64(c))
+		})
+	}
+}
+
+func TestMarkForNoDownsample(t *testing.T) {
+
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	for _, tcase := range []struct {
+		name      string
+		preUpload func(t testing.TB, id ulid.ULID, bkt objstore.Bucket)
+
+		blocksMarked int
+	}{
+		{
+			name:         "block marked",
+			preUpload:    func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {},
+			blocksMarked: 1,
+		},
+		{
+			name: "block with no-downsample mark already, expected log and no metric increment",
+			preUpload: func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {
+				m, err := json.Marshal(metadata.NoDownsampleMark{
+					ID:               id,
+					NoDownsampleTime: time.Now().Unix(),
+					Version:          metadata.NoDownsampleMarkVersion1,
+				})
+				testutil.Ok(t, err)
+				testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.NoDownsampleMarkFilename), bytes.NewReader(m)))
+			},
+			blocksMarked: 0,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			bkt := objstore.NewInMemBucket()
+			id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+				labels.New(labels.Label{Name: "a", Value: "1"}),
+				labels.New(labels.Label{Name: "a", Value: "2"}),
+				labels.New(labels.Label{Name: "a", Value: "3"}),
+				labels.New(labels.Label{Name: "a", Value: "4"}),
+				labels.New(labels.Label{Name: "b", Value: "1"}),
+			}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+			testutil.Ok(t, err)
+
+			tcase.preUpload(t, id, bkt)
+
+			testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String()), metadata.NoneFunc))
+
+			c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+			err = MarkForNoDownsample(ctx, log.NewNopLogger(), bkt, id, metadata.ManualNoDownsampleReason, "", c)
+			testutil.Ok(t, err)
+			testutil.Equals(t, float64(tcase.blocksMarked), promtest.ToFloat64(c))
+		})
+	}
+}
+
+func TestMarkAndDeleteWithRetries(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	policy := RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	id := ulid.MustNew(1, nil)
+
+	bkt := objstore.NewInMemBucket()
+	uploadTestMeta(t, bkt, id, 0, 100, map[string]string{"a": "1"})
+
+	testutil.NotOk(t, MarkForNoCompact(ctx, log.NewNopLogger(), &flakyBucket{Bucket: bkt, failures: 1, err: statusError(503)}, id, metadata.ManualNoCompactReason, "", c))
+	testutil.Ok(t, MarkForNoCompact(ctx, log.NewNopLogger(), &flakyBucket{Bucket: bkt, failures: 1, err: statusError(503)}, id, metadata.ManualNoCompactReason, "", c, WithNoCompactMarkRetries(policy, nil)))
+	testutil.Ok(t, MarkForNoDownsample(ctx, log.NewNopLogger(), &flakyBucket{Bucket: bkt, failures: 1, err: statusError(503)}, id, metadata.ManualNoDownsampleReason, "", c, WithNoDownsampleMarkRetries(policy, nil)))
+
+	m := NewRetryMetrics(prometheus.NewRegistry())
+	testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), &flakyBucket{Bucket: bkt, failures: 1, err: statusError(503)}, id, "", c, WithDeletionMarkRetries(policy, m)))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.Retries.WithLabelValues(objstore.OpUpload)))
+	for _, f := range []string{metadata.NoCompactMarkFilename, metadata.NoDownsampleMarkFilename, metadata.DeletionMarkFilename} {
+		_, ok := bkt.Objects()[path.Join(id.String(), f)]
+		testutil.Assert(t, ok, "%s should be uploaded", f)
+	}
+
+	fbkt := &failingDeleteBucket{Bucket: bkt, failSuffix: MetaFilename, failures: 1, err: statusError(503)}
+	testutil.Ok(t, Delete(ctx, log.NewNopLogger(), fbkt, id, WithDeleteRetries(policy, m)))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.Retries.WithLabelValues(objstore.OpDelete)))
+	testutil.Equals(t, 0, len(bkt.Objects()))
+}
+
+func TestRemoveMarkForDeletion(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	for _, testcases := range []struct {
+		name           string
+		preDelete      func(t testing.TB, id ulid.ULID, bkt objstore.Bucket)
+		blocksUnmarked int
+	}{
+		{
+			name: "unmarked block for deletion",
+			preDelete: func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {
+				deletionMark, err := json.Marshal(metadata.DeletionMark{
+					ID:           id,
+					DeletionTime: time.Now().Unix(),
+					Version:      metadata.DeletionMarkVersion1,
+				})
+				testutil.Ok(t, err)
+				testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.DeletionMarkFilename), bytes.NewReader(deletionMark)))
+			},
+			blocksUnmarked: 1,
+		},
+		{
+			name:           "block not marked for deletion, message logged and metric not incremented",
+			preDelete:      func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {},
+			blocksUnmarked: 0,
+		},
+	} {
+		t.Run(testcases.name, func(t *testing.T) {
+			bkt := objstore.NewInMemBucket()
+			id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-1"}),
+				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-2"}),
+				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-3"}),
+				labels.New(labels.Label{Name: "cluster-us1", Value: "service-1"}),
+				labels.New(labels.Label{Name: "cluster-us1", Value: "service-2"}),
+			}, 100, 0, 1000, labels.New(labels.Label{Name: "region-1", Value: "eu-west"}), 124, metadata.NoneFunc)
+			testutil.Ok(t, err)
+			testcases.preDelete(t, id, bkt)
+			counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+			err = RemoveMark(ctx, log.NewNopLogger(), bkt, id, counter, metadata.DeletionMarkFilename)
+			testutil.Ok(t, err)
+			testutil.Equals(t, float64(testcases.blocksUnmarked), promtest.ToFloat64(counter))
+		})
+	}
+}
+
+func TestRemoveMarkForNoCompact(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	for _, testCases := range []struct {
+		name           string
+		preDelete      func(t testing.TB, id ulid.ULID, bkt objstore.Bucket)
+		blocksUnmarked int
+	}{
+		{
+			name: "unmarked block for no-compact",
+			preDelete: func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {
+				m, err := json.Marshal(metadata.NoCompactMark{
+					ID:            id,
+					NoCompactTime: time.Now().Unix(),
+					Version:       metadata.NoCompactMarkVersion1,
+				})
+				testutil.Ok(t, err)
+				testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.NoCompactMarkFilename), bytes.NewReader(m)))
+			},
+			blocksUnmarked: 1,
+		},
+		{
+			name:           "block not marked for no-compact, message logged and metric not incremented",
+			preDelete:      func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {},
+			blocksUnmarked: 0,
+		},
+	} {
+		t.Run(testCases.name, func(t *testing.T) {
+			bkt := objstore.NewInMemBucket()
+			id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-1"}),
+				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-2"}),
+				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-3"}),
+				labels.New(labels.Label{Name: "cluster-us1", Value: "service-1"}),
+				labels.New(labels.Label{Name: "cluster-us1", Value: "service-2"}),
+			}, 100, 0, 1000, labels.New(labels.Label{Name: "region-1", Value: "eu-west"}), 124, metadata.NoneFunc)
+			testutil.Ok(t, err)
+			testCases.preDelete(t, id, bkt)
+			counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+			err = RemoveMark(ctx, log.NewNopLogger(), bkt, id, counter, metadata.NoCompactMarkFilename)
+			testutil.Ok(t, err)
+			testutil.Equals(t, float64(testCases.blocksUnmarked), promtest.ToFloat64(counter))
+		})
+	}
+}
+
+func TestRemoveMmarkForNoDownsample(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	for _, testCases := range []struct {
+		name           string
+		preDelete      func(t testing.TB, id ulid.ULID, bkt objstore.Bucket)
+		blocksUnmarked int
+	}{
+		{
+			name: "unmarked block for no-downsample",
+			preDelete: func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {
+				m, err := json.Marshal(metadata.NoDownsampleMark{
+					ID:               id,
+					NoDownsampleTime: time.Now().Unix(),
+					Version:          metadata.NoDownsampleMarkVersion1,
+				})
+				testutil.Ok(t, err)
+				testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.NoDownsampleMarkFilename), bytes.NewReader(m)))
+			},
+			blocksUnmarked: 1,
+		},
+		{
+			name:           "block not marked for no-downsample, message logged and metric not incremented",
+			preDelete:      func(t testing.TB, id ulid.ULID, bkt objstore.Bucket) {},
+			blocksUnmarked: 0,
+		},
+	} {
+		t.Run(testCases.name, func(t *testing.T) {
+			bkt := objstore.NewInMemBucket()
+			id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-1"}),
+				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-2"}),
+				labels.New(labels.Label{Name: "cluster-eu1", Value: "service-3"}),
+				labels.New(labels.Label{Name: "cluster-us1", Value: "service-1"}),
+				labels.New(labels.Label{Name: "cluster-us1", Value: "service-2"}),
+			}, 100, 0, 1000, labels.New(labels.Label{Name: "region-1", Value: "eu-west"}), 124, metadata.NoneFunc)
+			testutil.Ok(t, err)
+			testCases.preDelete(t, id, bkt)
+			counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+			err = RemoveMark(ctx, log.NewNopLogger(), bkt, id, counter, metadata.NoDownsampleMarkFilename)
+			testutil.Ok(t, err)
+			testutil.Equals(t, float64(testCases.blocksUnmarked), promtest.ToFloat64(counter))
+		})
+	}
+}
+
+func TestRemoveMarkIfExists(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	bkt := objstore.NewInMemBucket()
+	id := ulid.MustNew(1, nil)
+	c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+
+	removed, err := RemoveMarkIfExists(ctx, log.NewNopLogger(), bkt, id, c, metadata.NoCompactMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !removed, "nothing should be removed")
+	testutil.Equals(t, 0.0, promtest.ToFloat64(c))
+
+	testutil.Ok(t, MarkForNoCompact(ctx, log.NewNopLogger(), bkt, id, metadata.ManualNoCompactReason, "", promauto.With(nil).NewCounter(prometheus.CounterOpts{})))
+	removed, err = RemoveMarkIfExists(ctx, log.NewNopLogger(), bkt, id, c, metadata.NoCompactMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Assert(t, removed, "mark should be removed")
+	testutil.Equals(t, 1.0, promtest.ToFloat64(c))
+	testutil.Equals(t, 0, len(bkt.Objects()))
+}
+
+func TestListMarkedBlocks(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	bkt := objstore.NewInMemBucket()
+	c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+
+	b1, b2, b3 := ulid.MustNew(1, nil), ulid.MustNew(2, nil), ulid.MustNew(3, nil)
+	testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, b3, "", c))
+	testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, b1, "", c))
+	testutil.Ok(t, MarkForNoCompact(ctx, log.NewNopLogger(), bkt, b2, metadata.ManualNoCompactReason, "", c))
+	// Partial block without any mark.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ulid.MustNew(4, nil).String(), IndexFilename), strings.NewReader("index")))
+	// Object which is not a block.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join("debug", metadata.DeletionMarkFilename), strings.NewReader("{}")))
+
+	ids, err := ListMarkedBlocks(ctx, bkt, metadata.DeletionMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{b1, b3}, ids)
+
+	ids, err = ListMarkedBlocks(ctx, bkt, metadata.NoCompactMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{b2}, ids)
+
+	ids, err = ListMarkedBlocks(ctx, bkt, metadata.NoDownsampleMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(ids))
+}
+
+func TestSweepExpiredMarks(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.NewInMemBucket()
+	c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+
+	permanent, temporary := ulid.MustNew(1, nil), ulid.MustNew(2, nil)
+	testutil.Ok(t, MarkForNoCompact(ctx, logger, bkt, permanent, metadata.ManualNoCompactReason, "", c))
+	testutil.Ok(t, MarkForNoCompact(ctx, logger, bkt, temporary, metadata.ManualNoCompactReason, "investigating", c, WithNoCompactExpiry(7*24*time.Hour)))
+
+	m, err := ReadNoCompactMark(ctx, logger, objstore.WithNoopInstr(bkt), temporary)
+	testutil.Ok(t, err)
+	testutil.Equals(t, m.NoCompactTime+7*24*60*60, m.ExpiryTime)
+	testutil.Assert(t, metadata.IsNoCompactActive(m, time.Now()))
+
+	removed := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	n, err := SweepExpiredMarks(ctx, logger, bkt, time.Now(), removed)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, n)
+
+	n, err = SweepExpiredMarks(ctx, logger, bkt, time.Now().Add(8*24*time.Hour), removed)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, n)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(removed))
+
+	ids, err := ListMarkedBlocks(ctx, bkt, metadata.NoCompactMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{permanent}, ids)
+}
+
+func TestMarkWithCustomReason(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.NewInMemBucket()
+	c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	id := ulid.MustNew(1, nil)
+
+	testutil.NotOk(t, MarkForNoCompact(ctx, logger, bkt, id, "manaul", "", c))
+	testutil.NotOk(t, MarkForNoDownsample(ctx, logger, bkt, id, "manaul", "", c))
+	testutil.Equals(t, 0, len(bkt.Objects()))
+
+	testutil.Ok(t, MarkForNoCompact(ctx, logger, bkt, id, "investigation", "", c, AllowCustomNoCompactReason()))
+	testutil.Ok(t, MarkForNoDownsample(ctx, logger, bkt, id, "investigation", "", c, AllowCustomNoDownsampleReason()))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(c))
+}
+
+func TestMarkForQuarantine(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.NewInMemBucket()
+	counters := QuarantineCounters{
+		MarkedForNoCompact:    promauto.With(nil).NewCounter(prometheus.CounterOpts{}),
+		MarkedForNoDownsample: promauto.With(nil).NewCounter(prometheus.CounterOpts{}),
+	}
+	id := ulid.MustNew(1, nil)
+
+	// No-downsample mark can't have this reason.
+	testutil.NotOk(t, MarkForQuarantine(ctx, logger, bkt, id, metadata.IndexSizeExceedingNoCompactReason, "", counters))
+	testutil.Equals(t, 0, len(bkt.Objects()))
+
+	testutil.Ok(t, MarkForQuarantine(ctx, logger, bkt, id, string(metadata.ManualNoCompactReason), "suspicious block", counters))
+	// Quarantine is idempotent.
+	testutil.Ok(t, MarkForQuarantine(ctx, logger, bkt, id, string(metadata.ManualNoCompactReason), "suspicious block", counters))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(counters.MarkedForNoCompact))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(counters.MarkedForNoDownsample))
+
+	ncm, err := ReadNoCompactMark(ctx, logger, objstore.WithNoopInstr(bkt), id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "suspicious block", ncm.Details)
+	ndm, err := ReadNoDownsampleMark(ctx, logger, objstore.WithNoopInstr(bkt), id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "suspicious block", ndm.Details)
+
+	// Errors of both marks are reported.
+	id2 := ulid.MustNew(2, nil)
+	errBkt := errBucket{Bucket: bkt, failSuffix: path.Join(id2.String(), metadata.NoCompactMarkFilename)}
+	err = MarkForQuarantine(ctx, logger, errBkt, id2, string(metadata.ManualNoCompactReason), "", counters)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "mark for no compaction"), "unexpected error %v", err)
+	_, err = ReadNoDownsampleMark(ctx, logger, objstore.WithNoopInstr(bkt), id2)
+	testutil.Ok(t, err)
+}
+
+func TestFrozenBlock(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, logger, bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	testutil.Ok(t, MarkFrozen(ctx, logger, bkt, b1, "legal hold", counter))
+	// Freezing is idempotent.
+	testutil.Ok(t, MarkFrozen(ctx, logger, bkt, b1, "legal hold", counter))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(counter))
+	m, err := ReadFrozenMark(ctx, logger, objstore.WithNoopInstr(bkt), b1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "legal hold", m.Details)
+	frozen, err := IsFrozen(ctx, bkt, b1)
+	testutil.Ok(t, err)
+	testutil.Assert(t, frozen, "expected block to be frozen")
+
+	objects := map[string][]byte{}
+	for name, b := range bkt.Objects() {
+		objects[name] = b
+	}
+	expectFrozenErr := func(t *testing.T, err error) {
+		t.Helper()
+		testutil.NotOk(t, err)
+		testutil.Equals(t, ErrBlockFrozen, errors.Cause(err))
+	}
+	expectFrozenErr(t, Delete(ctx, logger, bkt, b1))
+	_, err = DeleteDryRun(ctx, logger, bkt, b1)
+	expectFrozenErr(t, err)
+	expectFrozenErr(t, MarkForDeletion(ctx, logger, bkt, b1, "", counter))
+	expectFrozenErr(t, UpdateMeta(ctx, bkt, b1, func(*metadata.Meta) error { return nil }))
+	expectFrozenErr(t, RelabelBlockMeta(ctx, logger, bkt, b1, map[string]string{"ext1": "val2"}))
+	_, err = BackfillUploadTime(ctx, logger, bkt, b1)
+	expectFrozenErr(t, err)
+	expectFrozenErr(t, CompressMeta(ctx, logger, bkt, b1))
+	expectFrozenErr(t, RepathBlock(ctx, logger, bkt, b1, ulid.MustNew(1, nil)))
+	testutil.Equals(t, objects, bkt.Objects())
+
+	// Force options override the frozen mark.
+	testutil.Ok(t, RelabelBlockMeta(ctx, logger, bkt, b1, map[string]string{"ext1": "val2"}, WithForceUpdateFrozen()))
+	testutil.Ok(t, MarkForDeletion(ctx, logger, bkt, b1, "", counter, WithForceMarkFrozen()))
+
+	// Unfrozen block can be modified again.
+	testutil.Ok(t, Unfreeze(ctx, logger, bkt, b1, counter))
+	_, err = ReadFrozenMark(ctx, logger, objstore.WithNoopInstr(bkt), b1)
+	testutil.Equals(t, metadata.ErrorMarkerNotFound, err)
+	testutil.Ok(t, UpdateMeta(ctx, bkt, b1, func(*metadata.Meta) error { return nil }))
+
+	testutil.Ok(t, MarkFrozen(ctx, logger, bkt, b1, "legal hold", counter))
+	testutil.Ok(t, Delete(ctx, logger, bkt, b1, WithForceDeleteFrozen()))
+	testutil.Equals(t, 0, len(bkt.Objects()))
+}
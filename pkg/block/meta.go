@@ -0,0 +1,417 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// DefaultMaxMetaSize is the default limit of size of meta JSON downloaded by DownloadMeta. See WithMaxMetaSize.
+const DefaultMaxMetaSize = 64 << 20
+
+// DownloadMetaOption configures the provided params.
+type DownloadMetaOption func(params *downloadMetaParams)
+
+// downloadMetaParams holds the DownloadMeta() parameters.
+type downloadMetaParams struct {
+	maxBytes int64
+}
+
+// WithMaxMetaSize is an option to set the limit of size of downloaded meta JSON, decompressed if needed, instead of
+// DefaultMaxMetaSize, e.g. for huge blocks compacted over a long time. Download of larger meta fails with an error
+// wrapping metadata.ErrorMetaTooLarge. Non-positive limit means no limit.
+func WithMaxMetaSize(maxBytes int64) DownloadMetaOption {
+	return func(params *downloadMetaParams) {
+		params.maxBytes = maxBytes
+	}
+}
+
+func applyDownloadMetaOptions(options ...DownloadMetaOption) downloadMetaParams {
+	out := downloadMetaParams{
+		maxBytes: DefaultMaxMetaSize,
+	}
+	for _, opt := range options {
+		opt(&out)
+	}
+	return out
+}
+
+// DownloadMeta downloads only meta file from bucket by block ID.
+// TODO(bwplotka): Differentiate between network error & partial upload.
+func DownloadMeta(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, options ...DownloadMetaOption) (metadata.Meta, error) {
+	opts := applyDownloadMetaOptions(options...)
+	rc, err := getMetaObject(ctx, bkt, id)
+	if err != nil {
+		return metadata.Meta{}, err
+	}
+	return decodeDownloadedMeta(logger, rc, id, opts.maxBytes)
+}
+
+// DownloadMetaHeader works like DownloadMeta, but reads only the cheap top-level fields of meta, without decoding
+// the rest of it, e.g. the Files section which is huge for long compacted blocks. See metadata.ReadHeader.
+func DownloadMetaHeader(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID) (metadata.Header, error) {
+	rc, err := getMetaObject(ctx, bkt, id)
+	if err != nil {
+		return metadata.Header{}, err
+	}
+	// The rest of meta is not needed, so the reader is not exhausted.
+	defer runutil.CloseWithLogOnErr(logger, rc, "download meta header bucket client")
+
+	h, err := metadata.ReadHeader(rc)
+	if err != nil {
+		return metadata.Header{}, errors.Wrapf(err, "read meta.json header for block %s", id.String())
+	}
+	return *h, nil
+}
+
+// getMetaObject returns reader of meta of the given block, falling back to compressed meta if there is no plain one.
+func getMetaObject(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID) (io.ReadCloser, error) {
+	rc, err := bkt.Get(ctx, path.Join(id.String(), MetaFilename))
+	if err != nil && bkt.IsObjNotFoundErr(err) {
+		// Try compressed meta, but report the original error if there is none.
+		if gzrc, gzerr := bkt.Get(ctx, path.Join(id.String(), metadata.MetaGzipFilename)); gzerr == nil || !bkt.IsObjNotFoundErr(gzerr) {
+			rc, err = gzrc, gzerr
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "meta.json bkt get for %s", id.String())
+	}
+	return rc, nil
+}
+
+// decodeDownloadedMeta decodes meta of the given block read from rc, plain or compressed, and closes rc. Meta larger
+// than positive maxBytes is not read.
+func decodeDownloadedMeta(logger log.Logger, rc io.ReadCloser, id ulid.ULID, maxBytes int64) (metadata.Meta, error) {
+	defer runutil.CloseWithLogOnErr(logger, rc, "download meta bucket client")
+
+	var m metadata.Meta
+
+	r, err := metadata.NewMetaReader(rc)
+	if err != nil {
+		return metadata.Meta{}, errors.Wrapf(err, "read meta.json for block %s", id.String())
+	}
+	if maxBytes > 0 {
+		r = metadata.LimitMetaReader(r, maxBytes)
+	}
+	obj, err := io.ReadAll(r)
+	if err != nil {
+		return metadata.Meta{}, errors.Wrapf(err, "read meta.json for block %s", id.String())
+	}
+
+	if err = json.Unmarshal(obj, &m); err != nil {
+		return metadata.Meta{}, errors.Wrapf(err, "unmarshal meta.json for block %s", id.String())
+	}
+
+	return m, nil
+}
+
+// DownloadMetas works like DownloadMeta for many blocks, downloading up to concurrency metas in parallel.
+// It returns metas of blocks downloaded successfully and errors of the others, both by block ID.
+func DownloadMetas(ctx context.Context, logger log.Logger, bkt objstore.Bucket, ids []ulid.ULID, concurrency int, options ...DownloadMetaOption) (map[ulid.ULID]metadata.Meta, map[ulid.ULID]error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mtx   sync.Mutex
+		metas = make(map[ulid.ULID]metadata.Meta, len(ids))
+		errs  = map[ulid.ULID]error{}
+		g     errgroup.Group
+	)
+	g.SetLimit(concurrency)
+	for _, id := range ids {
+		id := id
+		g.Go(func() error {
+			m, err := DownloadMeta(ctx, logger, bkt, id, options...)
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			if err != nil {
+				errs[id] = err
+				return nil
+			}
+			metas[id] = m
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return metas, errs
+}
+
+// CompressMeta migrates meta.json of the given block to gzip-compressed metadata.MetaGzipFilename in place.
+// The compressed meta is uploaded before meta.json is deleted, so the block never looks partial. Blocks which
+// already have only compressed meta are left untouched. Frozen blocks are refused unless WithForceUpdateFrozen option
+// is passed. The same caution as for WithCompressedMeta applies: older components would delete migrated blocks.
+func CompressMeta(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, options ...UpdateMetaOption) error {
+	if err := applyUpdateMetaOptions(options...).checkNotFrozen(ctx, bkt, id); err != nil {
+		return err
+	}
+	metaFile := path.Join(id.String(), MetaFilename)
+	rc, err := bkt.Get(ctx, metaFile)
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "get file %s", metaFile)
+	}
+	m, err := metadata.Read(rc)
+	if err != nil {
+		return errors.Wrapf(err, "read file %s", metaFile)
+	}
+
+	var buf bytes.Buffer
+	if err := m.Write(&buf, metadata.WithGzip()); err != nil {
+		return errors.Wrap(err, "encode compressed meta")
+	}
+	gzMetaFile := path.Join(id.String(), metadata.MetaGzipFilename)
+	if err := bkt.Upload(ctx, gzMetaFile, &buf); err != nil {
+		return errors.Wrapf(err, "upload file %s", gzMetaFile)
+	}
+	if err := bkt.Delete(ctx, metaFile); err != nil {
+		return errors.Wrapf(err, "delete file %s", metaFile)
+	}
+	level.Info(logger).Log("msg", "compressed meta of the block", "block", id)
+	return nil
+}
+
+// BackfillUploadTime sets UploadTime in meta of the given block, if it's not set yet (e.g. for blocks uploaded before
+// the field was introduced), to the last modification time of its meta file in the bucket. It returns true if meta
+// was updated. Frozen blocks are refused unless WithForceUpdateFrozen option is passed.
+func BackfillUploadTime(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, options ...UpdateMetaOption) (bool, error) {
+	if err := applyUpdateMetaOptions(options...).checkNotFrozen(ctx, bkt, id); err != nil {
+		return false, err
+	}
+	m, metaFile, err := readBucketMeta(ctx, bkt, id)
+	if err != nil {
+		return false, err
+	}
+	if m.Thanos.UploadTime != 0 {
+		return false, nil
+	}
+
+	attrs, err := bkt.Attributes(ctx, metaFile)
+	if err != nil {
+		return false, errors.Wrapf(err, "get attributes of %s", metaFile)
+	}
+	if attrs.LastModified.IsZero() {
+		return false, errors.Errorf("unknown last modification time of %s", metaFile)
+	}
+	m.Thanos.UploadTime = attrs.LastModified.Unix()
+
+	if err := writeBucketMeta(ctx, bkt, m, metaFile); err != nil {
+		return false, err
+	}
+	level.Info(logger).Log("msg", "backfilled upload time of the block", "block", id, "uploadTime", attrs.LastModified)
+	return true, nil
+}
+
+// RelabelBlockMeta replaces external labels of the given block in the bucket, without touching other files of the block.
+// The change is recorded as a rewrite of the block, with both old and new labels (see metadata.ExternalLabelsChange),
+// keeping the block ID, Files and other fields of the meta.
+// NOTE: External labels determine the compaction group of the block (see metadata.Thanos.GroupKey), so the compactor
+// treats the relabeled block as part of a different group, and it might be compacted with blocks of that group.
+// Frozen blocks are refused unless WithForceUpdateFrozen option is passed.
+func RelabelBlockMeta(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, newLabels map[string]string, options ...UpdateMetaOption) error {
+	if len(newLabels) == 0 {
+		return errors.New("empty external labels are not allowed for Thanos block.")
+	}
+	var oldLabels map[string]string
+	if err := UpdateMeta(ctx, bkt, id, func(m *metadata.Meta) error {
+		sources := m.Compaction.Sources
+		if len(sources) == 0 {
+			sources = []ulid.ULID{id}
+		}
+		if err := metadata.AppendRewrite(m, sources, nil, nil); err != nil {
+			return errors.Wrap(err, "record rewrite")
+		}
+		oldLabels = m.Thanos.Labels
+		m.Thanos.Labels = make(map[string]string, len(newLabels))
+		recorded := make(map[string]string, len(newLabels))
+		for k, v := range newLabels {
+			m.Thanos.Labels[k] = v
+			recorded[k] = v
+		}
+		m.Thanos.Rewrites[len(m.Thanos.Rewrites)-1].ExternalLabelsChanged = &metadata.ExternalLabelsChange{Old: oldLabels, New: recorded}
+		return nil
+	}, options...); err != nil {
+		return err
+	}
+	level.Info(logger).Log("msg", "replaced external labels of the block", "block", id,
+		"oldLabels", labels.FromMap(oldLabels).String(), "newLabels", labels.FromMap(newLabels).String())
+	return nil
+}
+
+// readBucketMeta reads meta of the given block from the bucket, returning also the name of the meta object, which is
+// either meta.json or compressed metadata.MetaGzipFilename.
+func readBucketMeta(ctx context.Context, bkt objstore.Bucket, id ulid.ULID) (*metadata.Meta, string, error) {
+	metaFile := path.Join(id.String(), MetaFilename)
+	rc, err := bkt.Get(ctx, metaFile)
+	if err != nil && bkt.IsObjNotFoundErr(err) {
+		metaFile = path.Join(id.String(), metadata.MetaGzipFilename)
+		rc, err = bkt.Get(ctx, metaFile)
+	}
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "get meta file of block %s", id)
+	}
+	m, err := metadata.Read(rc)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "read file %s", metaFile)
+	}
+	return m, metaFile, nil
+}
+
+// writeBucketMeta overwrites the meta object read by readBucketMeta, keeping its form.
+func writeBucketMeta(ctx context.Context, bkt objstore.Bucket, m *metadata.Meta, metaFile string) error {
+	buf, err := encodeBucketMeta(m, metaFile)
+	if err != nil {
+		return err
+	}
+	if err := bkt.Upload(ctx, metaFile, buf); err != nil {
+		return errors.Wrapf(err, "upload file %s", metaFile)
+	}
+	return nil
+}
+
+// encodeBucketMeta encodes meta in the form of the given meta object.
+func encodeBucketMeta(m *metadata.Meta, metaFile string) (*bytes.Buffer, error) {
+	var writeOpts []metadata.WriteOption
+	if path.Base(metaFile) == metadata.MetaGzipFilename {
+		writeOpts = append(writeOpts, metadata.WithGzip())
+	}
+	var buf bytes.Buffer
+	if err := m.Write(&buf, writeOpts...); err != nil {
+		return nil, errors.Wrap(err, "encode meta")
+	}
+	return &buf, nil
+}
+
+// ErrVersionConflict is returned by ConditionalBucket if the object was modified since the given version.
+var ErrVersionConflict = errors.New("object version conflict")
+
+// ConditionalBucket is an optional interface of buckets supporting conditional writes, e.g. using ETags of S3 objects
+// or generations of GCS objects. UpdateMeta and updates of MarkIndex use it to avoid lost updates.
+// NOTE: No bucket shipped with objstore implements it, including S3, GCS, Azure, filesystem and in-memory buckets, and
+// wrappers like objstore.NewPrefixedBucket hide it of the wrapped bucket. With those, UpdateMeta and MarkIndex updates
+// are best-effort. It's implemented only by buckets of the caller, e.g. using the SDK of its storage directly.
+type ConditionalBucket interface {
+	// GetWithVersion returns the object along with its current version.
+	GetWithVersion(ctx context.Context, name string) (io.ReadCloser, string, error)
+	// UploadIfVersion uploads the object only if its current version is the given one, or only if it does not exist
+	// if the given version is empty. Otherwise, it returns an error wrapping ErrVersionConflict.
+	UploadIfVersion(ctx context.Context, name string, r io.Reader, version string) error
+}
+
+// readConditionalBucketMeta is readBucketMeta of ConditionalBucket, returning also the version of the meta object.
+func readConditionalBucketMeta(ctx context.Context, bkt objstore.Bucket, cbkt ConditionalBucket, id ulid.ULID) (*metadata.Meta, string, string, error) {
+	metaFile := path.Join(id.String(), MetaFilename)
+	rc, version, err := cbkt.GetWithVersion(ctx, metaFile)
+	if err != nil && bkt.IsObjNotFoundErr(err) {
+		metaFile = path.Join(id.String(), metadata.MetaGzipFilename)
+		rc, version, err = cbkt.GetWithVersion(ctx, metaFile)
+	}
+	if err != nil {
+		return nil, "", "", errors.Wrapf(err, "get meta file of block %s", id)
+	}
+	m, err := metadata.Read(rc)
+	if err != nil {
+		return nil, "", "", errors.Wrapf(err, "read file %s", metaFile)
+	}
+	return m, metaFile, version, nil
+}
+
+// UpdateMetaOption configures the provided params.
+type UpdateMetaOption func(params *updateMetaParams)
+
+// updateMetaParams holds the parameters of UpdateMeta() and other helpers modifying meta in the bucket.
+type updateMetaParams struct {
+	forceFrozen bool
+}
+
+// WithForceUpdateFrozen is an option to modify meta of the block even if it's frozen (see MarkFrozen).
+func WithForceUpdateFrozen() UpdateMetaOption {
+	return func(params *updateMetaParams) {
+		params.forceFrozen = true
+	}
+}
+
+func applyUpdateMetaOptions(options ...UpdateMetaOption) updateMetaParams {
+	var params updateMetaParams
+	for _, opt := range options {
+		opt(&params)
+	}
+	return params
+}
+
+func (p updateMetaParams) checkNotFrozen(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID) error {
+	if p.forceFrozen {
+		return nil
+	}
+	return checkNotFrozen(ctx, bkt, id)
+}
+
+// conditionalUpdateAttempts is the maximum number of attempts of UpdateMeta and mark index updates to write an object
+// modified concurrently.
+const conditionalUpdateAttempts = 5
+
+// UpdateMeta reads meta of the given block from the bucket, applies mutate to it and writes it back.
+// If the bucket implements ConditionalBucket, meta is written only if it wasn't modified since it was read. If it was,
+// meta is read and mutated again, in up to 5 attempts, after which an error wrapping ErrVersionConflict is returned.
+// Thus mutate can be called more than once and should only modify the given meta.
+// Other buckets, which are all buckets shipped with objstore (see ConditionalBucket), can't detect concurrent updates of
+// the same meta, so the update is best-effort: e.g. two tools relabeling the block at the same time might overwrite each
+// other.
+// Frozen blocks (see MarkFrozen) are refused with ErrBlockFrozen unless WithForceUpdateFrozen option is passed.
+func UpdateMeta(ctx context.Context, bkt objstore.Bucket, id ulid.ULID, mutate func(*metadata.Meta) error, options ...UpdateMetaOption) error {
+	if err := applyUpdateMetaOptions(options...).checkNotFrozen(ctx, bkt, id); err != nil {
+		return err
+	}
+	cbkt, ok := bkt.(ConditionalBucket)
+	if !ok {
+		m, metaFile, err := readBucketMeta(ctx, bkt, id)
+		if err != nil {
+			return err
+		}
+		if err := mutate(m); err != nil {
+			return errors.Wrapf(err, "update meta of block %s", id)
+		}
+		return writeBucketMeta(ctx, bkt, m, metaFile)
+	}
+
+	for attempt := 1; ; attempt++ {
+		m, metaFile, version, err := readConditionalBucketMeta(ctx, bkt, cbkt, id)
+		if err != nil {
+			return err
+		}
+		if err := mutate(m); err != nil {
+			return errors.Wrapf(err, "update meta of block %s", id)
+		}
+		buf, err := encodeBucketMeta(m, metaFile)
+		if err != nil {
+			return err
+		}
+		err = cbkt.UploadIfVersion(ctx, metaFile, buf, version)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrVersionConflict) || attempt >= conditionalUpdateAttempts {
+			return errors.Wrapf(err, "upload file %s", metaFile)
+		}
+	}
+}
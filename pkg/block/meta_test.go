@@ -0,0 +1,362 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestCompressedMeta(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	b2, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, UploadWithOptions(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.SHA256Func, WithCompressedMeta()))
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b2.String()), metadata.SHA256Func))
+	_, ok := bkt.Objects()[path.Join(b1.String(), MetaFilename)]
+	testutil.Assert(t, !ok, "expected no uncompressed meta")
+	_, ok = bkt.Objects()[path.Join(b1.String(), metadata.MetaGzipFilename)]
+	testutil.Assert(t, ok, "expected compressed meta")
+
+	// Existing blocks can be migrated.
+	testutil.Ok(t, CompressMeta(ctx, log.NewNopLogger(), bkt, b2))
+	testutil.Ok(t, CompressMeta(ctx, log.NewNopLogger(), bkt, b2))
+	_, ok = bkt.Objects()[path.Join(b2.String(), MetaFilename)]
+	testutil.Assert(t, !ok, "expected no uncompressed meta")
+
+	for _, id := range []ulid.ULID{b1, b2} {
+		expected, err := metadata.ReadFromDir(path.Join(tmpDir, id.String()))
+		testutil.Ok(t, err)
+
+		m, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		testutil.Equals(t, expected.ULID, m.ULID)
+		testutil.Equals(t, 3, len(m.Thanos.Files))
+
+		dst := path.Join(t.TempDir(), id.String())
+		testutil.Ok(t, Download(ctx, log.NewNopLogger(), bkt, id, dst))
+		dm, err := metadata.ReadFromDir(dst)
+		testutil.Ok(t, err)
+		testutil.Equals(t, m.Thanos.Files, dm.Thanos.Files)
+	}
+
+	ids, err := ListPartialBlocks(ctx, bkt)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(ids))
+
+	testutil.Ok(t, Delete(ctx, log.NewNopLogger(), bkt, b1))
+	testutil.Ok(t, Delete(ctx, log.NewNopLogger(), bkt, b2))
+	testutil.Equals(t, 0, len(bkt.Objects()))
+}
+
+func TestBackfillUploadTime(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.NewInMemBucket()
+
+	id := ulid.MustNew(1, nil)
+	uploadTestMeta(t, bkt, id, 0, 100, map[string]string{"a": "1"})
+	attrs, err := bkt.Attributes(ctx, path.Join(id.String(), MetaFilename))
+	testutil.Ok(t, err)
+
+	updated, err := BackfillUploadTime(ctx, logger, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Assert(t, updated, "expected upload time to be backfilled")
+	m, err := DownloadMeta(ctx, logger, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, attrs.LastModified.Unix(), m.Thanos.UploadTime)
+	testutil.Equals(t, map[string]string{"a": "1"}, m.Thanos.Labels)
+
+	// Already set upload time is kept.
+	updated, err = BackfillUploadTime(ctx, logger, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !updated, "expected upload time to be kept")
+
+	// Compressed meta stays compressed.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), MetaFilename), strings.NewReader(`{"ulid":"`+id.String()+`","version":1,"thanos":{"version":1}}`)))
+	testutil.Ok(t, CompressMeta(ctx, logger, bkt, id))
+	updated, err = BackfillUploadTime(ctx, logger, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Assert(t, updated, "expected upload time to be backfilled")
+	testutil.Equals(t, []byte{0x1f, 0x8b}, bkt.Objects()[path.Join(id.String(), metadata.MetaGzipFilename)][:2])
+	m, err = DownloadMeta(ctx, logger, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Assert(t, m.Thanos.UploadTime > 0, "expected upload time to be set")
+
+	_, err = BackfillUploadTime(ctx, logger, bkt, ulid.MustNew(2, nil))
+	testutil.NotOk(t, err)
+}
+
+func TestRelabelBlockMeta(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, logger, bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+	before, err := DownloadMeta(ctx, logger, bkt, b1)
+	testutil.Ok(t, err)
+	objects := map[string][]byte{}
+	for name, b := range bkt.Objects() {
+		objects[name] = b
+	}
+
+	testutil.NotOk(t, RelabelBlockMeta(ctx, logger, bkt, b1, nil))
+	testutil.Ok(t, RelabelBlockMeta(ctx, logger, bkt, b1, map[string]string{"ext1": "val2", "tenant": "acme"}))
+
+	after, err := DownloadMeta(ctx, logger, bkt, b1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"ext1": "val2", "tenant": "acme"}, after.Thanos.Labels)
+	testutil.Equals(t, before.Thanos.Files, after.Thanos.Files)
+	testutil.Equals(t, before.BlockMeta, after.BlockMeta)
+	testutil.Equals(t, []metadata.Rewrite{{
+		Sources: before.Compaction.Sources,
+		ExternalLabelsChanged: &metadata.ExternalLabelsChange{
+			Old: map[string]string{"ext1": "val1"},
+			New: map[string]string{"ext1": "val2", "tenant": "acme"},
+		},
+	}}, after.Thanos.Rewrites)
+	testutil.Assert(t, before.Thanos.GroupKey() != after.Thanos.GroupKey(), "expected group key to change")
+
+	// Only meta was re-uploaded.
+	for name, b := range bkt.Objects() {
+		if path.Base(name) != MetaFilename {
+			testutil.Equals(t, objects[name], b)
+		}
+	}
+	testutil.Equals(t, len(objects), len(bkt.Objects()))
+}
+
+func TestUpdateMeta(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	id := ulid.MustNew(1, nil)
+	addRewrite := func(m *metadata.Meta) error {
+		return metadata.AppendRewrite(m, []ulid.ULID{id}, nil, nil)
+	}
+
+	bkt := objstore.NewInMemBucket()
+	uploadTestMeta(t, bkt, id, 0, 100, map[string]string{"a": "1"})
+
+	testutil.Ok(t, UpdateMeta(ctx, bkt, id, addRewrite))
+	m, err := DownloadMeta(ctx, logger, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(m.Thanos.Rewrites))
+
+	testutil.NotOk(t, UpdateMeta(ctx, bkt, id, func(*metadata.Meta) error { return errors.New("fail") }))
+	testutil.NotOk(t, UpdateMeta(ctx, bkt, ulid.MustNew(2, nil), addRewrite))
+}
+
+// conditionalBucket is ConditionalBucket with versions counting uploads of objects, and an empty version of missing
+// objects. beforeUpload, if set, is called before each conditional upload.
+type conditionalBucket struct {
+	*objstore.InMemBucket
+
+	mtx          sync.Mutex
+	versions     map[string]int
+	beforeUpload func()
+}
+
+func newConditionalBucket() *conditionalBucket {
+	return &conditionalBucket{InMemBucket: objstore.NewInMemBucket(), versions: map[string]int{}}
+}
+
+func (b *conditionalBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.versions[name]++
+	return b.InMemBucket.Upload(ctx, name, r)
+}
+
+func (b *conditionalBucket) GetWithVersion(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	rc, err := b.InMemBucket.Get(ctx, name)
+	return rc, b.version(ctx, name), err
+}
+
+func (b *conditionalBucket) version(ctx context.Context, name string) string {
+	if ok, _ := b.InMemBucket.Exists(ctx, name); !ok {
+		return ""
+	}
+	return strconv.Itoa(b.versions[name])
+}
+
+func (b *conditionalBucket) UploadIfVersion(ctx context.Context, name string, r io.Reader, version string) error {
+	if b.beforeUpload != nil {
+		b.beforeUpload()
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.version(ctx, name) != version {
+		return errors.Wrapf(ErrVersionConflict, "upload %s", name)
+	}
+	b.versions[name]++
+	return b.InMemBucket.Upload(ctx, name, r)
+}
+
+func TestUpdateMetaConditional(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	id := ulid.MustNew(1, nil)
+	var mutated int
+	addRewrite := func(m *metadata.Meta) error {
+		mutated++
+		return metadata.AppendRewrite(m, []ulid.ULID{id}, nil, nil)
+	}
+
+	bkt := newConditionalBucket()
+	uploadTestMeta(t, bkt, id, 0, 100, map[string]string{"a": "1"})
+
+	// Concurrent update is not lost, the update is retried on top of it.
+	concurrent := true
+	bkt.beforeUpload = func() {
+		if concurrent {
+			concurrent = false
+			testutil.Ok(t, UpdateMeta(ctx, bkt, id, addRewrite))
+		}
+	}
+	testutil.Ok(t, UpdateMeta(ctx, bkt, id, addRewrite))
+	testutil.Equals(t, 3, mutated)
+	m, err := DownloadMeta(ctx, logger, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(m.Thanos.Rewrites))
+
+	// Update fails if meta keeps changing.
+	mutated = 0
+	bkt.beforeUpload = func() {
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), MetaFilename), bytes.NewReader(bkt.Objects()[path.Join(id.String(), MetaFilename)])))
+	}
+	err = UpdateMeta(ctx, bkt, id, addRewrite)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, errors.Is(err, ErrVersionConflict), "expected version conflict, got %v", err)
+	testutil.Equals(t, conditionalUpdateAttempts, mutated)
+	m, err = DownloadMeta(ctx, logger, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(m.Thanos.Rewrites))
+}
+
+func TestDownloadMetas(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	var ids []ulid.ULID
+	for i := 1; i <= 10; i++ {
+		id := ulid.MustNew(uint64(i), nil)
+		uploadTestMeta(t, bkt, id, int64(i)*100, int64(i+1)*100, map[string]string{"a": "1"})
+		ids = append(ids, id)
+	}
+	missing := ulid.MustNew(11, nil)
+	corrupted := ulid.MustNew(12, nil)
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(corrupted.String(), MetaFilename), strings.NewReader("{")))
+
+	metas, errs := DownloadMetas(ctx, log.NewNopLogger(), bkt, append(ids, missing, corrupted), 4)
+	testutil.Equals(t, len(ids), len(metas))
+	for i, id := range ids {
+		testutil.Equals(t, id, metas[id].ULID)
+		testutil.Equals(t, int64(i+1)*100, metas[id].MinTime)
+	}
+	testutil.Equals(t, 2, len(errs))
+	testutil.Assert(t, bkt.IsObjNotFoundErr(errors.Cause(errs[missing])))
+	testutil.NotOk(t, errs[corrupted])
+}
+
+func TestDownloadMetaHeader(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.NewInMemBucket()
+
+	id1, id2 := ulid.MustNew(1, nil), ulid.MustNew(2, nil)
+	uploadTestMeta(t, bkt, id1, 0, 100, map[string]string{"a": "1"})
+	m := metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{ULID: id2, MinTime: 100, MaxTime: 200, Version: metadata.TSDBVersion1},
+		Thanos:    metadata.Thanos{Labels: map[string]string{"a": "2"}, Source: metadata.ReceiveSource},
+	}
+	var buf bytes.Buffer
+	testutil.Ok(t, m.Write(&buf, metadata.WithGzip()))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id2.String(), metadata.MetaGzipFilename), &buf))
+
+	h, err := DownloadMetaHeader(ctx, logger, bkt, id1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, metadata.Header{ULID: id1, MinTime: 0, MaxTime: 100, Labels: map[string]string{"a": "1"}}, h)
+
+	h, err = DownloadMetaHeader(ctx, logger, bkt, id2)
+	testutil.Ok(t, err)
+	testutil.Equals(t, metadata.Header{ULID: id2, MinTime: 100, MaxTime: 200, Labels: map[string]string{"a": "2"}, Source: metadata.ReceiveSource}, h)
+
+	_, err = DownloadMetaHeader(ctx, logger, bkt, ulid.MustNew(3, nil))
+	testutil.NotOk(t, err)
+	testutil.Assert(t, bkt.IsObjNotFoundErr(errors.Cause(err)), "expected not found error, got %v", err)
+}
+
+func TestDownloadMetaSizeLimit(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.NewInMemBucket()
+
+	id := ulid.MustNew(1, nil)
+	uploadTestMeta(t, bkt, id, 0, 100, map[string]string{"a": "1"})
+
+	m, err := DownloadMeta(ctx, logger, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, id, m.ULID)
+
+	_, err = DownloadMeta(ctx, logger, bkt, id, WithMaxMetaSize(10))
+	testutil.Assert(t, errors.Is(err, metadata.ErrorMetaTooLarge), "expected meta too large, got %v", err)
+
+	_, errs := DownloadMetas(ctx, logger, bkt, []ulid.ULID{id}, 1, WithMaxMetaSize(10))
+	testutil.Assert(t, errors.Is(errs[id], metadata.ErrorMetaTooLarge), "expected meta too large, got %v", errs[id])
+
+	_, err = DownloadMeta(ctx, logger, bkt, id, WithMaxMetaSize(0))
+	testutil.Ok(t, err)
+}
@@ -0,0 +1,173 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// MetaCache downloads meta of blocks from the bucket like DownloadMeta, caching up to the given number of
+// parsed metas in memory. Concurrent downloads of the same meta are deduplicated. It's safe for concurrent use.
+// NOTE: Meta is not immutable, it's rewritten e.g. by UpdateMeta, RelabelBlockMeta, BackfillUploadTime and CompressMeta.
+// Changes done through MetaCache.UpdateMeta, or followed by Invalidate, are visible right away. Changes done otherwise,
+// e.g. by other processes, are visible only once cached meta expires, which never happens unless WithMetaCacheTTL is given.
+type MetaCache struct {
+	logger          log.Logger
+	bkt             objstore.Bucket
+	ttl             time.Duration
+	downloadTimeout time.Duration
+
+	cache *lru.Cache[ulid.ULID, cachedMeta]
+	g     singleflight.Group
+
+	// mtx guards gen and changes of the cache done by downloads and invalidations.
+	mtx sync.Mutex
+	// gen is incremented by each invalidation. Downloads started before it don't cache the meta they return, as it
+	// might be stale already.
+	gen uint64
+
+	requests prometheus.Counter
+	hits     prometheus.Counter
+}
+
+type cachedMeta struct {
+	meta    metadata.Meta
+	fetched time.Time
+}
+
+// MetaCacheOption configures the provided params.
+type MetaCacheOption func(params *metaCacheParams)
+
+// metaCacheParams holds the NewMetaCache() parameters.
+type metaCacheParams struct {
+	ttl             time.Duration
+	downloadTimeout time.Duration
+}
+
+// DefaultMetaCacheDownloadTimeout is the default timeout of downloads of meta by MetaCache.
+const DefaultMetaCacheDownloadTimeout = time.Minute
+
+// WithMetaCacheTTL is an option to download meta again once it was cached for longer than the given duration, so
+// changes of meta done outside of the cache are picked up eventually. Non-positive TTL means cached meta never expires.
+func WithMetaCacheTTL(ttl time.Duration) MetaCacheOption {
+	return func(params *metaCacheParams) {
+		params.ttl = ttl
+	}
+}
+
+// WithMetaCacheDownloadTimeout is an option to set the timeout of downloads of meta, which are shared by concurrent
+// callers and thus not canceled by their contexts. Non-positive timeout means DefaultMetaCacheDownloadTimeout.
+func WithMetaCacheDownloadTimeout(timeout time.Duration) MetaCacheOption {
+	return func(params *metaCacheParams) {
+		params.downloadTimeout = timeout
+	}
+}
+
+// NewMetaCache returns MetaCache caching up to size metas of blocks from the given bucket.
+func NewMetaCache(logger log.Logger, bkt objstore.Bucket, size int, reg prometheus.Registerer, options ...MetaCacheOption) (*MetaCache, error) {
+	var opts metaCacheParams
+	for _, opt := range options {
+		opt(&opts)
+	}
+	if opts.downloadTimeout <= 0 {
+		opts.downloadTimeout = DefaultMetaCacheDownloadTimeout
+	}
+	cache, err := lru.New[ulid.ULID, cachedMeta](size)
+	if err != nil {
+		return nil, errors.Wrap(err, "create LRU cache")
+	}
+	return &MetaCache{
+		logger:          logger,
+		bkt:             bkt,
+		ttl:             opts.ttl,
+		downloadTimeout: opts.downloadTimeout,
+		cache:           cache,
+		requests: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_block_meta_cache_requests_total",
+			Help: "Total number of requests for block meta to the meta cache.",
+		}),
+		hits: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_block_meta_cache_hits_total",
+			Help: "Total number of requests for block meta served from the meta cache.",
+		}),
+	}, nil
+}
+
+// DownloadMeta returns meta of the given block, downloading it from the bucket if it's not cached.
+// Returned meta is shared with other callers and must not be modified. Download shared by concurrent callers isn't
+// canceled when some of them are, each returns once its own context is done. The download itself is bounded by the
+// timeout set with WithMetaCacheDownloadTimeout.
+func (c *MetaCache) DownloadMeta(ctx context.Context, id ulid.ULID) (metadata.Meta, error) {
+	c.requests.Inc()
+	if cm, ok := c.cache.Get(id); ok && (c.ttl <= 0 || time.Since(cm.fetched) <= c.ttl) {
+		c.hits.Inc()
+		return cm.meta, nil
+	}
+
+	c.mtx.Lock()
+	gen := c.gen
+	ch := c.g.DoChan(id.String(), func() (interface{}, error) {
+		dctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.downloadTimeout)
+		defer cancel()
+
+		fetched := time.Now()
+		m, err := DownloadMeta(dctx, c.logger, c.bkt, id)
+		if err != nil {
+			return nil, err
+		}
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		if c.gen == gen {
+			c.cache.Add(id, cachedMeta{meta: m, fetched: fetched})
+		}
+		return m, nil
+	})
+	c.mtx.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return metadata.Meta{}, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return metadata.Meta{}, res.Err
+		}
+		return res.Val.(metadata.Meta), nil
+	}
+}
+
+// Invalidate removes meta of the given block from the cache. Downloads in flight don't cache the meta they return, and
+// following calls of DownloadMeta download meta again.
+func (c *MetaCache) Invalidate(id ulid.ULID) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.gen++
+	c.cache.Remove(id)
+	c.g.Forget(id.String())
+}
+
+// UpdateMeta updates meta of the given block in the bucket like UpdateMeta, and removes its meta from the cache.
+func (c *MetaCache) UpdateMeta(ctx context.Context, id ulid.ULID, mutate func(*metadata.Meta) error, options ...UpdateMetaOption) error {
+	defer c.Invalidate(id)
+	return UpdateMeta(ctx, c.bkt, id, mutate, options...)
+}
+
+// Delete deletes the given block from the bucket like Delete with the given options, and removes its meta from the cache.
+func (c *MetaCache) Delete(ctx context.Context, id ulid.ULID, options ...DeleteOption) error {
+	// Invalidate even if deletion fails, as meta.json is deleted first.
+	defer c.Invalidate(id)
+	return Delete(ctx, c.logger, c.bkt, id, options...)
+}
@@ -0,0 +1,253 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"io"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestMetaCache(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	var ids []ulid.ULID
+	for i := 0; i < 2; i++ {
+		id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+			labels.New(labels.Label{Name: "a", Value: "1"}),
+		}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String()), metadata.NoneFunc))
+		ids = append(ids, id)
+	}
+
+	cBkt := &getCountingBucket{Bucket: bkt}
+	c, err := NewMetaCache(log.NewNopLogger(), cBkt, 1, prometheus.NewRegistry())
+	testutil.Ok(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m, err := c.DownloadMeta(ctx, ids[0])
+			testutil.Ok(t, err)
+			testutil.Equals(t, ids[0], m.ULID)
+		}()
+	}
+	wg.Wait()
+	gets := cBkt.gets.Load()
+	testutil.Assert(t, gets >= 1 && gets <= 10, "unexpected number of gets %d", gets)
+
+	// Cached meta is not downloaded again.
+	_, err = c.DownloadMeta(ctx, ids[0])
+	testutil.Ok(t, err)
+	testutil.Equals(t, gets, cBkt.gets.Load())
+	testutil.Equals(t, 11.0, promtest.ToFloat64(c.requests))
+
+	// Least recently used meta is evicted.
+	m, err := c.DownloadMeta(ctx, ids[1])
+	testutil.Ok(t, err)
+	testutil.Equals(t, ids[1], m.ULID)
+	_, err = c.DownloadMeta(ctx, ids[0])
+	testutil.Ok(t, err)
+	testutil.Equals(t, gets+2, cBkt.gets.Load())
+
+	// Meta of deleted block is not served anymore.
+	testutil.Ok(t, c.Delete(ctx, ids[0]))
+	_, err = c.DownloadMeta(ctx, ids[0])
+	testutil.NotOk(t, err)
+	testutil.Assert(t, bkt.IsObjNotFoundErr(errors.Cause(err)), "unexpected error %v", err)
+
+	// Delete options are forwarded.
+	testutil.Ok(t, MarkFrozen(ctx, log.NewNopLogger(), bkt, ids[1], "legal hold", promauto.With(nil).NewCounter(prometheus.CounterOpts{})))
+	err = c.Delete(ctx, ids[1])
+	testutil.Assert(t, errors.Is(err, ErrBlockFrozen), "expected frozen block error, got %v", err)
+	testutil.Ok(t, c.Delete(ctx, ids[1], WithForceDeleteFrozen()))
+	_, err = c.DownloadMeta(ctx, ids[1])
+	testutil.Assert(t, bkt.IsObjNotFoundErr(errors.Cause(err)), "unexpected error %v", err)
+}
+
+func TestMetaCacheUpdates(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	bkt := objstore.NewInMemBucket()
+	id := ulid.MustNew(1, nil)
+	uploadTestMeta(t, bkt, id, 0, 100, map[string]string{"a": "1"})
+
+	c, err := NewMetaCache(log.NewNopLogger(), bkt, 10, prometheus.NewRegistry())
+	testutil.Ok(t, err)
+	_, err = c.DownloadMeta(ctx, id)
+	testutil.Ok(t, err)
+
+	// Updates done through the cache are visible right away.
+	testutil.Ok(t, c.UpdateMeta(ctx, id, func(m *metadata.Meta) error {
+		m.Thanos.Labels["a"] = "2"
+		return nil
+	}))
+	m, err := c.DownloadMeta(ctx, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "2", m.Thanos.Labels["a"])
+
+	// Updates done elsewhere are not visible until cached meta expires.
+	testutil.Ok(t, UpdateMeta(ctx, bkt, id, func(m *metadata.Meta) error {
+		m.Thanos.Labels["a"] = "3"
+		return nil
+	}))
+	m, err = c.DownloadMeta(ctx, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "2", m.Thanos.Labels["a"])
+
+	ttlCache, err := NewMetaCache(log.NewNopLogger(), bkt, 10, prometheus.NewRegistry(), WithMetaCacheTTL(time.Millisecond))
+	testutil.Ok(t, err)
+	_, err = ttlCache.DownloadMeta(ctx, id)
+	testutil.Ok(t, err)
+	testutil.Ok(t, UpdateMeta(ctx, bkt, id, func(m *metadata.Meta) error {
+		m.Thanos.Labels["a"] = "4"
+		return nil
+	}))
+	time.Sleep(2 * time.Millisecond)
+	m, err = ttlCache.DownloadMeta(ctx, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "4", m.Thanos.Labels["a"])
+}
+
+// blockingGetBucket blocks Get of objects with the given name, after the object is read, until release is closed or
+// the context is done.
+type blockingGetBucket struct {
+	objstore.Bucket
+
+	name    string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingGetBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil || name != b.name {
+		return rc, err
+	}
+	b.started <- struct{}{}
+	select {
+	case <-b.release:
+		return rc, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestMetaCacheConcurrentInvalidation(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	bkt := objstore.NewInMemBucket()
+	id := ulid.MustNew(1, nil)
+	uploadTestMeta(t, bkt, id, 0, 100, map[string]string{"a": "1"})
+
+	bBkt := &blockingGetBucket{Bucket: bkt, name: path.Join(id.String(), MetaFilename), started: make(chan struct{}, 1), release: make(chan struct{})}
+	c, err := NewMetaCache(log.NewNopLogger(), bBkt, 10, prometheus.NewRegistry())
+	testutil.Ok(t, err)
+
+	// Meta downloaded before invalidation is returned, but not cached.
+	stale := make(chan metadata.Meta)
+	go func() {
+		m, err := c.DownloadMeta(ctx, id)
+		testutil.Ok(t, err)
+		stale <- m
+	}()
+	<-bBkt.started
+	testutil.Ok(t, UpdateMeta(ctx, bkt, id, func(m *metadata.Meta) error {
+		m.Thanos.Labels["a"] = "2"
+		return nil
+	}))
+	c.Invalidate(id)
+	close(bBkt.release)
+	testutil.Equals(t, "1", (<-stale).Thanos.Labels["a"])
+
+	m, err := c.DownloadMeta(ctx, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "2", m.Thanos.Labels["a"])
+}
+
+func TestMetaCacheDownloadTimeout(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	bkt := objstore.NewInMemBucket()
+	id := ulid.MustNew(1, nil)
+	uploadTestMeta(t, bkt, id, 0, 100, map[string]string{"a": "1"})
+
+	bBkt := &blockingGetBucket{Bucket: bkt, name: path.Join(id.String(), MetaFilename), started: make(chan struct{}, 1), release: make(chan struct{})}
+	c, err := NewMetaCache(log.NewNopLogger(), bBkt, 10, prometheus.NewRegistry(), WithMetaCacheDownloadTimeout(10*time.Millisecond))
+	testutil.Ok(t, err)
+
+	// Stuck download fails once it times out, even though the caller's context is never done.
+	_, err = c.DownloadMeta(ctx, id)
+	testutil.Assert(t, errors.Is(err, context.DeadlineExceeded), "expected deadline exceeded, got %v", err)
+}
+
+func TestMetaCacheCanceledCaller(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	bkt := objstore.NewInMemBucket()
+	id := ulid.MustNew(1, nil)
+	uploadTestMeta(t, bkt, id, 0, 100, map[string]string{"a": "1"})
+
+	bBkt := &blockingGetBucket{Bucket: bkt, name: path.Join(id.String(), MetaFilename), started: make(chan struct{}, 1), release: make(chan struct{})}
+	c, err := NewMetaCache(log.NewNopLogger(), bBkt, 10, prometheus.NewRegistry())
+	testutil.Ok(t, err)
+
+	cctx, cancel := context.WithCancel(ctx)
+	canceled := make(chan error)
+	go func() {
+		_, err := c.DownloadMeta(cctx, id)
+		canceled <- err
+	}()
+	<-bBkt.started
+
+	// Second caller shares the download, which is not canceled together with the first caller.
+	shared := make(chan error)
+	go func() {
+		m, err := c.DownloadMeta(ctx, id)
+		if err == nil && m.ULID != id {
+			err = errors.Errorf("unexpected meta of block %s", m.ULID)
+		}
+		shared <- err
+	}()
+	for promtest.ToFloat64(c.requests) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	testutil.Equals(t, context.Canceled, <-canceled)
+	close(bBkt.release)
+	testutil.Ok(t, <-shared)
+}
@@ -0,0 +1,172 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// MetaDiffKind is the kind of change of a meta field.
+type MetaDiffKind string
+
+const (
+	// MetaFieldAdded means the field is present only in the new meta.
+	MetaFieldAdded MetaDiffKind = "added"
+	// MetaFieldRemoved means the field is present only in the old meta.
+	MetaFieldRemoved MetaDiffKind = "removed"
+	// MetaFieldChanged means the field has a different value in the new meta.
+	MetaFieldChanged MetaDiffKind = "changed"
+)
+
+// MetaFieldDiff describes a change of a single meta field.
+type MetaFieldDiff struct {
+	// Field is the JSON path of the field, e.g. "thanos.labels.cluster", "thanos.files.index" or "thanos.rewrites[1]".
+	Field string       `json:"field"`
+	Kind  MetaDiffKind `json:"kind"`
+	// Old and New are the encoded values of the field, empty if the field is added or removed respectively.
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+func (d MetaFieldDiff) String() string {
+	switch d.Kind {
+	case MetaFieldAdded:
+		return fmt.Sprintf("+ %s: %s", d.Field, d.New)
+	case MetaFieldRemoved:
+		return fmt.Sprintf("- %s: %s", d.Field, d.Old)
+	}
+	return fmt.Sprintf("~ %s: %s -> %s", d.Field, d.Old, d.New)
+}
+
+// DiffMeta returns changes of the fields of the previous meta in the current one, e.g. to review or audit automated
+// changes of meta. It covers the time range, stats, compaction level, external labels, resolution, source, annotations,
+// rewrites and files. Files are compared by their relative paths, size, hash and encryption. Nil meta is treated as
+// empty. It returns nil if there are no changes.
+func DiffMeta(prev, cur *Meta) []MetaFieldDiff {
+	if prev == nil {
+		prev = &Meta{}
+	}
+	if cur == nil {
+		cur = &Meta{}
+	}
+
+	var d metaDiff
+	d.value("ulid", prev.ULID, cur.ULID)
+	d.value("minTime", prev.MinTime, cur.MinTime)
+	d.value("maxTime", prev.MaxTime, cur.MaxTime)
+	d.value("stats.numSamples", prev.Stats.NumSamples, cur.Stats.NumSamples)
+	d.value("stats.numSeries", prev.Stats.NumSeries, cur.Stats.NumSeries)
+	d.value("stats.numChunks", prev.Stats.NumChunks, cur.Stats.NumChunks)
+	d.value("compaction.level", prev.Compaction.Level, cur.Compaction.Level)
+	d.stringMap("thanos.labels", prev.Thanos.Labels, cur.Thanos.Labels)
+	d.value("thanos.downsample.resolution", prev.Thanos.Downsample.Resolution, cur.Thanos.Downsample.Resolution)
+	d.value("thanos.source", prev.Thanos.Source, cur.Thanos.Source)
+	d.stringMap("thanos.annotations", prev.Thanos.Annotations, cur.Thanos.Annotations)
+	d.rewrites(prev.Thanos.Rewrites, cur.Thanos.Rewrites)
+	d.files(prev.Thanos.Files, cur.Thanos.Files)
+	return d.diffs
+}
+
+type metaDiff struct {
+	diffs []MetaFieldDiff
+}
+
+func (d *metaDiff) value(field string, prev, cur any) {
+	if reflect.DeepEqual(prev, cur) {
+		return
+	}
+	d.diffs = append(d.diffs, MetaFieldDiff{Field: field, Kind: MetaFieldChanged, Old: encodeDiffValue(prev), New: encodeDiffValue(cur)})
+}
+
+func (d *metaDiff) added(field string, cur any) {
+	d.diffs = append(d.diffs, MetaFieldDiff{Field: field, Kind: MetaFieldAdded, New: encodeDiffValue(cur)})
+}
+
+func (d *metaDiff) removed(field string, prev any) {
+	d.diffs = append(d.diffs, MetaFieldDiff{Field: field, Kind: MetaFieldRemoved, Old: encodeDiffValue(prev)})
+}
+
+// stringMap diffs maps by key, in the order of keys.
+func (d *metaDiff) stringMap(field string, prev, cur map[string]string) {
+	keys := make([]string, 0, len(prev)+len(cur))
+	for k := range prev {
+		keys = append(keys, k)
+	}
+	for k := range cur {
+		if _, ok := prev[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		o, inOld := prev[k]
+		n, inNew := cur[k]
+		switch {
+		case !inOld:
+			d.added(field+"."+k, n)
+		case !inNew:
+			d.removed(field+"."+k, o)
+		default:
+			d.value(field+"."+k, o, n)
+		}
+	}
+}
+
+// rewrites diffs rewrites by their position, as rewrites are only ever appended.
+func (d *metaDiff) rewrites(prev, cur []Rewrite) {
+	for i := 0; i < max(len(prev), len(cur)); i++ {
+		field := fmt.Sprintf("thanos.rewrites[%d]", i)
+		switch {
+		case i >= len(prev):
+			d.added(field, cur[i])
+		case i >= len(cur):
+			d.removed(field, prev[i])
+		default:
+			d.value(field, prev[i], cur[i])
+		}
+	}
+}
+
+// files diffs files by their relative paths. Changed and added files are listed in the order of new files, followed
+// by removed ones in the order of old files.
+func (d *metaDiff) files(prev, cur []File) {
+	prevByPath := make(map[string]File, len(prev))
+	for _, f := range prev {
+		prevByPath[f.RelPath] = f
+	}
+	curPaths := make(map[string]struct{}, len(cur))
+	for _, f := range cur {
+		curPaths[f.RelPath] = struct{}{}
+		field := "thanos.files." + f.RelPath
+		o, ok := prevByPath[f.RelPath]
+		if !ok {
+			d.added(field, f)
+			continue
+		}
+		d.value(field, o, f)
+	}
+	for _, f := range prev {
+		if _, ok := curPaths[f.RelPath]; !ok {
+			d.removed("thanos.files."+f.RelPath, f)
+		}
+	}
+}
+
+func encodeDiffValue(v any) string {
+	if s, ok := v.(fmt.Stringer); ok {
+		return s.String()
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.String {
+		return rv.String()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
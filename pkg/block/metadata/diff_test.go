@@ -0,0 +1,59 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+func TestDiffMeta(t *testing.T) {
+	old := &Meta{
+		BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(1, nil), MinTime: 0, MaxTime: 100},
+		Thanos: Thanos{
+			Labels: map[string]string{"a": "1", "b": "2"},
+			Files: []File{
+				{RelPath: "chunks/000001", SizeBytes: 100},
+				{RelPath: "index", SizeBytes: 50},
+				{RelPath: MetaFilename},
+			},
+		},
+	}
+	testutil.Equals(t, 0, len(DiffMeta(old, old)))
+	testutil.Equals(t, 0, len(DiffMeta(nil, nil)))
+
+	updated := &Meta{
+		BlockMeta: old.BlockMeta,
+		Thanos: Thanos{
+			Labels:     map[string]string{"a": "1", "b": "3", "c": "4"},
+			Downsample: ThanosDownsample{Resolution: 300000},
+			Rewrites:   []Rewrite{{Sources: []ulid.ULID{old.ULID}}},
+			Files: []File{
+				{RelPath: "chunks/000002", SizeBytes: 80},
+				{RelPath: "index", SizeBytes: 40},
+				{RelPath: MetaFilename},
+			},
+		},
+	}
+	delete(updated.Thanos.Labels, "a")
+	testutil.Equals(t, []MetaFieldDiff{
+		{Field: "thanos.labels.a", Kind: MetaFieldRemoved, Old: "1"},
+		{Field: "thanos.labels.b", Kind: MetaFieldChanged, Old: "2", New: "3"},
+		{Field: "thanos.labels.c", Kind: MetaFieldAdded, New: "4"},
+		{Field: "thanos.downsample.resolution", Kind: MetaFieldChanged, Old: "0", New: "300000"},
+		{Field: "thanos.rewrites[0]", Kind: MetaFieldAdded, New: `{"sources":["00000000010000000000000000"]}`},
+		{Field: "thanos.files.chunks/000002", Kind: MetaFieldAdded, New: `{"rel_path":"chunks/000002","size_bytes":80}`},
+		{Field: "thanos.files.index", Kind: MetaFieldChanged, Old: `{"rel_path":"index","size_bytes":50}`, New: `{"rel_path":"index","size_bytes":40}`},
+		{Field: "thanos.files.chunks/000001", Kind: MetaFieldRemoved, Old: `{"rel_path":"chunks/000001","size_bytes":100}`},
+	}, DiffMeta(old, updated))
+
+	// Nil meta is empty.
+	diffs := DiffMeta(nil, old)
+	testutil.Equals(t, MetaFieldDiff{Field: "ulid", Kind: MetaFieldChanged, Old: "00000000000000000000000000", New: old.ULID.String()}, diffs[0])
+	testutil.Equals(t, MetaFieldDiff{Field: "thanos.files.meta.json", Kind: MetaFieldAdded, New: `{"rel_path":"meta.json"}`}, diffs[len(diffs)-1])
+	testutil.Equals(t, "+ thanos.files.meta.json: {\"rel_path\":\"meta.json\"}", diffs[len(diffs)-1].String())
+}
@@ -4,12 +4,16 @@
 package metadata
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/go-kit/log"
 	"github.com/minio/sha256-simd"
 	"github.com/pkg/errors"
@@ -18,11 +22,16 @@ import (
 )
 
 // HashFunc indicates what type of hash it is.
+// SHA256Func is a cryptographic hash, which makes accidental collisions practically impossible, but is relatively slow
+// for large files. XXHash64Func is a non-cryptographic hash which is many times faster, at the cost of a weaker
+// (64 bit) protection against collisions, which is still plenty for detecting corrupted or changed files.
 type HashFunc string
 
 const (
 	// SHA256Func shows that SHA256 has been used to generate the hash.
 	SHA256Func HashFunc = "SHA256"
+	// XXHash64Func shows that xxhash64 has been used to generate the hash.
+	XXHash64Func HashFunc = "XXHASH64"
 	// NoneFunc shows that hashes should not be added. Used internally.
 	NoneFunc HashFunc = ""
 )
@@ -33,32 +42,96 @@ type ObjectHash struct {
 	Value string   `json:"value"`
 }
 
-// Equal returns true if two hashes are equal.
+// Equal returns true if two hashes are equal. Hashes calculated with different functions are never equal.
 func (oh *ObjectHash) Equal(other *ObjectHash) bool {
-	return oh.Value == other.Value
+	return oh.Func == other.Func && oh.Value == other.Value
 }
 
-// CalculateHash calculates the hash of the given type.
-func CalculateHash(p string, hf HashFunc, logger log.Logger) (ObjectHash, error) {
+// NewHash returns a new hash.Hash computing the hash of the given type.
+func NewHash(hf HashFunc) (hash.Hash, error) {
 	switch hf {
 	case SHA256Func:
-		f, err := os.Open(filepath.Clean(p))
-		if err != nil {
-			return ObjectHash{}, errors.Wrap(err, "opening file")
-		}
-		defer runutil.CloseWithLogOnErr(logger, f, "closing %s", p)
+		return sha256.New(), nil
+	case XXHash64Func:
+		return xxhash.New(), nil
+	}
+	return nil, fmt.Errorf("hash function %v is not supported", hf)
+}
+
+// ObjectHashFrom returns ObjectHash with the current value of h, calculated with the hash function hf.
+func ObjectHashFrom(hf HashFunc, h hash.Hash) ObjectHash {
+	return ObjectHash{
+		Func:  hf,
+		Value: hex.EncodeToString(h.Sum(nil)),
+	}
+}
 
-		h := sha256.New()
+// CalculateHash calculates the hash of the given type.
+func CalculateHash(p string, hf HashFunc, logger log.Logger) (ObjectHash, error) {
+	return CalculateHashWithContext(context.Background(), p, hf, logger)
+}
 
-		if _, err := io.Copy(h, f); err != nil {
-			return ObjectHash{}, errors.Wrap(err, "copying")
-		}
+// CalculateHashWithContext works like CalculateHash, but stops hashing as soon as the context is canceled.
+func CalculateHashWithContext(ctx context.Context, p string, hf HashFunc, logger log.Logger) (ObjectHash, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectHash{}, err
+	}
+	h, err := NewHash(hf)
+	if err != nil {
+		return ObjectHash{}, err
+	}
 
-		return ObjectHash{
-			Func:  SHA256Func,
-			Value: hex.EncodeToString(h.Sum(nil)),
-		}, nil
+	f, err := os.Open(filepath.Clean(p))
+	if err != nil {
+		return ObjectHash{}, errors.Wrap(err, "opening file")
 	}
-	return ObjectHash{}, fmt.Errorf("hash function %v is not supported", hf)
+	defer runutil.CloseWithLogOnErr(logger, f, "closing %s", p)
 
+	if _, err := io.Copy(h, &contextReader{ctx: ctx, r: f}); err != nil {
+		return ObjectHash{}, errors.Wrap(err, "copying")
+	}
+	return ObjectHashFrom(hf, h), nil
+}
+
+// contextReader is a reader which fails once the context is canceled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// ContentHash returns a digest of the block content, combining hashes of all block files from the Files section,
+// sorted by relative path, except for meta itself, which is unique to each block. Byte-identical blocks with
+// different ULIDs have the same content hash, as long as their files were hashed with the same hash function.
+// It fails if some file has no hash.
+func (m *Meta) ContentHash() (string, error) {
+	files := make([]File, 0, len(m.Thanos.Files))
+	for _, f := range m.Thanos.Files {
+		if f.RelPath == MetaFilename || f.RelPath == MetaGzipFilename {
+			continue
+		}
+		if f.Hash == nil || f.Hash.Func == NoneFunc {
+			return "", errors.Errorf("file %s has no hash", f.RelPath)
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return "", errors.New("no hashed files")
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].RelPath < files[j].RelPath
+	})
+
+	h := sha256.New()
+	for _, f := range files {
+		// Separators make the encoding unambiguous, as relative paths contain neither.
+		_, _ = fmt.Fprintf(h, "%s\x00%s\x00%s\n", f.RelPath, f.Hash.Func, f.Hash.Value)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
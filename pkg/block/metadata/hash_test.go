@@ -4,10 +4,12 @@
 package metadata
 
 import (
+	"context"
 	"os"
 	"testing"
 
 	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
 
 	"github.com/efficientgo/core/testutil"
 )
@@ -25,6 +27,56 @@ func TestHashSmoke(t *testing.T) {
 	testutil.Ok(t, err)
 	testutil.Equals(t, exp, h)
 
+	exp = ObjectHash{Func: XXHash64Func, Value: "4fdcca5ddb678139"}
+	h, err = CalculateHash(f.Name(), XXHash64Func, log.NewNopLogger())
+	testutil.Ok(t, err)
+	testutil.Equals(t, exp, h)
+
 	_, err = CalculateHash(f.Name(), NoneFunc, log.NewNopLogger())
 	testutil.NotOk(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = CalculateHashWithContext(ctx, f.Name(), SHA256Func, log.NewNopLogger())
+	testutil.Equals(t, context.Canceled, err)
+}
+
+func TestObjectHashEqual(t *testing.T) {
+	h := ObjectHash{Func: SHA256Func, Value: "4fdcca5ddb678139"}
+	testutil.Assert(t, h.Equal(&ObjectHash{Func: SHA256Func, Value: "4fdcca5ddb678139"}))
+	testutil.Assert(t, !h.Equal(&ObjectHash{Func: SHA256Func, Value: "9f86d081884c7d65"}))
+	testutil.Assert(t, !h.Equal(&ObjectHash{Func: XXHash64Func, Value: "4fdcca5ddb678139"}))
+}
+
+func TestMeta_ContentHash(t *testing.T) {
+	files := func() []File {
+		return []File{
+			{RelPath: "chunks/000001", SizeBytes: 100, Hash: &ObjectHash{Func: SHA256Func, Value: "aa"}},
+			{RelPath: "index", SizeBytes: 50, Hash: &ObjectHash{Func: SHA256Func, Value: "bb"}},
+			{RelPath: MetaFilename},
+		}
+	}
+	m1 := &Meta{Thanos: Thanos{Files: files()}}
+	m1.ULID = ulid.MustNew(1, nil)
+	m2 := &Meta{Thanos: Thanos{Files: files()}}
+	m2.ULID = ulid.MustNew(2, nil)
+	m2.Thanos.Files[0], m2.Thanos.Files[1] = m2.Thanos.Files[1], m2.Thanos.Files[0]
+
+	h1, err := m1.ContentHash()
+	testutil.Ok(t, err)
+	h2, err := m2.ContentHash()
+	testutil.Ok(t, err)
+	testutil.Equals(t, h1, h2)
+
+	m2.Thanos.Files[0].Hash = &ObjectHash{Func: SHA256Func, Value: "cc"}
+	h2, err = m2.ContentHash()
+	testutil.Ok(t, err)
+	testutil.Assert(t, h1 != h2, "different content should have different hash")
+
+	m2.Thanos.Files[0].Hash = nil
+	_, err = m2.ContentHash()
+	testutil.NotOk(t, err)
+
+	_, err = (&Meta{}).ContentHash()
+	testutil.NotOk(t, err)
 }
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"io"
 	"path"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/oklog/ulid"
@@ -27,12 +28,17 @@ const (
 	// NoDownsampleMarkFilename is the known json filenanme for optional file storing details about why block has to be excluded from downsampling.
 	// If such file is present in block dir, it means the block has to be excluded from downsampling.
 	NoDownsampleMarkFilename = "no-downsample-mark.json"
+	// FrozenMarkFilename is the known json filename for optional file storing details about why block is frozen.
+	// If such file is present in block dir, it means the block must not be modified nor deleted, e.g. due to legal hold.
+	FrozenMarkFilename = "frozen.json"
 	// DeletionMarkVersion1 is the version of deletion-mark file supported by Thanos.
 	DeletionMarkVersion1 = 1
 	// NoCompactMarkVersion1 is the version of no-compact-mark file supported by Thanos.
 	NoCompactMarkVersion1 = 1
 	// NoDownsampleVersion1 is the version of no-downsample-mark file supported by Thanos.
 	NoDownsampleMarkVersion1 = 1
+	// FrozenMarkVersion1 is the version of frozen mark file supported by Thanos.
+	FrozenMarkVersion1 = 1
 )
 
 var (
@@ -59,10 +65,21 @@ type DeletionMark struct {
 
 	// DeletionTime is a unix timestamp of when the block was marked to be deleted.
 	DeletionTime int64 `json:"deletion_time"`
+	// RetentionDelay is an optional grace period in seconds, counted from DeletionTime, before the block can be deleted.
+	RetentionDelay int64 `json:"retention_delay,omitempty"`
+	// Annotations are optional machine-readable key-value details of the mark, e.g. the job which marked the block.
+	// Use Details for human readable text.
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 func (m *DeletionMark) markerFilename() string { return DeletionMarkFilename }
 
+// IsReadyForDeletion returns true if the grace period of the deletion mark has elapsed at the given time.
+// Marks without RetentionDelay are ready right after DeletionTime; it's up to the caller to apply its own delay for those.
+func IsReadyForDeletion(m DeletionMark, now time.Time) bool {
+	return !now.Before(time.Unix(m.DeletionTime+m.RetentionDelay, 0))
+}
+
 // NoCompactReason is a reason for a block to be excluded from compaction.
 type NoCompactReason string
 
@@ -83,6 +100,41 @@ const (
 	DownsampleVerticalCompactionNoCompactReason = "downsample-vertical-compaction"
 )
 
+// NoCompactReasons returns all known reasons of excluding blocks from compaction.
+func NoCompactReasons() []NoCompactReason {
+	return []NoCompactReason{
+		ManualNoCompactReason,
+		IndexSizeExceedingNoCompactReason,
+		OutOfOrderChunksNoCompactReason,
+		DownsampleVerticalCompactionNoCompactReason,
+	}
+}
+
+// NoDownsampleReasons returns all known reasons of excluding blocks from downsample.
+func NoDownsampleReasons() []NoDownsampleReason {
+	return []NoDownsampleReason{ManualNoDownsampleReason}
+}
+
+// IsValidNoCompactReason returns true if the reason is one of NoCompactReasons.
+func IsValidNoCompactReason(reason NoCompactReason) bool {
+	for _, r := range NoCompactReasons() {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidNoDownsampleReason returns true if the reason is one of NoDownsampleReasons.
+func IsValidNoDownsampleReason(reason NoDownsampleReason) bool {
+	for _, r := range NoDownsampleReasons() {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
 // NoCompactMark marker stores reason of block being excluded from compaction if needed.
 type NoCompactMark struct {
 	// ID of the tsdb block.
@@ -95,10 +147,17 @@ type NoCompactMark struct {
 	// NoCompactTime is a unix timestamp of when the block was marked for no compact.
 	NoCompactTime int64           `json:"no_compact_time"`
 	Reason        NoCompactReason `json:"reason"`
+	// ExpiryTime is an optional unix timestamp after which the mark is no longer in effect. Marks without it never expire.
+	ExpiryTime int64 `json:"expiry_time,omitempty"`
 }
 
 func (n *NoCompactMark) markerFilename() string { return NoCompactMarkFilename }
 
+// IsNoCompactActive returns true if the no-compact mark is still in effect at the given time, i.e. it has not expired.
+func IsNoCompactActive(m NoCompactMark, now time.Time) bool {
+	return m.ExpiryTime == 0 || now.Before(time.Unix(m.ExpiryTime, 0))
+}
+
 // NoDownsampleMark marker stores reason of block being excluded from downsample if needed.
 type NoDownsampleMark struct {
 	// ID of the tsdb block.
@@ -115,6 +174,21 @@ type NoDownsampleMark struct {
 
 func (n *NoDownsampleMark) markerFilename() string { return NoDownsampleMarkFilename }
 
+// FrozenMark marker stores reason of block being frozen, i.e. excluded from any modification or deletion.
+type FrozenMark struct {
+	// ID of the tsdb block.
+	ID ulid.ULID `json:"id"`
+	// Version of the file.
+	Version int `json:"version"`
+	// Details is a human readable string giving details of reason, e.g. reference of the legal hold.
+	Details string `json:"details,omitempty"`
+
+	// FrozenTime is a unix timestamp of when the block was frozen.
+	FrozenTime int64 `json:"frozen_time"`
+}
+
+func (f *FrozenMark) markerFilename() string { return FrozenMarkFilename }
+
 // ReadMarker reads the given mark file from <dir>/<marker filename>.json in bucket.
 func ReadMarker(ctx context.Context, logger log.Logger, bkt objstore.InstrumentedBucketReader, dir string, marker Marker) error {
 	markerFile := path.Join(dir, marker.markerFilename())
@@ -144,6 +218,10 @@ func ReadMarker(ctx context.Context, logger log.Logger, bkt objstore.Instrumente
 		if version := marker.(*NoDownsampleMark).Version; version != NoDownsampleMarkVersion1 {
 			return errors.Errorf("unexpected no-downsample-mark file version %d, expected %d", version, NoDownsampleMarkVersion1)
 		}
+	case FrozenMarkFilename:
+		if version := marker.(*FrozenMark).Version; version != FrozenMarkVersion1 {
+			return errors.Errorf("unexpected frozen mark file version %d, expected %d", version, FrozenMarkVersion1)
+		}
 	case DeletionMarkFilename:
 		if version := marker.(*DeletionMark).Version; version != DeletionMarkVersion1 {
 			return errors.Errorf("unexpected deletion-mark file version %d, expected %d", version, DeletionMarkVersion1)
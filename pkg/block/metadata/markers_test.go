@@ -67,6 +67,22 @@ func TestReadMarker(t *testing.T) {
 		err = ReadMarker(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, blockWithValidMark.String()), &d)
 		testutil.Ok(t, err)
 		testutil.Equals(t, *expected, d)
+
+		blockWithAnnotatedMark := ulid.MustNew(uint64(4), nil)
+		buf.Reset()
+		expected = &DeletionMark{
+			ID:           blockWithAnnotatedMark,
+			DeletionTime: time.Now().Unix(),
+			Version:      1,
+			Details:      "tenant offboarded",
+			Annotations:  map[string]string{"ticket": "OPS-123"},
+		}
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(expected))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(tmpDir, blockWithAnnotatedMark.String(), DeletionMarkFilename), &buf))
+		d = DeletionMark{}
+		err = ReadMarker(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, blockWithAnnotatedMark.String()), &d)
+		testutil.Ok(t, err)
+		testutil.Equals(t, *expected, d)
 	})
 	t.Run(NoCompactMarkFilename, func(t *testing.T) {
 		blockWithoutMark := ulid.MustNew(uint64(1), nil)
@@ -109,3 +125,34 @@ func TestReadMarker(t *testing.T) {
 		testutil.Equals(t, *expected, n)
 	})
 }
+
+func TestIsReadyForDeletion(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	testutil.Assert(t, IsReadyForDeletion(DeletionMark{DeletionTime: 1000}, now))
+	testutil.Assert(t, !IsReadyForDeletion(DeletionMark{DeletionTime: 1001}, now))
+	testutil.Assert(t, !IsReadyForDeletion(DeletionMark{DeletionTime: 900, RetentionDelay: 101}, now))
+	testutil.Assert(t, IsReadyForDeletion(DeletionMark{DeletionTime: 900, RetentionDelay: 100}, now))
+}
+
+func TestIsNoCompactActive(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	testutil.Assert(t, IsNoCompactActive(NoCompactMark{NoCompactTime: 900}, now))
+	testutil.Assert(t, IsNoCompactActive(NoCompactMark{NoCompactTime: 900, ExpiryTime: 1001}, now))
+	testutil.Assert(t, !IsNoCompactActive(NoCompactMark{NoCompactTime: 900, ExpiryTime: 1000}, now))
+}
+
+func TestIsValidReason(t *testing.T) {
+	for _, r := range NoCompactReasons() {
+		testutil.Assert(t, IsValidNoCompactReason(r), "%s", r)
+	}
+	testutil.Assert(t, IsValidNoCompactReason(IndexSizeExceedingNoCompactReason))
+	testutil.Assert(t, !IsValidNoCompactReason("manaul"))
+	testutil.Assert(t, !IsValidNoCompactReason(""))
+
+	for _, r := range NoDownsampleReasons() {
+		testutil.Assert(t, IsValidNoDownsampleReason(r), "%s", r)
+	}
+	testutil.Assert(t, !IsValidNoDownsampleReason("manaul"))
+}
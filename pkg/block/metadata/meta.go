@@ -9,11 +9,22 @@ package metadata
 // this package.
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/oklog/ulid"
@@ -48,6 +59,9 @@ const (
 const (
 	// MetaFilename is the known JSON filename for meta information.
 	MetaFilename = "meta.json"
+	// MetaGzipFilename is the filename of gzip-compressed meta information, used instead of MetaFilename
+	// by blocks uploaded with compressed meta.
+	MetaGzipFilename = "meta.json.gz"
 	// TSDBVersion1 is a enumeration of TSDB meta versions supported by Thanos.
 	TSDBVersion1 = 1
 	// ThanosVersion1 is a enumeration of Thanos section of TSDB meta supported by Thanos.
@@ -66,6 +80,126 @@ func (m *Meta) String() string {
 	return fmt.Sprintf("%s (min time: %d, max time: %d)", m.ULID, m.MinTime, m.MaxTime)
 }
 
+// TimeRange returns the time range covered by the block. As for MaxTime, end is exclusive.
+func (m *Meta) TimeRange() (start, end time.Time) {
+	return time.UnixMilli(m.MinTime).UTC(), time.UnixMilli(m.MaxTime).UTC()
+}
+
+// Duration returns the duration of the time range covered by the block.
+func (m *Meta) Duration() time.Duration {
+	return time.Duration(m.MaxTime-m.MinTime) * time.Millisecond
+}
+
+// IsDownsampled returns true if the block was produced by downsampling, i.e. it has positive resolution.
+func (m *Meta) IsDownsampled() bool {
+	return m.Thanos.Downsample.Resolution > 0
+}
+
+// IsRaw returns true if the block has raw, not downsampled data. Negative resolution, which is possible only in
+// corrupted meta, is treated as raw too; Thanos.Validate reports it, so callers can log such meta.
+func (m *Meta) IsRaw() bool {
+	return !m.IsDownsampled()
+}
+
+// TotalSizeBytes returns the sum of sizes of all block files known from the Files section.
+func (m *Meta) TotalSizeBytes() int64 {
+	size, _ := m.TotalSizeWithUnknown()
+	return size
+}
+
+// TotalSizeWithUnknown works like TotalSizeBytes, but also returns true if the size of some block files is unknown,
+// so the returned size is only a lower bound. That's the case for blocks without the Files section (e.g. listing only
+// deprecated SegmentFiles) and for files recorded without size. Meta file, which is never recorded with size, is
+// not considered unknown.
+func (m *Meta) TotalSizeWithUnknown() (size int64, hasUnknown bool) {
+	if len(m.Thanos.Files) == 0 {
+		return 0, true
+	}
+	for _, f := range m.Thanos.Files {
+		size += f.SizeBytes
+		if f.SizeBytes == 0 && f.RelPath != MetaFilename {
+			hasUnknown = true
+		}
+	}
+	return size, hasUnknown
+}
+
+// Summary is an overview of the block meta, e.g. for inspection tools.
+type Summary struct {
+	ULID     ulid.ULID
+	Start    time.Time
+	End      time.Time
+	Duration time.Duration
+	// Resolution is the downsample resolution of the block. It's not guaranteed to be valid.
+	Resolution ResolutionLevel
+	Source     SourceType
+	Labels     labels.Labels
+
+	NumSeries  uint64
+	NumChunks  uint64
+	NumSamples uint64
+
+	// NumFiles is the number of block files known from the Files section, including meta.json.
+	NumFiles       int
+	TotalSizeBytes int64
+	// SizeUnknown is true if TotalSizeBytes is only a lower bound. See TotalSizeWithUnknown.
+	SizeUnknown bool
+}
+
+// Summary returns an overview of the block meta.
+func (m *Meta) Summary() Summary {
+	start, end := m.TimeRange()
+	size, sizeUnknown := m.TotalSizeWithUnknown()
+	return Summary{
+		ULID:           m.ULID,
+		Start:          start,
+		End:            end,
+		Duration:       m.Duration(),
+		Resolution:     ResolutionLevel(m.Thanos.Downsample.Resolution),
+		Source:         m.Thanos.Source,
+		Labels:         labels.FromMap(m.Thanos.Labels),
+		NumSeries:      m.Stats.NumSeries,
+		NumChunks:      m.Stats.NumChunks,
+		NumSamples:     m.Stats.NumSamples,
+		NumFiles:       len(m.Thanos.Files),
+		TotalSizeBytes: size,
+		SizeUnknown:    sizeUnknown,
+	}
+}
+
+// EstimateDownload estimates how long downloading the block files known from the Files section takes, if each
+// file is downloaded over a single connection with the given throughput and at most concurrency files are downloaded
+// at once. Files are assumed to be scheduled largest first, each to the connection which becomes free first. Files of
+// unknown size are not accounted for, see TotalSizeWithUnknown. It returns 0 for non-positive throughput.
+func EstimateDownload(meta *Meta, throughputBytesPerSec float64, concurrency int) time.Duration {
+	if throughputBytesPerSec <= 0 {
+		return 0
+	}
+	concurrency = max(concurrency, 1)
+
+	sizes := make([]int64, 0, len(meta.Thanos.Files))
+	for _, f := range meta.Thanos.Files {
+		if f.SizeBytes > 0 {
+			sizes = append(sizes, f.SizeBytes)
+		}
+	}
+	slices.Sort(sizes)
+
+	loads := make([]int64, min(concurrency, len(sizes)))
+	var longest int64
+	for i := len(sizes) - 1; i >= 0; i-- {
+		j := 0
+		for k := range loads {
+			if loads[k] < loads[j] {
+				j = k
+			}
+		}
+		loads[j] += sizes[i]
+		longest = max(longest, loads[j])
+	}
+	return time.Duration(float64(longest) / throughputBytesPerSec * float64(time.Second))
+}
+
 // Thanos holds block meta information specific to Thanos.
 type Thanos struct {
 	// Version of Thanos meta file. If none specified, 1 is assumed (since first version did not have explicit version specified).
@@ -97,6 +231,36 @@ type Thanos struct {
 
 	// Extensions are used for plugin any arbitrary additional information for block. Optional.
 	Extensions any `json:"extensions,omitempty"`
+
+	// UploadTime is a unix timestamp of when the block was uploaded to the bucket. Optional; zero means unknown.
+	UploadTime int64 `json:"upload_time,omitempty"`
+
+	// Annotations are informational key-value pairs, e.g. owner team or pipeline version. Unlike Labels, they do not
+	// affect grouping of blocks for compaction, and unlike Extensions, they are not meant to be parsed. Optional.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// SetAnnotation sets the annotation with the given key to the given value.
+func (m *Thanos) SetAnnotation(key, value string) {
+	if m.Annotations == nil {
+		m.Annotations = map[string]string{}
+	}
+	m.Annotations[key] = value
+}
+
+// GetAnnotation returns the value of the annotation with the given key and whether it's set.
+func (m *Thanos) GetAnnotation(key string) (string, bool) {
+	v, ok := m.Annotations[key]
+	return v, ok
+}
+
+// IsRecentlyUploaded returns true if the block was uploaded less than delay before now. Blocks with unknown
+// upload time are not considered recently uploaded.
+func IsRecentlyUploaded(meta *Meta, delay time.Duration, now time.Time) bool {
+	if meta.Thanos.UploadTime == 0 {
+		return false
+	}
+	return now.Before(time.Unix(meta.Thanos.UploadTime, 0).Add(delay))
 }
 
 type IndexStats struct {
@@ -124,6 +288,94 @@ func ConvertExtensions(extensions any, v any) (any, error) {
 	return v, nil
 }
 
+var (
+	extensionsMtx      sync.RWMutex
+	registeredExtTypes = map[string]reflect.Type{}
+)
+
+// RegisterExtension registers the concrete type of the extension stored under the given key of Thanos.Extensions,
+// so TypedExtensions can decode it directly. The type is taken from prototype, e.g. RegisterExtension("my_ext", MyExt{}).
+// It's meant to be called from init functions and panics if the key is already registered.
+func RegisterExtension(key string, prototype any) {
+	extensionsMtx.Lock()
+	defer extensionsMtx.Unlock()
+
+	if _, ok := registeredExtTypes[key]; ok {
+		panic(fmt.Sprintf("extension %q is already registered", key))
+	}
+	t := reflect.TypeOf(prototype)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	registeredExtTypes[key] = t
+}
+
+// TypedExtensions returns extensions, which have to be a JSON object, by their keys. Values of keys registered with
+// RegisterExtension are decoded into pointers to the registered types, e.g. *MyExt. Values of other keys are decoded
+// as by encoding/json into `any`. Extensions are encoded only once, regardless of number of keys.
+// Nil extensions result in an empty map.
+func (m *Thanos) TypedExtensions() (map[string]any, error) {
+	res := map[string]any{}
+	if m.Extensions == nil {
+		return res, nil
+	}
+
+	var raw map[string]json.RawMessage
+	if _, err := ConvertExtensions(m.Extensions, &raw); err != nil {
+		return nil, errors.Wrap(err, "extensions are not a JSON object")
+	}
+
+	extensionsMtx.RLock()
+	defer extensionsMtx.RUnlock()
+
+	for key, b := range raw {
+		var v any
+		if t, ok := registeredExtTypes[key]; ok {
+			v = reflect.New(t).Interface()
+		} else {
+			v = new(any)
+		}
+		if err := json.Unmarshal(b, v); err != nil {
+			return nil, errors.Wrapf(err, "decode extension %q", key)
+		}
+		if p, ok := v.(*any); ok {
+			v = *p
+		}
+		res[key] = v
+	}
+	return res, nil
+}
+
+// ParquetMigratedExtensionKey is the key of the extension marking the block as migrated to parquet format.
+// The value of the extension is a boolean.
+const ParquetMigratedExtensionKey = "parquet_migrated"
+
+func init() {
+	RegisterExtension(ParquetMigratedExtensionKey, false)
+}
+
+// IsParquetMigrated returns true if the block is marked as migrated to parquet format in its extensions.
+// Nil extensions, extensions which are not a JSON object and missing key all mean the block is not migrated.
+// Malformed value of the extension results in an error.
+func IsParquetMigrated(meta *Meta) (bool, error) {
+	if meta.Thanos.Extensions == nil {
+		return false, nil
+	}
+	var raw map[string]json.RawMessage
+	if _, err := ConvertExtensions(meta.Thanos.Extensions, &raw); err != nil {
+		return false, nil
+	}
+	b, ok := raw[ParquetMigratedExtensionKey]
+	if !ok {
+		return false, nil
+	}
+	var migrated bool
+	if err := json.Unmarshal(b, &migrated); err != nil {
+		return false, errors.Wrapf(err, "decode extension %q of block %s", ParquetMigratedExtensionKey, meta.ULID)
+	}
+	return migrated, nil
+}
+
 type Rewrite struct {
 	// ULIDs of all source head blocks that went into the block.
 	Sources []ulid.ULID `json:"sources,omitempty"`
@@ -131,6 +383,76 @@ type Rewrite struct {
 	DeletionsApplied []DeletionRequest `json:"deletions_applied,omitempty"`
 	// Relabels if applied.
 	RelabelsApplied []*relabel.Config `json:"relabels_applied,omitempty"`
+	// ExternalLabelsChanged is present if external labels of the block were replaced, without rewriting its data.
+	ExternalLabelsChanged *ExternalLabelsChange `json:"external_labels_changed,omitempty"`
+	// FilesRepaired are relative paths of files, which stats were added, changed or removed in meta to match the
+	// block contents, without rewriting its data.
+	FilesRepaired []string `json:"files_repaired,omitempty"`
+}
+
+// ExternalLabelsChange records external labels of the block before and after they were replaced.
+// NOTE: It's not recorded as RelabelsApplied, as relabel.Config can't be encoded to JSON and decoded back.
+type ExternalLabelsChange struct {
+	Old map[string]string `json:"old"`
+	New map[string]string `json:"new"`
+}
+
+// AppendRewrite records a rewrite of the block, which had the given source blocks, applying the given deletions and
+// relabels, in meta's Thanos section. Sources are required, so that the rewrite can be tracked back.
+func AppendRewrite(meta *Meta, sources []ulid.ULID, deletions []DeletionRequest, relabels []*relabel.Config) error {
+	if len(sources) == 0 {
+		return errors.New("rewrite requires at least one source block")
+	}
+	for _, s := range sources {
+		if s == (ulid.ULID{}) {
+			return errors.New("rewrite source block ID is empty")
+		}
+	}
+	for i, r := range relabels {
+		if r == nil {
+			return errors.Errorf("rewrite relabel config %d is nil", i)
+		}
+	}
+
+	meta.Thanos.Rewrites = append(meta.Thanos.Rewrites, Rewrite{
+		Sources:          append([]ulid.ULID(nil), sources...),
+		DeletionsApplied: append([]DeletionRequest(nil), deletions...),
+		RelabelsApplied:  append([]*relabel.Config(nil), relabels...),
+	})
+	return nil
+}
+
+// MergeMetasForCompaction returns the skeleton of meta of the block compacted from blocks with the given metas: its Thanos
+// section, with labels and resolution of the blocks, compactor source and rewrites of all the blocks, and its TSDB meta,
+// without ULID, covering time ranges and sources of all the blocks (see tsdb.CompactBlockMetas). All blocks have to
+// belong to the same compaction group (see GroupKey).
+func MergeMetasForCompaction(metas []*Meta) (Thanos, tsdb.BlockMeta, error) {
+	if len(metas) == 0 {
+		return Thanos{}, tsdb.BlockMeta{}, errors.New("no metas to merge")
+	}
+	groupKey := metas[0].Thanos.GroupKey()
+	blockMetas := make([]*tsdb.BlockMeta, 0, len(metas))
+	var rewrites []Rewrite
+	for _, m := range metas {
+		if k := m.Thanos.GroupKey(); k != groupKey {
+			return Thanos{}, tsdb.BlockMeta{}, errors.Errorf("block %s belongs to group %s, expected %s like block %s", m.ULID, k, groupKey, metas[0].ULID)
+		}
+		blockMetas = append(blockMetas, &m.BlockMeta)
+		rewrites = append(rewrites, m.Thanos.Rewrites...)
+	}
+
+	lset := make(map[string]string, len(metas[0].Thanos.Labels))
+	for k, v := range metas[0].Thanos.Labels {
+		lset[k] = v
+	}
+	thanos := Thanos{
+		Version:    ThanosVersion1,
+		Labels:     lset,
+		Downsample: metas[0].Thanos.Downsample,
+		Source:     CompactorSource,
+		Rewrites:   rewrites,
+	}
+	return thanos, *tsdb.CompactBlockMetas(ulid.ULID{}, blockMetas...), nil
 }
 
 type Matchers []*labels.Matcher
@@ -143,25 +465,130 @@ func (m *Matchers) UnmarshalYAML(value *yaml.Node) (err error) {
 	return nil
 }
 
+// MarshalYAML renders matchers as a metric selector, which can be parsed back by UnmarshalYAML.
+func (m Matchers) MarshalYAML() (interface{}, error) {
+	ms := make([]string, 0, len(m))
+	for _, matcher := range m {
+		ms = append(ms, matcher.String())
+	}
+	return "{" + strings.Join(ms, ", ") + "}", nil
+}
+
 type DeletionRequest struct {
 	Matchers  Matchers             `json:"matchers" yaml:"matchers"`
 	Intervals tombstones.Intervals `json:"intervals,omitempty" yaml:"intervals,omitempty"`
 	RequestID string               `json:"request_id,omitempty" yaml:"request_id,omitempty"`
 }
 
+// Validate checks that the deletion request can be applied safely: it has to have matchers and its intervals
+// have to be well-formed and not overlapping. Overlapping intervals can be merged with Normalize.
+func (d DeletionRequest) Validate() error {
+	if len(d.Matchers) == 0 {
+		return errors.New("deletion request has no matchers")
+	}
+	for _, iv := range d.Intervals {
+		if iv.Mint > iv.Maxt {
+			return errors.Errorf("deletion request has inverted interval [%d, %d]", iv.Mint, iv.Maxt)
+		}
+	}
+
+	sorted := append(tombstones.Intervals(nil), d.Intervals...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Mint < sorted[j].Mint })
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Mint <= sorted[i-1].Maxt {
+			return errors.Errorf("deletion request has overlapping intervals [%d, %d] and [%d, %d]",
+				sorted[i-1].Mint, sorted[i-1].Maxt, sorted[i].Mint, sorted[i].Maxt)
+		}
+	}
+	return nil
+}
+
+// Normalize sorts intervals of the deletion request and merges overlapping and adjacent ones.
+// Inverted intervals are not fixed; use Validate to detect them.
+func (d *DeletionRequest) Normalize() {
+	var merged tombstones.Intervals
+	for _, iv := range d.Intervals {
+		if iv.Mint > iv.Maxt {
+			continue
+		}
+		merged = merged.Add(iv)
+	}
+	for _, iv := range d.Intervals {
+		if iv.Mint > iv.Maxt {
+			merged = append(merged, iv)
+		}
+	}
+	d.Intervals = merged
+}
+
 type File struct {
 	RelPath string `json:"rel_path"`
 	// SizeBytes is optional (e.g meta.json does not show size).
 	SizeBytes int64 `json:"size_bytes,omitempty"`
 
 	// Hash is an optional hash of this file. Used for potentially avoiding an extra download.
+	// For encrypted files, it's the hash of the ciphertext, as stored in the bucket.
 	Hash *ObjectHash `json:"hash,omitempty"`
+
+	// Encrypted is true if the file is stored in the bucket encrypted by the uploader, in which case SizeBytes
+	// is the size of the ciphertext.
+	Encrypted bool `json:"encrypted,omitempty"`
 }
 
 type ThanosDownsample struct {
 	Resolution int64 `json:"resolution"`
 }
 
+// ResolutionLevel is the resolution of block samples, in milliseconds, as produced by downsampling.
+type ResolutionLevel int64
+
+const (
+	// ResolutionLevelRaw is the resolution of blocks that were not downsampled.
+	ResolutionLevelRaw = ResolutionLevel(0)
+	// ResolutionLevel5m is the resolution of blocks downsampled from raw blocks.
+	ResolutionLevel5m = ResolutionLevel(5 * 60 * 1000)
+	// ResolutionLevel1h is the resolution of blocks downsampled from 5m blocks.
+	ResolutionLevel1h = ResolutionLevel(60 * 60 * 1000)
+)
+
+// ParseResolutionLevel returns the level of the given resolution in milliseconds, or an error if it's not one of those
+// produced by downsampling.
+func ParseResolutionLevel(resolution int64) (ResolutionLevel, error) {
+	l := ResolutionLevel(resolution)
+	if !l.IsValid() {
+		return 0, errors.Errorf("unsupported downsample resolution %d", resolution)
+	}
+	return l, nil
+}
+
+// IsValid returns true if the level is one of those produced by downsampling.
+func (l ResolutionLevel) IsValid() bool {
+	switch l {
+	case ResolutionLevelRaw, ResolutionLevel5m, ResolutionLevel1h:
+		return true
+	}
+	return false
+}
+
+// String returns the resolution in milliseconds.
+func (l ResolutionLevel) String() string {
+	return strconv.FormatInt(int64(l), 10)
+}
+
+// Level returns the resolution level, or an error if the resolution is not one of those produced by downsampling.
+func (d ThanosDownsample) Level() (ResolutionLevel, error) {
+	return ParseResolutionLevel(d.Resolution)
+}
+
+// SetLevel sets the resolution to the given level, or returns an error if it's not one of those produced by downsampling.
+func (d *ThanosDownsample) SetLevel(l ResolutionLevel) error {
+	if !l.IsValid() {
+		return errors.Errorf("unsupported downsample resolution %d", l)
+	}
+	d.Resolution = int64(l)
+	return nil
+}
+
 // InjectThanos sets Thanos meta to the block meta JSON and saves it to the disk.
 // NOTE: It should be used after writing any block by any Thanos component, otherwise we will miss crucial metadata.
 func InjectThanos(logger log.Logger, bdir string, meta Thanos, downsampledMeta *tsdb.BlockMeta) (*Meta, error) {
@@ -186,18 +613,193 @@ func InjectThanos(logger log.Logger, bdir string, meta Thanos, downsampledMeta *
 // GroupKey returns a unique identifier for the compaction group the block belongs to.
 // It considers the downsampling resolution and the block's labels.
 func (m *Thanos) GroupKey() string {
-	return fmt.Sprintf("%d@%v", m.Downsample.Resolution, labels.FromMap(m.Labels).Hash())
+	return GroupKeyFor(m.Downsample.Resolution, labels.FromMap(m.Labels))
+}
+
+// GroupKeyFor returns a unique identifier for the compaction group of blocks with the given downsampling
+// resolution and labels. It's the same as GroupKey of such blocks.
+func GroupKeyFor(resolution int64, lbls labels.Labels) string {
+	return fmt.Sprintf("%d@%v", resolution, lbls.Hash())
+}
+
+// StrongGroupKey is like GroupKey, but includes the block's labels instead of their hash.
+// GroupKey identifies labels by their 64-bit hash only, so two different label sets (e.g. of different tenants with
+// different label schemas) might collide and their blocks would be compacted together, even though unlikely.
+// StrongGroupKey can't collide, but it's longer and it's not compatible with GroupKey.
+func (m *Thanos) StrongGroupKey() string {
+	return StrongGroupKeyFor(m.Downsample.Resolution, labels.FromMap(m.Labels))
+}
+
+// StrongGroupKeyFor returns the same identifier as StrongGroupKey of blocks with the given downsampling
+// resolution and labels.
+func StrongGroupKeyFor(resolution int64, lbls labels.Labels) string {
+	return fmt.Sprintf("%d@%s", resolution, lbls.String())
+}
+
+// Overlaps returns true if the blocks belong to the same compaction group (see GroupKey) and their time ranges overlap.
+// As MaxTime is exclusive, adjacent blocks, one starting where the other ends, do not overlap.
+func Overlaps(a, b *Meta) bool {
+	return OverlapDuration(a, b) > 0
+}
+
+// OverlapDuration returns the length of the overlap of time ranges of the blocks in milliseconds, or zero if they do not
+// overlap or they belong to different compaction groups.
+func OverlapDuration(a, b *Meta) int64 {
+	if a.Thanos.GroupKey() != b.Thanos.GroupKey() {
+		return 0
+	}
+	return max(0, min(a.MaxTime, b.MaxTime)-max(a.MinTime, b.MinTime))
+}
+
+// knownSources are all SourceTypes defined by Thanos and registered by RegisterSourceType.
+var (
+	knownSourcesMtx sync.RWMutex
+	knownSources    = map[SourceType]struct{}{
+		UnknownSource:         {},
+		SidecarSource:         {},
+		ReceiveSource:         {},
+		CompactorSource:       {},
+		CompactorRepairSource: {},
+		RulerSource:           {},
+		BucketRepairSource:    {},
+		BucketRewriteSource:   {},
+		BucketUploadSource:    {},
+		TestSource:            {},
+	}
+)
+
+// RegisterSourceType makes the custom source known, e.g. to Thanos.Validate, next to the SourceTypes defined by Thanos.
+// It's meant to be called on startup by components uploading blocks with their own source.
+func RegisterSourceType(s SourceType) {
+	knownSourcesMtx.Lock()
+	defer knownSourcesMtx.Unlock()
+	knownSources[s] = struct{}{}
+}
+
+// IsKnownSource returns true if the source is one of SourceTypes defined by Thanos or registered by RegisterSourceType.
+func IsKnownSource(s SourceType) bool {
+	knownSourcesMtx.RLock()
+	defer knownSourcesMtx.RUnlock()
+	_, ok := knownSources[s]
+	return ok
+}
+
+// Validate checks that the Thanos section is consistent: its version is supported, resolution is one of those produced
+// by downsampling, source is known and files have non-empty relative paths, sorted.
+func (m *Thanos) Validate() error {
+	if m.Version != 0 && m.Version != ThanosVersion1 {
+		return errors.Errorf("unsupported Thanos section version %d", m.Version)
+	}
+	if _, err := m.Downsample.Level(); err != nil {
+		return err
+	}
+	if !IsKnownSource(m.Source) {
+		return errors.Errorf("unknown source %q", m.Source)
+	}
+	for i, f := range m.Files {
+		if f.RelPath == "" {
+			return errors.Errorf("file %d has empty relative path", i)
+		}
+		if i > 0 && m.Files[i-1].RelPath >= f.RelPath {
+			return errors.Errorf("files are not sorted by relative path or contain duplicates: %s before %s", m.Files[i-1].RelPath, f.RelPath)
+		}
+	}
+	return nil
 }
 
 // ResolutionString returns a the block's resolution as a string.
 func (m *Thanos) ResolutionString() string {
-	return fmt.Sprintf("%d", m.Downsample.Resolution)
+	return ResolutionLevel(m.Downsample.Resolution).String()
+}
+
+// ErrorMetaChecksumMismatch is returned when the checksum stored in meta.json does not match its content.
+var ErrorMetaChecksumMismatch = errors.New("meta checksum mismatch")
+
+// ErrorMetaTooLarge is returned when meta JSON is larger than the limit it's read with.
+var ErrorMetaTooLarge = errors.New("meta too large")
+
+// WriteOption configures how the meta is written.
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	checksum     bool
+	gzip         bool
+	compact      bool
+	withoutFiles bool
+}
+
+// WithChecksum is an option to store the checksum of the meta alongside it. Read verifies the checksum if present,
+// which allows to detect corrupted or truncated meta.json files.
+func WithChecksum() WriteOption {
+	return func(o *writeOptions) {
+		o.checksum = true
+	}
+}
+
+// WithGzip is an option to compress the written meta with gzip. Read detects compressed meta automatically.
+func WithGzip() WriteOption {
+	return func(o *writeOptions) {
+		o.gzip = true
+	}
+}
+
+// WithCompactJSON is an option to write meta without indentation, which makes meta of blocks with many files
+// considerably smaller. Read accepts both forms.
+func WithCompactJSON() WriteOption {
+	return func(o *writeOptions) {
+		o.compact = true
+	}
+}
+
+// WithoutFiles is an option to omit the Files section of the Thanos meta from the written meta.
+// NOTE: Files are used e.g. to skip downloading files with matching hashes and to learn the size of the block
+// without listing it, so it should be used only for metas not uploaded to the bucket.
+func WithoutFiles() WriteOption {
+	return func(o *writeOptions) {
+		o.withoutFiles = true
+	}
+}
+
+// metaWithChecksum is the encoding of meta.json with an optional checksum of the meta.
+type metaWithChecksum struct {
+	Meta
+
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// checksumField is the JSON field of meta.json holding the checksum of the meta.
+const checksumField = "checksum"
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// metaChecksum returns the CRC32 (Castagnoli) checksum of the given meta JSON object, excluding the checksum field,
+// in its canonical form: compact, with sorted keys and numbers kept as they are. The checksum covers all fields of the
+// object, including the ones unknown to this version, so that meta written by newer versions verifies too.
+func metaChecksum(b []byte) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return "", err
+	}
+	delete(obj, checksumField)
+	canonical, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%08x", crc32.Checksum(canonical, castagnoliTable)), nil
 }
 
 // WriteToDir writes the encoded meta into <dir>/meta.json.
-func (m Meta) WriteToDir(logger log.Logger, dir string) error {
+func (m Meta) WriteToDir(logger log.Logger, dir string, opts ...WriteOption) error {
+	return m.WriteToPath(logger, filepath.Join(dir, MetaFilename), opts...)
+}
+
+// WriteToPath writes the encoded meta into the file with the given path, e.g. to stage it outside of the block
+// directory. Like WriteToDir, it writes a temporary file next to it first, which is then renamed, so the change
+// appears atomic.
+func (m Meta) WriteToPath(logger log.Logger, path string, opts ...WriteOption) error {
 	// Make any changes to the file appear atomic.
-	path := filepath.Join(dir, MetaFilename)
 	tmp := path + ".tmp"
 
 	f, err := os.Create(tmp)
@@ -205,7 +807,7 @@ func (m Meta) WriteToDir(logger log.Logger, dir string) error {
 		return err
 	}
 
-	if err := m.Write(f); err != nil {
+	if err := m.Write(f, opts...); err != nil {
 		runutil.CloseWithLogOnErr(logger, f, "close meta")
 		return err
 	}
@@ -216,10 +818,248 @@ func (m Meta) WriteToDir(logger log.Logger, dir string) error {
 }
 
 // Write writes the given encoded meta to writer.
-func (m Meta) Write(w io.Writer) error {
+func (m Meta) Write(w io.Writer, opts ...WriteOption) error {
+	var o writeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.withoutFiles {
+		m.Thanos.Files = nil
+	}
+	if !o.gzip {
+		return m.encode(w, o)
+	}
+	gw := gzip.NewWriter(w)
+	if err := m.encode(gw, o); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func (m Meta) encode(w io.Writer, o writeOptions) error {
 	enc := json.NewEncoder(w)
-	enc.SetIndent("", "\t")
-	return enc.Encode(&m)
+	if !o.compact {
+		enc.SetIndent("", "\t")
+	}
+	if !o.checksum {
+		return enc.Encode(&m)
+	}
+
+	b, err := json.Marshal(&m)
+	if err != nil {
+		return errors.Wrap(err, "encode meta")
+	}
+	sum, err := metaChecksum(b)
+	if err != nil {
+		return errors.Wrap(err, "calculate meta checksum")
+	}
+	return enc.Encode(&metaWithChecksum{Meta: m, Checksum: sum})
+}
+
+// WriteCanonical writes the canonical encoding of the meta to writer: compact JSON, in which semantically identical metas
+// are byte-identical, e.g. for content addressing. On top of the sorted map keys of any JSON encoding, files are sorted
+// by relative path, missing labels are encoded as empty ones and extensions are encoded as decoded by Read, regardless
+// of their type. Unlike Write, it does not support write options.
+func (m Meta) WriteCanonical(w io.Writer) error {
+	if m.Thanos.Labels == nil {
+		m.Thanos.Labels = map[string]string{}
+	}
+	if len(m.Thanos.Files) > 0 {
+		m.Thanos.Files = slices.Clone(m.Thanos.Files)
+		sort.SliceStable(m.Thanos.Files, func(i, j int) bool {
+			return m.Thanos.Files[i].RelPath < m.Thanos.Files[j].RelPath
+		})
+	}
+	if m.Thanos.Extensions != nil {
+		// Struct fields are encoded in order of declaration, so extensions are normalized to generic maps first.
+		b, err := json.Marshal(m.Thanos.Extensions)
+		if err != nil {
+			return errors.Wrap(err, "encode extensions")
+		}
+		var ext any
+		if err := json.Unmarshal(b, &ext); err != nil {
+			return errors.Wrap(err, "decode extensions")
+		}
+		m.Thanos.Extensions = ext
+	}
+	b, err := json.Marshal(&m)
+	if err != nil {
+		return errors.Wrap(err, "encode meta")
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Header holds the cheap top-level fields of meta, read by ReadHeader.
+type Header struct {
+	ULID       ulid.ULID
+	MinTime    int64
+	MaxTime    int64
+	Labels     map[string]string
+	Downsample ThanosDownsample
+	Source     SourceType
+}
+
+// GroupKey returns the compaction group key of the block. It's the same as Thanos.GroupKey of the full meta.
+func (h *Header) GroupKey() string {
+	return GroupKeyFor(h.Downsample.Resolution, labels.FromMap(h.Labels))
+}
+
+// Flags of Header fields read so far by ReadHeader.
+const (
+	headerULID = 1 << iota
+	headerMinTime
+	headerMaxTime
+	headerLabels
+	headerDownsample
+	headerSource
+
+	headerAll = headerULID | headerMinTime | headerMaxTime | headerLabels | headerDownsample | headerSource
+)
+
+// ReadHeader reads only the Header fields of meta JSON read from r, plain or compressed, without decoding the rest of it,
+// notably the possibly huge Files section. As meta is written with the Header fields first, reading stops as soon as
+// they are read. Unlike Read, it does not verify meta checksum, nor version.
+func ReadHeader(r io.Reader) (*Header, error) {
+	mr, err := NewMetaReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		dec  = json.NewDecoder(mr)
+		h    Header
+		seen int
+	)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	for seen != headerAll && dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "ulid":
+			err = dec.Decode(&h.ULID)
+			seen |= headerULID
+		case "minTime":
+			err = dec.Decode(&h.MinTime)
+			seen |= headerMinTime
+		case "maxTime":
+			err = dec.Decode(&h.MaxTime)
+			seen |= headerMaxTime
+		case "thanos":
+			seen, err = readThanosHeader(dec, &h, seen)
+		default:
+			err = skipJSONValue(dec)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode %v", key)
+		}
+	}
+	if h.Labels == nil {
+		// To avoid extra nil checks, allocate map here if empty, like Read does.
+		h.Labels = make(map[string]string)
+	}
+	return &h, nil
+}
+
+// readThanosHeader reads Header fields of the Thanos section until all Header fields are seen, or the section ends.
+func readThanosHeader(dec *json.Decoder, h *Header, seen int) (int, error) {
+	if err := expectDelim(dec, '{'); err != nil {
+		return seen, err
+	}
+	for dec.More() {
+		if seen == headerAll {
+			return seen, nil
+		}
+		key, err := dec.Token()
+		if err != nil {
+			return seen, err
+		}
+		switch key {
+		case "labels":
+			err = dec.Decode(&h.Labels)
+			seen |= headerLabels
+		case "downsample":
+			err = dec.Decode(&h.Downsample)
+			seen |= headerDownsample
+		case "source":
+			err = dec.Decode(&h.Source)
+			seen |= headerSource
+		default:
+			err = skipJSONValue(dec)
+		}
+		if err != nil {
+			return seen, errors.Wrapf(err, "decode thanos.%v", key)
+		}
+	}
+	return seen, expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return errors.Errorf("expected %v, got %v", delim, t)
+	}
+	return nil
+}
+
+// skipJSONValue skips the next value read by the decoder without decoding it.
+func skipJSONValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// NewMetaReader returns reader of meta JSON read from r, which is decompressed if it's gzip-compressed.
+func NewMetaReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	// Error means there are less than 2 bytes, which is not a gzip stream either way.
+	if magic, _ := br.Peek(2); len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return br, nil
+	}
+	gr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "create gzip reader")
+	}
+	return gr, nil
+}
+
+// LimitMetaReader returns reader of r, which fails with ErrorMetaTooLarge once more than maxBytes are read from it.
+// It's meant to wrap the reader returned by NewMetaReader, so the limit applies to the decompressed meta too.
+func LimitMetaReader(r io.Reader, maxBytes int64) io.Reader {
+	return &metaLimitReader{r: &io.LimitedReader{R: r, N: maxBytes + 1}, max: maxBytes}
+}
+
+type metaLimitReader struct {
+	r   *io.LimitedReader
+	max int64
+}
+
+func (l *metaLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if l.r.N <= 0 {
+		return n, errors.Wrapf(ErrorMetaTooLarge, "meta JSON exceeds %d bytes", l.max)
+	}
+	return n, err
 }
 
 func renameFile(logger log.Logger, from, to string) error {
@@ -243,23 +1083,85 @@ func renameFile(logger log.Logger, from, to string) error {
 	return pdir.Close()
 }
 
+// ReadOption configures how the meta is read.
+type ReadOption func(*readOptions)
+
+type readOptions struct {
+	migrate  bool
+	maxBytes int64
+}
+
+// WithMigration is an option to upgrade the read meta to the current internal representation with MigrateMeta.
+func WithMigration() ReadOption {
+	return func(o *readOptions) {
+		o.migrate = true
+	}
+}
+
 // ReadFromDir reads the given meta from <dir>/meta.json.
-func ReadFromDir(dir string) (*Meta, error) {
+func ReadFromDir(dir string, opts ...ReadOption) (*Meta, error) {
 	f, err := os.Open(filepath.Join(dir, filepath.Clean(MetaFilename)))
 	if err != nil {
 		return nil, err
 	}
-	return Read(f)
+	return Read(f, opts...)
+}
+
+// ReadWithLimit works like Read, but fails with ErrorMetaTooLarge if the meta JSON, decompressed if needed, is larger
+// than maxBytes, instead of reading it all into memory. Non-positive maxBytes means no limit.
+func ReadWithLimit(rc io.ReadCloser, maxBytes int64, opts ...ReadOption) (*Meta, error) {
+	return Read(rc, append(opts, func(o *readOptions) {
+		o.maxBytes = maxBytes
+	})...)
 }
 
 // Read the block meta from the given reader.
-func Read(rc io.ReadCloser) (_ *Meta, err error) {
-	defer runutil.ExhaustCloseWithErrCapture(&err, rc, "close meta JSON")
+func Read(rc io.ReadCloser, opts ...ReadOption) (_ *Meta, err error) {
+	defer func() {
+		if err == nil {
+			runutil.ExhaustCloseWithErrCapture(&err, rc, "close meta JSON")
+			return
+		}
+		// Errors are returned as they are, so that they can be matched with errors.Is. The rest of meta too large
+		// to read is not read either.
+		if !errors.Is(err, ErrorMetaTooLarge) {
+			_, _ = io.Copy(io.Discard, rc)
+		}
+		_ = rc.Close()
+	}()
+
+	var o readOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
 
-	var m Meta
-	if err = json.NewDecoder(rc).Decode(&m); err != nil {
+	r, err := NewMetaReader(rc)
+	if err != nil {
 		return nil, err
 	}
+	if o.maxBytes > 0 {
+		r = LimitMetaReader(r, o.maxBytes)
+	}
+	// Meta is read whole, so that its checksum can be verified over the raw JSON.
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var mc metaWithChecksum
+	if err = json.NewDecoder(bytes.NewReader(b)).Decode(&mc); err != nil {
+		return nil, err
+	}
+	m := mc.Meta
+
+	if mc.Checksum != "" {
+		sum, err := metaChecksum(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "calculate meta checksum")
+		}
+		if sum != mc.Checksum {
+			return nil, errors.Wrapf(ErrorMetaChecksumMismatch, "expected %s, got %s", mc.Checksum, sum)
+		}
+	}
 
 	if m.Version != TSDBVersion1 {
 		return nil, errors.Errorf("unexpected meta file version %d", m.Version)
@@ -279,5 +1181,12 @@ func Read(rc io.ReadCloser) (_ *Meta, err error) {
 		// To avoid extra nil checks, allocate map here if empty.
 		m.Thanos.Labels = make(map[string]string)
 	}
+	if o.migrate {
+		migrated, _, err := MigrateMeta(&m)
+		if err != nil {
+			return nil, err
+		}
+		return migrated, nil
+	}
 	return &m, nil
 }
@@ -5,12 +5,25 @@ package metadata
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
 	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/tombstones"
+	"gopkg.in/yaml.v3"
 )
 
 func TestMeta_ReadWrite(t *testing.T) {
@@ -339,9 +352,875 @@ func TestMeta_ReadWrite(t *testing.T) {
 		testutil.Ok(t, err)
 		testutil.Equals(t, m1.Thanos.Extensions, retExtensions)
 	})
+	t.Run("gzip write/read", func(t *testing.T) {
+		m1 := Meta{
+			BlockMeta: tsdb.BlockMeta{
+				ULID:    ulid.MustNew(5, nil),
+				MinTime: 2424,
+				MaxTime: 134,
+				Version: 1,
+			},
+			Thanos: Thanos{
+				Version: ThanosVersion1,
+				Labels:  map[string]string{"ext": "lset1"},
+				Source:  ReceiveSource,
+			},
+		}
+
+		plain := bytes.Buffer{}
+		testutil.Ok(t, m1.Write(&plain))
+		b := bytes.Buffer{}
+		testutil.Ok(t, m1.Write(&b, WithGzip(), WithChecksum()))
+		testutil.Equals(t, []byte{0x1f, 0x8b}, b.Bytes()[:2])
+		testutil.Assert(t, b.Len() < plain.Len(), "compressed meta should be smaller")
+
+		retMeta, err := Read(io.NopCloser(&b))
+		testutil.Ok(t, err)
+		testutil.Equals(t, m1, *retMeta)
+	})
+	t.Run("checksum write/read", func(t *testing.T) {
+		m1 := Meta{
+			BlockMeta: tsdb.BlockMeta{
+				ULID:    ulid.MustNew(5, nil),
+				MinTime: 2424,
+				MaxTime: 134,
+				Version: 1,
+			},
+			Thanos: Thanos{
+				Version:    ThanosVersion1,
+				Labels:     map[string]string{"ext": "lset1"},
+				Source:     ReceiveSource,
+				Extensions: TestExtensions{Field1: 1, Field2: "test_string"},
+			},
+		}
+
+		b := bytes.Buffer{}
+		testutil.Ok(t, m1.Write(&b, WithChecksum()))
+		testutil.Assert(t, bytes.Contains(b.Bytes(), []byte(`"checksum": "`)), "expected checksum in %s", b.String())
+		encoded := b.String()
+
+		retMeta, err := Read(io.NopCloser(&b))
+		testutil.Ok(t, err)
+		testutil.Equals(t, m1.ULID, retMeta.ULID)
+		testutil.Equals(t, m1.Thanos.Labels, retMeta.Thanos.Labels)
+
+		// Corrupted meta is detected.
+		corrupted := strings.Replace(encoded, "lset1", "lset2", 1)
+		_, err = Read(io.NopCloser(strings.NewReader(corrupted)))
+		testutil.NotOk(t, err)
+		testutil.Assert(t, errors.Is(err, ErrorMetaChecksumMismatch), "unexpected error %v", err)
+
+		// Fields unknown to this version, e.g. written by a newer one, are covered by the checksum too.
+		withUnknown := strings.Replace(encoded, `"thanos": {`, `"thanos": {"newer_field": 12345678901234567890,`, 1)
+		sum, err := metaChecksum([]byte(withUnknown))
+		testutil.Ok(t, err)
+		withUnknown = regexp.MustCompile(`"checksum": "[0-9a-f]+"`).ReplaceAllString(withUnknown, `"checksum": "`+sum+`"`)
+		retMeta, err = Read(io.NopCloser(strings.NewReader(withUnknown)))
+		testutil.Ok(t, err)
+		testutil.Equals(t, m1.Thanos.Labels, retMeta.Thanos.Labels)
+
+		// Meta without checksum is read fine.
+		b.Reset()
+		testutil.Ok(t, m1.Write(&b))
+		testutil.Assert(t, !bytes.Contains(b.Bytes(), []byte("checksum")))
+		_, err = Read(io.NopCloser(&b))
+		testutil.Ok(t, err)
+	})
+	t.Run("compact write/read", func(t *testing.T) {
+		m1 := Meta{
+			BlockMeta: tsdb.BlockMeta{
+				ULID:    ulid.MustNew(5, nil),
+				MinTime: 2424,
+				MaxTime: 134,
+				Version: 1,
+			},
+			Thanos: Thanos{
+				Version: ThanosVersion1,
+				Labels:  map[string]string{"ext": "lset1"},
+				Source:  ReceiveSource,
+				Files: []File{
+					{RelPath: "chunks/000001", SizeBytes: 3751},
+					{RelPath: "index", SizeBytes: 401},
+					{RelPath: "meta.json"},
+				},
+			},
+		}
+
+		indented := bytes.Buffer{}
+		testutil.Ok(t, m1.Write(&indented))
+		b := bytes.Buffer{}
+		testutil.Ok(t, m1.Write(&b, WithCompactJSON(), WithChecksum()))
+		testutil.Assert(t, !bytes.Contains(b.Bytes(), []byte("\t")), "expected no indentation in %s", b.String())
+		testutil.Assert(t, b.Len() < indented.Len(), "compact meta should be smaller")
+
+		retMeta, err := Read(io.NopCloser(&b))
+		testutil.Ok(t, err)
+		testutil.Equals(t, m1, *retMeta)
+
+		b.Reset()
+		testutil.Ok(t, m1.Write(&b, WithCompactJSON(), WithoutFiles()))
+		retMeta, err = Read(io.NopCloser(&b))
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(retMeta.Thanos.Files))
+		// Written meta is not modified.
+		testutil.Equals(t, 3, len(m1.Thanos.Files))
+	})
 }
 
 type TestExtensions struct {
 	Field1 int    `json:"field1"`
 	Field2 string `json:"field2"`
 }
+
+func init() {
+	RegisterExtension("typed", TestExtensions{})
+}
+
+func TestThanos_TypedExtensions(t *testing.T) {
+	m := Thanos{}
+	ext, err := m.TypedExtensions()
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]any{}, ext)
+
+	m.Extensions = map[string]any{
+		"typed":   TestExtensions{Field1: 1, Field2: "test_string"},
+		"untyped": map[string]any{"a": "b"},
+	}
+	ext, err = m.TypedExtensions()
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]any{
+		"typed":   &TestExtensions{Field1: 1, Field2: "test_string"},
+		"untyped": map[string]any{"a": "b"},
+	}, ext)
+
+	// Extensions decoded from meta.json are supported too.
+	b := bytes.Buffer{}
+	testutil.Ok(t, Meta{BlockMeta: tsdb.BlockMeta{Version: TSDBVersion1}, Thanos: m}.Write(&b))
+	retMeta, err := Read(io.NopCloser(&b))
+	testutil.Ok(t, err)
+	retExt, err := retMeta.Thanos.TypedExtensions()
+	testutil.Ok(t, err)
+	testutil.Equals(t, ext, retExt)
+
+	m.Extensions = map[string]any{"typed": "not an object"}
+	_, err = m.TypedExtensions()
+	testutil.NotOk(t, err)
+
+	// Extensions which are not a JSON object can be still parsed with ParseExtensions.
+	m.Extensions = "string extension"
+	_, err = m.TypedExtensions()
+	testutil.NotOk(t, err)
+	var v string
+	_, err = m.ParseExtensions(&v)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "string extension", v)
+}
+
+func TestIsParquetMigrated(t *testing.T) {
+	for _, tcase := range []struct {
+		name       string
+		extensions any
+		expected   bool
+		expectErr  bool
+	}{
+		{name: "nil extensions"},
+		{name: "missing key", extensions: map[string]any{"other": true}},
+		{name: "not an object", extensions: "string extension"},
+		{name: "migrated", extensions: map[string]any{ParquetMigratedExtensionKey: true}, expected: true},
+		{name: "not migrated", extensions: map[string]any{ParquetMigratedExtensionKey: false}},
+		{name: "migrated in JSON", extensions: json.RawMessage(`{"parquet_migrated": true, "other": 1}`), expected: true},
+		{name: "malformed string value", extensions: map[string]any{ParquetMigratedExtensionKey: "yes"}, expectErr: true},
+		{name: "malformed object value", extensions: map[string]any{ParquetMigratedExtensionKey: map[string]any{"a": 1}}, expectErr: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			migrated, err := IsParquetMigrated(&Meta{Thanos: Thanos{Extensions: tcase.extensions}})
+			if tcase.expectErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, migrated)
+		})
+	}
+
+	// The extension is decoded to its registered type by TypedExtensions.
+	ext, err := (&Thanos{Extensions: map[string]any{ParquetMigratedExtensionKey: true}}).TypedExtensions()
+	testutil.Ok(t, err)
+	migrated := true
+	testutil.Equals(t, map[string]any{ParquetMigratedExtensionKey: &migrated}, ext)
+}
+
+func TestMeta_TotalSize(t *testing.T) {
+	for _, tcase := range []struct {
+		name               string
+		thanos             Thanos
+		expectedSize       int64
+		expectedHasUnknown bool
+	}{
+		{
+			name: "all sizes known",
+			thanos: Thanos{Files: []File{
+				{RelPath: "chunks/000001", SizeBytes: 100},
+				{RelPath: "index", SizeBytes: 50},
+				{RelPath: MetaFilename},
+			}},
+			expectedSize: 150,
+		},
+		{
+			name: "some sizes unknown",
+			thanos: Thanos{Files: []File{
+				{RelPath: "chunks/000001", SizeBytes: 100},
+				{RelPath: "chunks/000002"},
+				{RelPath: "index", SizeBytes: 50},
+			}},
+			expectedSize:       150,
+			expectedHasUnknown: true,
+		},
+		{
+			name:               "no files",
+			expectedHasUnknown: true,
+		},
+		{
+			name:               "only deprecated segment files",
+			thanos:             Thanos{SegmentFiles: []string{"000001", "000002"}},
+			expectedHasUnknown: true,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			m := &Meta{Thanos: tcase.thanos}
+			testutil.Equals(t, tcase.expectedSize, m.TotalSizeBytes())
+
+			size, hasUnknown := m.TotalSizeWithUnknown()
+			testutil.Equals(t, tcase.expectedSize, size)
+			testutil.Equals(t, tcase.expectedHasUnknown, hasUnknown)
+
+			// Normalized meta has the same size, as segment files sizes stay unknown.
+			NormalizeMeta(m)
+			size, hasUnknown = m.TotalSizeWithUnknown()
+			testutil.Equals(t, tcase.expectedSize, size)
+			testutil.Equals(t, tcase.expectedHasUnknown, hasUnknown)
+		})
+	}
+}
+
+func TestAppendRewrite(t *testing.T) {
+	src := ulid.MustNew(1, nil)
+	deletions := []DeletionRequest{{RequestID: "req1"}}
+	relabels := []*relabel.Config{{Action: relabel.Drop}}
+
+	m := &Meta{}
+	testutil.NotOk(t, AppendRewrite(m, nil, deletions, relabels))
+	testutil.NotOk(t, AppendRewrite(m, []ulid.ULID{{}}, deletions, relabels))
+	testutil.NotOk(t, AppendRewrite(m, []ulid.ULID{src}, deletions, []*relabel.Config{nil}))
+	testutil.Equals(t, 0, len(m.Thanos.Rewrites))
+
+	sources := []ulid.ULID{src}
+	testutil.Ok(t, AppendRewrite(m, sources, deletions, relabels))
+	testutil.Ok(t, AppendRewrite(m, sources, nil, relabels))
+	// Recorded rewrite is not affected by later changes of the arguments.
+	sources[0] = ulid.MustNew(2, nil)
+
+	testutil.Equals(t, []Rewrite{
+		{Sources: []ulid.ULID{src}, DeletionsApplied: deletions, RelabelsApplied: relabels},
+		{Sources: []ulid.ULID{src}, RelabelsApplied: relabels},
+	}, m.Thanos.Rewrites)
+}
+
+func TestDeletionRequest_ValidateNormalize(t *testing.T) {
+	matchers := Matchers{labels.MustNewMatcher(labels.MatchEqual, "a", "1")}
+
+	for _, tc := range []struct {
+		name       string
+		req        DeletionRequest
+		expected   tombstones.Intervals
+		invalid    bool
+		normalized bool
+	}{
+		{
+			name:     "no matchers",
+			req:      DeletionRequest{Intervals: tombstones.Intervals{{Mint: 1, Maxt: 2}}},
+			expected: tombstones.Intervals{{Mint: 1, Maxt: 2}},
+			invalid:  true,
+		},
+		{
+			name:       "no intervals",
+			req:        DeletionRequest{Matchers: matchers},
+			normalized: true,
+		},
+		{
+			name:       "valid",
+			req:        DeletionRequest{Matchers: matchers, Intervals: tombstones.Intervals{{Mint: 5, Maxt: 5}, {Mint: 1, Maxt: 2}}},
+			expected:   tombstones.Intervals{{Mint: 1, Maxt: 2}, {Mint: 5, Maxt: 5}},
+			normalized: true,
+		},
+		{
+			name:     "inverted",
+			req:      DeletionRequest{Matchers: matchers, Intervals: tombstones.Intervals{{Mint: 1, Maxt: 2}, {Mint: 10, Maxt: 3}}},
+			expected: tombstones.Intervals{{Mint: 1, Maxt: 2}, {Mint: 10, Maxt: 3}},
+			invalid:  true,
+		},
+		{
+			name:       "overlapping",
+			req:        DeletionRequest{Matchers: matchers, Intervals: tombstones.Intervals{{Mint: 20, Maxt: 30}, {Mint: 1, Maxt: 10}, {Mint: 10, Maxt: 15}, {Mint: 16, Maxt: 17}}},
+			expected:   tombstones.Intervals{{Mint: 1, Maxt: 17}, {Mint: 20, Maxt: 30}},
+			invalid:    true,
+			normalized: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.req.Validate()
+			testutil.Equals(t, tc.invalid, err != nil)
+
+			tc.req.Normalize()
+			testutil.Equals(t, tc.expected, tc.req.Intervals)
+			testutil.Equals(t, tc.normalized, tc.req.Validate() == nil)
+		})
+	}
+}
+
+func TestDeletionRequest_YAMLRoundTrip(t *testing.T) {
+	const spec = `- matchers: '{__name__="up", job=~"api|web.*", env!="dev", path!~"/debug/.+", msg="say \"hi\""}'
+  intervals:
+    - mint: 1
+      maxt: 10
+  request_id: req1
+`
+	var reqs []DeletionRequest
+	testutil.Ok(t, yaml.Unmarshal([]byte(spec), &reqs))
+	testutil.Equals(t, 1, len(reqs))
+	testutil.Equals(t, 5, len(reqs[0].Matchers))
+
+	b, err := yaml.Marshal(reqs)
+	testutil.Ok(t, err)
+
+	var decoded []DeletionRequest
+	testutil.Ok(t, yaml.Unmarshal(b, &decoded))
+	testutil.Equals(t, len(reqs), len(decoded))
+	testutil.Equals(t, reqs[0].Intervals, decoded[0].Intervals)
+	testutil.Equals(t, reqs[0].RequestID, decoded[0].RequestID)
+	testutil.Equals(t, len(reqs[0].Matchers), len(decoded[0].Matchers))
+	for i, m := range reqs[0].Matchers {
+		testutil.Equals(t, m.String(), decoded[0].Matchers[i].String())
+	}
+
+	// Encoding is canonical.
+	b2, err := yaml.Marshal(decoded)
+	testutil.Ok(t, err)
+	testutil.Equals(t, string(b), string(b2))
+}
+
+func TestGroupKeyFor(t *testing.T) {
+	for _, m := range []Thanos{
+		{},
+		{Labels: map[string]string{"a": "1"}},
+		{Labels: map[string]string{"b": "2", "a": "1"}, Downsample: ThanosDownsample{Resolution: 300000}},
+	} {
+		testutil.Equals(t, m.GroupKey(), GroupKeyFor(m.Downsample.Resolution, labels.FromMap(m.Labels)))
+	}
+	testutil.Equals(t, "0@17241709254077376921", GroupKeyFor(0, labels.EmptyLabels()))
+}
+
+func TestStrongGroupKey(t *testing.T) {
+	m1 := Thanos{Labels: map[string]string{"tenant": "a", "region": "eu"}, Downsample: ThanosDownsample{Resolution: 300000}}
+	m2 := Thanos{Labels: map[string]string{"tenant": "b", "zone": "eu-1"}, Downsample: ThanosDownsample{Resolution: 300000}}
+
+	testutil.Equals(t, `300000@{region="eu", tenant="a"}`, m1.StrongGroupKey())
+	testutil.Equals(t, StrongGroupKeyFor(300000, labels.FromMap(m2.Labels)), m2.StrongGroupKey())
+	testutil.Assert(t, m1.GroupKey() != m2.GroupKey())
+
+	// Simulate hash collision of both label sets.
+	lset1, lset2 := labels.FromMap(m1.Labels), labels.FromMap(m2.Labels)
+	testutil.Equals(t, m1.GroupKey(), groupKeyWithHash(300000, lset1, labels.Labels.Hash))
+	collidingHash := func(labels.Labels) uint64 { return 42 }
+	testutil.Equals(t, groupKeyWithHash(300000, lset1, collidingHash), groupKeyWithHash(300000, lset2, collidingHash))
+	testutil.Assert(t, m1.StrongGroupKey() != m2.StrongGroupKey())
+}
+
+// groupKeyWithHash returns the same identifier as GroupKeyFor, but with labels hashed by the given function.
+func groupKeyWithHash(resolution int64, lbls labels.Labels, hash func(labels.Labels) uint64) string {
+	return fmt.Sprintf("%d@%v", resolution, hash(lbls))
+}
+
+func TestIsRecentlyUploaded(t *testing.T) {
+	now := time.Unix(1000, 0)
+	delay := 30 * time.Second
+
+	testutil.Assert(t, !IsRecentlyUploaded(&Meta{}, delay, now), "unknown upload time should not be recent")
+	for _, tc := range []struct {
+		uploadTime int64
+		recent     bool
+	}{
+		{uploadTime: 1000, recent: true},
+		{uploadTime: 971, recent: true},
+		{uploadTime: 970, recent: false},
+		{uploadTime: 100, recent: false},
+	} {
+		m := &Meta{Thanos: Thanos{UploadTime: tc.uploadTime}}
+		testutil.Equals(t, tc.recent, IsRecentlyUploaded(m, delay, now))
+	}
+}
+
+func TestThanos_Validate(t *testing.T) {
+	valid := Thanos{
+		Version:    ThanosVersion1,
+		Labels:     map[string]string{"a": "1"},
+		Downsample: ThanosDownsample{Resolution: 300000},
+		Source:     CompactorSource,
+		Files:      []File{{RelPath: "chunks/000001"}, {RelPath: "index"}, {RelPath: MetaFilename}},
+	}
+	testutil.Ok(t, valid.Validate())
+
+	// Version is optional for compatibility.
+	legacy := valid
+	legacy.Version = 0
+	testutil.Ok(t, legacy.Validate())
+
+	for _, tcase := range []struct {
+		name   string
+		modify func(m *Thanos)
+	}{
+		{name: "unsupported version", modify: func(m *Thanos) { m.Version = 2 }},
+		{name: "unsupported resolution", modify: func(m *Thanos) { m.Downsample.Resolution = 1000 }},
+		{name: "unknown source", modify: func(m *Thanos) { m.Source = "sidcar" }},
+		{name: "empty file path", modify: func(m *Thanos) { m.Files = []File{{RelPath: ""}} }},
+		{name: "unsorted files", modify: func(m *Thanos) { m.Files = []File{{RelPath: "index"}, {RelPath: "chunks/000001"}} }},
+		{name: "duplicated files", modify: func(m *Thanos) { m.Files = []File{{RelPath: "index"}, {RelPath: "index"}} }},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			m := valid
+			tcase.modify(&m)
+			testutil.NotOk(t, m.Validate())
+		})
+	}
+}
+
+func TestResolutionLevel(t *testing.T) {
+	for _, tcase := range []struct {
+		resolution int64
+		level      ResolutionLevel
+		str        string
+		err        bool
+	}{
+		{resolution: 0, level: ResolutionLevelRaw, str: "0"},
+		{resolution: 300000, level: ResolutionLevel5m, str: "300000"},
+		{resolution: 3600000, level: ResolutionLevel1h, str: "3600000"},
+		{resolution: 124, err: true},
+		{resolution: -1, err: true},
+	} {
+		l, err := ParseResolutionLevel(tcase.resolution)
+		if tcase.err {
+			testutil.NotOk(t, err)
+			continue
+		}
+		testutil.Ok(t, err)
+		testutil.Equals(t, tcase.level, l)
+
+		m := Thanos{Downsample: ThanosDownsample{Resolution: tcase.resolution}}
+		l, err = m.Downsample.Level()
+		testutil.Ok(t, err)
+		testutil.Equals(t, tcase.level, l)
+		testutil.Equals(t, tcase.str, m.ResolutionString())
+	}
+
+	var d ThanosDownsample
+	testutil.Ok(t, d.SetLevel(ResolutionLevel1h))
+	testutil.Equals(t, int64(3600000), d.Resolution)
+	testutil.NotOk(t, d.SetLevel(ResolutionLevel(124)))
+	testutil.Equals(t, int64(3600000), d.Resolution)
+
+	// Resolution string doesn't depend on validity, as it's used for labels of existing blocks.
+	m := Thanos{Downsample: ThanosDownsample{Resolution: 124}}
+	testutil.Equals(t, "124", m.ResolutionString())
+}
+
+func TestRegisterSourceType(t *testing.T) {
+	const custom SourceType = "customcollector"
+
+	testutil.Assert(t, IsKnownSource(SidecarSource))
+	testutil.Assert(t, IsKnownSource(UnknownSource))
+	testutil.Assert(t, !IsKnownSource(custom))
+	m := Thanos{Source: custom}
+	testutil.NotOk(t, m.Validate())
+
+	RegisterSourceType(custom)
+	testutil.Assert(t, IsKnownSource(custom))
+	testutil.Ok(t, m.Validate())
+}
+
+func TestMeta_IsDownsampled(t *testing.T) {
+	for _, tcase := range []struct {
+		resolution  int64
+		downsampled bool
+	}{
+		{resolution: 0},
+		{resolution: 300000, downsampled: true},
+		{resolution: 3600000, downsampled: true},
+		// Corrupted meta is treated as raw, but fails validation.
+		{resolution: -1},
+	} {
+		m := &Meta{Thanos: Thanos{Downsample: ThanosDownsample{Resolution: tcase.resolution}, Source: TestSource}}
+		testutil.Equals(t, tcase.downsampled, m.IsDownsampled())
+		testutil.Equals(t, !tcase.downsampled, m.IsRaw())
+		if tcase.resolution < 0 {
+			testutil.NotOk(t, m.Thanos.Validate())
+		}
+	}
+}
+
+func TestMeta_TimeRange(t *testing.T) {
+	for _, tcase := range []struct {
+		minTime, maxTime int64
+		start, end       time.Time
+		duration         time.Duration
+	}{
+		{
+			start: time.Unix(0, 0).UTC(),
+			end:   time.Unix(0, 0).UTC(),
+		},
+		{
+			maxTime:  2 * time.Hour.Milliseconds(),
+			start:    time.Unix(0, 0).UTC(),
+			end:      time.Date(1970, 1, 1, 2, 0, 0, 0, time.UTC),
+			duration: 2 * time.Hour,
+		},
+		{
+			minTime: 1700000000123,
+			maxTime: 1700000000123,
+			start:   time.Date(2023, 11, 14, 22, 13, 20, 123*int(time.Millisecond), time.UTC),
+			end:     time.Date(2023, 11, 14, 22, 13, 20, 123*int(time.Millisecond), time.UTC),
+		},
+		{
+			minTime:  -1,
+			maxTime:  1,
+			start:    time.Unix(0, -int64(time.Millisecond)).UTC(),
+			end:      time.Unix(0, int64(time.Millisecond)).UTC(),
+			duration: 2 * time.Millisecond,
+		},
+	} {
+		m := Meta{BlockMeta: tsdb.BlockMeta{MinTime: tcase.minTime, MaxTime: tcase.maxTime}}
+		start, end := m.TimeRange()
+		testutil.Equals(t, tcase.start, start)
+		testutil.Equals(t, tcase.end, end)
+		testutil.Equals(t, tcase.duration, m.Duration())
+	}
+}
+
+func TestThanos_Annotations(t *testing.T) {
+	m := Meta{
+		BlockMeta: tsdb.BlockMeta{Version: TSDBVersion1},
+		Thanos: Thanos{
+			Labels: map[string]string{"a": "1"},
+			Source: CompactorSource,
+		},
+	}
+	groupKey := m.Thanos.GroupKey()
+
+	_, ok := m.Thanos.GetAnnotation("owner")
+	testutil.Assert(t, !ok, "annotation should not be set")
+
+	m.Thanos.SetAnnotation("owner", "team-a")
+	m.Thanos.SetAnnotation("pipeline", "v2")
+	v, ok := m.Thanos.GetAnnotation("owner")
+	testutil.Assert(t, ok, "annotation should be set")
+	testutil.Equals(t, "team-a", v)
+
+	// Annotations are purely informational.
+	testutil.Equals(t, groupKey, m.Thanos.GroupKey())
+	testutil.Ok(t, m.Thanos.Validate())
+
+	b := bytes.Buffer{}
+	testutil.Ok(t, m.Write(&b))
+	testutil.Assert(t, strings.Contains(b.String(), `"annotations"`), "annotations should be written")
+	read, err := Read(io.NopCloser(&b))
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"owner": "team-a", "pipeline": "v2"}, read.Thanos.Annotations)
+}
+
+func TestMeta_Summary(t *testing.T) {
+	id := ulid.MustNew(1, nil)
+	m := Meta{
+		BlockMeta: tsdb.BlockMeta{
+			ULID:    id,
+			MinTime: 0,
+			MaxTime: 2 * time.Hour.Milliseconds(),
+			Stats:   tsdb.BlockStats{NumSeries: 3, NumChunks: 6, NumSamples: 600},
+		},
+		Thanos: Thanos{
+			Labels:     map[string]string{"b": "2", "a": "1"},
+			Downsample: ThanosDownsample{Resolution: 300000},
+			Source:     CompactorSource,
+			Files: []File{
+				{RelPath: "chunks/000001", SizeBytes: 100},
+				{RelPath: "index", SizeBytes: 50},
+				{RelPath: MetaFilename},
+			},
+		},
+	}
+	testutil.Equals(t, Summary{
+		ULID:           id,
+		Start:          time.Unix(0, 0).UTC(),
+		End:            time.Date(1970, 1, 1, 2, 0, 0, 0, time.UTC),
+		Duration:       2 * time.Hour,
+		Resolution:     ResolutionLevel5m,
+		Source:         CompactorSource,
+		Labels:         labels.FromStrings("a", "1", "b", "2"),
+		NumSeries:      3,
+		NumChunks:      6,
+		NumSamples:     600,
+		NumFiles:       3,
+		TotalSizeBytes: 150,
+	}, m.Summary())
+
+	m.Thanos.Files = nil
+	s := m.Summary()
+	testutil.Equals(t, 0, s.NumFiles)
+	testutil.Assert(t, s.SizeUnknown, "size should be unknown without files")
+}
+
+func TestEstimateDownload(t *testing.T) {
+	m := &Meta{Thanos: Thanos{Files: []File{
+		{RelPath: "chunks/000001", SizeBytes: 300},
+		{RelPath: "chunks/000002", SizeBytes: 200},
+		{RelPath: "index", SizeBytes: 100},
+		{RelPath: "tombstones", SizeBytes: 100},
+		{RelPath: MetaFilename},
+	}}}
+	for _, tcase := range []struct {
+		throughput  float64
+		concurrency int
+		expected    time.Duration
+	}{
+		{throughput: 100, concurrency: 1, expected: 7 * time.Second},
+		{throughput: 100, concurrency: 0, expected: 7 * time.Second},
+		{throughput: 100, concurrency: 2, expected: 4 * time.Second},
+		{throughput: 100, concurrency: 10, expected: 3 * time.Second},
+		{throughput: 1000, concurrency: 10, expected: 300 * time.Millisecond},
+		{throughput: 0, concurrency: 10, expected: 0},
+	} {
+		testutil.Equals(t, tcase.expected, EstimateDownload(m, tcase.throughput, tcase.concurrency), "throughput %v, concurrency %d", tcase.throughput, tcase.concurrency)
+	}
+	testutil.Equals(t, time.Duration(0), EstimateDownload(&Meta{}, 100, 1))
+}
+
+func TestMeta_WriteToPath(t *testing.T) {
+	m := Meta{
+		BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(1, nil), MinTime: 0, MaxTime: 100, Version: TSDBVersion1},
+		Thanos:    Thanos{Labels: map[string]string{"a": "1"}, Source: TestSource},
+	}
+	dir := t.TempDir()
+	staged := filepath.Join(dir, "staged-meta.json")
+	testutil.Ok(t, m.WriteToPath(log.NewNopLogger(), staged))
+	_, err := os.Stat(staged + ".tmp")
+	testutil.Assert(t, os.IsNotExist(err), "temporary file should be renamed")
+
+	// Staged meta can be promoted into the block directory.
+	testutil.Ok(t, os.Rename(staged, filepath.Join(dir, MetaFilename)))
+	read, err := ReadFromDir(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, m.ULID, read.ULID)
+	testutil.Equals(t, m.Thanos.Labels, read.Thanos.Labels)
+}
+
+func TestMeta_WriteCanonical(t *testing.T) {
+	type ext struct {
+		Zeta  string `json:"zeta"`
+		Alpha int    `json:"alpha"`
+	}
+	m1 := Meta{
+		BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(1, nil), Version: TSDBVersion1, MinTime: 0, MaxTime: 1000},
+		Thanos: Thanos{
+			Source:      SidecarSource,
+			Files:       []File{{RelPath: "index", SizeBytes: 10}, {RelPath: "chunks/000001", SizeBytes: 20}, {RelPath: MetaFilename}},
+			Extensions:  ext{Zeta: "z", Alpha: 1},
+			Annotations: map[string]string{"owner": "a", "pipeline": "b"},
+		},
+	}
+	m2 := m1
+	m2.Thanos.Labels = map[string]string{}
+	m2.Thanos.Files = []File{{RelPath: "chunks/000001", SizeBytes: 20}, {RelPath: "index", SizeBytes: 10}, {RelPath: MetaFilename}}
+	m2.Thanos.Extensions = map[string]any{"alpha": 1, "zeta": "z"}
+	m2.Thanos.Annotations = map[string]string{"pipeline": "b", "owner": "a"}
+
+	b1, b2 := bytes.Buffer{}, bytes.Buffer{}
+	testutil.Ok(t, m1.WriteCanonical(&b1))
+	testutil.Ok(t, m2.WriteCanonical(&b2))
+	testutil.Equals(t, b1.String(), b2.String())
+	testutil.Equals(t, `{"ulid":"00000000010000000000000000","minTime":0,"maxTime":1000,"stats":{},"compaction":{"level":0},"version":1,"thanos":{"labels":{},"downsample":{"resolution":0},"source":"sidecar","files":[{"rel_path":"chunks/000001","size_bytes":20},{"rel_path":"index","size_bytes":10},{"rel_path":"meta.json"}],"index_stats":{},"extensions":{"alpha":1,"zeta":"z"},"annotations":{"owner":"a","pipeline":"b"}}}`, b1.String())
+
+	// Meta itself is not modified.
+	testutil.Equals(t, "index", m1.Thanos.Files[0].RelPath)
+	testutil.Equals(t, ext{Zeta: "z", Alpha: 1}, m1.Thanos.Extensions)
+
+	// Canonical encoding can be read back.
+	read, err := Read(io.NopCloser(&b1))
+	testutil.Ok(t, err)
+	testutil.Equals(t, m2.Thanos.Files, read.Thanos.Files)
+
+	// Semantically different metas are encoded differently.
+	m2.Thanos.Annotations = map[string]string{"owner": "b"}
+	b2.Reset()
+	testutil.Ok(t, m2.WriteCanonical(&b2))
+	testutil.Assert(t, b1.String() != b2.String(), "expected different encoding")
+}
+
+func TestOverlaps(t *testing.T) {
+	newMeta := func(minTime, maxTime int64, lset map[string]string) *Meta {
+		return &Meta{
+			BlockMeta: tsdb.BlockMeta{MinTime: minTime, MaxTime: maxTime},
+			Thanos:    Thanos{Labels: lset},
+		}
+	}
+	lset := map[string]string{"a": "1"}
+	for _, tcase := range []struct {
+		name    string
+		a, b    *Meta
+		overlap int64
+	}{
+		{name: "disjoint", a: newMeta(0, 100, lset), b: newMeta(200, 300, lset)},
+		{name: "adjacent", a: newMeta(0, 100, lset), b: newMeta(100, 200, lset)},
+		{name: "off by one", a: newMeta(0, 101, lset), b: newMeta(100, 200, lset), overlap: 1},
+		{name: "partial", a: newMeta(0, 150, lset), b: newMeta(100, 200, lset), overlap: 50},
+		{name: "nested", a: newMeta(0, 300, lset), b: newMeta(100, 200, lset), overlap: 100},
+		{name: "identical", a: newMeta(100, 200, lset), b: newMeta(100, 200, lset), overlap: 100},
+		{name: "empty range", a: newMeta(100, 100, lset), b: newMeta(0, 200, lset)},
+		{name: "different labels", a: newMeta(0, 300, lset), b: newMeta(100, 200, map[string]string{"a": "2"})},
+		{name: "different resolution", a: newMeta(0, 300, lset), b: func() *Meta {
+			m := newMeta(100, 200, lset)
+			m.Thanos.Downsample.Resolution = 300000
+			return m
+		}()},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			testutil.Equals(t, tcase.overlap, OverlapDuration(tcase.a, tcase.b))
+			testutil.Equals(t, tcase.overlap, OverlapDuration(tcase.b, tcase.a))
+			testutil.Equals(t, tcase.overlap > 0, Overlaps(tcase.a, tcase.b))
+			testutil.Equals(t, tcase.overlap > 0, Overlaps(tcase.b, tcase.a))
+		})
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	m := Meta{
+		BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(5, nil), MinTime: 100, MaxTime: 200, Version: TSDBVersion1},
+		Thanos: Thanos{
+			Version:    ThanosVersion1,
+			Labels:     map[string]string{"a": "1"},
+			Downsample: ThanosDownsample{Resolution: 300000},
+			Source:     CompactorSource,
+			Files:      []File{{RelPath: "chunks/000001", SizeBytes: 10}, {RelPath: "index", SizeBytes: 20}, {RelPath: MetaFilename}},
+			Extensions: map[string]any{"a": []any{1.0, map[string]any{"b": "c"}}},
+		},
+	}
+	expected := &Header{
+		ULID:       ulid.MustNew(5, nil),
+		MinTime:    100,
+		MaxTime:    200,
+		Labels:     map[string]string{"a": "1"},
+		Downsample: ThanosDownsample{Resolution: 300000},
+		Source:     CompactorSource,
+	}
+
+	for _, opts := range [][]WriteOption{nil, {WithGzip()}, {WithCompactJSON()}, {WithChecksum()}} {
+		b := bytes.Buffer{}
+		testutil.Ok(t, m.Write(&b, opts...))
+		h, err := ReadHeader(&b)
+		testutil.Ok(t, err)
+		testutil.Equals(t, expected, h)
+	}
+
+	t.Run("reading stops once header is read", func(t *testing.T) {
+		h, err := ReadHeader(strings.NewReader(`{"ulid":"00000000050000000000000000","minTime":100,"maxTime":200,"stats":{"numSeries":1},"thanos":{"labels":{"a":"1"},"downsample":{"resolution":300000},"source":"compactor","files":[not JSON`))
+		testutil.Ok(t, err)
+		testutil.Equals(t, expected, h)
+	})
+	t.Run("any order", func(t *testing.T) {
+		h, err := ReadHeader(strings.NewReader(`{"thanos":{"files":[{"rel_path":"index"}],"source":"compactor","downsample":{"resolution":300000},"extensions":{"x":[1,{"y":[]}]},"labels":{"a":"1"}},"maxTime":200,"minTime":100,"ulid":"00000000050000000000000000"}`))
+		testutil.Ok(t, err)
+		testutil.Equals(t, expected, h)
+	})
+	t.Run("missing fields", func(t *testing.T) {
+		h, err := ReadHeader(strings.NewReader(`{"ulid":"00000000050000000000000000","thanos":{}}`))
+		testutil.Ok(t, err)
+		testutil.Equals(t, &Header{ULID: ulid.MustNew(5, nil), Labels: map[string]string{}}, h)
+	})
+	t.Run("malformed header", func(t *testing.T) {
+		_, err := ReadHeader(strings.NewReader(`{"ulid":"00000000050000000000000000","minTime":"x"`))
+		testutil.NotOk(t, err)
+		_, err = ReadHeader(strings.NewReader(`[]`))
+		testutil.NotOk(t, err)
+	})
+}
+
+func TestMergeMetasForCompaction(t *testing.T) {
+	lset := map[string]string{"a": "1"}
+	del := DeletionRequest{Intervals: tombstones.Intervals{{Mint: 0, Maxt: 10}}}
+	m1 := &Meta{
+		BlockMeta: tsdb.BlockMeta{
+			ULID: ulid.MustNew(1, nil), MinTime: 0, MaxTime: 100,
+			Compaction: tsdb.BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{ulid.MustNew(1, nil)}},
+		},
+		Thanos: Thanos{Labels: lset, Downsample: ThanosDownsample{Resolution: 300000}, Source: SidecarSource},
+	}
+	m2 := &Meta{
+		BlockMeta: tsdb.BlockMeta{
+			ULID: ulid.MustNew(4, nil), MinTime: 200, MaxTime: 300,
+			Compaction: tsdb.BlockMetaCompaction{Level: 2, Sources: []ulid.ULID{ulid.MustNew(3, nil), ulid.MustNew(2, nil)}},
+		},
+		Thanos: Thanos{
+			Labels:     map[string]string{"a": "1"},
+			Downsample: ThanosDownsample{Resolution: 300000},
+			Source:     CompactorSource,
+			Rewrites:   []Rewrite{{Sources: []ulid.ULID{ulid.MustNew(5, nil)}, DeletionsApplied: []DeletionRequest{del}}},
+		},
+	}
+
+	thanos, bm, err := MergeMetasForCompaction([]*Meta{m2, m1})
+	testutil.Ok(t, err)
+	testutil.Equals(t, Thanos{
+		Version:    ThanosVersion1,
+		Labels:     lset,
+		Downsample: ThanosDownsample{Resolution: 300000},
+		Source:     CompactorSource,
+		Rewrites:   []Rewrite{{Sources: []ulid.ULID{ulid.MustNew(5, nil)}, DeletionsApplied: []DeletionRequest{del}}},
+	}, thanos)
+	testutil.Equals(t, ulid.ULID{}, bm.ULID)
+	testutil.Equals(t, int64(0), bm.MinTime)
+	testutil.Equals(t, int64(300), bm.MaxTime)
+	testutil.Equals(t, 3, bm.Compaction.Level)
+	testutil.Equals(t, []ulid.ULID{ulid.MustNew(1, nil), ulid.MustNew(2, nil), ulid.MustNew(3, nil)}, bm.Compaction.Sources)
+	testutil.Equals(t, 2, len(bm.Compaction.Parents))
+
+	// Labels are copied.
+	thanos.Labels["b"] = "2"
+	testutil.Equals(t, map[string]string{"a": "1"}, m2.Thanos.Labels)
+
+	m3 := &Meta{BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(6, nil)}, Thanos: Thanos{Labels: lset}}
+	_, _, err = MergeMetasForCompaction([]*Meta{m1, m3})
+	testutil.NotOk(t, err)
+	_, _, err = MergeMetasForCompaction(nil)
+	testutil.NotOk(t, err)
+}
+
+func TestReadWithLimit(t *testing.T) {
+	m := Meta{
+		BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(1, nil), MinTime: 0, MaxTime: 100, Version: TSDBVersion1},
+		Thanos:    Thanos{Labels: map[string]string{"a": "1"}, Source: TestSource},
+	}
+	var plain, gz bytes.Buffer
+	testutil.Ok(t, m.Write(&plain))
+	testutil.Ok(t, m.Write(&gz, WithGzip()))
+	size := int64(plain.Len())
+
+	for _, b := range [][]byte{plain.Bytes(), gz.Bytes()} {
+		read, err := ReadWithLimit(io.NopCloser(bytes.NewReader(b)), size)
+		testutil.Ok(t, err)
+		testutil.Equals(t, m.ULID, read.ULID)
+
+		// Limit applies to the decompressed meta.
+		_, err = ReadWithLimit(io.NopCloser(bytes.NewReader(b)), size/2)
+		testutil.Assert(t, errors.Is(err, ErrorMetaTooLarge), "expected meta too large, got %v", err)
+
+		_, err = ReadWithLimit(io.NopCloser(bytes.NewReader(b)), 0)
+		testutil.Ok(t, err)
+	}
+}
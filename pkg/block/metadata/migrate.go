@@ -0,0 +1,75 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// metaMigration upgrades meta of the given Thanos section version to the current internal representation.
+type metaMigration struct {
+	// name describes the migration in errors.
+	name string
+	// version is the Thanos section version the migration applies to.
+	version int
+	// migrate changes m in place and returns true if anything was changed. It must not modify slices or maps of m
+	// in place, as they are shared with the meta passed to MigrateMeta.
+	migrate func(m *Meta) (bool, error)
+}
+
+// metaMigrations are applied in order by MigrateMeta.
+var metaMigrations = []metaMigration{
+	{
+		name:    "explicit Thanos section version",
+		version: 0,
+		migrate: func(m *Meta) (bool, error) {
+			// First version of Thanos section did not have explicit version specified.
+			m.Thanos.Version = ThanosVersion1
+			return true, nil
+		},
+	},
+	{
+		name:    "files from segment files",
+		version: ThanosVersion1,
+		migrate: func(m *Meta) (bool, error) {
+			return NormalizeMeta(m), nil
+		},
+	},
+}
+
+// MigrateMeta upgrades the given meta, which might be written by older Thanos, to the current internal representation
+// by applying all migrations relevant to its Thanos section version, e.g. populating deprecated SegmentFiles as Files.
+// The given meta is not modified; the migrated copy is returned together with information whether anything changed.
+func MigrateMeta(m *Meta) (*Meta, bool, error) {
+	migrated := *m
+	changed := false
+	for _, mg := range metaMigrations {
+		if migrated.Thanos.Version != mg.version {
+			continue
+		}
+		ok, err := mg.migrate(&migrated)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "migrate meta of block %s: %s", m.ULID, mg.name)
+		}
+		changed = changed || ok
+	}
+	return &migrated, changed, nil
+}
+
+// NormalizeMeta synthesizes Files entries of chunk segment files from the deprecated SegmentFiles, if the meta has
+// no Files, so Files can be used as the single source of block files. Synthesized entries have neither size nor hash.
+// It returns true if the meta was changed. Files slice of the meta is replaced, not modified in place.
+func NormalizeMeta(m *Meta) bool {
+	if len(m.Thanos.Files) > 0 || len(m.Thanos.SegmentFiles) == 0 {
+		return false
+	}
+	files := make([]File, 0, len(m.Thanos.SegmentFiles))
+	for _, f := range m.Thanos.SegmentFiles {
+		files = append(files, File{RelPath: path.Join("chunks", f)})
+	}
+	m.Thanos.Files = files
+	return true
+}
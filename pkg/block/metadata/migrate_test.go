@@ -0,0 +1,75 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+func TestMigrateMeta(t *testing.T) {
+	t.Run("current meta is not changed", func(t *testing.T) {
+		m := &Meta{Thanos: Thanos{
+			Version: ThanosVersion1,
+			Files:   []File{{RelPath: "chunks/000001", SizeBytes: 10}},
+		}}
+		migrated, changed, err := MigrateMeta(m)
+		testutil.Ok(t, err)
+		testutil.Assert(t, !changed)
+		testutil.Equals(t, m, migrated)
+	})
+	t.Run("segment files are migrated to files", func(t *testing.T) {
+		m := &Meta{Thanos: Thanos{
+			SegmentFiles: []string{"000001", "000002"},
+		}}
+		migrated, changed, err := MigrateMeta(m)
+		testutil.Ok(t, err)
+		testutil.Assert(t, changed)
+		testutil.Equals(t, ThanosVersion1, migrated.Thanos.Version)
+		testutil.Equals(t, []File{{RelPath: "chunks/000001"}, {RelPath: "chunks/000002"}}, migrated.Thanos.Files)
+		testutil.Equals(t, []string{"000001", "000002"}, migrated.Thanos.SegmentFiles)
+
+		// Original meta is untouched.
+		testutil.Equals(t, 0, m.Thanos.Version)
+		testutil.Equals(t, 0, len(m.Thanos.Files))
+	})
+	t.Run("read with migration", func(t *testing.T) {
+		m := Meta{
+			BlockMeta: tsdb.BlockMeta{Version: TSDBVersion1},
+			Thanos:    Thanos{SegmentFiles: []string{"000001"}},
+		}
+		b := bytes.Buffer{}
+		testutil.Ok(t, m.Write(&b))
+		raw := b.String()
+
+		ret, err := Read(io.NopCloser(bytes.NewBufferString(raw)))
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(ret.Thanos.Files))
+
+		ret, err = Read(io.NopCloser(bytes.NewBufferString(raw)), WithMigration())
+		testutil.Ok(t, err)
+		testutil.Equals(t, []File{{RelPath: "chunks/000001"}}, ret.Thanos.Files)
+	})
+}
+
+func TestNormalizeMeta(t *testing.T) {
+	m := &Meta{Thanos: Thanos{SegmentFiles: []string{"000001", "000002"}}}
+	testutil.Assert(t, NormalizeMeta(m))
+	testutil.Equals(t, []File{{RelPath: "chunks/000001"}, {RelPath: "chunks/000002"}}, m.Thanos.Files)
+
+	// Already normalized meta and meta with files are not changed.
+	testutil.Assert(t, !NormalizeMeta(m))
+	m = &Meta{Thanos: Thanos{
+		SegmentFiles: []string{"000001"},
+		Files:        []File{{RelPath: "chunks/000002", SizeBytes: 10}},
+	}}
+	testutil.Assert(t, !NormalizeMeta(m))
+	testutil.Equals(t, []File{{RelPath: "chunks/000002", SizeBytes: 10}}, m.Thanos.Files)
+
+	testutil.Assert(t, !NormalizeMeta(&Meta{}))
+}
@@ -0,0 +1,214 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/jpillora/backoff"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+	"google.golang.org/api/googleapi"
+)
+
+// RetryPolicy configures retries of bucket operations.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of a single operation, including the first one.
+	// Values lower than 2 disable retries.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. It is doubled for each following retry, up to MaxDelay.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between retries.
+	MaxDelay time.Duration
+	// Jitter randomizes delays between retries, to avoid retries of concurrent operations in lockstep.
+	Jitter bool
+	// IsRetriable decides whether a failed operation should be retried. IsRetriableError is used if nil.
+	IsRetriable func(error) bool
+}
+
+// DefaultRetryPolicy is a reasonable RetryPolicy for transient object storage errors.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: 500 * time.Millisecond, MaxDelay: 10 * time.Second, Jitter: true}
+
+// RetryMetrics holds metrics of retried bucket operations.
+type RetryMetrics struct {
+	Retries *prometheus.CounterVec
+}
+
+// NewRetryMetrics creates RetryMetrics registered in the given registerer.
+func NewRetryMetrics(reg prometheus.Registerer) *RetryMetrics {
+	return &RetryMetrics{
+		Retries: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_block_bucket_operation_retries_total",
+			Help: "Total number of retries of bucket operations done by block functions.",
+		}, []string{"operation"}),
+	}
+}
+
+// IsRetriableError returns true for errors which are likely transient: timeouts, broken connections and errors
+// carrying HTTP status 5xx or 429 (too many requests). Status is taken from errors of S3 (minio), GCS and Azure clients,
+// as well as from errors with HTTPStatusCode() or StatusCode() method. Other errors, including 4xx ones and provider
+// errors without status, are not retriable.
+func IsRetriableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var minioErr minio.ErrorResponse
+	if errors.As(err, &minioErr) {
+		return isRetriableStatus(minioErr.StatusCode)
+	}
+	var gcsErr *googleapi.Error
+	if errors.As(err, &gcsErr) {
+		return isRetriableStatus(gcsErr.Code)
+	}
+	var azureErr *azcore.ResponseError
+	if errors.As(err, &azureErr) {
+		return isRetriableStatus(azureErr.StatusCode)
+	}
+
+	var status interface{ HTTPStatusCode() int }
+	if errors.As(err, &status) {
+		return isRetriableStatus(status.HTTPStatusCode())
+	}
+	var statusCode interface{ StatusCode() int }
+	if errors.As(err, &statusCode) {
+		return isRetriableStatus(statusCode.StatusCode())
+	}
+	return false
+}
+
+func isRetriableStatus(code int) bool {
+	return code >= 500 || code == 429
+}
+
+// NewRetryBucket returns a bucket retrying failed operations of the given bucket according to the policy. Retries stop
+// when the context is canceled. Uploads are only retried if the uploaded reader implements io.Seeker and can be rewound.
+// Iterations are only retried if no entry was passed to the callback yet. Metrics are optional.
+// Upload, Download, Delete and the mark functions accept retry options; other functions retry bucket operations when
+// given a bucket wrapped by NewRetryBucket.
+func NewRetryBucket(bkt objstore.Bucket, policy RetryPolicy, metrics *RetryMetrics) objstore.Bucket {
+	if policy.IsRetriable == nil {
+		policy.IsRetriable = IsRetriableError
+	}
+	return &retryBucket{Bucket: bkt, policy: policy, metrics: metrics}
+}
+
+// withRetries wraps the bucket with NewRetryBucket if the policy is given and allows retries. Buckets already wrapped
+// by NewRetryBucket are left as they are, to not multiply attempts.
+func withRetries(bkt objstore.Bucket, policy *RetryPolicy, metrics *RetryMetrics) objstore.Bucket {
+	if policy == nil || policy.MaxAttempts < 2 {
+		return bkt
+	}
+	if _, ok := bkt.(*retryBucket); ok {
+		return bkt
+	}
+	return NewRetryBucket(bkt, *policy, metrics)
+}
+
+type retryBucket struct {
+	objstore.Bucket
+
+	policy  RetryPolicy
+	metrics *RetryMetrics
+}
+
+// do calls f until it succeeds, fails with an error which is not retriable, or attempts run out.
+// retriable is consulted before each retry and allows to prevent it.
+func (b *retryBucket) do(ctx context.Context, op string, f func() error, retriable func() bool) error {
+	bo := backoff.Backoff{Min: b.policy.BaseDelay, Max: b.policy.MaxDelay, Factor: 2, Jitter: b.policy.Jitter}
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= b.policy.MaxAttempts || b.Bucket.IsObjNotFoundErr(err) || !b.policy.IsRetriable(err) {
+			return err
+		}
+		if retriable != nil && !retriable() {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(bo.Duration()):
+		}
+		if b.metrics != nil {
+			b.metrics.Retries.WithLabelValues(op).Inc()
+		}
+	}
+}
+
+func (b *retryBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	called := false
+	return b.do(ctx, objstore.OpIter, func() error {
+		return b.Bucket.Iter(ctx, dir, func(name string) error {
+			called = true
+			return f(name)
+		}, options...)
+	}, func() bool { return !called })
+}
+
+func (b *retryBucket) Get(ctx context.Context, name string) (rc io.ReadCloser, err error) {
+	err = b.do(ctx, objstore.OpGet, func() error {
+		rc, err = b.Bucket.Get(ctx, name)
+		return err
+	}, nil)
+	return rc, err
+}
+
+func (b *retryBucket) GetRange(ctx context.Context, name string, off, length int64) (rc io.ReadCloser, err error) {
+	err = b.do(ctx, objstore.OpGetRange, func() error {
+		rc, err = b.Bucket.GetRange(ctx, name, off, length)
+		return err
+	}, nil)
+	return rc, err
+}
+
+func (b *retryBucket) Exists(ctx context.Context, name string) (ok bool, err error) {
+	err = b.do(ctx, objstore.OpExists, func() error {
+		ok, err = b.Bucket.Exists(ctx, name)
+		return err
+	}, nil)
+	return ok, err
+}
+
+func (b *retryBucket) Attributes(ctx context.Context, name string) (attrs objstore.ObjectAttributes, err error) {
+	err = b.do(ctx, objstore.OpAttributes, func() error {
+		attrs, err = b.Bucket.Attributes(ctx, name)
+		return err
+	}, nil)
+	return attrs, err
+}
+
+func (b *retryBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	return b.do(ctx, objstore.OpUpload, func() error {
+		return b.Bucket.Upload(ctx, name, r)
+	}, func() bool {
+		s, ok := r.(io.Seeker)
+		if !ok {
+			return false
+		}
+		_, err := s.Seek(0, io.SeekStart)
+		return err == nil
+	})
+}
+
+func (b *retryBucket) Delete(ctx context.Context, name string) error {
+	return b.do(ctx, objstore.OpDelete, func() error {
+		return b.Bucket.Delete(ctx, name)
+	}, nil)
+}
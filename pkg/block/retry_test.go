@@ -0,0 +1,165 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/efficientgo/core/testutil"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/objstore"
+	"google.golang.org/api/googleapi"
+
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+)
+
+type statusError int
+
+func (e statusError) Error() string       { return "status error" }
+func (e statusError) HTTPStatusCode() int { return int(e) }
+
+// flakyBucket fails the first failures operations with err.
+type flakyBucket struct {
+	objstore.Bucket
+
+	failures int
+	err      error
+	calls    int
+}
+
+func (b *flakyBucket) fail() error {
+	b.calls++
+	if b.calls <= b.failures {
+		return b.err
+	}
+	return nil
+}
+
+func (b *flakyBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.fail(); err != nil {
+		return nil, err
+	}
+	return b.Bucket.Get(ctx, name)
+}
+
+func (b *flakyBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.fail(); err != nil {
+		// Consume some of the reader, like a failed request would.
+		_, _ = io.CopyN(io.Discard, r, 2)
+		return err
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestIsRetriableError(t *testing.T) {
+	for _, tcase := range []struct {
+		err       error
+		retriable bool
+	}{
+		{err: nil},
+		{err: errors.New("some error")},
+		{err: context.Canceled},
+		{err: errors.Wrap(context.DeadlineExceeded, "get")},
+		{err: io.ErrUnexpectedEOF, retriable: true},
+		{err: statusError(503), retriable: true},
+		{err: errors.Wrap(statusError(500), "get"), retriable: true},
+		{err: statusError(429), retriable: true},
+		{err: statusError(404)},
+		{err: statusError(403)},
+		{err: errors.Wrap(minio.ErrorResponse{Code: "SlowDown", StatusCode: 503}, "upload"), retriable: true},
+		{err: minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404}},
+		{err: errors.Wrap(&googleapi.Error{Code: 502}, "get"), retriable: true},
+		{err: &googleapi.Error{Code: 403}},
+		{err: &azcore.ResponseError{ErrorCode: "ServerBusy", StatusCode: 503}, retriable: true},
+		{err: &azcore.ResponseError{ErrorCode: "BlobNotFound", StatusCode: 404}},
+	} {
+		testutil.Equals(t, tcase.retriable, IsRetriableError(tcase.err), "%v", tcase.err)
+	}
+}
+
+func TestRetryBucket(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+	t.Run("server errors are retried", func(t *testing.T) {
+		inmem := objstore.NewInMemBucket()
+		testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader("data")))
+
+		m := NewRetryMetrics(prometheus.NewRegistry())
+		fbkt := &flakyBucket{Bucket: inmem, failures: 2, err: statusError(503)}
+		rc, err := NewRetryBucket(fbkt, policy, m).Get(ctx, "obj")
+		testutil.Ok(t, err)
+		b, err := io.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, "data", string(b))
+		testutil.Equals(t, 3, fbkt.calls)
+		testutil.Equals(t, 2.0, promtest.ToFloat64(m.Retries.WithLabelValues(objstore.OpGet)))
+	})
+	t.Run("S3 throttling is retried", func(t *testing.T) {
+		inmem := objstore.NewInMemBucket()
+		testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader("data")))
+
+		// Error as returned by the S3 provider of objstore.
+		slowDown := errors.Wrapf(minio.ErrorResponse{Code: "SlowDown", Message: "Please reduce your request rate.", StatusCode: 503}, "get object %s", "obj")
+		m := NewRetryMetrics(prometheus.NewRegistry())
+		fbkt := &flakyBucket{Bucket: inmem, failures: 1, err: slowDown}
+		rc, err := NewRetryBucket(fbkt, policy, m).Get(ctx, "obj")
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, 2, fbkt.calls)
+		testutil.Equals(t, 1.0, promtest.ToFloat64(m.Retries.WithLabelValues(objstore.OpGet)))
+	})
+	t.Run("attempts run out", func(t *testing.T) {
+		fbkt := &flakyBucket{Bucket: objstore.NewInMemBucket(), failures: 5, err: statusError(500)}
+		_, err := NewRetryBucket(fbkt, policy, nil).Get(ctx, "obj")
+		testutil.NotOk(t, err)
+		testutil.Equals(t, 3, fbkt.calls)
+	})
+	t.Run("client errors are not retried", func(t *testing.T) {
+		m := NewRetryMetrics(prometheus.NewRegistry())
+		fbkt := &flakyBucket{Bucket: objstore.NewInMemBucket(), failures: 1, err: statusError(403)}
+		_, err := NewRetryBucket(fbkt, policy, m).Get(ctx, "obj")
+		testutil.NotOk(t, err)
+		testutil.Equals(t, 1, fbkt.calls)
+		testutil.Equals(t, 0.0, promtest.ToFloat64(m.Retries.WithLabelValues(objstore.OpGet)))
+	})
+	t.Run("canceled context stops retries", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		fbkt := &flakyBucket{Bucket: objstore.NewInMemBucket(), failures: 5, err: statusError(503)}
+		_, err := NewRetryBucket(fbkt, RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}, nil).Get(cctx, "obj")
+		testutil.NotOk(t, err)
+		testutil.Equals(t, 1, fbkt.calls)
+	})
+	t.Run("seekable upload is rewound", func(t *testing.T) {
+		inmem := objstore.NewInMemBucket()
+		fbkt := &flakyBucket{Bucket: inmem, failures: 1, err: statusError(503)}
+		testutil.Ok(t, NewRetryBucket(fbkt, policy, nil).Upload(ctx, "obj", bytes.NewReader([]byte("data"))))
+		testutil.Equals(t, 2, fbkt.calls)
+
+		rc, err := inmem.Get(ctx, "obj")
+		testutil.Ok(t, err)
+		b, err := io.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, "data", string(b))
+	})
+	t.Run("non-seekable upload is not retried", func(t *testing.T) {
+		fbkt := &flakyBucket{Bucket: objstore.NewInMemBucket(), failures: 1, err: statusError(503)}
+		testutil.NotOk(t, NewRetryBucket(fbkt, policy, nil).Upload(ctx, "obj", io.MultiReader(strings.NewReader("data"))))
+		testutil.Equals(t, 1, fbkt.calls)
+	})
+}
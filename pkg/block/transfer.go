@@ -0,0 +1,358 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+	"golang.org/x/time/rate"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+const (
+	transferOpUpload   = "upload"
+	transferOpDownload = "download"
+)
+
+// BlockTransferMetrics holds metrics tracked by Upload and Download of blocks.
+type BlockTransferMetrics struct {
+	Throughput       *prometheus.HistogramVec
+	Duration         *prometheus.HistogramVec
+	BytesTransferred *prometheus.CounterVec
+	// HashSkippedFiles counts files not downloaded, because local copy has the same hash as recorded in meta.
+	HashSkippedFiles prometheus.Counter
+	// HashSkippedBytes counts bytes of files counted by HashSkippedFiles, i.e. bytes saved by hash matching.
+	HashSkippedBytes prometheus.Counter
+	// DownloadedFiles counts block files actually downloaded, apart from meta.
+	DownloadedFiles prometheus.Counter
+}
+
+// NewBlockTransferMetrics creates BlockTransferMetrics registered in the given registerer.
+func NewBlockTransferMetrics(reg prometheus.Registerer) *BlockTransferMetrics {
+	var m BlockTransferMetrics
+
+	m.Throughput = promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "thanos_block_transfer_throughput_bytes_per_second",
+		Help:    "Throughput achieved by a single block upload or download, in bytes per second.",
+		Buckets: prometheus.ExponentialBuckets(64*1024, 4, 10),
+	}, []string{"operation"})
+	m.Duration = promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "thanos_block_transfer_duration_seconds",
+		Help:    "Duration of successful block uploads and downloads, in seconds.",
+		Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 1800},
+	}, []string{"operation"})
+	m.BytesTransferred = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_block_transfer_bytes_total",
+		Help: "Total number of bytes transferred by block uploads and downloads, including failed ones.",
+	}, []string{"operation"})
+	m.HashSkippedFiles = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_block_download_hash_skipped_files_total",
+		Help: "Total number of block files not downloaded, because local file with matching hash was present.",
+	})
+	m.HashSkippedBytes = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_block_download_hash_skipped_bytes_total",
+		Help: "Total number of bytes of block files not downloaded, because local file with matching hash was present.",
+	})
+	m.DownloadedFiles = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_block_download_downloaded_files_total",
+		Help: "Total number of block files downloaded, apart from meta.json.",
+	})
+	return &m
+}
+
+// observeHashSkipped records that the given files were not downloaded thanks to matching hashes.
+func (m *BlockTransferMetrics) observeHashSkipped(files []metadata.File, skipped []string) {
+	if m == nil {
+		return
+	}
+	sizes := make(map[string]int64, len(files))
+	for _, f := range files {
+		sizes[f.RelPath] = f.SizeBytes
+	}
+	var bytes int64
+	for _, relPath := range skipped {
+		bytes += sizes[relPath]
+	}
+	m.HashSkippedFiles.Add(float64(len(skipped)))
+	m.HashSkippedBytes.Add(float64(bytes))
+}
+
+// observeDownloaded records that a block file was downloaded.
+func (m *BlockTransferMetrics) observeDownloaded() {
+	if m == nil {
+		return
+	}
+	m.DownloadedFiles.Inc()
+}
+
+// NewBandwidthLimiter returns a limiter capping transfer to the given number of bytes per second.
+// Zero or negative bytesPerSec means unlimited, in which case nil is returned.
+func NewBandwidthLimiter(bytesPerSec int) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), bytesPerSec)
+}
+
+// transferBucket is a bucket limiting the rate of uploaded and downloaded data and tracking the amount of
+// transferred bytes and files. The same limiter is shared by all concurrent transfers.
+// Unless the bytes are limited or counted, readers are passed to the bucket as they are, so that it can still
+// see their capabilities, e.g. parallel multipart upload of S3 needs io.ReaderAt of *os.File.
+type transferBucket struct {
+	objstore.Bucket
+
+	limiter *rate.Limiter
+	// passthrough is true if readers don't need to be wrapped.
+	passthrough bool
+	bytes       atomic.Int64
+
+	uploadedFiles atomic.Int64
+	uploadedBytes atomic.Int64
+}
+
+func newTransferBucket(bkt objstore.Bucket, limiter *rate.Limiter, countBytes bool) *transferBucket {
+	return &transferBucket{Bucket: bkt, limiter: limiter, passthrough: limiter == nil && !countBytes}
+}
+
+// transferParams holds the parameters of bucket access shared by Download() and Upload().
+type transferParams struct {
+	limiter      *rate.Limiter
+	metrics      *BlockTransferMetrics
+	retries      *RetryPolicy
+	retryMetrics *RetryMetrics
+	prefix       string
+}
+
+// wrapBucket wraps the bucket according to the params: under the prefix, with the bandwidth limit and with retries.
+// The returned transferBucket sits below retries, so retried attempts are accounted for too, and has to be observed
+// once the transfer is done.
+func wrapBucket(bkt objstore.Bucket, params transferParams) (objstore.Bucket, *transferBucket) {
+	if params.prefix != "" {
+		bkt = objstore.NewPrefixedBucket(bkt, params.prefix)
+	}
+	tbkt := newTransferBucket(bkt, params.limiter, params.metrics != nil)
+	return withRetries(tbkt, params.retries, params.retryMetrics), tbkt
+}
+
+func (b *transferBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil || b.passthrough {
+		return rc, err
+	}
+	return &transferReader{ctx: ctx, r: rc, closer: rc, limiter: b.limiter, bytes: &b.bytes}, nil
+}
+
+func (b *transferBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if b.passthrough {
+		// Size of uploaded files is known upfront, e.g. from *os.File, so reads don't have to be counted.
+		if size, err := objstore.TryToGetSize(r); err == nil {
+			if err := b.Bucket.Upload(ctx, name, r); err != nil {
+				return err
+			}
+			b.uploadedFiles.Add(1)
+			b.uploadedBytes.Add(size)
+			return nil
+		}
+	}
+
+	tr := &transferReader{ctx: ctx, r: r, limiter: b.limiter, bytes: &b.bytes}
+	var upload io.Reader = tr
+	if ra, ok := r.(readSeekerAt); ok {
+		upload = &transferReaderAt{transferReader: tr, ra: ra}
+	}
+	if err := b.Bucket.Upload(ctx, name, upload); err != nil {
+		return err
+	}
+	b.uploadedFiles.Add(1)
+	b.uploadedBytes.Add(tr.read.Load())
+	return nil
+}
+
+// observe records metrics of the operation which started at the given time and finished with the given error.
+// Duration and throughput are only recorded for successful operations.
+func (b *transferBucket) observe(m *BlockTransferMetrics, op string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	transferred := b.bytes.Load()
+	m.BytesTransferred.WithLabelValues(op).Add(float64(transferred))
+	if err != nil {
+		return
+	}
+
+	elapsed := time.Since(start).Seconds()
+	m.Duration.WithLabelValues(op).Observe(elapsed)
+	if elapsed <= 0 || transferred == 0 {
+		return
+	}
+	m.Throughput.WithLabelValues(op).Observe(float64(transferred) / elapsed)
+}
+
+type transferReader struct {
+	ctx     context.Context
+	r       io.Reader
+	closer  io.Closer
+	limiter *rate.Limiter
+	bytes   *atomic.Int64
+
+	// read is the number of bytes read by this reader.
+	read atomic.Int64
+}
+
+func (r *transferReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(r.limit(p))
+	if werr := r.transferred(n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// limit returns p shortened to the burst of the limiter, if any, so that it can be waited for at once.
+func (r *transferReader) limit(p []byte) []byte {
+	if r.limited() && len(p) > r.limiter.Burst() {
+		return p[:r.limiter.Burst()]
+	}
+	return p
+}
+
+func (r *transferReader) limited() bool {
+	return r.limiter != nil && r.limiter.Limit() != rate.Inf && r.limiter.Burst() > 0
+}
+
+// transferred accounts n bytes read and waits for the limiter, if any.
+func (r *transferReader) transferred(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	r.read.Add(int64(n))
+	r.bytes.Add(int64(n))
+	if r.limited() {
+		return r.limiter.WaitN(r.ctx, n)
+	}
+	return nil
+}
+
+// ObjectSize allows objstore.TryToGetSize to see through the reader.
+func (r *transferReader) ObjectSize() (int64, error) {
+	return objstore.TryToGetSize(r.r)
+}
+
+func (r *transferReader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+type readSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// transferReaderAt is transferReader of a reader with random access, like *os.File. It keeps io.ReaderAt and io.Seeker
+// of the reader, so that the bucket can still read it in parallel (e.g. multipart upload of S3) and rewind it.
+type transferReaderAt struct {
+	*transferReader
+
+	ra readSeekerAt
+}
+
+func (r *transferReaderAt) ReadAt(p []byte, off int64) (read int, err error) {
+	for len(p) > 0 {
+		chunk := r.limit(p)
+		n, err := r.ra.ReadAt(chunk, off)
+		read += n
+		off += int64(n)
+		p = p[n:]
+		if werr := r.transferred(n); werr != nil {
+			return read, werr
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (r *transferReaderAt) Seek(offset int64, whence int) (int64, error) {
+	return r.ra.Seek(offset, whence)
+}
+
+// DownloadProgressFunc is called with progress of download of the block file with the given path, relative to the
+// block directory: the number of bytes downloaded so far and the size of the file from meta, or 0 if it's unknown.
+// See WithDownloadProgress.
+type DownloadProgressFunc func(relPath string, bytes, total int64)
+
+// DownloadProgressStep is the number of bytes of a single file downloaded between calls of DownloadProgressFunc.
+const DownloadProgressStep = 8 << 20
+
+// withDownloadProgress returns the bucket reporting progress of reads of files of the given block to fn, or the
+// given bucket if fn is nil.
+func withDownloadProgress(bkt objstore.Bucket, id ulid.ULID, files []metadata.File, fn DownloadProgressFunc) objstore.Bucket {
+	if fn == nil {
+		return bkt
+	}
+	sizes := make(map[string]int64, len(files))
+	for _, f := range files {
+		sizes[f.RelPath] = f.SizeBytes
+	}
+	return &progressBucket{Bucket: bkt, fn: fn, prefix: id.String() + objstore.DirDelim, sizes: sizes}
+}
+
+type progressBucket struct {
+	objstore.Bucket
+
+	fn     DownloadProgressFunc
+	prefix string
+	sizes  map[string]int64
+}
+
+func (b *progressBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	relPath := strings.TrimPrefix(name, b.prefix)
+	return &progressReader{ReadCloser: rc, fn: b.fn, relPath: relPath, total: b.sizes[relPath]}, nil
+}
+
+type progressReader struct {
+	io.ReadCloser
+
+	fn      DownloadProgressFunc
+	relPath string
+	total   int64
+
+	read     int64
+	reported int64
+	done     bool
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	if r.done {
+		return n, err
+	}
+	if err == io.EOF || r.read-r.reported >= DownloadProgressStep {
+		r.done = err == io.EOF
+		r.reported = r.read
+		r.fn(r.relPath, r.read, r.total)
+	}
+	return n, err
+}
+
+// ObjectSize allows objstore.TryToGetSize to see through the reader.
+func (r *progressReader) ObjectSize() (int64, error) {
+	return objstore.TryToGetSize(r.ReadCloser)
+}
@@ -0,0 +1,204 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestNewBandwidthLimiter(t *testing.T) {
+	testutil.Assert(t, NewBandwidthLimiter(0) == nil, "zero limit should mean unlimited")
+	testutil.Assert(t, NewBandwidthLimiter(-1) == nil, "negative limit should mean unlimited")
+
+	l := NewBandwidthLimiter(1024)
+	testutil.Equals(t, 1024.0, float64(l.Limit()))
+	testutil.Equals(t, 1024, l.Burst())
+}
+
+func TestUploadDownloadWithRateLimiter(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 42, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	m := NewBlockTransferMetrics(prometheus.NewRegistry())
+	// Burst is larger than the whole block, so the test is not slowed down.
+	limiter := NewBandwidthLimiter(1024 * 1024)
+
+	testutil.Ok(t, UploadWithOptions(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc, WithUploadRateLimiter(limiter), WithUploadMetrics(m)))
+	testutil.Equals(t, 3, len(bkt.Objects()))
+	testutil.Equals(t, 1, promtest.CollectAndCount(m.Throughput))
+
+	dst := path.Join(t.TempDir(), b1.String())
+	testutil.Ok(t, DownloadWithOptions(ctx, log.NewNopLogger(), bkt, b1, dst, WithDownloadRateLimiter(limiter), WithDownloadMetrics(m), WithFetchConcurrency(2)))
+	testutil.Equals(t, 2, promtest.CollectAndCount(m.Throughput))
+
+	// Waiting for the limiter respects context cancellation.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	testutil.NotOk(t, UploadWithOptions(cctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc, WithUploadRateLimiter(NewBandwidthLimiter(1))))
+}
+
+func TestTransferBucketKeepsRandomAccess(t *testing.T) {
+	ctx := context.Background()
+
+	p := filepath.Join(t.TempDir(), "file")
+	testutil.Ok(t, os.WriteFile(p, []byte("some content"), 0600))
+	upload := func(t *testing.T, params transferParams) (io.Reader, *transferBucket) {
+		f, err := os.Open(p)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, f.Close()) }()
+
+		rbkt := &readerRecordingBucket{Bucket: objstore.NewInMemBucket()}
+		bkt, tbkt := wrapBucket(rbkt, params)
+		testutil.Ok(t, bkt.Upload(ctx, "file", f))
+		return rbkt.reader, tbkt
+	}
+
+	t.Run("file is passed as it is without limiter and metrics", func(t *testing.T) {
+		r, tbkt := upload(t, transferParams{})
+		_, ok := r.(*os.File)
+		testutil.Assert(t, ok, "expected *os.File, got %T", r)
+		testutil.Equals(t, int64(len("some content")), tbkt.uploadedBytes.Load())
+		testutil.Equals(t, int64(1), tbkt.uploadedFiles.Load())
+	})
+	t.Run("limited reader keeps random access", func(t *testing.T) {
+		r, tbkt := upload(t, transferParams{limiter: NewBandwidthLimiter(1024)})
+		_, ok := r.(io.ReaderAt)
+		testutil.Assert(t, ok, "expected io.ReaderAt, got %T", r)
+		_, ok = r.(io.Seeker)
+		testutil.Assert(t, ok, "expected io.Seeker, got %T", r)
+		testutil.Equals(t, int64(len("some content")), tbkt.uploadedBytes.Load())
+	})
+}
+
+// readerRecordingBucket records the reader passed to the last upload.
+type readerRecordingBucket struct {
+	objstore.Bucket
+
+	reader io.Reader
+}
+
+func (b *readerRecordingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.reader = r
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestBlockTransferMetrics(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 42, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	m := NewBlockTransferMetrics(prometheus.NewRegistry())
+	testutil.Ok(t, UploadWithOptions(ctx, logger, bkt, path.Join(tmpDir, b1.String()), metadata.SHA256Func, WithUploadMetrics(m)))
+	uploaded := promtest.ToFloat64(m.BytesTransferred.WithLabelValues(transferOpUpload))
+	testutil.Assert(t, uploaded > 0, "expected uploaded bytes to be tracked")
+	testutil.Equals(t, 1, promtest.CollectAndCount(m.Duration))
+
+	dst := path.Join(t.TempDir(), b1.String())
+	testutil.Ok(t, DownloadWithOptions(ctx, logger, bkt, b1, dst, WithDownloadMetrics(m)))
+	downloaded := promtest.ToFloat64(m.BytesTransferred.WithLabelValues(transferOpDownload))
+	testutil.Assert(t, downloaded > 0, "expected downloaded bytes to be tracked")
+	testutil.Equals(t, 0.0, promtest.ToFloat64(m.HashSkippedFiles))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(m.DownloadedFiles))
+
+	// Index and chunks are not downloaded again.
+	testutil.Ok(t, DownloadWithOptions(ctx, logger, bkt, b1, dst, WithDownloadMetrics(m)))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(m.HashSkippedFiles))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(m.DownloadedFiles))
+	meta, err := metadata.ReadFromDir(dst)
+	testutil.Ok(t, err)
+	testutil.Equals(t, float64(meta.TotalSizeBytes()), promtest.ToFloat64(m.HashSkippedBytes))
+	testutil.Assert(t, promtest.ToFloat64(m.BytesTransferred.WithLabelValues(transferOpDownload)) < 2*downloaded, "expected only meta to be downloaded again")
+	testutil.Equals(t, 2, promtest.CollectAndCount(m.Duration))
+}
+
+func TestDownloadWithProgress(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 42, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+	m, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, b1)
+	testutil.Ok(t, err)
+
+	var (
+		mtx      sync.Mutex
+		reported = map[string][2]int64{}
+	)
+	progress := func(relPath string, bytes, total int64) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		reported[relPath] = [2]int64{bytes, total}
+	}
+	testutil.Ok(t, DownloadWithOptions(ctx, log.NewNopLogger(), bkt, b1, path.Join(t.TempDir(), b1.String()), WithDownloadProgress(progress), WithFetchConcurrency(2)))
+
+	expected := map[string][2]int64{}
+	for _, f := range m.Thanos.Files {
+		if f.RelPath != MetaFilename {
+			expected[f.RelPath] = [2]int64{f.SizeBytes, f.SizeBytes}
+		}
+	}
+	testutil.Equals(t, expected, reported)
+
+	t.Run("large file is reported periodically", func(t *testing.T) {
+		var calls []int64
+		size := int64(2*DownloadProgressStep + DownloadProgressStep/2)
+		r := &progressReader{ReadCloser: io.NopCloser(io.LimitReader(zeroReader{}, size)), relPath: "chunks/000001", total: size, fn: func(relPath string, bytes, total int64) {
+			testutil.Equals(t, "chunks/000001", relPath)
+			testutil.Equals(t, size, total)
+			calls = append(calls, bytes)
+		}}
+		_, err := io.Copy(io.Discard, r)
+		testutil.Ok(t, err)
+		testutil.Equals(t, []int64{DownloadProgressStep, 2 * DownloadProgressStep, size}, calls)
+	})
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,872 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// UploadOption configures the provided params.
+type UploadOption func(params *uploadParams)
+
+// uploadParams holds the UploadWithOptions() parameters.
+type uploadParams struct {
+	transferParams
+
+	concurrency  int
+	labelsSchema *ExternalLabelsSchema
+
+	validateSegmentFiles bool
+	validateMeta         bool
+	compressedMeta       bool
+	indexStats           bool
+	allowNoChunks        bool
+	validateTimeBounds   bool
+	validateBlockID      bool
+	indexHeaderWriter    IndexHeaderWriter
+	encrypter            Encrypter
+	// persistedChunksRate is the fraction of chunk files checked to be persisted before meta is uploaded.
+	// Non-positive means no check at all.
+	persistedChunksRate float64
+	hashFilter          HashFilter
+
+	objstoreOptions []objstore.UploadOption
+}
+
+// WithUploadConcurrency is an option to set the number of block files uploaded in parallel.
+func WithUploadConcurrency(concurrency int) UploadOption {
+	return func(params *uploadParams) {
+		params.concurrency = concurrency
+	}
+}
+
+// WithUploadRateLimiter is an option to cap the bandwidth used by upload. The limit applies to all files
+// uploaded in parallel. Nil limiter means unlimited bandwidth.
+func WithUploadRateLimiter(limiter *rate.Limiter) UploadOption {
+	return func(params *uploadParams) {
+		params.limiter = limiter
+	}
+}
+
+// WithUploadMetrics is an option to track upload in the given metrics.
+func WithUploadMetrics(metrics *BlockTransferMetrics) UploadOption {
+	return func(params *uploadParams) {
+		params.metrics = metrics
+	}
+}
+
+// WithUploadRetries is an option to retry failed bucket operations of the upload according to the given policy.
+// Metrics are optional.
+func WithUploadRetries(policy RetryPolicy, metrics *RetryMetrics) UploadOption {
+	return func(params *uploadParams) {
+		params.retries = &policy
+		params.retryMetrics = metrics
+	}
+}
+
+// WithUploadPrefix is an option to upload the block under the given object key prefix (e.g. "tenants/acme"),
+// instead of the bucket root. It's equivalent to uploading to objstore.NewPrefixedBucket, which should be used
+// to make Delete and the mark functions honor the same prefix.
+func WithUploadPrefix(prefix string) UploadOption {
+	return func(params *uploadParams) {
+		params.prefix = prefix
+	}
+}
+
+// WithMetaValidation is an option to fail the upload, before any file is uploaded, if the Thanos section of meta
+// is not valid. See metadata.Thanos.Validate. Files section is validated once block files are uploaded.
+func WithMetaValidation() UploadOption {
+	return func(params *uploadParams) {
+		params.validateMeta = true
+	}
+}
+
+// WithSegmentFilesValidation is an option to fail the upload, before any file is uploaded, if segment files
+// of the block are not numbered contiguously. See ValidateSegmentFiles.
+func WithSegmentFilesValidation() UploadOption {
+	return func(params *uploadParams) {
+		params.validateSegmentFiles = true
+	}
+}
+
+// WithTimeBoundsValidation is an option to fail the upload, before any file is uploaded, if chunks of the block are
+// outside of the time range declared in its meta. See ValidateTimeBounds.
+func WithTimeBoundsValidation() UploadOption {
+	return func(params *uploadParams) {
+		params.validateTimeBounds = true
+	}
+}
+
+// WithPersistenceVerification is an option to check, right before meta is uploaded, that the index and the given
+// fraction of chunk files (at least one) of the block are readable from the bucket, failing the upload otherwise.
+// This protects from meta declaring the block complete before its data is visible on eventually consistent object
+// storages. The fraction is capped to 1, i.e. all chunk files; non-positive fraction disables the check.
+func WithPersistenceVerification(chunksSampleRate float64) UploadOption {
+	return func(params *uploadParams) {
+		params.persistedChunksRate = min(chunksSampleRate, 1)
+	}
+}
+
+// WithBlockIDValidation is an option to fail the upload, before any file is uploaded, if the ULID of the block in its
+// meta is not the name of the block directory. See VerifyBlockID.
+func WithBlockIDValidation() UploadOption {
+	return func(params *uploadParams) {
+		params.validateBlockID = true
+	}
+}
+
+// WithCompressedMeta is an option to upload gzip-compressed meta as metadata.MetaGzipFilename instead of meta.json.
+// Functions of this package reading meta from the bucket support both forms.
+// NOTE: Don't use it until all components accessing the bucket understand compressed meta. Older versions see such
+// blocks as partial uploads, and compactor deletes them once they are older than the partial upload threshold.
+func WithCompressedMeta() UploadOption {
+	return func(params *uploadParams) {
+		params.compressedMeta = true
+	}
+}
+
+// WithIndexStats is an option to compute IndexStats of the block with ComputeIndexStats and record them in the uploaded
+// meta, if the meta does not have them yet.
+func WithIndexStats() UploadOption {
+	return func(params *uploadParams) {
+		params.indexStats = true
+	}
+}
+
+// WithHashFilter is an option to hash only files accepted by the given filter with the hash function passed to Upload,
+// e.g. HashOnlyFiles(IndexFilename) to hash just the index, which benefits most from skipping downloads of matching
+// files. Other files get entries with size only in meta.
+func WithHashFilter(filter HashFilter) UploadOption {
+	return func(params *uploadParams) {
+		params.hashFilter = filter
+	}
+}
+
+// AllowNoChunks is an option to upload blocks without chunks, e.g. index-only blocks, whose chunks directory is
+// missing or empty. Without it, a missing chunks directory fails the upload.
+func AllowNoChunks() UploadOption {
+	return func(params *uploadParams) {
+		params.allowNoChunks = true
+	}
+}
+
+// IndexHeaderWriter writes the index-header of the block in the given local block directory to the given file.
+// See indexheader.WriteBinaryFromDir.
+type IndexHeaderWriter func(ctx context.Context, bdir, filename string) error
+
+// WithGenerateIndexHeader is an option to generate the index-header of the block with the given writer before upload,
+// into IndexHeaderFilename inside the block directory, and upload it with the block, so readers don't have to build it.
+// UploadReaders does not support it.
+func WithGenerateIndexHeader(w IndexHeaderWriter) UploadOption {
+	return func(params *uploadParams) {
+		params.indexHeaderWriter = w
+	}
+}
+
+// WithEncrypter is an option to encrypt block files, except for meta, with the given encrypter before they are uploaded.
+// Encrypted files are marked as such in the Files section of meta, with the size and hash of the ciphertext, and can be
+// downloaded only with WithDecrypter. Meta stays plaintext. Uploads of encrypted files are not retried, as encrypted
+// streams can't be rewound. UploadReaders does not support it.
+func WithEncrypter(e Encrypter) UploadOption {
+	return func(params *uploadParams) {
+		params.encrypter = e
+	}
+}
+
+// metaObject returns the name of the meta object of the given block and options to encode it with.
+func (p uploadParams) metaObject(id ulid.ULID) (string, []metadata.WriteOption) {
+	if p.compressedMeta {
+		return path.Join(id.String(), metadata.MetaGzipFilename), []metadata.WriteOption{metadata.WithGzip()}
+	}
+	return path.Join(id.String(), MetaFilename), nil
+}
+
+// WithObjstoreUploadOptions is an option to forward the given options (e.g. objstore.WithUploadConcurrency) to
+// objstore.UploadDir, used to upload chunks of the block, as Upload did before it had options of its own. Hashed and
+// encrypted chunks are uploaded by objstore.UploadDir too. They take precedence over WithUploadConcurrency.
+// UploadReaders doesn't support them.
+func WithObjstoreUploadOptions(options ...objstore.UploadOption) UploadOption {
+	return func(params *uploadParams) {
+		params.objstoreOptions = append(params.objstoreOptions, options...)
+	}
+}
+
+func applyUploadOptions(options ...UploadOption) uploadParams {
+	out := uploadParams{
+		concurrency: 1,
+	}
+	for _, opt := range options {
+		opt(&out)
+	}
+	if out.concurrency < 1 {
+		out.concurrency = 1
+	}
+	return out
+}
+
+// UploadStats holds statistics of a single block upload.
+type UploadStats struct {
+	// BytesUploaded is the number of bytes of all successfully uploaded files.
+	BytesUploaded int64
+	// FilesUploaded is the number of successfully uploaded files, including meta.json.
+	FilesUploaded int
+	// HashDuration is the time spent on gathering file stats and hashing the files. Hashes are calculated while files
+	// are uploaded, so it's the sum of time spent in hash function over all files, which may exceed TotalDuration when
+	// files are uploaded concurrently.
+	HashDuration time.Duration
+	// TotalDuration is the time spent on the whole upload.
+	TotalDuration time.Duration
+}
+
+// Upload uploads a TSDB block to the object storage. It verifies basic
+// features of Thanos block.
+// The given options are forwarded to objstore.UploadDir, see WithObjstoreUploadOptions. Use UploadWithOptions
+// to configure the upload with options of this package.
+func Upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, options ...objstore.UploadOption) error {
+	return UploadWithOptions(ctx, logger, bkt, bdir, hf, WithObjstoreUploadOptions(options...))
+}
+
+// UploadWithOptions works like Upload, configured by the given options.
+func UploadWithOptions(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, options ...UploadOption) error {
+	_, err := UploadWithStats(ctx, logger, bkt, bdir, hf, options...)
+	return err
+}
+
+// UploadWithStats works like Upload, but also returns statistics of the upload. Statistics are
+// populated even if upload fails, to show how far it got.
+func UploadWithStats(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, options ...UploadOption) (UploadStats, error) {
+	var stats UploadStats
+	err := upload(ctx, logger, bkt, bdir, hf, true, &stats, options...)
+	return stats, err
+}
+
+// ExternalLabelsSchema describes external labels blocks are required to have.
+type ExternalLabelsSchema struct {
+	required []string
+	patterns map[string]*regexp.Regexp
+}
+
+// NewExternalLabelsSchema returns a schema requiring the given external label names to be present and, for every name
+// in patterns, the value of that label (if present) to fully match the given regular expression.
+func NewExternalLabelsSchema(required []string, patterns map[string]string) (*ExternalLabelsSchema, error) {
+	s := &ExternalLabelsSchema{required: required, patterns: make(map[string]*regexp.Regexp, len(patterns))}
+	for name, p := range patterns {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "compile pattern of label %s", name)
+		}
+		s.patterns[name] = re
+	}
+	return s, nil
+}
+
+// Validate returns an error describing all the ways in which the given external labels do not conform to the schema.
+func (s *ExternalLabelsSchema) Validate(lset map[string]string) error {
+	var problems []string
+	for _, name := range s.required {
+		if _, ok := lset[name]; !ok {
+			problems = append(problems, fmt.Sprintf("missing required label %q", name))
+		}
+	}
+	names := make([]string, 0, len(s.patterns))
+	for name := range s.patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v, ok := lset[name]
+		if ok && !s.patterns[name].MatchString(v) {
+			problems = append(problems, fmt.Sprintf("value %q of label %q does not match %q", v, name, s.patterns[name].String()))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("external labels %v do not conform to schema: %s", lset, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// UploadWithLabelValidation works like Upload, but additionally fails the upload, before any file is uploaded,
+// if external labels of the block do not conform to the given schema.
+func UploadWithLabelValidation(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, schema *ExternalLabelsSchema, options ...UploadOption) error {
+	options = append(options[:len(options):len(options)], func(params *uploadParams) {
+		params.labelsSchema = schema
+	})
+	return upload(ctx, logger, bkt, bdir, hf, true, &UploadStats{}, options...)
+}
+
+// UploadPromBlock uploads a TSDB block to the object storage. It assumes
+// the block is used in Prometheus so it doesn't check Thanos external labels.
+// The given options are forwarded to objstore.UploadDir, see WithObjstoreUploadOptions.
+func UploadPromBlock(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, options ...objstore.UploadOption) error {
+	return UploadPromBlockWithOptions(ctx, logger, bkt, bdir, hf, WithObjstoreUploadOptions(options...))
+}
+
+// UploadPromBlockWithOptions works like UploadPromBlock, configured by the given options.
+func UploadPromBlockWithOptions(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, options ...UploadOption) error {
+	return upload(ctx, logger, bkt, bdir, hf, false, &UploadStats{}, options...)
+}
+
+// UploadData uploads chunks and index of the block from given block dir that ends with block id, without meta file.
+// It returns the Files section for the meta, to be passed to FinalizeUpload once the uploaded data is verified. Until then,
+// the block is partial and invisible to readers. Block is validated the same way as by Upload, and cleaned up on error.
+func UploadData(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, options ...UploadOption) (_ []metadata.File, err error) {
+	opts := applyUploadOptions(options...)
+	bkt, tbkt := wrapBucket(bkt, opts.transferParams)
+	defer func(start time.Time) {
+		tbkt.observe(opts.metrics, transferOpUpload, start, err)
+	}(time.Now())
+
+	id, _, err := prepareUpload(bdir, true, opts)
+	if err != nil {
+		return nil, err
+	}
+	return uploadData(ctx, logger, bkt, bdir, id, hf, opts, &UploadStats{})
+}
+
+// FinalizeUpload uploads meta file of the block from given block dir, whose data was uploaded by UploadData, with the given
+// Files section returned by UploadData. This makes the block visible to readers.
+func FinalizeUpload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, files []metadata.File, options ...UploadOption) (err error) {
+	opts := applyUploadOptions(options...)
+	bkt, tbkt := wrapBucket(bkt, opts.transferParams)
+	defer func(start time.Time) {
+		tbkt.observe(opts.metrics, transferOpUpload, start, err)
+	}(time.Now())
+
+	id, meta, err := prepareUpload(bdir, true, opts)
+	if err != nil {
+		return err
+	}
+	return finalizeUpload(ctx, logger, bkt, bdir, id, meta, files, opts)
+}
+
+// upload uploads block from given block dir that ends with block id.
+// It makes sure cleanup is done on error to avoid partial block uploads.
+// Bucket operations are retried only if WithUploadRetries option is given.
+// NOTE: Upload updates `meta.Thanos.File` section.
+func upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, checkExternalLabels bool, stats *UploadStats, options ...UploadOption) (err error) {
+	opts := applyUploadOptions(options...)
+	bkt, tbkt := wrapBucket(bkt, opts.transferParams)
+	defer func(start time.Time) {
+		stats.BytesUploaded = tbkt.uploadedBytes.Load()
+		stats.FilesUploaded = int(tbkt.uploadedFiles.Load())
+		stats.TotalDuration = time.Since(start)
+		tbkt.observe(opts.metrics, transferOpUpload, start, err)
+	}(time.Now())
+
+	id, meta, err := prepareUpload(bdir, checkExternalLabels, opts)
+	if err != nil {
+		return err
+	}
+	files, err := uploadData(ctx, logger, bkt, bdir, id, hf, opts, stats)
+	if err != nil {
+		return err
+	}
+	return finalizeUpload(ctx, logger, bkt, bdir, id, meta, files, opts)
+}
+
+// prepareUpload validates the block in the given block dir before anything is uploaded and returns its ID and meta.
+func prepareUpload(bdir string, checkExternalLabels bool, opts uploadParams) (ulid.ULID, *metadata.Meta, error) {
+	df, err := os.Stat(bdir)
+	if err != nil {
+		return ulid.ULID{}, nil, err
+	}
+	if !df.IsDir() {
+		return ulid.ULID{}, nil, errors.Errorf("%s is not a directory", bdir)
+	}
+
+	// Verify dir.
+	id, err := ulid.Parse(df.Name())
+	if err != nil {
+		return ulid.ULID{}, nil, errors.Wrap(err, "not a block dir")
+	}
+
+	meta, err := metadata.ReadFromDir(bdir)
+	if err != nil {
+		// No meta or broken meta file.
+		return ulid.ULID{}, nil, errors.Wrap(err, "read meta")
+	}
+
+	if checkExternalLabels {
+		if meta.Thanos.Labels == nil || len(meta.Thanos.Labels) == 0 {
+			return ulid.ULID{}, nil, errors.New("empty external labels are not allowed for Thanos block.")
+		}
+	}
+	if opts.validateMeta {
+		if err := meta.Thanos.Validate(); err != nil {
+			return ulid.ULID{}, nil, errors.Wrapf(err, "invalid meta of block %s", id)
+		}
+	}
+	if opts.validateBlockID {
+		if err := verifyBlockID(id, meta); err != nil {
+			return ulid.ULID{}, nil, err
+		}
+	}
+	if opts.labelsSchema != nil {
+		if err := opts.labelsSchema.Validate(meta.Thanos.Labels); err != nil {
+			return ulid.ULID{}, nil, errors.Wrapf(err, "validate external labels of block %s", id)
+		}
+	}
+	if opts.validateSegmentFiles && !(opts.allowNoChunks && !hasChunksDir(bdir)) {
+		if err := ValidateSegmentFiles(bdir); err != nil {
+			return ulid.ULID{}, nil, errors.Wrapf(err, "validate segment files of block %s", id)
+		}
+	}
+	if opts.validateTimeBounds {
+		if err := ValidateTimeBounds(bdir); err != nil {
+			return ulid.ULID{}, nil, errors.Wrapf(err, "validate time bounds of block %s", id)
+		}
+	}
+	return id, meta, nil
+}
+
+// uploadData uploads chunks and index of the block and returns the Files section for its meta.
+func uploadData(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, id ulid.ULID, hf metadata.HashFunc, opts uploadParams, stats *UploadStats) ([]metadata.File, error) {
+	// Hashes are calculated while the files are uploaded, so that each file is read only once.
+	if opts.indexHeaderWriter != nil {
+		if err := opts.indexHeaderWriter(ctx, bdir, filepath.Join(bdir, IndexHeaderFilename)); err != nil {
+			return nil, errors.Wrapf(err, "generate index-header of block %s", id)
+		}
+	}
+
+	statsStart := time.Now()
+	files, err := gatherFileStats(ctx, bdir, metadata.NoneFunc, logger, gatherParams{
+		allowNoChunks: opts.allowNoChunks,
+		indexHeader:   opts.indexHeaderWriter != nil,
+	})
+	stats.HashDuration = time.Since(statsStart)
+	if err != nil {
+		return nil, errors.Wrap(err, "gather meta file stats")
+	}
+
+	timer := &hashTimer{}
+	defer func() {
+		stats.HashDuration += timer.duration()
+	}()
+	ubkt := bkt
+	if hf != metadata.NoneFunc || opts.encrypter != nil {
+		ubkt = newFileStatsBucket(logger, bkt, id, files, hf, opts, timer)
+	}
+	if opts.allowNoChunks && !hasChunksDir(bdir) {
+		level.Debug(logger).Log("msg", "no chunks directory, uploading block without chunks", "block", id)
+	} else if err := objstore.UploadDir(ctx, logger, ubkt, filepath.Join(bdir, ChunksDirname), path.Join(id.String(), ChunksDirname),
+		append([]objstore.UploadOption{objstore.WithUploadConcurrency(opts.concurrency)}, opts.objstoreOptions...)...); err != nil {
+		return nil, cleanUp(logger, bkt, id, errors.Wrap(err, "upload chunks"))
+	}
+
+	if err := objstore.UploadFile(ctx, logger, ubkt, filepath.Join(bdir, IndexFilename), path.Join(id.String(), IndexFilename)); err != nil {
+		return nil, cleanUp(logger, bkt, id, errors.Wrap(err, "upload index"))
+	}
+
+	for _, f := range files {
+		if f.RelPath != TombstonesFilename && f.RelPath != IndexHeaderFilename {
+			continue
+		}
+		if err := objstore.UploadFile(ctx, logger, ubkt, filepath.Join(bdir, f.RelPath), path.Join(id.String(), f.RelPath)); err != nil {
+			return nil, cleanUp(logger, bkt, id, errors.Wrapf(err, "upload %s", f.RelPath))
+		}
+	}
+	return files, nil
+}
+
+// fileStatsBucket hashes and encrypts block files according to the upload params while they are uploaded by
+// objstore.UploadDir and objstore.UploadFile, so that each file is read from disk only once and objstore upload options
+// apply to hashed and encrypted files too. Stats of the uploaded files are updated in place.
+type fileStatsBucket struct {
+	objstore.Bucket
+
+	logger log.Logger
+	hf     metadata.HashFunc
+	opts   uploadParams
+	timer  *hashTimer
+	// files maps object names of block files to their stats. The map isn't modified once the upload starts, each
+	// stats is updated only by the upload of its file.
+	files map[string]*metadata.File
+}
+
+func newFileStatsBucket(logger log.Logger, bkt objstore.Bucket, id ulid.ULID, files []metadata.File, hf metadata.HashFunc, opts uploadParams, timer *hashTimer) *fileStatsBucket {
+	b := &fileStatsBucket{Bucket: bkt, logger: logger, hf: hf, opts: opts, timer: timer, files: make(map[string]*metadata.File, len(files))}
+	for i := range files {
+		b.files[path.Join(id.String(), files[i].RelPath)] = &files[i]
+	}
+	return b
+}
+
+func (b *fileStatsBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	mf, ok := b.files[name]
+	if !ok {
+		return b.Bucket.Upload(ctx, name, r)
+	}
+	f, ok := r.(*os.File)
+	if !ok {
+		return errors.Errorf("block file %s is not read from disk", mf.RelPath)
+	}
+	hf := b.hf
+	if !shouldHash(hf, b.opts.hashFilter, mf.RelPath, mf.SizeBytes) {
+		hf = metadata.NoneFunc
+	}
+	if b.opts.encrypter != nil {
+		size, h, err := uploadEncrypted(ctx, b.logger, b.Bucket, b.opts.encrypter, mf.RelPath, f, name, hf, b.timer)
+		if err != nil {
+			return err
+		}
+		mf.SizeBytes, mf.Hash, mf.Encrypted = size, h, true
+		return nil
+	}
+	if hf == metadata.NoneFunc {
+		return b.Bucket.Upload(ctx, name, f)
+	}
+	h, err := uploadAndHash(ctx, b.logger, b.Bucket, f, name, hf, b.timer)
+	if err != nil {
+		return err
+	}
+	mf.Hash = &h
+	return nil
+}
+
+// finalizeUpload uploads meta of the block with the given Files section, which makes the block visible.
+func finalizeUpload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, id ulid.ULID, meta *metadata.Meta, files []metadata.File, opts uploadParams) error {
+	if opts.indexStats && meta.Thanos.IndexStats == (metadata.IndexStats{}) {
+		var err error
+		if meta.Thanos.IndexStats, err = ComputeIndexStats(ctx, logger, bdir); err != nil {
+			return cleanUp(logger, bkt, id, errors.Wrapf(err, "compute index stats of block %s", id))
+		}
+	}
+	meta.Thanos.Files = files
+	if opts.validateMeta {
+		if err := meta.Thanos.Validate(); err != nil {
+			return cleanUp(logger, bkt, id, errors.Wrapf(err, "invalid meta of block %s", id))
+		}
+	}
+
+	if opts.persistedChunksRate > 0 {
+		if err := verifyPersisted(ctx, bkt, id, files, opts.persistedChunksRate); err != nil {
+			return cleanUp(logger, bkt, id, err)
+		}
+	}
+
+	meta.Thanos.UploadTime = time.Now().Unix()
+	metaObject, writeOpts := opts.metaObject(id)
+	metaEncoded := strings.Builder{}
+	if err := meta.Write(&metaEncoded, writeOpts...); err != nil {
+		return cleanUp(logger, bkt, id, errors.Wrap(err, "encode meta file"))
+	}
+
+	// Meta.json always need to be uploaded as a last item. This will allow to assume block directories without meta file to be pending uploads.
+	if err := bkt.Upload(ctx, metaObject, strings.NewReader(metaEncoded.String())); err != nil {
+		// Don't call cleanUp here. Despite getting error, meta.json may have been uploaded in certain cases,
+		// and even though cleanUp will not see it yet, meta.json may appear in the bucket later.
+		// (Eg. S3 is known to behave this way when it returns 503 "SlowDown" error).
+		// If meta.json is not uploaded, this will produce partial blocks, but such blocks will be cleaned later.
+		return errors.Wrap(err, "upload meta file")
+	}
+
+	return nil
+}
+
+// verifyPersisted checks that the index and the given fraction of chunk files (at least one) of the uploaded block
+// exist in the bucket. Sampled chunk files are spread evenly and include the last one.
+func verifyPersisted(ctx context.Context, bkt objstore.Bucket, id ulid.ULID, files []metadata.File, chunksRate float64) error {
+	var chunks []string
+	relPaths := []string{IndexFilename}
+	for _, f := range files {
+		if strings.HasPrefix(f.RelPath, ChunksDirname+"/") {
+			chunks = append(chunks, f.RelPath)
+		}
+	}
+	if n := len(chunks); n > 0 {
+		k := min(max(int(math.Ceil(chunksRate*float64(n))), 1), n)
+		for j := 0; j < k; j++ {
+			relPaths = append(relPaths, chunks[(j+1)*n/k-1])
+		}
+	}
+
+	for _, relPath := range relPaths {
+		name := path.Join(id.String(), relPath)
+		ok, err := bkt.Exists(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "check existence of %s", name)
+		}
+		if !ok {
+			return errors.Errorf("uploaded file %s is not present in the bucket", name)
+		}
+	}
+	return nil
+}
+
+// UploadAndHash uploads the file from src to dst in the bucket, calculating the hash of the file with the hash function hf
+// while uploading, so the file is read from disk only once. The bucket can still read the file in parallel through
+// io.ReaderAt (e.g. multipart upload of S3), in which case it's read out of order, so it's read again to be hashed.
+func UploadAndHash(ctx context.Context, logger log.Logger, bkt objstore.Bucket, src, dst string, hf metadata.HashFunc) (metadata.ObjectHash, error) {
+	f, err := os.Open(filepath.Clean(src))
+	if err != nil {
+		return metadata.ObjectHash{}, errors.Wrapf(err, "open file %s", src)
+	}
+	defer runutil.CloseWithLogOnErr(logger, f, "close file %s", src)
+
+	h, err := uploadAndHash(ctx, logger, bkt, f, dst, hf, nil)
+	if err != nil {
+		return metadata.ObjectHash{}, errors.Wrapf(err, "upload file %s as %s", src, dst)
+	}
+	level.Debug(logger).Log("msg", "uploaded file", "from", src, "dst", dst, "bucket", bkt.Name())
+	return h, nil
+}
+
+// uploadAndHash uploads the opened file f to dst in the bucket like UploadAndHash does. Time spent hashing is added to
+// the timer, if any.
+func uploadAndHash(ctx context.Context, logger log.Logger, bkt objstore.Bucket, f *os.File, dst string, hf metadata.HashFunc, timer *hashTimer) (metadata.ObjectHash, error) {
+	h, err := metadata.NewHash(hf)
+	if err != nil {
+		return metadata.ObjectHash{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return metadata.ObjectHash{}, errors.Wrapf(err, "stat file %s", f.Name())
+	}
+
+	r := &sizedReaderAt{sizedReader: &sizedReader{r: f, h: h, timer: timer, size: fi.Size()}, ra: f}
+	if err := bkt.Upload(ctx, dst, r); err != nil {
+		return metadata.ObjectHash{}, err
+	}
+	if r.readAt.Load() {
+		level.Debug(logger).Log("msg", "uploaded file with random access, hashing it separately", "from", f.Name(), "dst", dst, "bucket", bkt.Name())
+		defer timer.since(time.Now())
+		return metadata.CalculateHashWithContext(ctx, f.Name(), hf, logger)
+	}
+	if r.read != r.size {
+		return metadata.ObjectHash{}, errors.Errorf("file %s: expected %d bytes, read %d", f.Name(), r.size, r.read)
+	}
+	return metadata.ObjectHashFrom(hf, h), nil
+}
+
+// ReaderFile is a block file supplied as a stream of known size.
+type ReaderFile struct {
+	// RelPath is the path of the file relative to the block directory, e.g. "index" or "chunks/000001".
+	RelPath string
+	// Reader provides exactly SizeBytes bytes of the file content.
+	Reader    io.Reader
+	SizeBytes int64
+}
+
+// UploadReaders uploads a TSDB block supplied as meta and streams of the index and chunk segment files to the object storage,
+// without a need of having the block on local disk. Files have to contain the index file and chunk segment files in the
+// chunks directory. Similar to Upload, meta.json is uploaded last and the block is cleaned up on error.
+// NOTE: UploadReaders updates `meta.Thanos.File` section, with hashes computed while streams are read unless hf is NoneFunc.
+func UploadReaders(ctx context.Context, logger log.Logger, bkt objstore.Bucket, meta *metadata.Meta, files []ReaderFile, hf metadata.HashFunc, options ...UploadOption) (err error) {
+	opts := applyUploadOptions(options...)
+	bkt, tbkt := wrapBucket(bkt, opts.transferParams)
+	defer func(start time.Time) {
+		tbkt.observe(opts.metrics, transferOpUpload, start, err)
+	}(time.Now())
+
+	if len(meta.Thanos.Labels) == 0 {
+		return errors.New("empty external labels are not allowed for Thanos block.")
+	}
+	if opts.encrypter != nil {
+		return errors.New("encryption is not supported by UploadReaders")
+	}
+	if len(opts.objstoreOptions) > 0 {
+		return errors.New("objstore upload options are not supported by UploadReaders, use WithUploadConcurrency instead")
+	}
+	if opts.validateMeta {
+		// Files section is replaced by the uploaded files, so it's validated only once they are known.
+		thanos := meta.Thanos
+		thanos.Files = nil
+		if err := thanos.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid meta of block %s", meta.ULID)
+		}
+	}
+
+	var index *ReaderFile
+	for i, f := range files {
+		switch {
+		case f.RelPath == IndexFilename:
+			index = &files[i]
+		case path.Dir(f.RelPath) == ChunksDirname:
+		default:
+			return errors.Errorf("unexpected block file %s", f.RelPath)
+		}
+	}
+	if index == nil {
+		return errors.New("index file is required")
+	}
+
+	var (
+		mtx   sync.Mutex
+		stats = make([]metadata.File, 0, len(files)+1)
+	)
+	uploadFile := func(ctx context.Context, f ReaderFile) error {
+		r := &sizedReader{r: f.Reader, size: f.SizeBytes}
+		if shouldHash(hf, opts.hashFilter, f.RelPath, f.SizeBytes) {
+			h, err := metadata.NewHash(hf)
+			if err != nil {
+				return err
+			}
+			r.h = h
+		}
+		if err := bkt.Upload(ctx, path.Join(meta.ULID.String(), f.RelPath), r); err != nil {
+			return errors.Wrapf(err, "upload file %s", f.RelPath)
+		}
+		if r.read != f.SizeBytes {
+			return errors.Errorf("file %s: expected %d bytes, read %d", f.RelPath, f.SizeBytes, r.read)
+		}
+
+		mf := metadata.File{RelPath: f.RelPath, SizeBytes: f.SizeBytes}
+		if r.h != nil {
+			h := metadata.ObjectHashFrom(hf, r.h)
+			mf.Hash = &h
+		}
+		mtx.Lock()
+		stats = append(stats, mf)
+		mtx.Unlock()
+		return nil
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.concurrency)
+	for _, f := range files {
+		if f.RelPath == IndexFilename {
+			continue
+		}
+		f := f
+		g.Go(func() error { return uploadFile(gctx, f) })
+	}
+	if err := g.Wait(); err != nil {
+		return cleanUp(logger, bkt, meta.ULID, errors.Wrap(err, "upload chunks"))
+	}
+
+	if err := uploadFile(ctx, *index); err != nil {
+		return cleanUp(logger, bkt, meta.ULID, errors.Wrap(err, "upload index"))
+	}
+
+	stats = append(stats, metadata.File{RelPath: MetaFilename})
+	sort.Slice(stats, func(i, j int) bool {
+		return strings.Compare(stats[i].RelPath, stats[j].RelPath) < 0
+	})
+	meta.Thanos.Files = stats
+	if opts.validateMeta {
+		if err := meta.Thanos.Validate(); err != nil {
+			return cleanUp(logger, bkt, meta.ULID, errors.Wrapf(err, "invalid meta of block %s", meta.ULID))
+		}
+	}
+
+	meta.Thanos.UploadTime = time.Now().Unix()
+	metaObject, writeOpts := opts.metaObject(meta.ULID)
+	metaEncoded := strings.Builder{}
+	if err := meta.Write(&metaEncoded, writeOpts...); err != nil {
+		return cleanUp(logger, bkt, meta.ULID, errors.Wrap(err, "encode meta file"))
+	}
+	// Meta.json always need to be uploaded as a last item. See upload for details.
+	if err := bkt.Upload(ctx, metaObject, strings.NewReader(metaEncoded.String())); err != nil {
+		return errors.Wrap(err, "upload meta file")
+	}
+	return nil
+}
+
+// sizedReader is a reader of known size, which optionally hashes everything read through it, adding time spent hashing
+// to the timer, if any.
+type sizedReader struct {
+	r     io.Reader
+	h     hash.Hash
+	timer *hashTimer
+	size  int64
+	read  int64
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.read += int64(n)
+		if r.h != nil {
+			start := time.Now()
+			_, _ = r.h.Write(p[:n])
+			r.timer.since(start)
+		}
+	}
+	return n, err
+}
+
+// ObjectSize allows objstore.TryToGetSize to learn the size upfront.
+func (r *sizedReader) ObjectSize() (int64, error) {
+	return r.size, nil
+}
+
+// Seek allows to rewind the reader to the start, so failed uploads can be retried. It resets the hash.
+func (r *sizedReader) Seek(offset int64, whence int) (int64, error) {
+	s, ok := r.r.(io.Seeker)
+	if !ok || offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("sized reader can only be rewound to the start of seekable reader")
+	}
+	if _, err := s.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r.read = 0
+	if r.h != nil {
+		r.h.Reset()
+	}
+	return 0, nil
+}
+
+// sizedReaderAt is sizedReader of a file, which keeps io.ReaderAt of the file. Content read through ReadAt is not
+// hashed, as it may be read out of order and concurrently.
+type sizedReaderAt struct {
+	*sizedReader
+
+	ra     io.ReaderAt
+	readAt atomic.Bool
+}
+
+func (r *sizedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.readAt.Store(true)
+	return r.ra.ReadAt(p, off)
+}
+
+// hashTimer accumulates time spent hashing files, which may be uploaded concurrently. Nil timer ignores the time.
+type hashTimer struct {
+	nanos atomic.Int64
+}
+
+// since adds the time elapsed since start.
+func (t *hashTimer) since(start time.Time) {
+	if t == nil {
+		return
+	}
+	t.nanos.Add(int64(time.Since(start)))
+}
+
+func (t *hashTimer) duration() time.Duration {
+	return time.Duration(t.nanos.Load())
+}
+
+func cleanUp(logger log.Logger, bkt objstore.Bucket, id ulid.ULID, err error, options ...DeleteOption) error {
+	// Cleanup the dir with an uncancelable context.
+	cleanErr := Delete(context.Background(), logger, bkt, id, options...)
+	if cleanErr != nil {
+		return errors.Wrapf(err, "failed to clean block after upload issue. Partial block in system. Err: %s", err.Error())
+	}
+	return err
+}
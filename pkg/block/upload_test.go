@@ -0,0 +1,826 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestUpload(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+		labels.New(labels.Label{Name: "a", Value: "3"}),
+		labels.New(labels.Label{Name: "a", Value: "4"}),
+		labels.New(labels.Label{Name: "b", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, os.MkdirAll(path.Join(tmpDir, "test", b1.String()), os.ModePerm))
+
+	{
+		// Wrong dir.
+		err := Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "not-existing"), metadata.NoneFunc)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.HasSuffix(err.Error(), "/not-existing: no such file or directory"), "")
+	}
+	{
+		// Wrong existing dir (not a block).
+		err := Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "test"), metadata.NoneFunc)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, "not a block dir: ulid: bad data size when unmarshaling", err.Error())
+	}
+	{
+		// Empty block dir.
+		err := Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "test", b1.String()), metadata.NoneFunc)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.HasSuffix(err.Error(), "/meta.json: no such file or directory"), "")
+	}
+	e2eutil.Copy(t, path.Join(tmpDir, b1.String(), MetaFilename), path.Join(tmpDir, "test", b1.String(), MetaFilename))
+	{
+		// Missing chunks.
+		err := Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "test", b1.String()), metadata.NoneFunc)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.HasSuffix(err.Error(), "/chunks: no such file or directory"), err.Error())
+	}
+	testutil.Ok(t, os.MkdirAll(path.Join(tmpDir, "test", b1.String(), ChunksDirname), os.ModePerm))
+	e2eutil.Copy(t, path.Join(tmpDir, b1.String(), ChunksDirname, "000001"), path.Join(tmpDir, "test", b1.String(), ChunksDirname, "000001"))
+	{
+		// Missing index file.
+		err := Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "test", b1.String()), metadata.NoneFunc)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.HasSuffix(err.Error(), "/index: no such file or directory"), "")
+	}
+	e2eutil.Copy(t, path.Join(tmpDir, b1.String(), IndexFilename), path.Join(tmpDir, "test", b1.String(), IndexFilename))
+	testutil.Ok(t, os.Remove(path.Join(tmpDir, "test", b1.String(), MetaFilename)))
+	{
+		// Missing meta.json file.
+		err := Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "test", b1.String()), metadata.NoneFunc)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.HasSuffix(err.Error(), "/meta.json: no such file or directory"), "")
+	}
+	e2eutil.Copy(t, path.Join(tmpDir, b1.String(), MetaFilename), path.Join(tmpDir, "test", b1.String(), MetaFilename))
+	{
+		// Full block.
+		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "test", b1.String()), metadata.NoneFunc))
+		testutil.Equals(t, 3, len(bkt.Objects()))
+		testutil.Equals(t, 3727, len(bkt.Objects()[path.Join(b1.String(), ChunksDirname, "000001")]))
+		testutil.Equals(t, 401, len(bkt.Objects()[path.Join(b1.String(), IndexFilename)]))
+		testutil.Equals(t, 624, len(bkt.Objects()[path.Join(b1.String(), MetaFilename)]))
+
+		// File stats and upload time are gathered.
+		m, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, b1)
+		testutil.Ok(t, err)
+		testutil.Assert(t, time.Since(time.Unix(m.Thanos.UploadTime, 0)) < time.Minute, "unexpected upload time %d", m.Thanos.UploadTime)
+		testutil.Assert(t, metadata.IsRecentlyUploaded(&m, time.Minute, time.Now()), "freshly uploaded block should be recently uploaded")
+		testutil.Equals(t, fmt.Sprintf(`{
+	"ulid": "%s",
+	"minTime": 0,
+	"maxTime": 1000,
+	"stats": {
+		"numSamples": 500,
+		"numSeries": 5,
+		"numChunks": 5
+	},
+	"compaction": {
+		"level": 1,
+		"sources": [
+			"%s"
+		]
+	},
+	"version": 1,
+	"thanos": {
+		"labels": {
+			"ext1": "val1"
+		},
+		"downsample": {
+			"resolution": 124
+		},
+		"source": "test",
+		"files": [
+			{
+				"rel_path": "chunks/000001",
+				"size_bytes": 3727
+			},
+			{
+				"rel_path": "index",
+				"size_bytes": 401
+			},
+			{
+				"rel_path": "meta.json"
+			}
+		],
+		"index_stats": {
+			"series_max_size": 16
+		},
+		"upload_time": %d
+	}
+}
+`, b1.String(), b1.String(), m.Thanos.UploadTime), string(bkt.Objects()[path.Join(b1.String(), MetaFilename)]))
+	}
+	{
+		// Test Upload is idempotent.
+		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, "test", b1.String()), metadata.NoneFunc))
+		testutil.Equals(t, 3, len(bkt.Objects()))
+		testutil.Equals(t, 3727, len(bkt.Objects()[path.Join(b1.String(), ChunksDirname, "000001")]))
+		testutil.Equals(t, 401, len(bkt.Objects()[path.Join(b1.String(), IndexFilename)]))
+		testutil.Equals(t, 624, len(bkt.Objects()[path.Join(b1.String(), MetaFilename)]))
+	}
+	{
+		// Upload with no external labels should be blocked.
+		b2, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+			labels.New(labels.Label{Name: "a", Value: "1"}),
+			labels.New(labels.Label{Name: "a", Value: "2"}),
+			labels.New(labels.Label{Name: "a", Value: "3"}),
+			labels.New(labels.Label{Name: "a", Value: "4"}),
+			labels.New(labels.Label{Name: "b", Value: "1"}),
+		}, 100, 0, 1000, labels.EmptyLabels(), 124, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		err = Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b2.String()), metadata.NoneFunc)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, "empty external labels are not allowed for Thanos block.", err.Error())
+		testutil.Equals(t, 3, len(bkt.Objects()))
+	}
+	{
+		// No external labels with UploadPromBlocks.
+		b2, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+			labels.New(labels.Label{Name: "a", Value: "1"}),
+			labels.New(labels.Label{Name: "a", Value: "2"}),
+			labels.New(labels.Label{Name: "a", Value: "3"}),
+			labels.New(labels.Label{Name: "a", Value: "4"}),
+			labels.New(labels.Label{Name: "b", Value: "1"}),
+		}, 100, 0, 1000, labels.EmptyLabels(), 124, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		err = UploadPromBlock(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b2.String()), metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 6, len(bkt.Objects()))
+		testutil.Equals(t, 3727, len(bkt.Objects()[path.Join(b2.String(), ChunksDirname, "000001")]))
+		testutil.Equals(t, 401, len(bkt.Objects()[path.Join(b2.String(), IndexFilename)]))
+		testutil.Equals(t, 603, len(bkt.Objects()[path.Join(b2.String(), MetaFilename)]))
+	}
+}
+
+func TestUploadCleanup(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+		labels.New(labels.Label{Name: "a", Value: "3"}),
+		labels.New(labels.Label{Name: "a", Value: "4"}),
+		labels.New(labels.Label{Name: "b", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	{
+		errBkt := errBucket{Bucket: bkt, failSuffix: "/index"}
+
+		uploadErr := Upload(ctx, log.NewNopLogger(), errBkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc)
+		testutil.Assert(t, errors.Is(uploadErr, errUploadFailed))
+
+		// If upload of index fails, block is deleted.
+		testutil.Equals(t, 0, len(bkt.Objects()))
+		testutil.Assert(t, len(bkt.Objects()[path.Join(DebugMetas, fmt.Sprintf("%s.json", b1.String()))]) == 0)
+	}
+
+	{
+		errBkt := errBucket{Bucket: bkt, failSuffix: "/meta.json"}
+
+		uploadErr := Upload(ctx, log.NewNopLogger(), errBkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc)
+		testutil.Assert(t, errors.Is(uploadErr, errUploadFailed))
+
+		// If upload of meta.json fails, nothing is cleaned up.
+		testutil.Equals(t, 3, len(bkt.Objects()))
+		testutil.Assert(t, len(bkt.Objects()[path.Join(b1.String(), ChunksDirname, "000001")]) > 0)
+		testutil.Assert(t, len(bkt.Objects()[path.Join(b1.String(), IndexFilename)]) > 0)
+		testutil.Assert(t, len(bkt.Objects()[path.Join(b1.String(), MetaFilename)]) > 0)
+		testutil.Assert(t, len(bkt.Objects()[path.Join(DebugMetas, fmt.Sprintf("%s.json", b1.String()))]) == 0)
+	}
+}
+
+func TestUploadWithStats(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+		labels.New(labels.Label{Name: "a", Value: "3"}),
+		labels.New(labels.Label{Name: "a", Value: "4"}),
+		labels.New(labels.Label{Name: "b", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	{
+		stats, err := UploadWithStats(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.SHA256Func)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 3, stats.FilesUploaded)
+
+		var size int64
+		for _, o := range bkt.Objects() {
+			size += int64(len(o))
+		}
+		testutil.Equals(t, size, stats.BytesUploaded)
+		testutil.Assert(t, stats.TotalDuration >= stats.HashDuration, "total duration should include hash duration")
+	}
+	{
+		// Stats are populated on failure too.
+		stats, err := UploadWithStats(ctx, log.NewNopLogger(), errBucket{Bucket: bkt, failSuffix: "/meta.json"}, path.Join(tmpDir, b1.String()), metadata.NoneFunc)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, 2, stats.FilesUploaded)
+		testutil.Equals(t, int64(len(bkt.Objects()[path.Join(b1.String(), ChunksDirname, "000001")])+len(bkt.Objects()[path.Join(b1.String(), IndexFilename)])), stats.BytesUploaded)
+	}
+	{
+		// Time spent hashing while files are uploaded is accounted.
+		h, err := metadata.NewHash(metadata.SHA256Func)
+		testutil.Ok(t, err)
+		timer := &hashTimer{}
+		r := &sizedReader{r: bytes.NewReader(make([]byte, 1<<20)), h: h, timer: timer, size: 1 << 20}
+		_, err = io.Copy(io.Discard, r)
+		testutil.Ok(t, err)
+		testutil.Assert(t, timer.duration() > 0, "time spent hashing should be accounted")
+	}
+}
+
+// readAtBucket uploads readers with io.ReaderAt through it, like S3 does for multipart uploads.
+type readAtBucket struct {
+	objstore.Bucket
+}
+
+func (b readAtBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return errors.Errorf("reader %T does not implement io.ReaderAt", r)
+	}
+	size, err := objstore.TryToGetSize(r)
+	if err != nil {
+		return err
+	}
+	return b.Bucket.Upload(ctx, name, io.NewSectionReader(ra, 0, size))
+}
+
+func TestUploadWithHashConcurrency(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bdir := path.Join(tmpDir, b1.String())
+	chunk, err := os.ReadFile(filepath.Join(bdir, ChunksDirname, "000001"))
+	testutil.Ok(t, err)
+	for i := 2; i <= 6; i++ {
+		testutil.Ok(t, os.WriteFile(filepath.Join(bdir, ChunksDirname, fmt.Sprintf("%06d", i)), chunk, os.ModePerm))
+	}
+
+	// Objstore options apply to hashed files, as in compaction.
+	bkt := &inFlightBucket{Bucket: objstore.NewInMemBucket(), delay: 20 * time.Millisecond}
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, bdir, metadata.SHA256Func, objstore.WithUploadConcurrency(3)))
+	testutil.Assert(t, bkt.max.Load() > 1, "expected chunks uploaded in parallel")
+	testutil.Assert(t, bkt.max.Load() <= 3, "expected at most 3 uploads in flight, got %d", bkt.max.Load())
+
+	m, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, b1)
+	testutil.Ok(t, err)
+	var hashed int
+	for _, f := range m.Thanos.Files {
+		if f.Hash != nil {
+			hashed++
+		}
+	}
+	// All chunks and index.
+	testutil.Equals(t, 7, hashed)
+}
+
+func TestUploadAndHash(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bdir := path.Join(tmpDir, b1.String())
+
+	for _, hf := range []metadata.HashFunc{metadata.SHA256Func, metadata.XXHash64Func} {
+		h, err := UploadAndHash(ctx, log.NewNopLogger(), bkt, path.Join(bdir, IndexFilename), "test/index", hf)
+		testutil.Ok(t, err)
+		exp, err := metadata.CalculateHash(path.Join(bdir, IndexFilename), hf, log.NewNopLogger())
+		testutil.Ok(t, err)
+		testutil.Equals(t, exp, h)
+
+		orig, err := os.ReadFile(path.Join(bdir, IndexFilename))
+		testutil.Ok(t, err)
+		testutil.Equals(t, orig, bkt.Objects()["test/index"])
+	}
+
+	_, err = UploadAndHash(ctx, log.NewNopLogger(), bkt, path.Join(bdir, IndexFilename), "test/index", metadata.NoneFunc)
+	testutil.NotOk(t, err)
+
+	// File is still uploaded with random access, if the bucket uses it.
+	h, err := UploadAndHash(ctx, log.NewNopLogger(), readAtBucket{Bucket: bkt}, path.Join(bdir, IndexFilename), "test/index", metadata.SHA256Func)
+	testutil.Ok(t, err)
+	exp, err := metadata.CalculateHash(path.Join(bdir, IndexFilename), metadata.SHA256Func, log.NewNopLogger())
+	testutil.Ok(t, err)
+	testutil.Equals(t, exp, h)
+
+	// Upload hashes files while uploading them, resulting in the same files section as hashing them upfront.
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, bdir, metadata.SHA256Func))
+	expected, err := GatherFileStatsWithContext(ctx, bdir, metadata.SHA256Func, log.NewNopLogger())
+	testutil.Ok(t, err)
+	m, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, b1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, expected, m.Thanos.Files)
+}
+
+func TestUploadWithLabelValidation(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "cluster", Value: "eu-1"}, labels.Label{Name: "replica", Value: "r1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bdir := path.Join(tmpDir, b1.String())
+
+	_, err = NewExternalLabelsSchema(nil, map[string]string{"cluster": "("})
+	testutil.NotOk(t, err)
+
+	for _, tcase := range []struct {
+		required    []string
+		patterns    map[string]string
+		expectedErr string
+	}{
+		{required: []string{"cluster", "replica"}, patterns: map[string]string{"cluster": "[a-z]+-[0-9]+", "tenant": ".+"}},
+		{required: []string{"cluster", "tenant"}, expectedErr: `missing required label "tenant"`},
+		{patterns: map[string]string{"cluster": "us-.*"}, expectedErr: `value "eu-1" of label "cluster" does not match "^(?:us-.*)$"`},
+		// Patterns match the whole value.
+		{patterns: map[string]string{"replica": "r"}, expectedErr: `value "r1" of label "replica" does not match "^(?:r)$"`},
+	} {
+		t.Run("", func(t *testing.T) {
+			bkt := objstore.NewInMemBucket()
+			schema, err := NewExternalLabelsSchema(tcase.required, tcase.patterns)
+			testutil.Ok(t, err)
+
+			err = UploadWithLabelValidation(ctx, log.NewNopLogger(), bkt, bdir, metadata.NoneFunc, schema)
+			if tcase.expectedErr == "" {
+				testutil.Ok(t, err)
+				testutil.Equals(t, 3, len(bkt.Objects()))
+				return
+			}
+			testutil.NotOk(t, err)
+			testutil.Assert(t, strings.Contains(err.Error(), tcase.expectedErr), "unexpected error %v", err)
+			testutil.Equals(t, 0, len(bkt.Objects()))
+		})
+	}
+}
+
+func TestUploadDownloadWithPrefix(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, UploadWithOptions(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.SHA256Func, WithUploadPrefix("tenants/acme")))
+	testutil.Equals(t, 3, len(bkt.Objects()))
+	for _, f := range []string{MetaFilename, IndexFilename, path.Join(ChunksDirname, "000001")} {
+		_, ok := bkt.Objects()[path.Join("tenants/acme", b1.String(), f)]
+		testutil.Assert(t, ok, "expected %s under the prefix", f)
+	}
+
+	dst := path.Join(t.TempDir(), b1.String())
+	testutil.NotOk(t, Download(ctx, log.NewNopLogger(), bkt, b1, dst))
+	testutil.Ok(t, DownloadWithOptions(ctx, log.NewNopLogger(), bkt, b1, dst, WithDownloadPrefix("tenants/acme")))
+	_, err = os.Stat(path.Join(dst, IndexFilename))
+	testutil.Ok(t, err)
+
+	// Mark functions and Delete honor the prefix through the prefixed bucket.
+	pbkt := objstore.NewPrefixedBucket(bkt, "tenants/acme")
+	testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), pbkt, b1, "", promauto.With(nil).NewCounter(prometheus.CounterOpts{})))
+	_, ok := bkt.Objects()[path.Join("tenants/acme", b1.String(), metadata.DeletionMarkFilename)]
+	testutil.Assert(t, ok, "expected deletion mark under the prefix")
+
+	testutil.Ok(t, Delete(ctx, log.NewNopLogger(), pbkt, b1))
+	testutil.Equals(t, 0, len(bkt.Objects()))
+}
+
+func TestUploadReaders(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	meta, err := metadata.ReadFromDir(path.Join(tmpDir, b1.String()))
+	testutil.Ok(t, err)
+	index, err := os.ReadFile(path.Join(tmpDir, b1.String(), IndexFilename))
+	testutil.Ok(t, err)
+	chunks, err := os.ReadFile(path.Join(tmpDir, b1.String(), ChunksDirname, "000001"))
+	testutil.Ok(t, err)
+
+	{
+		// Missing index.
+		bkt := objstore.NewInMemBucket()
+		err := UploadReaders(ctx, log.NewNopLogger(), bkt, meta, []ReaderFile{
+			{RelPath: path.Join(ChunksDirname, "000001"), Reader: bytes.NewReader(chunks), SizeBytes: int64(len(chunks))},
+		}, metadata.NoneFunc)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, 0, len(bkt.Objects()))
+	}
+	{
+		// Size mismatch cleans up the block.
+		bkt := objstore.NewInMemBucket()
+		err := UploadReaders(ctx, log.NewNopLogger(), bkt, meta, []ReaderFile{
+			{RelPath: IndexFilename, Reader: bytes.NewReader(index), SizeBytes: int64(len(index)) + 1},
+			{RelPath: path.Join(ChunksDirname, "000001"), Reader: bytes.NewReader(chunks), SizeBytes: int64(len(chunks))},
+		}, metadata.NoneFunc)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, 0, len(bkt.Objects()))
+	}
+	{
+		// Objstore options can't be applied to streams.
+		bkt := objstore.NewInMemBucket()
+		err := UploadReaders(ctx, log.NewNopLogger(), bkt, meta, []ReaderFile{
+			{RelPath: IndexFilename, Reader: bytes.NewReader(index), SizeBytes: int64(len(index))},
+		}, metadata.NoneFunc, WithObjstoreUploadOptions(objstore.WithUploadConcurrency(2)))
+		testutil.NotOk(t, err)
+		testutil.Equals(t, 0, len(bkt.Objects()))
+	}
+	{
+		bkt := objstore.NewInMemBucket()
+		testutil.Ok(t, UploadReaders(ctx, log.NewNopLogger(), bkt, meta, []ReaderFile{
+			{RelPath: IndexFilename, Reader: bytes.NewReader(index), SizeBytes: int64(len(index))},
+			{RelPath: path.Join(ChunksDirname, "000001"), Reader: bytes.NewReader(chunks), SizeBytes: int64(len(chunks))},
+		}, metadata.SHA256Func))
+		testutil.Equals(t, 3, len(bkt.Objects()))
+
+		// Files section matches what Upload would produce from disk.
+		expected, err := GatherFileStatsWithContext(ctx, path.Join(tmpDir, b1.String()), metadata.SHA256Func, log.NewNopLogger())
+		testutil.Ok(t, err)
+		m, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, b1)
+		testutil.Ok(t, err)
+		testutil.Equals(t, expected, m.Thanos.Files)
+		testutil.Assert(t, metadata.IsRecentlyUploaded(&m, time.Minute, time.Now()), "unexpected upload time %d", m.Thanos.UploadTime)
+	}
+}
+
+func TestUploadWithHashFilter(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, UploadWithOptions(ctx, logger, bkt, path.Join(tmpDir, b1.String()), metadata.SHA256Func, WithHashFilter(HashOnlyFiles(IndexFilename))))
+
+	meta, err := DownloadMeta(ctx, logger, bkt, b1)
+	testutil.Ok(t, err)
+	var hashed []string
+	for _, f := range meta.Thanos.Files {
+		if f.RelPath != MetaFilename {
+			testutil.Assert(t, f.SizeBytes > 0, "expected size of %s", f.RelPath)
+		}
+		if f.Hash != nil {
+			testutil.Equals(t, metadata.SHA256Func, f.Hash.Func)
+			hashed = append(hashed, f.RelPath)
+		}
+	}
+	testutil.Equals(t, []string{IndexFilename}, hashed)
+
+	// Files without hash are downloaded, only the index is verified.
+	testutil.Ok(t, DownloadWithOptions(ctx, logger, bkt, b1, filepath.Join(t.TempDir(), b1.String()), WithDownloadVerification()))
+}
+
+func TestUploadWithSegmentFilesValidation(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bdir := path.Join(tmpDir, b1.String())
+
+	e2eutil.Copy(t, path.Join(bdir, ChunksDirname, "000001"), path.Join(bdir, ChunksDirname, "000003"))
+	err = UploadWithOptions(ctx, log.NewNopLogger(), bkt, bdir, metadata.NoneFunc, WithSegmentFilesValidation())
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "missing segment file chunks/000002"), "unexpected error %v", err)
+	testutil.Equals(t, 0, len(bkt.Objects()))
+
+	// Validation is disabled by default.
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, bdir, metadata.NoneFunc))
+	testutil.Equals(t, 4, len(bkt.Objects()))
+}
+
+var errUploadFailed = errors.New("upload failed")
+
+type errBucket struct {
+	objstore.Bucket
+
+	failSuffix string
+}
+
+func (eb errBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	err := eb.Bucket.Upload(ctx, name, r)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(name, eb.failSuffix) {
+		return errUploadFailed
+	}
+	return nil
+}
+
+func TestUploadDataAndFinalize(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bdir := path.Join(tmpDir, b1.String())
+
+	bkt := objstore.NewInMemBucket()
+	files, err := UploadData(ctx, logger, bkt, bdir, metadata.SHA256Func)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(files))
+	testutil.Equals(t, 2, len(bkt.Objects()))
+	state, err := BlockState(ctx, bkt, b1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, StatePartial, state)
+
+	testutil.Ok(t, FinalizeUpload(ctx, logger, bkt, bdir, files))
+	state, err = BlockState(ctx, bkt, b1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, StateComplete, state)
+
+	// Two-phase upload results in the same objects as Upload.
+	expected := objstore.NewInMemBucket()
+	testutil.Ok(t, Upload(ctx, logger, expected, bdir, metadata.SHA256Func))
+	testutil.Equals(t, expected.Objects(), bkt.Objects())
+}
+
+func TestUploadWithMetaValidation(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	series := []labels.Labels{labels.New(labels.Label{Name: "a", Value: "1"})}
+	extLset := labels.New(labels.Label{Name: "ext1", Value: "val1"})
+	invalid, err := e2eutil.CreateBlock(ctx, tmpDir, series, 100, 0, 1000, extLset, 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	valid, err := e2eutil.CreateBlock(ctx, tmpDir, series, 100, 0, 1000, extLset, 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	bkt := objstore.NewInMemBucket()
+	err = UploadWithOptions(ctx, logger, bkt, path.Join(tmpDir, invalid.String()), metadata.NoneFunc, WithMetaValidation())
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "unsupported downsample resolution 124"), "unexpected error %v", err)
+	testutil.Equals(t, 0, len(bkt.Objects()))
+
+	testutil.Ok(t, UploadWithOptions(ctx, logger, bkt, path.Join(tmpDir, valid.String()), metadata.SHA256Func, WithMetaValidation()))
+	// Validation is opt-in.
+	testutil.Ok(t, Upload(ctx, logger, bkt, path.Join(tmpDir, invalid.String()), metadata.NoneFunc))
+}
+
+func TestUploadDownloadTombstones(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	b1, err := e2eutil.CreateBlockWithTombstone(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	expected, err := os.ReadFile(filepath.Join(tmpDir, b1.String(), TombstonesFilename))
+	testutil.Ok(t, err)
+
+	for _, hf := range []metadata.HashFunc{metadata.NoneFunc, metadata.SHA256Func} {
+		t.Run(string(hf), func(t *testing.T) {
+			bkt := objstore.NewInMemBucket()
+			testutil.Ok(t, Upload(ctx, logger, bkt, path.Join(tmpDir, b1.String()), hf))
+			testutil.Equals(t, expected, bkt.Objects()[path.Join(b1.String(), TombstonesFilename)])
+
+			m, err := DownloadMeta(ctx, logger, bkt, b1)
+			testutil.Ok(t, err)
+			testutil.Equals(t, []string{"chunks/000001", IndexFilename, MetaFilename, TombstonesFilename}, fileRelPaths(m.Thanos.Files))
+			testutil.Equals(t, int64(len(expected)), m.Thanos.Files[3].SizeBytes)
+			testutil.Equals(t, hf != metadata.NoneFunc, m.Thanos.Files[3].Hash != nil)
+
+			dst := filepath.Join(t.TempDir(), b1.String())
+			testutil.Ok(t, Download(ctx, logger, bkt, b1, dst))
+			downloaded, err := os.ReadFile(filepath.Join(dst, TombstonesFilename))
+			testutil.Ok(t, err)
+			testutil.Equals(t, expected, downloaded)
+		})
+	}
+}
+
+func TestUploadWithPersistenceVerification(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bdir := path.Join(tmpDir, b1.String())
+
+	for _, tcase := range []struct {
+		lost   string
+		rate   float64
+		failed bool
+	}{
+		{lost: IndexFilename, rate: 0.01, failed: true},
+		{lost: path.Join(ChunksDirname, "000001"), rate: 0.01, failed: true},
+		{lost: path.Join(ChunksDirname, "000001"), rate: 0, failed: false},
+		{lost: "", rate: 1, failed: false},
+	} {
+		t.Run(fmt.Sprintf("lost %q at rate %v", tcase.lost, tcase.rate), func(t *testing.T) {
+			bkt := objstore.NewInMemBucket()
+			lbkt := &losingUploadBucket{Bucket: bkt, lost: path.Join(b1.String(), tcase.lost)}
+
+			err := UploadWithOptions(ctx, logger, lbkt, bdir, metadata.NoneFunc, WithPersistenceVerification(tcase.rate))
+			_, metaUploaded := bkt.Objects()[path.Join(b1.String(), MetaFilename)]
+			if tcase.failed {
+				testutil.NotOk(t, err)
+				testutil.Assert(t, !metaUploaded, "meta should not be uploaded")
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Assert(t, metaUploaded, "meta should be uploaded")
+		})
+	}
+}
+
+// losingUploadBucket reports success of uploads of the given object without storing it.
+type losingUploadBucket struct {
+	objstore.Bucket
+
+	lost string
+}
+
+func (b *losingUploadBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if name == b.lost {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestUploadWithoutChunks(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, os.RemoveAll(filepath.Join(tmpDir, b1.String(), ChunksDirname)))
+
+	for _, hf := range []metadata.HashFunc{metadata.NoneFunc, metadata.SHA256Func} {
+		t.Run(string(hf), func(t *testing.T) {
+			bkt := objstore.NewInMemBucket()
+			testutil.NotOk(t, Upload(ctx, logger, bkt, path.Join(tmpDir, b1.String()), hf))
+			testutil.Equals(t, 0, len(bkt.Objects()))
+
+			testutil.Ok(t, UploadWithOptions(ctx, logger, bkt, path.Join(tmpDir, b1.String()), hf, AllowNoChunks(), WithSegmentFilesValidation()))
+			testutil.Equals(t, 2, len(bkt.Objects()))
+
+			m, err := DownloadMeta(ctx, logger, bkt, b1)
+			testutil.Ok(t, err)
+			testutil.Equals(t, []string{IndexFilename, MetaFilename}, fileRelPaths(m.Thanos.Files))
+
+			dst := filepath.Join(t.TempDir(), b1.String())
+			testutil.Ok(t, Download(ctx, logger, bkt, b1, dst))
+			_, err = os.Stat(filepath.Join(dst, IndexFilename))
+			testutil.Ok(t, err)
+		})
+	}
+}
+
+func TestUploadWithIndexHeader(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	tmpDir := t.TempDir()
+
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bdir := path.Join(tmpDir, b1.String())
+
+	writeHeader := func(_ context.Context, dir, filename string) error {
+		testutil.Equals(t, bdir, dir)
+		return os.WriteFile(filename, []byte("header"), 0600)
+	}
+	for _, hf := range []metadata.HashFunc{metadata.NoneFunc, metadata.SHA256Func} {
+		t.Run(string(hf), func(t *testing.T) {
+			bkt := objstore.NewInMemBucket()
+			testutil.Ok(t, UploadWithOptions(ctx, logger, bkt, bdir, hf, WithGenerateIndexHeader(writeHeader)))
+			testutil.Equals(t, "header", string(bkt.Objects()[path.Join(b1.String(), IndexHeaderFilename)]))
+
+			m, err := DownloadMeta(ctx, logger, bkt, b1)
+			testutil.Ok(t, err)
+			testutil.Equals(t, []string{"chunks/000001", IndexFilename, IndexHeaderFilename, MetaFilename}, fileRelPaths(m.Thanos.Files))
+			testutil.Equals(t, hf != metadata.NoneFunc, m.Thanos.Files[2].Hash != nil)
+		})
+	}
+
+	// Local index-header is not uploaded without the option.
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, Upload(ctx, logger, bkt, bdir, metadata.NoneFunc))
+	_, ok := bkt.Objects()[path.Join(b1.String(), IndexHeaderFilename)]
+	testutil.Assert(t, !ok, "index-header should not be uploaded")
+
+	failing := func(context.Context, string, string) error { return errors.New("failed") }
+	testutil.NotOk(t, UploadWithOptions(ctx, logger, objstore.NewInMemBucket(), bdir, metadata.NoneFunc, WithGenerateIndexHeader(failing)))
+}
@@ -47,6 +47,10 @@ func (s *BlocksCleaner) DeleteMarkedBlocks(ctx context.Context) error {
 	for _, deletionMark := range deletionMarkMap {
 		if time.Since(time.Unix(deletionMark.DeletionTime, 0)).Seconds() > s.deleteDelay.Seconds() {
 			if err := block.Delete(ctx, s.logger, s.bkt, deletionMark.ID); err != nil {
+				if errors.Is(err, block.ErrBlockFrozen) {
+					level.Warn(s.logger).Log("msg", "block marked for deletion is frozen; skipping it", "block", deletionMark.ID)
+					continue
+				}
 				s.blockCleanupFailures.Inc()
 				return errors.Wrap(err, "delete block")
 			}
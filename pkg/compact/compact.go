@@ -35,12 +35,12 @@ import (
 	"github.com/thanos-io/thanos/pkg/tracing"
 )
 
-type ResolutionLevel int64
+type ResolutionLevel = metadata.ResolutionLevel
 
 const (
-	ResolutionLevelRaw = ResolutionLevel(downsample.ResLevel0)
-	ResolutionLevel5m  = ResolutionLevel(downsample.ResLevel1)
-	ResolutionLevel1h  = ResolutionLevel(downsample.ResLevel2)
+	ResolutionLevelRaw = metadata.ResolutionLevelRaw
+	ResolutionLevel5m  = metadata.ResolutionLevel5m
+	ResolutionLevel1h  = metadata.ResolutionLevel1h
 )
 
 const (
@@ -209,6 +209,10 @@ func (s *Syncer) GarbageCollect(ctx context.Context) error {
 		level.Info(s.logger).Log("msg", "marking outdated block for deletion", "block", id)
 		err := block.MarkForDeletion(delCtx, s.logger, s.bkt, id, "outdated block", s.metrics.BlocksMarkedForDeletion)
 		cancel()
+		if errors.Is(err, block.ErrBlockFrozen) {
+			level.Warn(s.logger).Log("msg", "outdated block is frozen; skipping its deletion", "block", id)
+			continue
+		}
 		if err != nil {
 			s.metrics.GarbageCollectionFailures.Inc()
 			return retry(errors.Wrapf(err, "mark block %s for deletion", id))
@@ -1111,6 +1115,10 @@ func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket,
 
 	// TODO(bplotka): Issue with this will introduce overlap that will halt compactor. Automate that (fix duplicate overlaps caused by this).
 	if err := block.MarkForDeletion(delCtx, logger, bkt, ie.id, "source of repaired block", blocksMarkedForDeletion); err != nil {
+		if errors.Is(err, block.ErrBlockFrozen) {
+			level.Warn(logger).Log("msg", "broken block is frozen; skipping its deletion", "id", ie.id)
+			return nil
+		}
 		return errors.Wrapf(err, "marking old block %s for deletion has failed", ie.id)
 	}
 	return nil
@@ -1345,6 +1353,12 @@ func (cg *Group) deleteBlock(id ulid.ULID, bdir string, blockDeletableChecker Bl
 		defer cancel()
 		level.Info(cg.logger).Log("msg", "marking compacted block for deletion", "old_block", id)
 		if err := block.MarkForDeletion(delCtx, cg.logger, cg.bkt, id, "source of compacted block", cg.blocksMarkedForDeletion); err != nil {
+			// Frozen blocks are excluded from planning, so the block was frozen during compaction. Failing here would
+			// only make the other sources compacted again.
+			if errors.Is(err, block.ErrBlockFrozen) {
+				level.Warn(cg.logger).Log("msg", "source of compacted block was frozen during compaction; skipping its deletion", "old_block", id)
+				return nil
+			}
 			return errors.Wrapf(err, "mark block %s for deletion from bucket", id)
 		}
 	}
@@ -1572,6 +1586,7 @@ func (c *BucketCompactor) Compact(ctx context.Context) (rerr error) {
 var _ block.MetadataFilter = &GatherNoCompactionMarkFilter{}
 
 // GatherNoCompactionMarkFilter is a block.Fetcher filter that passes all metas. While doing it, it gathers all no-compact-mark.json markers.
+// Frozen blocks (see block.MarkFrozen) are gathered as marked for no compaction too, as their sources can't be deleted.
 // Not go routine safe.
 // TODO(bwplotka): Add unit test.
 type GatherNoCompactionMarkFilter struct {
@@ -1625,20 +1640,15 @@ func (f *GatherNoCompactionMarkFilter) Filter(ctx context.Context, metas map[uli
 		eg.Go(func() error {
 			var lastErr error
 			for id := range ch {
-				m := &metadata.NoCompactMark{}
-				// TODO(bwplotka): Hook up bucket cache here + reset API so we don't introduce API calls .
-				if err := metadata.ReadMarker(ctx, f.logger, f.bkt, id.String(), m); err != nil {
-					if errors.Cause(err) == metadata.ErrorMarkerNotFound {
-						continue
-					}
-					if errors.Cause(err) == metadata.ErrorUnmarshalMarker {
-						level.Warn(f.logger).Log("msg", "found partial no-compact-mark.json; if we will see it happening often for the same block, consider manually deleting no-compact-mark.json from the object storage", "block", id, "err", err)
-						continue
-					}
+				m, err := f.readNoCompactMark(ctx, id)
+				if err != nil {
 					// Remember the last error and continue draining the channel.
 					lastErr = err
 					continue
 				}
+				if m == nil {
+					continue
+				}
 
 				localNoCompactMapMtx.Lock()
 				noCompactMarkedMap[id] = m
@@ -1676,3 +1686,34 @@ func (f *GatherNoCompactionMarkFilter) Filter(ctx context.Context, metas map[uli
 
 	return nil
 }
+
+// readNoCompactMark returns the active no-compact mark of the block, a mark made up for a frozen block, or nil if the
+// block can be compacted.
+func (f *GatherNoCompactionMarkFilter) readNoCompactMark(ctx context.Context, id ulid.ULID) (*metadata.NoCompactMark, error) {
+	m := &metadata.NoCompactMark{}
+	// TODO(bwplotka): Hook up bucket cache here + reset API so we don't introduce API calls .
+	err := metadata.ReadMarker(ctx, f.logger, f.bkt, id.String(), m)
+	switch {
+	case err == nil:
+		if metadata.IsNoCompactActive(*m, time.Now()) {
+			return m, nil
+		}
+		level.Debug(f.logger).Log("msg", "ignoring expired no-compact-mark.json", "block", id)
+	case errors.Cause(err) == metadata.ErrorMarkerNotFound:
+	case errors.Cause(err) == metadata.ErrorUnmarshalMarker:
+		level.Warn(f.logger).Log("msg", "found partial no-compact-mark.json; if we will see it happening often for the same block, consider manually deleting no-compact-mark.json from the object storage", "block", id, "err", err)
+	default:
+		return nil, err
+	}
+
+	frozen, err := block.IsFrozen(ctx, f.bkt, id)
+	if err != nil || !frozen {
+		return nil, err
+	}
+	return &metadata.NoCompactMark{
+		ID:      id,
+		Version: metadata.NoCompactMarkVersion1,
+		Details: "block is frozen",
+		Reason:  metadata.ManualNoCompactReason,
+	}, nil
+}
@@ -558,7 +558,7 @@ func TestNoMarkFilterAtomic(t *testing.T) {
 		if i%2 == 0 {
 			testutil.Ok(
 				t,
-				block.MarkForNoCompact(ctx, logger, bkt, meta.ULID, metadata.NoCompactReason("test"), "nodetails", noMarkCounter),
+				block.MarkForNoCompact(ctx, logger, bkt, meta.ULID, metadata.NoCompactReason("test"), "nodetails", noMarkCounter, block.AllowCustomNoCompactReason()),
 			)
 		}
 	}
@@ -606,3 +606,38 @@ func TestNoMarkFilterAtomic(t *testing.T) {
 	})
 	testutil.Ok(t, g.Run())
 }
+
+func TestNoMarkFilterFrozenBlocks(t *testing.T) {
+	ctx := context.TODO()
+	logger := log.NewNopLogger()
+	bkt := objstore.NewInMemBucket()
+
+	m := extprom.NewTxGaugeVec(nil, prometheus.GaugeOpts{}, []string{"state"})
+	frozenCounter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+
+	var metasByMinTime []*metadata.Meta
+	metas := map[ulid.ULID]*metadata.Meta{}
+	for i := 0; i < 4; i++ {
+		meta := &metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ulid.MustNew(uint64(i+1), nil), MinTime: int64(i * 20), MaxTime: int64((i + 1) * 20)}}
+		metasByMinTime = append(metasByMinTime, meta)
+		metas[meta.ULID] = meta
+
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(meta))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), metadata.MetaFilename), &buf))
+	}
+	frozen := metasByMinTime[0].ULID
+	testutil.Ok(t, block.MarkFrozen(ctx, logger, bkt, frozen, "legal hold", frozenCounter))
+
+	f := NewGatherNoCompactionMarkFilter(logger, objstore.WithNoopInstr(bkt), 2)
+	testutil.Ok(t, f.Filter(ctx, metas, m, nil))
+	noCompactMarked := f.NoCompactMarkedBlocks()
+	testutil.Equals(t, 1, len(noCompactMarked))
+	_, ok := noCompactMarked[frozen]
+	testutil.Assert(t, ok, "frozen block should be excluded from compaction")
+
+	// Frozen source is not planned for compaction, so it's never left behind by a compacted block.
+	plan, err := NewPlanner(logger, []int64{20, 60, 180}, f).Plan(ctx, metasByMinTime, nil, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []*metadata.Meta{metasByMinTime[1], metasByMinTime[2]}, plan)
+}
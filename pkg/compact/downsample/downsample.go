@@ -147,7 +147,7 @@ func Downsample(
 		}
 
 		// Raw and already downsampled data need different processing.
-		if origMeta.Thanos.Downsample.Resolution == 0 {
+		if origMeta.IsRaw() {
 			for _, c := range chks {
 				// TODO(bwplotka): We can optimze this further by using in WriteSeries iterators of each chunk instead of
 				// samples. Also ensure 120 sample limit, otherwise we have gigantic chunks.
@@ -268,7 +268,7 @@ PlanLoop:
 		// Technically, the resolution is part of the group key but do not attach ourselves to that level of detail.
 		var marked = false
 		for _, m := range plan {
-			if m.Thanos.Downsample.Resolution == 0 {
+			if m.IsRaw() {
 				continue
 			}
 			if err := block.MarkForNoCompact(
@@ -40,6 +40,10 @@ func ApplyRetentionPolicyByResolution(
 		if time.Now().After(maxTime.Add(retentionDuration)) {
 			level.Info(logger).Log("msg", "applying retention: marking block for deletion", "id", id, "maxTime", maxTime.String())
 			if err := block.MarkForDeletion(ctx, logger, bkt, id, fmt.Sprintf("block exceeding retention of %v", retentionDuration), blocksMarkedForDeletion); err != nil {
+				if errors.Is(err, block.ErrBlockFrozen) {
+					level.Info(logger).Log("msg", "block exceeding retention is frozen; skipping it", "id", id)
+					continue
+				}
 				return errors.Wrap(err, "delete block")
 			}
 		}
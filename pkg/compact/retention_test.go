@@ -280,6 +280,33 @@ func TestApplyRetentionPolicyByResolution(t *testing.T) {
 	}
 }
 
+func TestApplyRetentionPolicyByResolutionFrozenBlock(t *testing.T) {
+	logger := log.NewNopLogger()
+	ctx := context.TODO()
+
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	uploadMockBlock(t, bkt, "01CPHBEX20729MJQZXE3W0BW48", time.Now().Add(-3*24*time.Hour), time.Now().Add(-2*24*time.Hour), int64(compact.ResolutionLevelRaw))
+	uploadMockBlock(t, bkt, "01CPHBEX20729MJQZXE3W0BW49", time.Now().Add(-3*24*time.Hour), time.Now().Add(-2*24*time.Hour), int64(compact.ResolutionLevelRaw))
+	frozen := ulid.MustParse("01CPHBEX20729MJQZXE3W0BW48")
+	testutil.Ok(t, block.MarkFrozen(ctx, logger, bkt, frozen, "legal hold", promauto.With(nil).NewCounter(prometheus.CounterOpts{})))
+
+	metaFetcher, err := block.NewMetaFetcher(logger, 32, bkt, block.NewConcurrentLister(logger, bkt), "", nil, nil)
+	testutil.Ok(t, err)
+	metas, _, err := metaFetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+
+	// Frozen block is skipped, while the rest of blocks exceeding retention are marked.
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	testutil.Ok(t, compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, metas, map[compact.ResolutionLevel]time.Duration{
+		compact.ResolutionLevelRaw: 24 * time.Hour,
+	}, blocksMarkedForDeletion))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(blocksMarkedForDeletion))
+
+	exists, err := bkt.Exists(ctx, filepath.Join(frozen.String(), metadata.DeletionMarkFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !exists, "frozen block should not be marked for deletion")
+}
+
 func uploadMockBlock(t *testing.T, bkt objstore.Bucket, id string, minTime, maxTime time.Time, resolutionLevel int64) {
 	t.Helper()
 	meta1 := metadata.Meta{
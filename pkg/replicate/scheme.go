@@ -214,6 +214,11 @@ func (rs *replicationScheme) ensureBlockIsReplicated(ctx context.Context, id uli
 	level.Debug(rs.logger).Log("msg", "ensuring block is replicated", "block_uuid", blockID)
 
 	originMetaFile, err := rs.fromBkt.ReaderWithExpectedErrs(rs.fromBkt.IsObjNotFoundErr).Get(ctx, metaFile)
+	if err != nil && rs.fromBkt.IsObjNotFoundErr(err) {
+		// Block might have compressed meta instead (see block.WithCompressedMeta), which is replicated as is.
+		metaFile = path.Join(blockID, metadata.MetaGzipFilename)
+		originMetaFile, err = rs.fromBkt.ReaderWithExpectedErrs(rs.fromBkt.IsObjNotFoundErr).Get(ctx, metaFile)
+	}
 	if err != nil {
 		return errors.Wrap(err, "get meta file from origin bucket")
 	}
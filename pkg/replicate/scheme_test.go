@@ -134,6 +134,22 @@ func TestReplicationSchemeAll(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "FullBlockWithCompressedMeta",
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket *objstore.InMemBucket) {
+				ulid := testULID(0)
+				meta := testMeta(ulid)
+
+				var b bytes.Buffer
+				testutil.Ok(t, meta.Write(&b, metadata.WithGzip()))
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), metadata.MetaGzipFilename), &b)
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000001"), bytes.NewReader(nil))
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader(nil))
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *objstore.InMemBucket) {
+				testutil.Equals(t, originBucket.Objects(), targetBucket.Objects())
+			},
+		},
 		{
 			name:                    "MarkedForDeletion",
 			ignoreMarkedForDeletion: true,
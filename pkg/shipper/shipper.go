@@ -301,11 +301,17 @@ func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
 			}
 		}
 
-		// Check against bucket if the meta file for this block exists.
+		// Check against bucket if the meta file for this block exists, plain or compressed.
 		ok, err := s.bucket.Exists(ctx, path.Join(m.ULID.String(), block.MetaFilename))
 		if err != nil {
 			return 0, errors.Wrap(err, "check exists")
 		}
+		if !ok {
+			ok, err = s.bucket.Exists(ctx, path.Join(m.ULID.String(), metadata.MetaGzipFilename))
+			if err != nil {
+				return 0, errors.Wrap(err, "check exists")
+			}
+		}
 		if ok {
 			meta.Uploaded = append(meta.Uploaded, m.ULID)
 			continue
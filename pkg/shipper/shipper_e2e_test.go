@@ -180,12 +180,7 @@ func TestShipper_SyncBlocks_e2e(t *testing.T) {
 			testutil.Assert(t, ok, "block %s was not uploaded", id)
 		}
 		for fn, exp := range expFiles {
-			rc, err := bkt.Get(ctx, fn)
-			testutil.Ok(t, err)
-			act, err := io.ReadAll(rc)
-			testutil.Ok(t, err)
-			testutil.Ok(t, rc.Close())
-			testutil.Equals(t, string(exp), string(act))
+			testutil.Equals(t, string(exp), string(readUploadedFile(t, ctx, bkt, fn)))
 		}
 		// Verify the fifth block is still deleted by the end.
 		ok, err := bkt.Exists(ctx, ids[4].String()+"/meta.json")
@@ -326,12 +321,7 @@ func TestShipper_SyncBlocksWithMigrating_e2e(t *testing.T) {
 			testutil.Assert(t, ok, "block %s was not uploaded", id)
 		}
 		for fn, exp := range expFiles {
-			rc, err := bkt.Get(ctx, fn)
-			testutil.Ok(t, err)
-			act, err := io.ReadAll(rc)
-			testutil.Ok(t, err)
-			testutil.Ok(t, rc.Close())
-			testutil.Equals(t, string(exp), string(act))
+			testutil.Equals(t, string(exp), string(readUploadedFile(t, ctx, bkt, fn)))
 		}
 		// Verify the fifth block is still deleted by the end.
 		ok, err := bkt.Exists(ctx, ids[4].String()+"/meta.json")
@@ -471,11 +461,27 @@ func TestShipper_SyncOverlapBlocks_e2e(t *testing.T) {
 	}
 
 	for fn, exp := range expFiles {
-		rc, err := bkt.Get(ctx, fn)
-		testutil.Ok(t, err)
-		act, err := io.ReadAll(rc)
-		testutil.Ok(t, err)
-		testutil.Ok(t, rc.Close())
-		testutil.Equals(t, string(exp), string(act))
+		testutil.Equals(t, string(exp), string(readUploadedFile(t, ctx, bkt, fn)))
 	}
 }
+
+// readUploadedFile reads the file from the bucket. Upload time, set in uploaded meta.json, is cleared so that the meta
+// can be compared with the local one.
+func readUploadedFile(t testing.TB, ctx context.Context, bkt objstore.BucketReader, name string) []byte {
+	rc, err := bkt.Get(ctx, name)
+	testutil.Ok(t, err)
+	b, err := io.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	if path.Base(name) != block.MetaFilename {
+		return b
+	}
+
+	m, err := metadata.Read(io.NopCloser(bytes.NewReader(b)))
+	testutil.Ok(t, err)
+	testutil.Assert(t, m.Thanos.UploadTime > 0, "upload time of %s not set", name)
+	m.Thanos.UploadTime = 0
+	var buf bytes.Buffer
+	testutil.Ok(t, m.Write(&buf))
+	return buf.Bytes()
+}
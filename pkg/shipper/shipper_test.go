@@ -4,6 +4,7 @@
 package shipper
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"math"
@@ -296,3 +297,42 @@ func TestShipperExistingThanosLabels(t *testing.T) {
 	testutil.Ok(t, err)
 	testutil.Equals(t, map[string]string{"cluster": "us-east-1", "test": "test"}, meta.Thanos.Labels)
 }
+
+func TestShipperSkipsBlocksWithCompressedMeta(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	inmemory := objstore.NewInMemBucket()
+	s := New(nil, nil, dir, inmemory, func() labels.Labels { return labels.FromStrings("test", "test") }, metadata.TestSource, nil, false, metadata.NoneFunc, DefaultMetaFilename)
+
+	id := ulid.MustNew(1, nil)
+	blockDir := path.Join(dir, id.String())
+	testutil.Ok(t, os.MkdirAll(path.Join(blockDir, block.ChunksDirname), os.ModePerm))
+	meta := metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{
+			ULID:    id,
+			MaxTime: 2000,
+			MinTime: 1000,
+			Version: 1,
+			Stats: tsdb.BlockStats{
+				NumSamples: 1000, // Not really, but shipper needs nonzero value.
+			},
+		},
+	}
+	testutil.Ok(t, meta.WriteToDir(log.NewNopLogger(), blockDir))
+	testutil.Ok(t, os.WriteFile(filepath.Join(blockDir, "index"), []byte("index file"), 0666))
+
+	// Block was uploaded already, with compressed meta.
+	var buf bytes.Buffer
+	testutil.Ok(t, meta.Write(&buf, metadata.WithGzip()))
+	testutil.Ok(t, inmemory.Upload(ctx, path.Join(id.String(), metadata.MetaGzipFilename), &buf))
+
+	uploaded, err := s.Sync(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, uploaded)
+	testutil.Equals(t, 1, len(inmemory.Objects()))
+
+	shipMeta, err := ReadMetaFile(path.Join(dir, DefaultMetaFilename))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{id}, shipMeta.Uploaded)
+}
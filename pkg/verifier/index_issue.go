@@ -85,7 +85,7 @@ func repairIndex(stats block.HealthStats, ctx Context, id ulid.ULID, meta *metad
 		level.Warn(ctx.Logger).Log("msg", "detected outsiders are not all 'complete' outsiders or outsiders from https://github.com/prometheus/tsdb/issues/347. We can safely delete only these outsiders", "id", id)
 	}
 
-	if meta.Thanos.Downsample.Resolution > 0 {
+	if meta.IsDownsampled() {
 		return errors.Wrap(err, "cannot repair downsampled blocks")
 	}
 